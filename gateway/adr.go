@@ -0,0 +1,90 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"gateway/lorawan"
+	"gateway/node"
+	"slices"
+)
+
+// fCtrlADR is the bit of the uplink FCtrl set by devices that let the network control their data rate.
+const fCtrlADR = 0x80
+
+// default ADR settings if adr_margin_db and adr_uplink_history are not set.
+const (
+	defaultADRMargin  = 10.0 // dB
+	defaultADRHistory = 20
+	// adrStep is the SNR margin needed for each data rate step.
+	adrStep = 3.0 // dB
+)
+
+// adrConfig is the adaptive data rate settings of the gateway. The zero value uses the defaults.
+type adrConfig struct {
+	margin  float64 // installation margin in dB kept above the SNR required by the data rate
+	history int     // number of uplinks the max SNR is taken over
+}
+
+func (c adrConfig) marginDB() float64 {
+	if c.margin <= 0 {
+		return defaultADRMargin
+	}
+	return c.margin
+}
+
+func (c adrConfig) uplinkHistory() int {
+	if c.history <= 0 {
+		return defaultADRHistory
+	}
+	return c.history
+}
+
+// requiredSNR returns the minimum SNR in dB needed to demodulate an uplink at the spreading factor.
+func requiredSNR(sf uint8) float64 {
+	return -20 + float64(12-int(sf))*2.5
+}
+
+// adaptDataRate records the SNR of an uplink from a device with ADR enabled.
+// Once there are enough uplinks, if the best SNR leaves enough margin a LinkADRReq is queued
+// to move the device to a faster data rate, which uses less airtime and battery.
+func (g *Gateway) adaptDataRate(device *node.Node, rx rxInfo) {
+	dr, ok := g.region.uplinkDataRate(rx.sf, rx.bandwidth)
+	if !ok || dr >= g.region.maxADRDataRate {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	history := g.adr.uplinkHistory()
+	device.SNRHistory = append(device.SNRHistory, float64(rx.snr))
+	if len(device.SNRHistory) > history {
+		device.SNRHistory = device.SNRHistory[len(device.SNRHistory)-history:]
+	}
+	if len(device.SNRHistory) < history {
+		return
+	}
+
+	margin := slices.Max(device.SNRHistory) - requiredSNR(rx.sf) - g.adr.marginDB()
+	steps := int(margin / adrStep)
+	if steps <= 0 {
+		return
+	}
+	newDR := min(int(dr)+steps, int(g.region.maxADRDataRate))
+
+	g.logger.Debugf("requesting node %s change data rate from DR%d to DR%d", device.NodeName, dr, newDR)
+	g.queueMACCommandLocked(device, linkADRReq(uint8(newDR), g.region.channelMask))
+	// the SNR at the new data rate is measured from scratch.
+	device.SNRHistory = nil
+}
+
+// Structure of a LinkADRReq:
+// | CID | DataRate_TXPower | ChMask | Redundancy |
+// | 1 B |        1 B       |  2 B   |    1 B     |
+// linkADRReq builds a LinkADRReq setting the data rate and enabling the channels in chMask.
+// The tx power is set to the max and each uplink is sent once.
+func linkADRReq(dr uint8, chMask uint16) []byte {
+	cmd := []byte{lorawan.CIDLinkADR, dr << 4}
+	cmd = binary.LittleEndian.AppendUint16(cmd, chMask)
+	// ChMaskCntl 0 applies the mask to channels 0-15, NbTrans 1.
+	return append(cmd, 0x01)
+}
@@ -0,0 +1,100 @@
+package gateway
+
+import (
+	"context"
+	"gateway/lorawan"
+	"testing"
+
+	"go.thethings.network/lorawan-stack/v3/pkg/crypto"
+	"go.thethings.network/lorawan-stack/v3/pkg/types"
+	"go.viam.com/test"
+)
+
+// createTestADRUplink builds a data uplink from the test device with the ADR bit set.
+func createTestADRUplink(t *testing.T, fCnt uint32) []byte {
+	uplink := createTestUplink(t, fCnt, 1, []byte{0x15, 0x05})
+	uplink[5] |= fCtrlADR
+	mic, err := crypto.ComputeLegacyUplinkMIC(types.AES128Key(testNwkSKey), *types.MustDevAddr(testDevAddr), fCnt, uplink[:len(uplink)-4])
+	test.That(t, err, test.ShouldBeNil)
+	copy(uplink[len(uplink)-4:], mic[:])
+	return uplink
+}
+
+func TestAdaptDataRate(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	g.adr = adrConfig{margin: 10, history: 4}
+	device := g.devices["test-device"]
+
+	// DR0 in US915.
+	rx := rxInfo{frequency: 902300000, sf: 10, bandwidth: bandwidth125k, snr: 5}
+
+	// uplinks without the ADR bit don't change the data rate.
+	_, _, err := g.parseDataUplink(ctx, createTestUplink(t, 1, 1, []byte{0x15, 0x05}), rx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, device.SNRHistory, test.ShouldBeEmpty)
+
+	// nothing is requested until there are enough uplinks.
+	for fCnt := uint32(2); fCnt < 5; fCnt++ {
+		_, _, err = g.parseDataUplink(ctx, createTestADRUplink(t, fCnt), rx)
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, g.downlinks["test-device"], test.ShouldBeEmpty)
+	}
+
+	// the 5 dB SNR leaves 10 dB above the installation margin at SF10, enough to move up 3 data rates to DR3.
+	_, _, err = g.parseDataUplink(ctx, createTestADRUplink(t, 5), rx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(g.downlinks["test-device"]), test.ShouldEqual, 1)
+	test.That(t, device.SNRHistory, test.ShouldBeEmpty)
+
+	// the LinkADRReq is sent in FOpts, with the ADR bit set since the device asked for ADR.
+	frame, err := buildDownlink(device, g.downlinks["test-device"][0])
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, frame[5], test.ShouldEqual, fCtrlADR|5)
+	test.That(t, frame[8:13], test.ShouldResemble, []byte{lorawan.CIDLinkADR, 0x30, 0xFF, 0x00, 0x01})
+	test.That(t, len(frame), test.ShouldEqual, 17)
+
+	// a weak signal doesn't leave enough margin.
+	g.downlinks = nil
+	rx.snr = -12
+	for fCnt := uint32(6); fCnt < 10; fCnt++ {
+		_, _, err = g.parseDataUplink(ctx, createTestADRUplink(t, fCnt), rx)
+		test.That(t, err, test.ShouldBeNil)
+	}
+	test.That(t, g.downlinks["test-device"], test.ShouldBeEmpty)
+	test.That(t, len(device.SNRHistory), test.ShouldEqual, 4)
+
+	// devices already at the fastest data rate are left alone.
+	rx = rxInfo{frequency: 902300000, sf: 7, bandwidth: bandwidth125k, snr: 10}
+	device.SNRHistory = nil
+	for fCnt := uint32(10); fCnt < 14; fCnt++ {
+		_, _, err = g.parseDataUplink(ctx, createTestADRUplink(t, fCnt), rx)
+		test.That(t, err, test.ShouldBeNil)
+	}
+	test.That(t, g.downlinks["test-device"], test.ShouldBeEmpty)
+}
+
+func TestQueueMACCommand(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+
+	// MAC commands are added to a queued downlink.
+	err := g.SendDownlink(ctx, testDevAddr, 10, []byte{0x01})
+	test.That(t, err, test.ShouldBeNil)
+	g.queueMACCommandLocked(device, linkADRReq(3, 0x00FF))
+	test.That(t, len(g.downlinks["test-device"]), test.ShouldEqual, 1)
+
+	frame, err := buildDownlink(device, g.downlinks["test-device"][0])
+	test.That(t, err, test.ShouldBeNil)
+	fPort, payload := decryptTestDownlink(t, frame)
+	test.That(t, fPort, test.ShouldEqual, 10)
+	test.That(t, payload, test.ShouldResemble, []byte{0x01})
+
+	// a new downlink is queued once FOpts is full.
+	for i := 0; i < 3; i++ {
+		g.queueMACCommandLocked(device, linkADRReq(3, 0x00FF))
+	}
+	test.That(t, len(g.downlinks["test-device"]), test.ShouldEqual, 2)
+	test.That(t, len(g.downlinks["test-device"][0].fOpts), test.ShouldEqual, 15)
+}
@@ -0,0 +1,97 @@
+package gateway
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"time"
+)
+
+// Class B timing from the LoRaWAN 1.0.3 specification, chapter 13.
+// Beacons are sent at the start of each beacon period, aligned to GPS time. The beacon reserved time
+// is followed by the beacon window, which is divided into ping slots the devices listen in.
+const (
+	beaconPeriod   = 128 * time.Second
+	beaconReserved = 2120 * time.Millisecond
+	pingSlotLength = 30 * time.Millisecond
+	// pingSlotCount is the number of ping slots in the beacon window.
+	pingSlotCount = 4096
+)
+
+// beaconTime returns the Time field of the beacon for the beacon period gpsTime is in,
+// the GPS time in seconds of the start of the period.
+func beaconTime(gpsTime time.Duration) uint32 {
+	return uint32(gpsTime.Truncate(beaconPeriod) / time.Second)
+}
+
+// pingPeriod returns the number of slots between the ping slots of a device.
+// Devices with ping slot periodicity p open 2^(7-p) ping slots every beacon period.
+func pingPeriod(periodicity uint8) (int, error) {
+	if periodicity > 7 {
+		return 0, errPingPeriodicity
+	}
+	return pingSlotCount >> (7 - periodicity), nil
+}
+
+// Structure of the block encrypted for the ping offset, with the fields little endian:
+// | BEACON TIME | DEV ADDR | PAD  |
+// |     4 B     |   4 B    | 8 B  |
+// pingSlotOffset returns the slot of the device's first ping slot in the beacon period.
+// The offset is pseudo random so devices don't collide in the same slots every period.
+func pingSlotOffset(beaconTime uint32, devAddr []byte, periodicity uint8) (int, error) {
+	period, err := pingPeriod(periodicity)
+	if err != nil {
+		return 0, err
+	}
+
+	var block [aes.BlockSize]byte
+	binary.LittleEndian.PutUint32(block[0:4], beaconTime)
+	binary.LittleEndian.PutUint32(block[4:8], binary.BigEndian.Uint32(devAddr))
+
+	// the key is all zeros.
+	cipher, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		return 0, err
+	}
+	var rand [aes.BlockSize]byte
+	cipher.Encrypt(rand[:], block[:])
+
+	return (int(rand[0]) + int(rand[1])*256) % period, nil
+}
+
+// pingSlots returns the GPS time of the start of each of the device's ping slots in the beacon period.
+func pingSlots(beaconTime uint32, devAddr []byte, periodicity uint8) ([]time.Duration, error) {
+	offset, err := pingSlotOffset(beaconTime, devAddr, periodicity)
+	if err != nil {
+		return nil, err
+	}
+	// the period can't fail after the offset was computed.
+	period, _ := pingPeriod(periodicity)
+
+	start := time.Duration(beaconTime)*time.Second + beaconReserved
+	slots := make([]time.Duration, 0, pingSlotCount/period)
+	for slot := offset; slot < pingSlotCount; slot += period {
+		slots = append(slots, start+time.Duration(slot)*pingSlotLength)
+	}
+	return slots, nil
+}
+
+// nextPingSlot returns the GPS time of the device's first ping slot starting at or after gpsTime.
+func nextPingSlot(gpsTime time.Duration, devAddr []byte, periodicity uint8) (time.Duration, error) {
+	bt := beaconTime(gpsTime)
+	slots, err := pingSlots(bt, devAddr, periodicity)
+	if err != nil {
+		return 0, err
+	}
+	for _, slot := range slots {
+		if slot >= gpsTime {
+			return slot, nil
+		}
+	}
+
+	// the device's last ping slot of the period has passed, use its first slot of the next period.
+	slots, err = pingSlots(bt+uint32(beaconPeriod/time.Second), devAddr, periodicity)
+	if err != nil {
+		return 0, err
+	}
+	return slots[0], nil
+}
@@ -0,0 +1,84 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"go.viam.com/test"
+)
+
+func TestPingSlotOffset(t *testing.T) {
+	// with a zero beacon time and dev addr the block is all zeros, AES-128 of the zero block with the zero key
+	// is 66e94bd4ef8a2c3b884cfa59ca342b2e so the offset is (0x66 + 0xE9*256) mod period.
+	devAddr := []byte{0x00, 0x00, 0x00, 0x00}
+	offset, err := pingSlotOffset(0, devAddr, 7)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, offset, test.ShouldEqual, 59750%4096)
+	offset, err = pingSlotOffset(0, devAddr, 0)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, offset, test.ShouldEqual, 59750%32)
+
+	// beacon time 128 sets the first byte to 0x80, the ECBVarTxt128 known answer is 3ad78e726c1ec02b7ebfe92b23d9ec34.
+	offset, err = pingSlotOffset(128, devAddr, 7)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, offset, test.ShouldEqual, (0x3A+0xD7*256)%4096)
+
+	// the offset changes with the dev addr and beacon period.
+	offset, err = pingSlotOffset(128, testDevAddr, 7)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, offset, test.ShouldNotEqual, (0x3A+0xD7*256)%4096)
+
+	_, err = pingSlotOffset(0, devAddr, 8)
+	test.That(t, err, test.ShouldBeError, errPingPeriodicity)
+}
+
+func TestPingSlots(t *testing.T) {
+	devAddr := []byte{0x00, 0x00, 0x00, 0x00}
+	offset := time.Duration(59750%32) * pingSlotLength
+
+	// periodicity 0 opens 128 ping slots, one every 32 slots.
+	slots, err := pingSlots(0, devAddr, 0)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(slots), test.ShouldEqual, 128)
+	test.That(t, slots[0], test.ShouldEqual, beaconReserved+offset)
+	test.That(t, slots[1]-slots[0], test.ShouldEqual, 32*pingSlotLength)
+	// every slot ends before the next beacon.
+	test.That(t, slots[127]+pingSlotLength, test.ShouldBeLessThanOrEqualTo, beaconPeriod)
+
+	slots, err = pingSlots(0, devAddr, 7)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, slots, test.ShouldResemble, []time.Duration{beaconReserved + time.Duration(59750%4096)*pingSlotLength})
+}
+
+func TestNextPingSlot(t *testing.T) {
+	devAddr := []byte{0x00, 0x00, 0x00, 0x00}
+	first := beaconReserved + time.Duration(59750%4096)*pingSlotLength
+
+	slot, err := nextPingSlot(0, devAddr, 7)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, slot, test.ShouldEqual, first)
+	slot, err = nextPingSlot(first, devAddr, 7)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, slot, test.ShouldEqual, first)
+
+	// after the only slot of the period, the slot is in the next period at its own offset.
+	slot, err = nextPingSlot(first+time.Millisecond, devAddr, 7)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, slot, test.ShouldEqual, beaconPeriod+beaconReserved+time.Duration((0x3A+0xD7*256)%4096)*pingSlotLength)
+}
+
+func TestBeaconChannels(t *testing.T) {
+	test.That(t, beaconTime(300*time.Second), test.ShouldEqual, 256)
+
+	// US915 hops over 8 channels starting at 923.3 MHz.
+	us := regions["US915"]
+	test.That(t, us.beaconChannel(0), test.ShouldEqual, 923300000)
+	test.That(t, us.beaconChannel(128), test.ShouldEqual, 923900000)
+	test.That(t, us.beaconChannel(8*128), test.ShouldEqual, 923300000)
+	test.That(t, us.pingSlotChannel(128, []byte{0x00, 0x00, 0x00, 0x07}), test.ShouldEqual, 923300000)
+
+	eu := regions["EU868"]
+	test.That(t, eu.beaconChannel(128), test.ShouldEqual, 869525000)
+	test.That(t, eu.pingSlotChannel(128, testDevAddr), test.ShouldEqual, 869525000)
+	test.That(t, eu.dataRates[eu.beaconDataRate].sf, test.ShouldEqual, 9)
+}
@@ -0,0 +1,30 @@
+package gateway
+
+// reloadDecoderCommand evicts the cached decoders of a device, or the decoder of a single path or URL, from the
+// reload_decoder docommand. The cache only notices a changed file by its size and mtime, and checks URLs every minute,
+// so this picks up a change right away.
+func (g *Gateway) reloadDecoderCommand(cmd map[string]interface{}) error {
+	if path, ok := cmd["path"].(string); ok && path != "" {
+		g.decoders.Evict(path)
+		return nil
+	}
+	name, ok := cmd["device"].(string)
+	if !ok {
+		return errReloadDecoder
+	}
+
+	g.mu.Lock()
+	device, ok := g.devices[name]
+	if !ok {
+		g.mu.Unlock()
+		return errNoDevice
+	}
+	paths := append([]string{device.DecoderPath}, device.DecoderStages...)
+	for _, path := range device.PortDecoders {
+		paths = append(paths, path)
+	}
+	g.mu.Unlock()
+
+	g.decoders.Evict(paths...)
+	return nil
+}
@@ -0,0 +1,350 @@
+package gateway
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"gateway/lorawan"
+	"gateway/node"
+	"os"
+	"strings"
+	"testing"
+
+	"go.viam.com/rdk/logging"
+	"go.viam.com/test"
+)
+
+func TestDecodePayloadPortDecoders(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := &node.Node{
+		DecoderScript: testDecoderScript,
+		PortDecoders: map[string]string{
+			"10": writeTestDecoder(t, `function Decode(fPort, bytes) { return {"config": bytes[0]}; }`),
+			"20": writeTestDecoder(t, `function Decode(fPort, bytes) { return {"battery": bytes[0] / 10}; }`),
+		},
+	}
+
+	readings, err := g.decodePayload(ctx, 10, device, []byte{0x15, 0x05})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{"config": int64(0x15)})
+
+	readings, err = g.decodePayload(ctx, 20, device, []byte{0x15, 0x05})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{"battery": 2.1})
+
+	// other ports use the default decoder.
+	readings, err = g.decodePayload(ctx, 1, device, []byte{0x15, 0x05})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+
+	// port decoders are used over the built-in format.
+	device.DecoderScript = ""
+	device.DecoderFormat = "cayenne"
+	readings, err = g.decodePayload(ctx, 10, device, []byte{0x15, 0x05})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{"config": int64(0x15)})
+	readings, err = g.decodePayload(ctx, 1, device, []byte{0x03, 0x67, 0x01, 0x10})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{"temperature_3": 27.2})
+}
+
+func TestDecodePayloadStages(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := &node.Node{
+		DecoderScript: testDecoderScript,
+		DecoderStages: []string{
+			writeTestDecoder(t, `function Decode(fPort, input) {
+	return {"temperature_c": input.temperature, "fport": fPort};
+}`),
+			writeTestDecoder(t, `function Decode(fPort, input) {
+	input.temperature_f = input.temperature_c * 9 / 5 + 32;
+	return input;
+}`),
+		},
+	}
+
+	// the first stage gets the payload and each stage after it gets the readings of the one before it.
+	readings, err := g.decodePayload(ctx, 1, device, []byte{0x15, 0x05})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature_c"], test.ShouldEqual, 21.5)
+	test.That(t, readings["temperature_f"], test.ShouldAlmostEqual, 70.7)
+	test.That(t, readings["fport"], test.ShouldEqual, 1)
+	test.That(t, readings, test.ShouldNotContainKey, "temperature")
+
+	// a failing stage fails the uplink.
+	device.DecoderStages = append(device.DecoderStages, writeTestDecoder(t, `function Decode(fPort, input) {
+	return {"errors": ["no temperature"]};
+}`))
+	_, err = g.decodePayload(ctx, 1, device, []byte{0x15, 0x05})
+	test.That(t, errors.Is(err, lorawan.ErrDecoderErrors), test.ShouldBeTrue)
+}
+
+func TestDecodePayloadDeviceVars(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := &node.Node{
+		DecoderScript: `function Decode(fPort, bytes) {
+	return {"temperature": bytes[0] + device.vars.calibration, "dev_eui": device.dev_eui, "dev_addr": device.dev_addr};
+}`,
+		DecoderStages: []string{writeTestDecoder(t, `function Decode(fPort, input) {
+	input.location = device.vars.location.room;
+	device.vars.calibration = 0;
+	return input;
+}`)},
+		DecoderVars: map[string]interface{}{"calibration": -1.5, "location": map[string]interface{}{"room": "kitchen"}},
+		DevEui:      testDevEUI,
+		Addr:        testDevAddr,
+	}
+
+	// the decoder applies the calibration value from the node's config.
+	readings, err := g.decodePayload(ctx, 1, device, []byte{0x15})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 19.5)
+	test.That(t, readings["dev_eui"], test.ShouldEqual, hex.EncodeToString(testDevEUI))
+	test.That(t, readings["dev_addr"], test.ShouldEqual, hex.EncodeToString(testDevAddr))
+	test.That(t, readings["location"], test.ShouldEqual, "kitchen")
+	// decoders can't change the config.
+	test.That(t, device.DecoderVars["calibration"], test.ShouldEqual, -1.5)
+
+	// the vars are empty if the node doesn't set any.
+	device.DecoderVars = nil
+	device.DecoderStages = nil
+	device.DecoderScript = `function Decode(fPort, bytes) { return {"calibration": device.vars.calibration === undefined}; }`
+	readings, err = g.decodePayload(ctx, 1, device, []byte{0x15})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["calibration"], test.ShouldBeTrue)
+}
+
+func TestDecoderHelpers(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	logger, logs := logging.NewObservedTestLogger(t)
+	g.logger = logger
+	device := &node.Node{
+		NodeName: "test-device",
+		DecoderScript: `function Decode(fPort, bytes) {
+	console.log("decoding", bytes.length, "bytes", {fPort: fPort});
+	return {"temperature": bytes[0], "raw": bytesToHex(bytes)};
+}`,
+		DecoderStages: []string{writeTestDecoder(t, `function Decode(fPort, input) {
+	console.warn("stage got", input.raw);
+	return input;
+}`)},
+	}
+
+	// without decoder_helpers the helpers aren't defined and console output isn't logged.
+	_, err := g.decodePayload(ctx, 1, device, []byte{0x15, 0xAB})
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "'bytesToHex' is not defined")
+	test.That(t, logs.FilterMessageSnippet("logged:").Len(), test.ShouldEqual, 0)
+
+	// console output is logged.
+	device.DecoderHelpers = true
+	readings, err := g.decodePayload(ctx, 1, device, []byte{0x15, 0xAB})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21)
+	test.That(t, readings["raw"], test.ShouldEqual, "15ab")
+	entries := logs.FilterMessageSnippet("logged:").All()
+	test.That(t, len(entries), test.ShouldEqual, 2)
+	test.That(t, entries[0].Message, test.ShouldEqual, `decoder for test-device logged: decoding 2 bytes {"fPort":1}`)
+	test.That(t, entries[1].Message, test.ShouldEqual, "decoder for test-device logged: stage got 15ab")
+
+}
+
+func TestDecodeDoCommand(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+
+	resp, err := g.DoCommand(ctx, map[string]interface{}{
+		"decode": map[string]interface{}{"device": "test-device", "fport": 1.0, "payload": "1505"},
+	})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, resp["temperature"], test.ShouldEqual, 21.5)
+
+	resp, err = g.DoCommand(ctx, map[string]interface{}{
+		"decode": map[string]interface{}{"device": "test-device", "fport": 1.0, "payload": "FQU=", "encoding": "base64"},
+	})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, resp["temperature"], test.ShouldEqual, 21.5)
+
+	_, err = g.DoCommand(ctx, map[string]interface{}{
+		"decode": map[string]interface{}{"device": "test-device", "fport": 1.0, "payload": "1505", "encoding": "base32"},
+	})
+	test.That(t, err, test.ShouldBeError, errInvalidEncoding)
+
+	_, err = g.DoCommand(ctx, map[string]interface{}{
+		"decode": map[string]interface{}{"device": "test-device", "fport": 1.0, "payload": "FQU=", "encoding": "hex"},
+	})
+	test.That(t, err, test.ShouldNotBeNil)
+
+	_, err = g.DoCommand(ctx, map[string]interface{}{
+		"decode": map[string]interface{}{"device": "other-device", "fport": 1.0, "payload": "1505"},
+	})
+	test.That(t, err, test.ShouldBeError, errNoDevice)
+
+	_, err = g.DoCommand(ctx, map[string]interface{}{"decode": map[string]interface{}{"device": "test-device", "payload": "1505"}})
+	test.That(t, err, test.ShouldBeError, errInvalidDecode)
+}
+
+func TestReloadDecoderDoCommand(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+	info, err := os.Stat(device.DecoderPath)
+	test.That(t, err, test.ShouldBeNil)
+
+	readings, err := g.decodePayload(ctx, 1, device, []byte{0x15, 0x05})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+
+	// a change that keeps the size and mtime of the file isn't noticed by the cache.
+	changed := strings.Replace(testDecoderScript, "/ 10", "/ 20", 1)
+	err = os.WriteFile(device.DecoderPath, []byte(changed), 0o600)
+	test.That(t, err, test.ShouldBeNil)
+	err = os.Chtimes(device.DecoderPath, info.ModTime(), info.ModTime())
+	test.That(t, err, test.ShouldBeNil)
+	readings, err = g.decodePayload(ctx, 1, device, []byte{0x15, 0x05})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+
+	resp, err := g.DoCommand(ctx, map[string]interface{}{"reload_decoder": map[string]interface{}{"device": "test-device"}})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, resp, test.ShouldResemble, map[string]interface{}{"reload_decoder": "reloaded"})
+	readings, err = g.decodePayload(ctx, 1, device, []byte{0x15, 0x05})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.25)
+
+	// a single path can be reloaded too.
+	err = os.WriteFile(device.DecoderPath, []byte(testDecoderScript), 0o600)
+	test.That(t, err, test.ShouldBeNil)
+	err = os.Chtimes(device.DecoderPath, info.ModTime(), info.ModTime())
+	test.That(t, err, test.ShouldBeNil)
+	_, err = g.DoCommand(ctx, map[string]interface{}{"reload_decoder": map[string]interface{}{"path": device.DecoderPath}})
+	test.That(t, err, test.ShouldBeNil)
+	readings, err = g.decodePayload(ctx, 1, device, []byte{0x15, 0x05})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+
+	_, err = g.DoCommand(ctx, map[string]interface{}{"reload_decoder": map[string]interface{}{"device": "other-device"}})
+	test.That(t, err, test.ShouldBeError, errNoDevice)
+	_, err = g.DoCommand(ctx, map[string]interface{}{"reload_decoder": "test-device"})
+	test.That(t, err, test.ShouldBeError, errReloadDecoder)
+}
+
+func TestDecodePayloadDecoderFunction(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	script := testDecoderScript + `
+function decodeUplink(input) {
+	if (input.fPort != 2) {
+		return {errors: ["unknown port " + input.fPort]};
+	}
+	return {data: {"humidity": input.bytes[0]}, warnings: ["low battery"]};
+}`
+
+	// the legacy Decode function is the default.
+	device := &node.Node{DecoderScript: script}
+	readings, err := g.decodePayload(ctx, 2, device, []byte{0x15, 0x05})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{"temperature": 21.5})
+
+	device.DecoderFunction = "Decode"
+	readings, err = g.decodePayload(ctx, 2, device, []byte{0x15, 0x05})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{"temperature": 21.5})
+
+	// decodeUplink gets the input object and its data are the readings.
+	device.DecoderFunction = "decodeUplink"
+	readings, err = g.decodePayload(ctx, 2, device, []byte{0x15, 0x05})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{"humidity": int64(0x15)})
+
+	_, err = g.decodePayload(ctx, 1, device, []byte{0x15, 0x05})
+	test.That(t, errors.Is(err, lorawan.ErrDecoderErrors), test.ShouldBeTrue)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "unknown port 1")
+
+	// a decoder without decodeUplink fails.
+	device.DecoderScript = testDecoderScript
+	_, err = g.decodePayload(ctx, 2, device, []byte{0x15, 0x05})
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestDecodePayloadRaw(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+	device.DecoderPath = ""
+	device.DecoderFormat = "raw"
+
+	// the decrypted payload is returned without a decoder.
+	_, readings, err := g.parseDataUplink(ctx, createTestUplink(t, 1, 5, []byte{0x15, 0x05, 0xAB}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["payload_hex"], test.ShouldEqual, "1505ab")
+	test.That(t, readings["fport"], test.ShouldEqual, 5)
+	test.That(t, readings, test.ShouldContainKey, "last_seen")
+
+	// a port decoder is still used on its port.
+	device.PortDecoders = map[string]string{"2": writeTestDecoder(t, testDecoderScript)}
+	readings, err = g.decodePayload(ctx, 2, device, []byte{0x15, 0x05})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{"temperature": 21.5})
+}
+
+func TestDecodePayloadTimestamps(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+	device.DecoderScript = `function Decode(fPort, bytes) {
+		return {
+			"timestamp": 1714670494,
+			"sample_ts": 1714670494.25,
+			"event": {"start_ts": "2024-05-02T19:21:34+02:00", "timestamp": 1714670494},
+			"bad_ts": "yesterday",
+			"temperature": 1714670494,
+		};
+	}`
+	device.DecoderPath = ""
+
+	// Unix seconds and RFC 3339 strings are converted to RFC 3339 in UTC.
+	readings, err := g.decodePayload(ctx, 1, device, []byte{0x01})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["timestamp"], test.ShouldEqual, "2024-05-02T17:21:34Z")
+	test.That(t, readings["sample_ts"], test.ShouldEqual, "2024-05-02T17:21:34.25Z")
+	event := readings["event"].(map[string]interface{})
+	test.That(t, event["start_ts"], test.ShouldEqual, "2024-05-02T17:21:34Z")
+
+	// timestamp is only a timestamp at the top level, and other fields aren't changed.
+	test.That(t, event["timestamp"], test.ShouldEqual, 1714670494)
+	test.That(t, readings["bad_ts"], test.ShouldEqual, "yesterday")
+	test.That(t, readings["temperature"], test.ShouldEqual, 1714670494)
+}
+
+func TestDecodePayloadCayenne(t *testing.T) {
+	g := createTestGateway(t)
+
+	// no decoder script is needed for the built-in format.
+	readings, err := g.decodePayload(context.Background(), 1, &node.Node{DecoderFormat: "cayenne"}, []byte{0x03, 0x67, 0x01, 0x10})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{"temperature_3": 27.2})
+}
+
+func TestDecodePayloadFields(t *testing.T) {
+	g := createTestGateway(t)
+	device := &node.Node{
+		DecoderFormat: "fields",
+		DecoderFields: []node.DecoderField{{Name: "temperature", Offset: 0, Length: 2, Type: "int", Endianness: "little", Scale: 0.01}},
+	}
+
+	// no decoder script is needed for the fields format.
+	readings, err := g.decodePayload(context.Background(), 1, device, []byte{0x2E, 0xFB})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldAlmostEqual, -12.34)
+
+	// the fields survive the register_device docommand.
+	converted := convertToDecoderFields([]interface{}{map[string]interface{}{
+		"name": "temperature", "offset": 0.0, "length": 2.0, "type": "int", "endianness": "little", "scale": 0.01,
+	}})
+	test.That(t, converted, test.ShouldResemble, device.DecoderFields)
+}
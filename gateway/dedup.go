@@ -0,0 +1,113 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultDedupWindow is how long a received uplink is remembered if dedup_window_ms is not set.
+const defaultDedupWindow = 500 * time.Millisecond
+
+// maxSettleDelay is the longest an answer that counts the receptions of an uplink waits for them,
+// so the downlink is still sent in the device's receive window.
+const maxSettleDelay = 200 * time.Millisecond
+
+// uplinkKey identifies a single transmission of an uplink.
+type uplinkKey struct {
+	devAddr [4]byte
+	fCnt    uint16 // frame counter as sent over the air
+	mic     [4]byte
+}
+
+// newUplinkKey returns the key of the data uplink, the phyPayload must be at least 12 bytes.
+func newUplinkKey(phyPayload []byte) uplinkKey {
+	var key uplinkKey
+	copy(key.devAddr[:], phyPayload[1:5])
+	key.fCnt = uint16(phyPayload[6]) | uint16(phyPayload[7])<<8
+	copy(key.mic[:], phyPayload[len(phyPayload)-4:])
+	return key
+}
+
+// dedupCache remembers recently received uplinks so the same transmission received more than once
+// is only decoded the first time. The zero value is ready to use.
+type dedupCache struct {
+	mu     sync.Mutex
+	window time.Duration             // how long uplinks are remembered, the default is used if zero
+	seen   map[uplinkKey]*dedupEntry // map of uplink to its receptions
+}
+
+type dedupEntry struct {
+	received time.Time // time the uplink was first received
+	count    int       // number of times the uplink was received
+}
+
+// isDuplicate returns true if the uplink was already received within the window, the reception is counted.
+func (c *dedupCache) isDuplicate(key uplinkKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.seen[key]
+	if !ok || time.Since(entry.received) >= c.windowLocked() {
+		return false
+	}
+	entry.count++
+	return true
+}
+
+// receptions returns the number of times the uplink was received within the window.
+func (c *dedupCache) receptions(key uplinkKey) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.seen[key]
+	if !ok || time.Since(entry.received) >= c.windowLocked() {
+		return 0
+	}
+	return entry.count
+}
+
+// settleDelay returns how long until the receptions of the uplink have been counted, half the window or
+// maxSettleDelay after it was first received. It is zero if the uplink is no longer remembered.
+func (c *dedupCache) settleDelay(key uplinkKey) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.seen[key]
+	if !ok {
+		return 0
+	}
+	settled := entry.received.Add(min(c.windowLocked()/2, maxSettleDelay))
+	return max(time.Until(settled), 0)
+}
+
+// add records the uplink as received and removes the uplinks that are older than the window.
+func (c *dedupCache) add(key uplinkKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.seen == nil {
+		c.seen = make(map[uplinkKey]*dedupEntry)
+	}
+
+	now := time.Now()
+	for k, entry := range c.seen {
+		if now.Sub(entry.received) >= c.windowLocked() {
+			delete(c.seen, k)
+		}
+	}
+	c.seen[key] = &dedupEntry{received: now, count: 1}
+}
+
+// setWindow sets how long uplinks are remembered.
+func (c *dedupCache) setWindow(window time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.window = window
+}
+
+func (c *dedupCache) windowLocked() time.Duration {
+	if c.window <= 0 {
+		return defaultDedupWindow
+	}
+	return c.window
+}
@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"gateway/lorawan"
+	"testing"
+	"time"
+
+	"go.viam.com/test"
+)
+
+func TestParseDataUplinkDuplicate(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	g.dedup.setWindow(50 * time.Millisecond)
+
+	uplink := createTestUplink(t, 1, 1, []byte{0x15, 0x05})
+	_, readings, err := g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+
+	// the same frame received again within the window is dropped.
+	_, readings, err = g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, errors.Is(err, errDuplicateUplink), test.ShouldBeTrue)
+	test.That(t, readings, test.ShouldBeEmpty)
+
+	// after the window the frame is no longer a duplicate, the frame counter check rejects the replay.
+	time.Sleep(60 * time.Millisecond)
+	_, _, err = g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, errors.Is(err, errInvalidFCnt), test.ShouldBeTrue)
+
+	// a frame with an invalid MIC isn't remembered, so it can't block the real frame.
+	uplink = createTestUplink(t, 2, 1, []byte{0x15, 0x05})
+	corrupted := append([]byte{}, uplink...)
+	corrupted[9] ^= 0xFF
+	_, _, err = g.parseDataUplink(ctx, corrupted, testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrInvalidMIC), test.ShouldBeTrue)
+	_, _, err = g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+}
+
+func TestDedupCacheWindow(t *testing.T) {
+	var c dedupCache
+	c.setWindow(50 * time.Millisecond)
+	key := newUplinkKey(createTestUplink(t, 1, 1, []byte{0x15, 0x05}))
+
+	test.That(t, c.isDuplicate(key), test.ShouldBeFalse)
+	c.add(key)
+	test.That(t, c.isDuplicate(key), test.ShouldBeTrue)
+
+	// a different frame counter is a different uplink.
+	test.That(t, c.isDuplicate(newUplinkKey(createTestUplink(t, 2, 1, []byte{0x15, 0x05}))), test.ShouldBeFalse)
+
+	// the uplink is accepted once the window expires, and expired uplinks are removed.
+	time.Sleep(60 * time.Millisecond)
+	test.That(t, c.isDuplicate(key), test.ShouldBeFalse)
+	c.add(newUplinkKey(createTestUplink(t, 3, 1, []byte{0x15, 0x05})))
+	test.That(t, c.seen, test.ShouldNotContainKey, key)
+	test.That(t, len(c.seen), test.ShouldEqual, 1)
+}
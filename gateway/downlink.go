@@ -0,0 +1,404 @@
+package gateway
+
+/*
+#cgo CFLAGS: -I./sx1302/libloragw/inc -I./sx1302/libtools/inc
+#cgo LDFLAGS: -L./sx1302/libloragw -lloragw -L./sx1302/libtools -lbase64 -lparson -ltinymt32  -lm
+
+#include "../sx1302/libloragw/inc/loragw_hal.h"
+#include "gateway.h"
+#include <stdlib.h>
+
+*/
+import "C"
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"gateway/node"
+	"time"
+
+	"go.thethings.network/lorawan-stack/v3/pkg/crypto"
+	"go.thethings.network/lorawan-stack/v3/pkg/types"
+	"go.viam.com/utils"
+)
+
+// downlink is a downlink queued for a device, sent in the device's next receive window.
+type downlink struct {
+	fPort   uint8 // 0 if the downlink has no payload
+	payload []byte
+	// ack is set to acknowledge a confirmed uplink, confFCnt is the frame counter of that uplink.
+	ack      bool
+	confFCnt uint32
+	fOpts    []byte // MAC commands sent to the device
+	// fPending is set if more downlinks are queued after this one, so the device sends an uplink soon to get them.
+	fPending bool
+	// linkChecks are the LinkCheckAns in fOpts, their gateway count is set when the downlink is sent.
+	linkChecks []linkCheck
+}
+
+// linkCheck is a LinkCheckAns queued for the uplink with key, offset is the index of its GwCnt in the fOpts.
+type linkCheck struct {
+	key    uplinkKey
+	offset int
+}
+
+// Bits of the downlink FCtrl, the ADR bit is the same as in uplinks.
+const (
+	fCtrlACK      = 0x20
+	fCtrlFPending = 0x10
+)
+
+// maxFOptsLength is the max length of the FOpts field.
+const maxFOptsLength = 15
+
+// SendDownlink queues the payload to be sent to the device with the given DevAddr on fPort.
+// The downlink is sent when the device's class allows, see dispatchDownlinks.
+func (g *Gateway) SendDownlink(ctx context.Context, devAddr []byte, fPort uint8, payload []byte) error {
+	if fPort == 0 || fPort > 223 {
+		return errInvalidFPort
+	}
+	g.mu.Lock()
+	device, err := matchDeviceAddr(devAddr, g.devices)
+	if err != nil {
+		g.mu.Unlock()
+		return errNoDevice
+	}
+
+	if err := g.checkPayloadSizeLocked(device, len(payload), 0); err != nil {
+		g.mu.Unlock()
+		return err
+	}
+
+	if g.downlinks == nil {
+		g.downlinks = make(map[string][]*downlink)
+	}
+	g.downlinks[device.NodeName] = append(g.downlinks[device.NodeName], &downlink{fPort: fPort, payload: payload})
+	name := device.NodeName
+	g.mu.Unlock()
+	return g.dispatchDownlinks(ctx, name)
+}
+
+// dispatchDownlinks sends the device's queued downlinks on the timing path of its class, it is called
+// when a downlink or MAC command is queued. Class A devices only listen in the receive windows after an
+// uplink, so their downlinks wait for sendQueuedDownlink after the next uplink. Class C devices are always
+// listening and get the next downlink right away, the rest follow with fPending set as the device sends uplinks.
+// The gateway doesn't send class B beacons, so there are no ping slots to schedule downlinks in.
+func (g *Gateway) dispatchDownlinks(ctx context.Context, name string) error {
+	g.mu.Lock()
+	device, ok := g.devices[name]
+	if !ok {
+		g.mu.Unlock()
+		return errNoDevice
+	}
+	switch device.Class {
+	case "C":
+		rx, ok := g.classCRouteLocked(name)
+		g.mu.Unlock()
+		if !ok {
+			// there is no way to reach the device yet, the downlink is sent after its next uplink.
+			g.logger.Debugf("no gateway to send the downlink to class C node %s through, queueing it", name)
+			return nil
+		}
+		return g.sendQueuedDownlink(ctx, name, rx)
+	default:
+		g.mu.Unlock()
+		return nil
+	}
+}
+
+// checkPayloadSizeLocked returns an error if a downlink with the payload and MAC commands doesn't fit in the
+// data rate of the device's rx2 window, the window its downlinks are sent in. The MAC commands in FOpts count
+// against the max payload size of the data rate. The caller must hold the gateway mutex.
+func (g *Gateway) checkPayloadSizeLocked(device *node.Node, payloadLength, fOptsLength int) error {
+	dataRate := g.region.rxSettings(device).rx2DataRate
+	maxSize := g.region.maxPayloadSize(dataRate, fOptsLength)
+	if payloadLength > maxSize {
+		return fmt.Errorf("%w: %d bytes is more than the %d bytes that fit at DR%d", errPayloadTooLarge, payloadLength, maxSize, dataRate)
+	}
+	return nil
+}
+
+// setRoute saves the radio metadata of the device's uplink, so class C downlinks can be sent
+// back the same way.
+func (g *Gateway) setRoute(name string, rx rxInfo) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.routes == nil {
+		g.routes = make(map[string]rxInfo)
+	}
+	g.routes[name] = rx
+}
+
+// classCRouteLocked returns where to send a downlink to the class C device outside of its receive windows.
+// Downlinks go back through the gateway that received the device's last uplink. Before the first uplink they
+// go out on the gateway's own radio, or through a connected packet forwarder or Basics Station.
+// The caller must hold the gateway mutex.
+func (g *Gateway) classCRouteLocked(name string) (rxInfo, bool) {
+	if rx, ok := g.routes[name]; ok {
+		rx.immediate = true
+		return rx, true
+	}
+	rx := rxInfo{immediate: true}
+	if g.started {
+		return rx, true
+	}
+	if eui, ok := g.udp.anyForwarder(); ok {
+		rx.forwarder = &forwarderRx{gatewayEUI: eui}
+		return rx, true
+	}
+	if conn, ok := g.station.anyConn(); ok {
+		rx.station = &stationRx{conn: conn}
+		return rx, true
+	}
+	return rx, false
+}
+
+// encodePayload runs the Encode function of the device's decoder to convert obj into the downlink payload.
+func (g *Gateway) encodePayload(ctx context.Context, fPort uint8, device *node.Node, obj map[string]interface{}) ([]byte, error) {
+	g.mu.Lock()
+	encoding := lorawanDevice(device)
+	g.mu.Unlock()
+	return g.decoders.Encode(ctx, fPort, encoding, obj, func(msg string) {
+		g.logger.Debugf("encoder for %s logged: %s", device.NodeName, msg)
+	})
+}
+
+// queueAck acknowledges a confirmed uplink from the device with frame counter fCnt in the next downlink.
+// The ack is sent with the next queued downlink, if there is none an empty downlink is queued.
+func (g *Gateway) queueAck(device *node.Node, fCnt uint32) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.downlinks == nil {
+		g.downlinks = make(map[string][]*downlink)
+	}
+
+	queue := g.downlinks[device.NodeName]
+	if len(queue) > 0 {
+		queue[0].ack = true
+		queue[0].confFCnt = fCnt
+		return
+	}
+	g.downlinks[device.NodeName] = append(queue, &downlink{ack: true, confFCnt: fCnt})
+}
+
+// queueMACCommandLocked sends the MAC command in the FOpts of the device's next downlink that has room for it,
+// if there is none an empty downlink is queued. It returns the downlink the command was added to.
+// The caller must hold the gateway mutex.
+func (g *Gateway) queueMACCommandLocked(device *node.Node, cmd []byte) *downlink {
+	if g.downlinks == nil {
+		g.downlinks = make(map[string][]*downlink)
+	}
+
+	queue := g.downlinks[device.NodeName]
+	for _, dl := range queue {
+		// the MAC commands are only added to a downlink whose payload still fits with them.
+		fOptsLength := len(dl.fOpts) + len(cmd)
+		if fOptsLength <= maxFOptsLength && g.checkPayloadSizeLocked(device, len(dl.payload), fOptsLength) == nil {
+			dl.fOpts = append(dl.fOpts, cmd...)
+			return dl
+		}
+	}
+	dl := &downlink{fOpts: cmd}
+	g.downlinks[device.NodeName] = append(queue, dl)
+	return dl
+}
+
+// linkCheckDelay returns how long the device's next downlink waits for the receptions of the uplinks its
+// LinkCheckAns answer to be counted.
+func (g *Gateway) linkCheckDelay(name string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var delay time.Duration
+	if queue := g.downlinks[name]; len(queue) > 0 {
+		for _, lc := range queue[0].linkChecks {
+			delay = max(delay, g.dedup.settleDelay(lc.key))
+		}
+	}
+	return delay
+}
+
+// sendQueuedDownlink sends the next queued downlink for the device in the rx2 window.
+// It should be called after an uplink from the device is received with the uplink's radio metadata,
+// or with an immediate rx for class C devices.
+func (g *Gateway) sendQueuedDownlink(ctx context.Context, name string, rx rxInfo) error {
+	// a LinkCheckAns counts the gateways that received the uplink, so wait for the copies of the other gateways.
+	if delay := g.linkCheckDelay(name); delay > 0 && !utils.SelectContextOrWait(ctx, delay) {
+		return nil
+	}
+
+	g.mu.Lock()
+	queue := g.downlinks[name]
+	device, ok := g.devices[name]
+	if len(queue) == 0 || !ok {
+		g.mu.Unlock()
+		return nil
+	}
+	g.downlinks[name] = queue[1:]
+	queue[0].fPending = len(queue) > 1
+	for _, lc := range queue[0].linkChecks {
+		// the count is kept if the uplink is no longer remembered.
+		queue[0].fOpts[lc.offset] = max(queue[0].fOpts[lc.offset], byte(min(g.dedup.receptions(lc.key), 255)))
+	}
+	// the rx2 data rate of the device can change after the downlink was queued, such as with a new config.
+	if err := g.checkPayloadSizeLocked(device, len(queue[0].payload), len(queue[0].fOpts)); err != nil {
+		g.mu.Unlock()
+		return fmt.Errorf("dropping downlink to %s: %w", name, err)
+	}
+	frame, err := buildDownlink(device, queue[0])
+	if err == nil {
+		g.saveSessionLocked(device)
+	}
+	settings := g.region.rxSettings(device)
+	rx2Freq := g.region.rx2Freq(device)
+	g.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// the join accept sets the rx1 delay, rx2 opens 1 second after rx1.
+	rx2 := rxWindow{frequency: rx2Freq, dataRate: settings.rx2DataRate, delay: settings.rx1Delay + time.Second}
+	if rx.immediate {
+		rx2.delay = 0
+	}
+	return g.transmit(ctx, frame, nil, rx2, rx)
+}
+
+// Structure of a downlink phyPayload:
+// | MHDR | DEV ADDR |  FCTL |  FCnt  | FOpts  | FPort  |  FRM Payload | MIC |
+// | 1 B  |   4 B    |  1 B  |  2 B   | 0-15 B |  0-1 B |   variable   | 4 B |
+// buildDownlink builds an unconfirmed data downlink and increments the device's downlink frame counter.
+// The caller must hold the gateway mutex.
+func buildDownlink(device *node.Node, dl *downlink) ([]byte, error) {
+	if len(device.Addr) == 0 {
+		return nil, errNotJoined
+	}
+	if len(device.Addr) != 4 {
+		return nil, fmt.Errorf("%w: %x", errInvalidDevAddr, device.Addr)
+	}
+	dAddr := types.MustDevAddr(device.Addr)
+	fCnt := device.FCntDown
+
+	// FCtrl: | ADR | RFU | ACK | FPending | FOptsLen |
+	//         | 7   |  6  |  5  |    4     |   3..0   |
+	fCtrl := byte(len(dl.fOpts))
+	if device.ADR {
+		fCtrl |= fCtrlADR
+	}
+	if dl.ack {
+		fCtrl |= fCtrlACK
+	}
+	if dl.fPending {
+		fCtrl |= fCtrlFPending
+	}
+
+	payload := make([]byte, 0)
+	payload = append(payload, 0x60) // unconfirmed data down
+	payload = append(payload, reverseByteArray(device.Addr)...)
+	payload = append(payload, fCtrl)
+	payload = binary.LittleEndian.AppendUint16(payload, uint16(fCnt))
+
+	fOpts := dl.fOpts
+	if len(fOpts) > 0 && device.LorawanVersion == "1.1.0" {
+		// LoRaWAN 1.1 encrypts the MAC commands in FOpts with the NwkSEncKey.
+		var err error
+		fOpts, err = crypto.EncryptDownlink(types.AES128Key(device.NwkSEncKey), *dAddr, fCnt, fOpts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt fopts: %w", err)
+		}
+	}
+	payload = append(payload, fOpts...)
+
+	// an ack or MAC commands on their own have no fport or payload.
+	if dl.fPort != 0 {
+		enc, err := crypto.EncryptDownlink(types.AES128Key(device.AppSKey), *dAddr, fCnt, dl.payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt downlink: %w", err)
+		}
+		payload = append(payload, dl.fPort)
+		payload = append(payload, enc...)
+	}
+
+	var mic [4]byte
+	var err error
+	if device.LorawanVersion == "1.1.0" {
+		// the 1.1 MIC includes the frame counter of the uplink being acknowledged.
+		var confFCnt uint32
+		if dl.ack {
+			confFCnt = dl.confFCnt
+		}
+		mic, err = crypto.ComputeDownlinkMIC(types.AES128Key(device.SNwkSIntKey), *dAddr, confFCnt, fCnt, payload)
+	} else {
+		mic, err = crypto.ComputeLegacyDownlinkMIC(types.AES128Key(device.NwkSKey), *dAddr, fCnt, payload)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute downlink MIC: %w", err)
+	}
+	payload = append(payload, mic[:]...)
+
+	device.FCntDown++
+
+	return payload, nil
+}
+
+// transmit sends the payload in the rx1 window if it is set, falling back to rx2 if it can't be sent in rx1.
+// Replies to packets received by a packet forwarder or Basics Station are sent back through it,
+// a Basics Station gets both windows and falls back to rx2 itself.
+func (g *Gateway) transmit(ctx context.Context, payload []byte, rx1 *rxWindow, rx2 rxWindow, rx rxInfo) error {
+	if rx.station != nil {
+		return g.transmitStation(ctx, payload, rx1, rx2, rx.station, rx.immediate)
+	}
+	if rx1 != nil {
+		err := g.transmitWindow(ctx, payload, *rx1, rx)
+		if err == nil {
+			return nil
+		}
+		g.logger.Debugf("failed to send downlink in rx1, sending it in rx2: %s", err)
+	}
+	return g.transmitWindow(ctx, payload, rx2, rx)
+}
+
+// transmitWindow sends the payload in the receive window, through the packet forwarder if the packet came from one.
+func (g *Gateway) transmitWindow(ctx context.Context, payload []byte, w rxWindow, rx rxInfo) error {
+	if rx.forwarder != nil {
+		return g.transmitUDP(payload, w, rx.forwarder, rx.immediate)
+	}
+
+	dr := g.region.dataRates[w.dataRate]
+	txPkt := C.struct_lgw_pkt_tx_s{
+		freq_hz:    C.uint32_t(w.frequency),
+		tx_mode:    C.uint8_t(0), // immediate mode
+		rf_chain:   C.uint8_t(0),
+		rf_power:   C.int8_t(g.region.txPower), // tx power in dbm
+		modulation: C.uint8_t(0x10),            // LORA modulation
+		bandwidth:  C.uint8_t(dr.bandwidth),
+		datarate:   C.uint32_t(dr.sf),
+		coderate:   C.uint8_t(0x01), // code rate 4/5
+		invert_pol: C.bool(true),    // Downlinks are always reverse polarity.
+		size:       C.uint16_t(len(payload)),
+	}
+
+	var cPayload [256]C.uchar
+	for i, b := range payload {
+		cPayload[i] = C.uchar(b)
+	}
+	txPkt.payload = cPayload
+
+	// wait for the receive window to open, it is timed from when the uplink was received.
+	delay := w.delay
+	if !rx.received.IsZero() {
+		delay = max(time.Until(rx.received.Add(w.delay)), 0)
+	}
+	if !utils.SelectContextOrWait(ctx, delay) {
+		return nil
+	}
+
+	// lock so there is not two sends at the same time.
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	errCode := int(C.send(&txPkt))
+	if errCode != 0 {
+		return errSendDownlink
+	}
+
+	return nil
+}
@@ -0,0 +1,451 @@
+package gateway
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gateway/lorawan"
+	"gateway/node"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.thethings.network/lorawan-stack/v3/pkg/crypto"
+	"go.thethings.network/lorawan-stack/v3/pkg/types"
+	"go.viam.com/test"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// decryptTestDownlink verifies the MIC of the downlink and returns the FPort and decrypted FRMPayload.
+func decryptTestDownlink(t *testing.T, frame []byte) (uint8, []byte) {
+	devAddr := types.MustDevAddr(reverseByteArray(frame[1:5]))
+	fCnt := uint32(binary.LittleEndian.Uint16(frame[6:8]))
+	foptsLength := frame[5] & 0x0F
+
+	mic, err := crypto.ComputeLegacyDownlinkMIC(types.AES128Key(testNwkSKey), *devAddr, fCnt, frame[:len(frame)-4])
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, frame[len(frame)-4:], test.ShouldResemble, mic[:])
+
+	fPort := frame[8+foptsLength]
+	dec, err := crypto.DecryptDownlink(types.AES128Key(testAppSKey), *devAddr, fCnt, frame[9+foptsLength:len(frame)-4])
+	test.That(t, err, test.ShouldBeNil)
+	return fPort, dec
+}
+
+func TestSendDownlink(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+
+	err := g.SendDownlink(ctx, testDevAddr, 10, []byte{0x01, 0x02, 0x03})
+	test.That(t, err, test.ShouldBeNil)
+	err = g.SendDownlink(ctx, testDevAddr, 11, []byte{0xAA})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(g.downlinks["test-device"]), test.ShouldEqual, 2)
+
+	// the frames round trip back to the original payloads and the frame counter increments.
+	frame, err := buildDownlink(device, g.downlinks["test-device"][0])
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, frame[0], test.ShouldEqual, 0x60)
+	test.That(t, frame[1:5], test.ShouldResemble, reverseByteArray(testDevAddr))
+	test.That(t, binary.LittleEndian.Uint16(frame[6:8]), test.ShouldEqual, 0)
+	fPort, payload := decryptTestDownlink(t, frame)
+	test.That(t, fPort, test.ShouldEqual, 10)
+	test.That(t, payload, test.ShouldResemble, []byte{0x01, 0x02, 0x03})
+
+	frame, err = buildDownlink(device, g.downlinks["test-device"][1])
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, binary.LittleEndian.Uint16(frame[6:8]), test.ShouldEqual, 1)
+	fPort, payload = decryptTestDownlink(t, frame)
+	test.That(t, fPort, test.ShouldEqual, 11)
+	test.That(t, payload, test.ShouldResemble, []byte{0xAA})
+	test.That(t, device.FCntDown, test.ShouldEqual, 2)
+
+	// a device without a valid dev addr gets an error instead of a frame.
+	_, err = buildDownlink(&node.Node{NodeName: "unjoined"}, &downlink{fPort: 10, payload: []byte{0x01}})
+	test.That(t, err, test.ShouldBeError, errNotJoined)
+	_, err = buildDownlink(&node.Node{NodeName: "short-addr", Addr: []byte{0x01, 0x02}}, &downlink{fPort: 10, payload: []byte{0x01}})
+	test.That(t, errors.Is(err, errInvalidDevAddr), test.ShouldBeTrue)
+
+	// invalid fport
+	err = g.SendDownlink(ctx, testDevAddr, 0, []byte{0x01})
+	test.That(t, err, test.ShouldBeError, errInvalidFPort)
+
+	// unknown device
+	err = g.SendDownlink(ctx, []byte{0x09, 0x09, 0x09, 0x09}, 1, []byte{0x01})
+	test.That(t, err, test.ShouldBeError, errNoDevice)
+
+	// payload too large
+	err = g.SendDownlink(ctx, testDevAddr, 1, make([]byte, g.region.rx2().maxPayloadSize+1))
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestConfirmedUplinkAck(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+
+	// unconfirmed uplinks aren't acknowledged.
+	_, _, err := g.parseDataUplink(ctx, createTestUplink(t, 1, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, g.downlinks["test-device"], test.ShouldBeEmpty)
+
+	uplink := createUplinkWithMHDR(t, confirmedDataUp, testNwkSKey, testAppSKey, testDevAddr, 2, nil, 1, []byte{0x15, 0x05})
+	_, readings, err := g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+
+	// an empty downlink with the ack bit set is queued.
+	test.That(t, len(g.downlinks["test-device"]), test.ShouldEqual, 1)
+	frame, err := buildDownlink(device, g.downlinks["test-device"][0])
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, frame[0], test.ShouldEqual, 0x60)
+	test.That(t, frame[5], test.ShouldEqual, 0x20)
+	// MHDR, DevAddr, FCtrl, FCnt and MIC, with no FPort or payload.
+	test.That(t, len(frame), test.ShouldEqual, 12)
+
+	devAddr := types.MustDevAddr(testDevAddr)
+	mic, err := crypto.ComputeLegacyDownlinkMIC(types.AES128Key(testNwkSKey), *devAddr, 0, frame[:8])
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, frame[8:], test.ShouldResemble, mic[:])
+
+	// the ack is sent with a downlink that is already queued.
+	g.downlinks = nil
+	err = g.SendDownlink(ctx, testDevAddr, 10, []byte{0x01})
+	test.That(t, err, test.ShouldBeNil)
+	uplink = createUplinkWithMHDR(t, confirmedDataUp, testNwkSKey, testAppSKey, testDevAddr, 3, nil, 1, []byte{0x15, 0x05})
+	_, _, err = g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(g.downlinks["test-device"]), test.ShouldEqual, 1)
+
+	frame, err = buildDownlink(device, g.downlinks["test-device"][0])
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, frame[5]&0x20, test.ShouldEqual, 0x20)
+	fPort, payload := decryptTestDownlink(t, frame)
+	test.That(t, fPort, test.ShouldEqual, 10)
+	test.That(t, payload, test.ShouldResemble, []byte{0x01})
+}
+
+func TestConfirmedUplinkRetransmission(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	g.dedup.setWindow(time.Millisecond)
+
+	uplink := createUplinkWithMHDR(t, confirmedDataUp, testNwkSKey, testAppSKey, testDevAddr, 1, nil, 1, []byte{0x15, 0x05})
+	_, readings, err := g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+	test.That(t, len(g.downlinks["test-device"]), test.ShouldEqual, 1)
+
+	// the ack was sent but the device didn't receive it, so it sends the uplink again after the dedup window.
+	g.downlinks = nil
+	time.Sleep(5 * time.Millisecond)
+	name, readings, err := g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, name, test.ShouldEqual, "test-device")
+	test.That(t, readings, test.ShouldBeNil)
+	test.That(t, len(g.downlinks["test-device"]), test.ShouldEqual, 1)
+	test.That(t, g.downlinks["test-device"][0].ack, test.ShouldBeTrue)
+	test.That(t, g.downlinks["test-device"][0].confFCnt, test.ShouldEqual, 1)
+
+	// unconfirmed uplinks with the same frame counter are still rejected.
+	g.downlinks = nil
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 1, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, errors.Is(err, errInvalidFCnt), test.ShouldBeTrue)
+	test.That(t, g.downlinks["test-device"], test.ShouldBeEmpty)
+}
+
+func TestSendDownlinkDoCommand(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+
+	resp, err := g.DoCommand(ctx, map[string]interface{}{
+		"send_downlink": map[string]interface{}{"device": "test-device", "fport": 2.0, "payload": "0102"},
+	})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, resp["send_downlink"], test.ShouldEqual, "queued")
+
+	_, err = g.DoCommand(ctx, map[string]interface{}{
+		"send_downlink": map[string]interface{}{"dev_addr": "01020304", "fport": 3.0, "payload": "03"},
+	})
+	test.That(t, err, test.ShouldBeNil)
+
+	queue := g.downlinks["test-device"]
+	test.That(t, len(queue), test.ShouldEqual, 2)
+	test.That(t, queue[0].fPort, test.ShouldEqual, 2)
+	test.That(t, queue[0].payload, test.ShouldResemble, []byte{0x01, 0x02})
+	test.That(t, queue[1].fPort, test.ShouldEqual, 3)
+
+	// missing payload
+	_, err = g.DoCommand(ctx, map[string]interface{}{
+		"send_downlink": map[string]interface{}{"device": "test-device", "fport": 2.0},
+	})
+	test.That(t, err, test.ShouldBeError, errInvalidDownlink)
+
+	// invalid hex
+	_, err = g.DoCommand(ctx, map[string]interface{}{
+		"send_downlink": map[string]interface{}{"device": "test-device", "fport": 2.0, "payload": "zz"},
+	})
+	test.That(t, err, test.ShouldNotBeNil)
+
+	// an OTAA device that hasn't joined has no dev addr to send to.
+	otaa := addTestOTAADevice(g)
+	otaa.Class = "C"
+	_, err = g.DoCommand(ctx, map[string]interface{}{
+		"send_downlink": map[string]interface{}{"device": otaa.NodeName, "fport": 2.0, "payload": "01"},
+	})
+	test.That(t, err, test.ShouldBeError, errNotJoined)
+	test.That(t, g.downlinks, test.ShouldNotContainKey, otaa.NodeName)
+}
+
+func TestSendDownlinkClassC(t *testing.T) {
+	ctx := context.Background()
+
+	// the downlink waits for the next uplink if there is no gateway to send it through.
+	g := createTestGateway(t)
+	g.devices["test-device"].Class = "C"
+	err := g.SendDownlink(ctx, testDevAddr, 10, []byte{0x01})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(g.downlinks["test-device"]), test.ShouldEqual, 1)
+
+	g, conn := startTestStation(t)
+	g.devices["test-device"].Class = "C"
+	// wait for the station to be connected.
+	err = conn.Write(ctx, websocket.MessageText, []byte(`{"msgtype":"version","station":"2.0.6","protocol":2}`))
+	test.That(t, err, test.ShouldBeNil)
+	var conf routerConfig
+	err = wsjson.Read(ctx, conn, &conf)
+	test.That(t, err, test.ShouldBeNil)
+
+	// the downlink is sent right away without an uplink from the device.
+	_, err = g.DoCommand(ctx, map[string]interface{}{
+		"send_downlink": map[string]interface{}{"device": "test-device", "fport": 10.0, "payload": "0102"},
+	})
+	test.That(t, err, test.ShouldBeNil)
+	dn := readTestDownlink(t, conn)
+	test.That(t, dn.DC, test.ShouldEqual, 2)
+	test.That(t, dn.XTime, test.ShouldEqual, 0)
+	test.That(t, dn.RX2Freq, test.ShouldEqual, g.region.rx2Frequency)
+	frame, err := hex.DecodeString(dn.PDU)
+	test.That(t, err, test.ShouldBeNil)
+	fPort, payload := decryptTestDownlink(t, frame)
+	test.That(t, fPort, test.ShouldEqual, 10)
+	test.That(t, payload, test.ShouldResemble, []byte{0x01, 0x02})
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	test.That(t, g.downlinks["test-device"], test.ShouldBeEmpty)
+}
+
+func TestDispatchDownlinksByClass(t *testing.T) {
+	ctx := context.Background()
+	g, conn := startTestStation(t)
+	// wait for the station to be connected.
+	err := conn.Write(ctx, websocket.MessageText, []byte(`{"msgtype":"version","station":"2.0.6","protocol":2}`))
+	test.That(t, err, test.ShouldBeNil)
+	var conf routerConfig
+	err = wsjson.Read(ctx, conn, &conf)
+	test.That(t, err, test.ShouldBeNil)
+
+	// the MAC command for a class A device waits for its next uplink.
+	_, err = g.DoCommand(ctx, map[string]interface{}{"set_duty_cycle": map[string]interface{}{"device": "test-device", "max_duty_cycle": 4.0}})
+	test.That(t, err, test.ShouldBeNil)
+	g.mu.Lock()
+	test.That(t, len(g.downlinks["test-device"]), test.ShouldEqual, 1)
+	g.mu.Unlock()
+
+	// once the device is class C, the next queued MAC command is dispatched right away with the one waiting.
+	g.mu.Lock()
+	g.devices["test-device"].Class = "C"
+	g.mu.Unlock()
+	_, err = g.DoCommand(ctx, map[string]interface{}{"set_rx_delay": map[string]interface{}{"device": "test-device", "rx_delay_s": 2.0}})
+	test.That(t, err, test.ShouldBeNil)
+	dn := readTestDownlink(t, conn)
+	test.That(t, dn.XTime, test.ShouldEqual, 0)
+	frame, err := hex.DecodeString(dn.PDU)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, frame[5]&0x0F, test.ShouldEqual, 4)
+	test.That(t, frame[8:12], test.ShouldResemble, []byte{lorawan.CIDDutyCycle, 0x04, lorawan.CIDRXTimingSetup, 0x02})
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	test.That(t, g.downlinks["test-device"], test.ShouldBeEmpty)
+}
+
+func TestDownlinkPayloadSize(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+
+	// DR8 is the default rx2 data rate of US915, DR10 fits larger payloads.
+	dr10 := uint8(10)
+	for _, tc := range []struct {
+		rx2DataRate *uint8
+		maxSize     int
+	}{
+		{nil, 53},
+		{&dr10, 242},
+	} {
+		device.RX2DataRate = tc.rx2DataRate
+		g.downlinks = nil
+		for _, size := range []int{tc.maxSize - 1, tc.maxSize} {
+			err := g.SendDownlink(ctx, testDevAddr, 10, make([]byte, size))
+			test.That(t, err, test.ShouldBeNil)
+		}
+		_, err := g.DoCommand(ctx, map[string]interface{}{
+			"send_downlink": map[string]interface{}{"device": "test-device", "fport": 10.0, "payload": hex.EncodeToString(make([]byte, tc.maxSize+1))},
+		})
+		test.That(t, errors.Is(err, errPayloadTooLarge), test.ShouldBeTrue)
+		test.That(t, err.Error(), test.ShouldContainSubstring, fmt.Sprintf("%d bytes is more than the %d bytes", tc.maxSize+1, tc.maxSize))
+		test.That(t, len(g.downlinks["test-device"]), test.ShouldEqual, 2)
+	}
+
+	// MAC commands count against the max size, so they aren't added to downlinks without room for them.
+	g.mu.Lock()
+	g.queueMACCommandLocked(device, dutyCycleReq(4))
+	queue := g.downlinks["test-device"]
+	test.That(t, len(queue), test.ShouldEqual, 3)
+	test.That(t, queue[2].fOpts, test.ShouldResemble, []byte{lorawan.CIDDutyCycle, 0x04})
+	test.That(t, queue[2].payload, test.ShouldBeNil)
+	g.mu.Unlock()
+
+	// a downlink that no longer fits the rx2 data rate of the device is dropped.
+	device.RX2DataRate = nil
+	err := g.sendQueuedDownlink(ctx, "test-device", testRxInfo)
+	test.That(t, errors.Is(err, errPayloadTooLarge), test.ShouldBeTrue)
+	test.That(t, len(g.downlinks["test-device"]), test.ShouldEqual, 2)
+}
+
+func TestDownlinkFCtrl(t *testing.T) {
+	ctx := context.Background()
+	g, conn := startTestStation(t)
+	for i := byte(1); i <= 3; i++ {
+		err := g.SendDownlink(ctx, testDevAddr, 10, []byte{i})
+		test.That(t, err, test.ShouldBeNil)
+	}
+
+	// sendUplink sends an uplink through the station and returns the FCtrl of the downlink sent after it.
+	sendUplink := func(mhdr byte, fCnt uint32, adr bool) byte {
+		uplink := createUplinkWithMHDR(t, mhdr, testNwkSKey, testAppSKey, testDevAddr, fCnt, nil, 1, []byte{0x15, 0x05})
+		if adr {
+			uplink[5] |= fCtrlADR
+			mic, err := crypto.ComputeLegacyUplinkMIC(types.AES128Key(testNwkSKey), *types.MustDevAddr(testDevAddr), fCnt, uplink[:len(uplink)-4])
+			test.That(t, err, test.ShouldBeNil)
+			copy(uplink[len(uplink)-4:], mic[:])
+		}
+		err := wsjson.Write(ctx, conn, toStationUplink(uplink))
+		test.That(t, err, test.ShouldBeNil)
+		frame, err := hex.DecodeString(readTestDownlink(t, conn).PDU)
+		test.That(t, err, test.ShouldBeNil)
+		return frame[5]
+	}
+
+	// more downlinks are queued, and the ADR bit follows the device's uplink.
+	fCtrl := sendUplink(confirmedDataUp, 1, true)
+	test.That(t, fCtrl, test.ShouldEqual, fCtrlADR|fCtrlACK|fCtrlFPending)
+	fCtrl = sendUplink(unconfirmedDataUp, 2, false)
+	test.That(t, fCtrl, test.ShouldEqual, fCtrlFPending)
+
+	// the last queued downlink doesn't have the frame pending bit.
+	fCtrl = sendUplink(unconfirmedDataUp, 3, true)
+	test.That(t, fCtrl, test.ShouldEqual, fCtrlADR)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	test.That(t, g.downlinks["test-device"], test.ShouldBeEmpty)
+}
+
+func TestDownlinkRXSettings(t *testing.T) {
+	ctx := context.Background()
+	g, conn := startTestStation(t)
+	rx2DataRate, rxDelay, rx2Frequency := uint8(10), uint8(3), uint32(925100000)
+	g.mu.Lock()
+	g.devices["test-device"].RX2DataRate = &rx2DataRate
+	g.devices["test-device"].RXDelay = &rxDelay
+	g.devices["test-device"].RX2Frequency = &rx2Frequency
+	g.mu.Unlock()
+
+	// the payload has to fit in the device's rx2 data rate instead of the region's.
+	err := g.SendDownlink(ctx, testDevAddr, 10, make([]byte, g.region.rx2().maxPayloadSize+1))
+	test.That(t, err, test.ShouldBeNil)
+
+	err = conn.Write(ctx, websocket.MessageText, []byte(testStationUplink))
+	test.That(t, err, test.ShouldBeNil)
+	dn := readTestDownlink(t, conn)
+	test.That(t, dn.RxDelay, test.ShouldEqual, 3)
+	test.That(t, dn.RX2DR, test.ShouldEqual, 10)
+	test.That(t, dn.RX2Freq, test.ShouldEqual, 925100000)
+}
+
+const testCodecScript = `function Decode(fPort, bytes) {
+	return {"temperature": bytes[0] + bytes[1] / 10};
+}
+
+function Encode(fPort, obj) {
+	var whole = Math.floor(obj.temperature);
+	return [whole, Math.round((obj.temperature - whole) * 10)];
+}`
+
+// writeTestDecoder writes the script to a decoder file and returns its path.
+func writeTestDecoder(t *testing.T, script string) string {
+	path := filepath.Join(t.TempDir(), "codec.js")
+	err := os.WriteFile(path, []byte(script), 0o600)
+	test.That(t, err, test.ShouldBeNil)
+	return path
+}
+
+func TestEncodePayload(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	path := writeTestDecoder(t, testCodecScript)
+
+	// round trip the object through Encode and Decode.
+	payload, err := g.encodePayload(ctx, 1, &node.Node{DecoderPath: path}, map[string]interface{}{"temperature": 21.5})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, payload, test.ShouldResemble, []byte{0x15, 0x05})
+
+	readings, err := g.decodePayload(ctx, 1, &node.Node{DecoderPath: path}, payload)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+
+	// decoder files with only a Decode function can't encode.
+	_, err = g.encodePayload(ctx, 1, &node.Node{DecoderPath: writeTestDecoder(t, testDecoderScript)}, map[string]interface{}{"temperature": 21.5})
+	test.That(t, err, test.ShouldBeError, lorawan.ErrNoEncodeFunction)
+
+	// errors thrown by Encode are returned.
+	path = writeTestDecoder(t, `function Encode(fPort, obj) { throw new Error("bad object"); }`)
+	_, err = g.encodePayload(ctx, 1, &node.Node{DecoderPath: path}, map[string]interface{}{})
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "bad object")
+
+	// Encode must return an array of bytes.
+	path = writeTestDecoder(t, `function Encode(fPort, obj) { return [1, 256]; }`)
+	_, err = g.encodePayload(ctx, 1, &node.Node{DecoderPath: path}, map[string]interface{}{})
+	test.That(t, err, test.ShouldNotBeNil)
+
+	path = writeTestDecoder(t, `function Encode(fPort, obj) { return "0102"; }`)
+	_, err = g.encodePayload(ctx, 1, &node.Node{DecoderPath: path}, map[string]interface{}{})
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestSendDownlinkDoCommandObject(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	g.devices["test-device"].DecoderPath = writeTestDecoder(t, testCodecScript)
+
+	_, err := g.DoCommand(ctx, map[string]interface{}{
+		"send_downlink": map[string]interface{}{
+			"device": "test-device",
+			"fport":  2.0,
+			"object": map[string]interface{}{"temperature": 21.5},
+		},
+	})
+	test.That(t, err, test.ShouldBeNil)
+
+	queue := g.downlinks["test-device"]
+	test.That(t, len(queue), test.ShouldEqual, 1)
+	test.That(t, queue[0].payload, test.ShouldResemble, []byte{0x15, 0x05})
+}
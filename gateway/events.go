@@ -0,0 +1,198 @@
+package gateway
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxUplinkEvents is how many of the most recent uplinks are kept for each device, unless its history_size is set.
+const maxUplinkEvents = 64
+
+// maxUplinkWait is the longest a get_uplinks docommand waits for a new uplink.
+const maxUplinkWait = time.Minute
+
+// uplinkEvent is a decoded uplink from a device.
+// Each device's uplinks are numbered from 1 in the order they were received, so callers can tell
+// which uplinks are new and notice if they fell behind.
+type uplinkEvent struct {
+	seq      uint64
+	received time.Time
+	readings map[string]interface{}
+}
+
+// uplinkLog keeps the recent uplinks of each device and wakes callers waiting for new ones.
+// The zero value is ready to use.
+type uplinkLog struct {
+	mu      sync.Mutex
+	seq     map[string]uint64        // map of node name to the seq of its last uplink
+	events  map[string][]uplinkEvent // map of node name to its recent uplinks, oldest first
+	sizes   map[string]int           // map of node name to how many uplinks are kept, if not maxUplinkEvents
+	updated chan struct{}            // closed and replaced when an uplink is added
+}
+
+// add records the readings of a new uplink from the device and returns its seq.
+func (l *uplinkLog) add(name string, readings map[string]interface{}) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seq == nil {
+		l.seq = make(map[string]uint64)
+		l.events = make(map[string][]uplinkEvent)
+	}
+	l.seq[name]++
+	events := append(l.events[name], uplinkEvent{seq: l.seq[name], received: time.Now(), readings: readings})
+	l.events[name] = trimEvents(events, l.sizeLocked(name))
+
+	if l.updated != nil {
+		close(l.updated)
+		l.updated = nil
+	}
+	return l.seq[name]
+}
+
+// setSize sets how many uplinks are kept for the device, zero keeps maxUplinkEvents.
+// The oldest uplinks are dropped if more are kept already.
+func (l *uplinkLog) setSize(name string, size int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sizes == nil {
+		l.sizes = make(map[string]int)
+	}
+	if size <= 0 {
+		delete(l.sizes, name)
+	} else {
+		l.sizes[name] = size
+	}
+	if events, ok := l.events[name]; ok {
+		l.events[name] = trimEvents(events, l.sizeLocked(name))
+	}
+}
+
+func (l *uplinkLog) sizeLocked(name string) int {
+	if size, ok := l.sizes[name]; ok {
+		return size
+	}
+	return maxUplinkEvents
+}
+
+// trimEvents drops the oldest events so at most size are left.
+func trimEvents(events []uplinkEvent, size int) []uplinkEvent {
+	if len(events) <= size {
+		return events
+	}
+	// copy so the dropped events aren't kept alive by the backing array.
+	return append([]uplinkEvent(nil), events[len(events)-size:]...)
+}
+
+// after returns the device's uplinks with a seq greater than seq, and the seq of its last uplink.
+func (l *uplinkLog) after(name string, seq uint64) ([]uplinkEvent, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events, _ := l.afterLocked(name, seq)
+	return events, l.seq[name]
+}
+
+func (l *uplinkLog) afterLocked(name string, seq uint64) ([]uplinkEvent, <-chan struct{}) {
+	var events []uplinkEvent
+	for _, event := range l.events[name] {
+		if event.seq > seq {
+			events = append(events, event)
+		}
+	}
+	if l.updated == nil {
+		l.updated = make(chan struct{})
+	}
+	return events, l.updated
+}
+
+// wait returns the device's uplinks after seq, waiting up to timeout for one if there are none yet.
+func (l *uplinkLog) wait(ctx context.Context, name string, seq uint64, timeout time.Duration) ([]uplinkEvent, uint64) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		l.mu.Lock()
+		events, updated := l.afterLocked(name, seq)
+		last := l.seq[name]
+		l.mu.Unlock()
+		if len(events) > 0 {
+			return events, last
+		}
+
+		select {
+		case <-updated:
+		case <-timer.C:
+			return nil, last
+		case <-ctx.Done():
+			return nil, last
+		}
+	}
+}
+
+// remove forgets the uplinks of the device.
+func (l *uplinkLog) remove(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.seq, name)
+	delete(l.events, name)
+	delete(l.sizes, name)
+}
+
+// getUplinksCommand returns the device's uplinks from the get_uplinks docommand.
+// Without after only the last uplink is returned, otherwise the uplinks with a greater seq are returned,
+// waiting up to wait_ms for a new one if there are none.
+func (g *Gateway) getUplinksCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	name, ok := cmd["device"].(string)
+	if !ok {
+		return nil, errInvalidGetUplinks
+	}
+
+	var events []uplinkEvent
+	var last uint64
+	switch after := cmd["after"].(type) {
+	case nil:
+		events, last = g.uplinks.after(name, 0)
+		if len(events) > 0 {
+			events = events[len(events)-1:]
+		}
+	case float64:
+		if after < 0 {
+			return nil, errInvalidGetUplinks
+		}
+		var timeout time.Duration
+		if waitMs, ok := cmd["wait_ms"].(float64); ok {
+			timeout = min(time.Duration(waitMs)*time.Millisecond, maxUplinkWait)
+		}
+		events, last = g.uplinks.wait(ctx, name, uint64(after), timeout)
+	default:
+		return nil, errInvalidGetUplinks
+	}
+
+	uplinks := make([]interface{}, 0, len(events))
+	for _, event := range events {
+		uplinks = append(uplinks, map[string]interface{}{
+			"seq":      event.seq,
+			"received": event.received.Format(time.RFC3339Nano),
+			"readings": event.readings,
+		})
+	}
+	return map[string]interface{}{"uplinks": uplinks, "seq": last}, nil
+}
+
+// historyCommand returns the kept uplinks of the device from the history docommand, oldest first.
+// Each entry has the time the uplink was received and its decoded readings, so rates or deltas can be
+// computed from the recent values without storing them elsewhere.
+func (g *Gateway) historyCommand(cmd map[string]interface{}) (map[string]interface{}, error) {
+	name, ok := cmd["device"].(string)
+	if !ok {
+		return nil, errInvalidHistory
+	}
+	events, _ := g.uplinks.after(name, 0)
+	history := make([]interface{}, 0, len(events))
+	for _, event := range events {
+		history = append(history, map[string]interface{}{
+			"time":     event.received.Format(time.RFC3339Nano),
+			"readings": event.readings,
+		})
+	}
+	return map[string]interface{}{"history": history}, nil
+}
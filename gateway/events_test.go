@@ -0,0 +1,152 @@
+package gateway
+
+import (
+	"context"
+	"gateway/node"
+	"testing"
+	"time"
+
+	"go.viam.com/test"
+)
+
+func TestGetUplinks(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+
+	// no uplinks yet.
+	resp, err := g.DoCommand(ctx, map[string]interface{}{"get_uplinks": map[string]interface{}{"device": "test-device"}})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, resp["uplinks"], test.ShouldBeEmpty)
+	test.That(t, resp["seq"], test.ShouldEqual, 0)
+
+	g.updateReadings("test-device", map[string]interface{}{"temperature": 21.5})
+	g.updateReadings("test-device", map[string]interface{}{"humidity": 40.0})
+
+	// without after only the last uplink is returned, with its own readings.
+	resp, err = g.DoCommand(ctx, map[string]interface{}{"get_uplinks": map[string]interface{}{"device": "test-device"}})
+	test.That(t, err, test.ShouldBeNil)
+	uplinks := resp["uplinks"].([]interface{})
+	test.That(t, len(uplinks), test.ShouldEqual, 1)
+	test.That(t, uplinks[0].(map[string]interface{})["seq"], test.ShouldEqual, 2)
+	test.That(t, uplinks[0].(map[string]interface{})["readings"], test.ShouldResemble, map[string]interface{}{"humidity": 40.0})
+
+	// the first uplink isn't changed when later readings are merged into the node's readings.
+	resp, err = g.DoCommand(ctx, map[string]interface{}{"get_uplinks": map[string]interface{}{"device": "test-device", "after": 0.0}})
+	test.That(t, err, test.ShouldBeNil)
+	uplinks = resp["uplinks"].([]interface{})
+	test.That(t, len(uplinks), test.ShouldEqual, 2)
+	test.That(t, uplinks[0].(map[string]interface{})["readings"], test.ShouldResemble, map[string]interface{}{"temperature": 21.5})
+
+	// waiting for a new uplink times out.
+	start := time.Now()
+	resp, err = g.DoCommand(ctx, map[string]interface{}{"get_uplinks": map[string]interface{}{"device": "test-device", "after": 2.0, "wait_ms": 50.0}})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, resp["uplinks"], test.ShouldBeEmpty)
+	test.That(t, resp["seq"], test.ShouldEqual, 2)
+	test.That(t, time.Since(start), test.ShouldBeGreaterThanOrEqualTo, 50*time.Millisecond)
+
+	_, err = g.DoCommand(ctx, map[string]interface{}{"get_uplinks": map[string]interface{}{"after": 0.0}})
+	test.That(t, err, test.ShouldBeError, errInvalidGetUplinks)
+
+	// removing the device forgets its uplinks.
+	g.RemoveDevice("test-device")
+	resp, err = g.DoCommand(ctx, map[string]interface{}{"get_uplinks": map[string]interface{}{"device": "test-device", "after": 0.0}})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, resp["uplinks"], test.ShouldBeEmpty)
+}
+
+func TestGetUplinksOrdering(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+
+	// a caller waits for each new uplink while they arrive as fast as they can.
+	received := make(chan []uint64)
+	go func() {
+		var seqs []uint64
+		var last uint64
+		for len(seqs) < maxUplinkEvents {
+			resp, err := g.getUplinksCommand(ctx, map[string]interface{}{
+				"device": "test-device", "after": float64(last), "wait_ms": 5000.0,
+			})
+			if err != nil {
+				break
+			}
+			uplinks := resp["uplinks"].([]interface{})
+			if len(uplinks) == 0 {
+				break
+			}
+			for _, up := range uplinks {
+				last = up.(map[string]interface{})["seq"].(uint64)
+				seqs = append(seqs, last)
+			}
+		}
+		received <- seqs
+	}()
+
+	for i := 1; i <= maxUplinkEvents; i++ {
+		g.updateReadings("test-device", map[string]interface{}{"count": i})
+	}
+
+	// every uplink is seen once, in the order it was received.
+	seqs := <-received
+	test.That(t, len(seqs), test.ShouldEqual, maxUplinkEvents)
+	for i, seq := range seqs {
+		test.That(t, seq, test.ShouldEqual, i+1)
+	}
+
+	// a caller that falls further behind than the kept uplinks sees the gap in the seqs.
+	for i := 0; i < maxUplinkEvents+1; i++ {
+		g.updateReadings("test-device", map[string]interface{}{"count": i})
+	}
+	events, last := g.uplinks.after("test-device", maxUplinkEvents)
+	test.That(t, len(events), test.ShouldEqual, maxUplinkEvents)
+	test.That(t, events[0].seq, test.ShouldEqual, maxUplinkEvents+2)
+	test.That(t, last, test.ShouldEqual, 2*maxUplinkEvents+1)
+}
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+	reconfigured := &node.Node{
+		NodeName:    device.NodeName,
+		JoinType:    "ABP",
+		DecoderPath: device.DecoderPath,
+		Addr:        testDevAddr,
+		AppSKey:     testAppSKey,
+		NwkSKey:     testNwkSKey,
+		HistorySize: 3,
+	}
+	err := g.registerDevice(reconfigured)
+	test.That(t, err, test.ShouldBeNil)
+
+	// two more uplinks than the history size evict the two oldest.
+	for fCnt := uint32(1); fCnt <= 5; fCnt++ {
+		err := g.routePacket(ctx, createTestUplink(t, fCnt, 1, []byte{byte(fCnt), 0}), testRxInfo)
+		test.That(t, err, test.ShouldBeNil)
+	}
+	resp, err := g.DoCommand(ctx, map[string]interface{}{"history": map[string]interface{}{"device": "test-device"}})
+	test.That(t, err, test.ShouldBeNil)
+	history := resp["history"].([]interface{})
+	test.That(t, len(history), test.ShouldEqual, 3)
+	for i, entry := range history {
+		entry := entry.(map[string]interface{})
+		test.That(t, entry["readings"].(map[string]interface{})["temperature"], test.ShouldEqual, i+3)
+		received, err := time.Parse(time.RFC3339Nano, entry["time"].(string))
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, time.Since(received), test.ShouldBeLessThan, time.Second)
+	}
+
+	// shrinking the history drops the oldest kept uplinks.
+	reconfigured.HistorySize = 1
+	err = g.registerDevice(reconfigured)
+	test.That(t, err, test.ShouldBeNil)
+	resp, err = g.DoCommand(ctx, map[string]interface{}{"history": map[string]interface{}{"device": "test-device"}})
+	test.That(t, err, test.ShouldBeNil)
+	history = resp["history"].([]interface{})
+	test.That(t, len(history), test.ShouldEqual, 1)
+	test.That(t, history[0].(map[string]interface{})["readings"].(map[string]interface{})["temperature"], test.ShouldEqual, 5)
+
+	_, err = g.DoCommand(ctx, map[string]interface{}{"history": true})
+	test.That(t, err, test.ShouldBeError, errInvalidHistory)
+}
@@ -0,0 +1,241 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"fmt"
+	"gateway/lorawan"
+	"sync"
+)
+
+// fragmentationPort is the fPort of the fragmented data block transport messages.
+const fragmentationPort = lorawan.FragmentationPort
+
+// Fragmented data block transport command ids.
+const (
+	fragSessionSetupReq  = 0x02
+	fragSessionDeleteReq = 0x03
+	dataFragment         = 0x08
+)
+
+// maxFragmentedBlockSize is the largest data block a device can send in fragments.
+const maxFragmentedBlockSize = 64 * 1024
+
+// fragSession reassembles one fragmented data block.
+// Fragments 1 to nbFrag are the uncoded fragments of the block, the fragments after them are coded
+// fragments, each the xor of about half the uncoded fragments, which are used to recover lost ones.
+// Each fragment is reduced against the fragments already received, like gaussian elimination, so the
+// block is recovered as soon as nbFrag independent fragments are received.
+type fragSession struct {
+	nbFrag   int
+	fragSize int
+	padding  int
+	done     bool
+	rows     [][]uint64 // reduced fragments by the first uncoded fragment they include, as bitsets
+	data     [][]byte   // data of the reduced fragments
+	received int
+}
+
+// newFragSession parses a FragSessionSetupReq.
+//
+// | FragSession | NbFrag | FragSize | Control | Padding | Descriptor |
+// |     1 B     |  2 B   |   1 B    |   1 B   |   1 B   |    4 B     |
+func newFragSession(req []byte) (int, *fragSession, error) {
+	index := int(req[0] >> 4 & 0x03)
+	s := &fragSession{
+		nbFrag:   int(binary.LittleEndian.Uint16(req[1:3])),
+		fragSize: int(req[3]),
+		padding:  int(req[5]),
+	}
+	// only the fragmentation algorithm of the spec is supported.
+	if algo := req[4] >> 3 & 0x07; algo != 0 {
+		return 0, nil, fmt.Errorf("unsupported fragmentation algorithm %d", algo)
+	}
+	if s.nbFrag == 0 || s.fragSize == 0 || s.padding >= s.fragSize {
+		return 0, nil, fmt.Errorf("invalid fragmentation session with %d fragments of %d bytes", s.nbFrag, s.fragSize)
+	}
+	if s.nbFrag*s.fragSize > maxFragmentedBlockSize {
+		return 0, nil, fmt.Errorf("fragmented data block of %d bytes is larger than %d bytes", s.nbFrag*s.fragSize, maxFragmentedBlockSize)
+	}
+	s.rows = make([][]uint64, s.nbFrag)
+	s.data = make([][]byte, s.nbFrag)
+	return index, s, nil
+}
+
+// add adds the fragment with counter n, and returns the data block once it can be recovered.
+func (s *fragSession) add(n int, fragment []byte) ([]byte, error) {
+	if s.done {
+		return nil, nil
+	}
+	if len(fragment) != s.fragSize {
+		return nil, fmt.Errorf("fragment is %d bytes, expected %d", len(fragment), s.fragSize)
+	}
+
+	row := make([]uint64, (s.nbFrag+63)/64)
+	if n <= s.nbFrag {
+		setBit(row, n-1)
+	} else {
+		for i, set := range parityMatrixRow(n-s.nbFrag, s.nbFrag) {
+			if set {
+				setBit(row, i)
+			}
+		}
+	}
+	data := append([]byte{}, fragment...)
+
+	// reduce the fragment until it includes an uncoded fragment no earlier fragment starts with.
+	for {
+		pivot := lowestBit(row)
+		if pivot < 0 {
+			// the fragment only has data that was already received.
+			return nil, nil
+		}
+		if s.rows[pivot] == nil {
+			s.rows[pivot] = row
+			s.data[pivot] = data
+			s.received++
+			break
+		}
+		xorInto(row, s.rows[pivot])
+		xorInto(data, s.data[pivot])
+	}
+	if s.received < s.nbFrag {
+		return nil, nil
+	}
+
+	// every row starts with its own uncoded fragment, solve them starting from the last.
+	for i := s.nbFrag - 1; i >= 0; i-- {
+		for j := i + 1; j < s.nbFrag; j++ {
+			if s.rows[i][j/64]&(1<<(j%64)) != 0 {
+				xorInto(s.data[i], s.data[j])
+			}
+		}
+	}
+	block := make([]byte, 0, s.nbFrag*s.fragSize)
+	for _, data := range s.data {
+		block = append(block, data...)
+	}
+	s.done = true
+	s.rows = nil
+	s.data = nil
+	return block[:len(block)-s.padding], nil
+}
+
+// parityMatrixRow returns the uncoded fragments included in coded fragment n of a block of m fragments,
+// as defined by the fragmented data block transport spec.
+func parityMatrixRow(n, m int) []bool {
+	row := make([]bool, m)
+	mTemp := 0
+	if m&(m-1) == 0 {
+		mTemp = 1
+	}
+	x := 1 + 1001*n
+	for nbCoeff := 0; nbCoeff < m/2; nbCoeff++ {
+		r := 1 << 16
+		for r >= m {
+			x = prbs23(x)
+			r = x % (m + mTemp)
+		}
+		row[r] = true
+	}
+	return row
+}
+
+// prbs23 is the pseudo random generator of the parity matrix.
+func prbs23(x int) int {
+	b0 := x & 0x01
+	b1 := (x & 0x20) >> 5
+	return (x >> 1) + ((b0 ^ b1) << 22)
+}
+
+func setBit(row []uint64, i int) {
+	row[i/64] |= 1 << (i % 64)
+}
+
+func lowestBit(row []uint64) int {
+	for i, word := range row {
+		for j := 0; j < 64; j++ {
+			if word&(1<<j) != 0 {
+				return i*64 + j
+			}
+		}
+	}
+	return -1
+}
+
+func xorInto[T uint64 | byte](dst, src []T) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// fragmentStore keeps the fragmentation sessions of each device.
+// The zero value is ready to use.
+type fragmentStore struct {
+	mu       sync.Mutex
+	sessions map[string]*[4]*fragSession // map of node name to its sessions by fragment index
+}
+
+// add handles the fragmentation messages from an uplink on the fragmentation port.
+// It returns the data block when the uplink completes one.
+func (f *fragmentStore) add(name string, payload []byte) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sessions == nil {
+		f.sessions = make(map[string]*[4]*fragSession)
+	}
+	sessions, ok := f.sessions[name]
+	if !ok {
+		sessions = &[4]*fragSession{}
+		f.sessions[name] = sessions
+	}
+
+	for len(payload) > 0 {
+		switch payload[0] {
+		case fragSessionSetupReq:
+			if len(payload) < 11 {
+				return nil, fmt.Errorf("fragmentation session setup is %d bytes, expected 11", len(payload))
+			}
+			index, session, err := newFragSession(payload[1:11])
+			if err != nil {
+				return nil, err
+			}
+			sessions[index] = session
+			payload = payload[11:]
+		case fragSessionDeleteReq:
+			if len(payload) < 2 {
+				return nil, fmt.Errorf("fragmentation session delete is %d bytes, expected 2", len(payload))
+			}
+			sessions[payload[1]&0x03] = nil
+			payload = payload[2:]
+		case dataFragment:
+			// the fragment takes up the rest of the payload.
+			//
+			// | CID | IndexAndN | Fragment |
+			// | 1 B |    2 B    | variable |
+			if len(payload) < 3 {
+				return nil, fmt.Errorf("data fragment is %d bytes, expected at least 3", len(payload))
+			}
+			indexAndN := binary.LittleEndian.Uint16(payload[1:3])
+			index := indexAndN >> 14
+			n := int(indexAndN & 0x3FFF)
+			session := sessions[index]
+			if session == nil {
+				return nil, fmt.Errorf("data fragment for fragmentation session %d which was not set up", index)
+			}
+			if n == 0 {
+				return nil, fmt.Errorf("data fragment counter must start at 1")
+			}
+			return session.add(n, payload[3:])
+		default:
+			return nil, fmt.Errorf("unknown fragmentation command 0x%02X", payload[0])
+		}
+	}
+	return nil, nil
+}
+
+// remove forgets the fragmentation sessions of the device.
+func (f *fragmentStore) remove(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.sessions, name)
+}
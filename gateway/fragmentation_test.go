@@ -0,0 +1,159 @@
+package gateway
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"go.viam.com/test"
+)
+
+// testFragSessionSetup is a FragSessionSetupReq for session index 1.
+func testFragSessionSetup(nbFrag, fragSize, padding int) []byte {
+	req := []byte{fragSessionSetupReq, 0x10, 0, 0, byte(fragSize), 0, byte(padding), 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(req[2:4], uint16(nbFrag))
+	return req
+}
+
+// testDataFragments splits the block into fragments for session index 1.
+// The uncoded fragments are followed by coded fragments built from the parity matrix.
+func testDataFragments(block []byte, fragSize, coded int) [][]byte {
+	var uncoded [][]byte
+	for i := 0; i < len(block); i += fragSize {
+		fragment := make([]byte, fragSize)
+		copy(fragment, block[i:])
+		uncoded = append(uncoded, fragment)
+	}
+	nbFrag := len(uncoded)
+	for n := 1; n <= coded; n++ {
+		fragment := make([]byte, fragSize)
+		for i, set := range parityMatrixRow(n, nbFrag) {
+			if set {
+				xorInto(fragment, uncoded[i])
+			}
+		}
+		uncoded = append(uncoded, fragment)
+	}
+
+	fragments := make([][]byte, len(uncoded))
+	for i, fragment := range uncoded {
+		msg := []byte{dataFragment, 0, 0}
+		binary.LittleEndian.PutUint16(msg[1:3], 1<<14|uint16(i+1))
+		fragments[i] = append(msg, fragment...)
+	}
+	return fragments
+}
+
+func TestFragmentReassembly(t *testing.T) {
+	block := []byte("a fragmented data block sent in several uplinks")
+	fragSize := 8
+	padding := (fragSize - len(block)%fragSize) % fragSize
+	nbFrag := (len(block) + padding) / fragSize
+	fragments := testDataFragments(block, fragSize, 0)
+	test.That(t, len(fragments), test.ShouldEqual, nbFrag)
+
+	var f fragmentStore
+	out, err := f.add("test-device", testFragSessionSetup(nbFrag, fragSize, padding))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, out, test.ShouldBeNil)
+
+	// the block is returned once every fragment was received, in any order.
+	for _, i := range []int{0, 3, 1, 4, 3, 2} {
+		out, err = f.add("test-device", fragments[i])
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, out, test.ShouldBeNil)
+	}
+	out, err = f.add("test-device", fragments[5])
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, out, test.ShouldResemble, block)
+
+	// fragments after the block is complete are ignored.
+	out, err = f.add("test-device", fragments[0])
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, out, test.ShouldBeNil)
+}
+
+func TestFragmentReassemblyCoded(t *testing.T) {
+	block := make([]byte, 20*10)
+	for i := range block {
+		block[i] = byte(i * 7)
+	}
+	fragments := testDataFragments(block, 10, 20)
+
+	// lost uncoded fragments are recovered from the coded fragments.
+	var f fragmentStore
+	_, err := f.add("test-device", testFragSessionSetup(20, 10, 0))
+	test.That(t, err, test.ShouldBeNil)
+	var out []byte
+	for i, fragment := range fragments {
+		if i%4 == 1 || i == 7 || i == 18 {
+			continue
+		}
+		out, err = f.add("test-device", fragment)
+		test.That(t, err, test.ShouldBeNil)
+		if out != nil {
+			break
+		}
+	}
+	test.That(t, out, test.ShouldResemble, block)
+}
+
+func TestFragmentErrors(t *testing.T) {
+	var f fragmentStore
+	fragments := testDataFragments([]byte{0x01, 0x02, 0x03, 0x04}, 2, 0)
+
+	_, err := f.add("test-device", fragments[0])
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "not set up")
+
+	_, err = f.add("test-device", testFragSessionSetup(0, 2, 0))
+	test.That(t, err, test.ShouldNotBeNil)
+	_, err = f.add("test-device", testFragSessionSetup(1000, 255, 0))
+	test.That(t, err, test.ShouldNotBeNil)
+	_, err = f.add("test-device", []byte{0x7F})
+	test.That(t, err, test.ShouldNotBeNil)
+
+	_, err = f.add("test-device", testFragSessionSetup(2, 2, 0))
+	test.That(t, err, test.ShouldBeNil)
+	_, err = f.add("test-device", append(fragments[0], 0x05))
+	test.That(t, err, test.ShouldNotBeNil)
+
+	// deleting the session drops its fragments.
+	_, err = f.add("test-device", []byte{fragSessionDeleteReq, 0x01})
+	test.That(t, err, test.ShouldBeNil)
+	_, err = f.add("test-device", fragments[0])
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestParseDataUplinkFragments(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	g.devices["test-device"].PortDecoders = map[string]string{
+		"201": writeTestDecoder(t, `function Decode(fPort, bytes) { return {"length": bytes.length, "last": bytes[bytes.length - 1]}; }`),
+	}
+	block := make([]byte, 30)
+	for i := range block {
+		block[i] = byte(i)
+	}
+	fragments := testDataFragments(block, 16, 0)
+
+	// the setup and first fragment don't have readings from the decoder.
+	_, readings, err := g.parseDataUplink(ctx, createTestUplink(t, 1, fragmentationPort, testFragSessionSetup(2, 16, 2)), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldNotContainKey, "length")
+	_, readings, err = g.parseDataUplink(ctx, createTestUplink(t, 2, fragmentationPort, fragments[0]), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldNotContainKey, "length")
+	test.That(t, readings, test.ShouldContainKey, "last_seen")
+
+	// the decoder gets the whole block with the last fragment.
+	_, readings, err = g.parseDataUplink(ctx, createTestUplink(t, 3, fragmentationPort, fragments[1]), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["length"], test.ShouldEqual, 30)
+	test.That(t, readings["last"], test.ShouldEqual, 29)
+
+	// removing the device forgets its sessions.
+	g.RemoveDevice("test-device")
+	_, err = g.fragments.add("test-device", fragments[0])
+	test.That(t, err, test.ShouldNotBeNil)
+}
@@ -7,27 +7,13 @@
 
 #define MAX_RX_PKT 8
 
-#define RADIO_0_FREQ     902700000
-#define RADIO_1_FREQ     903700000
+#define NUM_IF_CHAINS 8
 
-// the IF chain frequencies allow the gateway to read on multiple frequency channels.
-// subtracting main frequenecy - intermediate frequency will give that channel's freq.
-const int32_t ifFrequencies[9] = {
-	-400000,
-	-200000,
-	0,
-	200000,
-	400000,
-	-400000,
-	-200000,
-	0,
-};
-
-// This defines what RF chain to use for each of the 8 if chains
-const int32_t rfChains [9] = {0, 0, 0, 0, 1, 1, 1};
-
-
-int setUpGateway(int bus) {
+// radio0Freq and radio1Freq are the center frequencies of the two RF chains.
+// The IF chain frequencies allow the gateway to read on multiple frequency channels.
+// Adding the RF chain's frequency and the intermediate frequency will give that channel's freq.
+// ifRFChains defines what RF chain to use for each of the 8 IF chains.
+int setUpGateway(int bus, uint32_t radio0Freq, uint32_t radio1Freq, const int32_t* ifFrequencies, const int32_t* ifRFChains) {
 
     // the board config defines parameters for the entire gateway HAT.
     struct lgw_conf_board_s boardconf;
@@ -58,10 +44,10 @@ int setUpGateway(int bus) {
 
     // set configuration for RF (radio frequency) chains on the gateway.
     // There are two sx1250 radios on the gateway - these can be used to listen on two different frequency bands.
-    // We are setting default frequencies for the RF chains to listen on US915 band at two different frequencies.
+    // The frequencies for the RF chains are set by the region's channel plan.
     memset( &rfconf, 0, sizeof rfconf);
     rfconf.enable = true;
-    rfconf.freq_hz = RADIO_0_FREQ;
+    rfconf.freq_hz = radio0Freq;
     rfconf.radio_type = LGW_RADIO_TYPE_SX1250;
     rfconf.rssi_offset = -215;
     rfconf.tx_enable = true;
@@ -70,7 +56,7 @@ int setUpGateway(int bus) {
         return EXIT_FAILURE;
     }
 
-    rfconf.freq_hz = RADIO_1_FREQ;
+    rfconf.freq_hz = radio1Freq;
     if (lgw_rxrf_setconf(1, &rfconf) != LGW_HAL_SUCCESS) {
         return EXIT_FAILURE;
 
@@ -85,8 +71,8 @@ int setUpGateway(int bus) {
     ifconf.enable = true;
     ifconf.datarate = DR_LORA_SF7;
     ifconf.bandwidth = 0x04; //125k
-    for (int i = 0; i < 8; i++) {
-        ifconf.rf_chain = rfChains[i];
+    for (int i = 0; i < NUM_IF_CHAINS; i++) {
+        ifconf.rf_chain = ifRFChains[i];
         ifconf.freq_hz = ifFrequencies[i];
         if (lgw_rxif_setconf(i, &ifconf) != LGW_HAL_SUCCESS) {
             return EXIT_FAILURE;
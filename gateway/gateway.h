@@ -7,4 +7,4 @@ struct lgw_pkt_rx_s* createRxPacketArray();
 int receive(struct lgw_pkt_rx_s* packet);
 int send(struct lgw_pkt_tx_s* packet);
 int stopGateway();
-int setUpGateway(int com_path);
+int setUpGateway(int com_path, uint32_t radio0Freq, uint32_t radio1Freq, const int32_t* ifFrequencies, const int32_t* ifRFChains);
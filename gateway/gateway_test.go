@@ -1,10 +1,22 @@
 package gateway
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gateway/lorawan"
+	"gateway/node"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 
+	"go.viam.com/rdk/logging"
 	"go.viam.com/rdk/resource"
 	"go.viam.com/test"
+	"go.viam.com/utils"
+	"go.viam.com/utils/protoutils"
 )
 
 func TestValidate(t *testing.T) {
@@ -31,6 +43,14 @@ func TestValidate(t *testing.T) {
 	_, err = conf.Validate("")
 	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errResetPinRequired))
 
+	// a gateway only using packet forwarders doesn't need a reset pin.
+	conf = &Config{UDPListenAddr: ":1700"}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+	conf = &Config{UDPListenAddr: "[::]:99999"}
+	_, err = conf.Validate("")
+	test.That(t, errors.Is(err, errUDPListenAddr), test.ShouldBeTrue)
+
 	// Test invalid bus value
 	conf = &Config{
 		ResetPin: &resetPin,
@@ -38,4 +58,613 @@ func TestValidate(t *testing.T) {
 	}
 	_, err = conf.Validate("")
 	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errInvalidSpiBus))
+
+	// Test valid region
+	conf = &Config{
+		ResetPin: &resetPin,
+		Region:   "EU868",
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+
+	// Test unsupported region
+	conf = &Config{
+		ResetPin: &resetPin,
+		Region:   "CN470",
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errInvalidRegion))
+
+	// Test zero dedup window
+	zeroWindow := 0
+	conf = &Config{
+		ResetPin:      &resetPin,
+		DedupWindowMs: &zeroWindow,
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errDedupWindow))
+
+	// Test invalid ADR thresholds
+	zeroMargin := 0.0
+	conf = &Config{
+		ResetPin:    &resetPin,
+		ADRMarginDB: &zeroMargin,
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errADRMargin))
+
+	zeroHistory := 0
+	conf = &Config{
+		ResetPin:         &resetPin,
+		ADRUplinkHistory: &zeroHistory,
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errADRHistory))
+
+	// Test net id that isn't 3 bytes
+	for _, netID := range []string{"0102", "01020304", "zz0203"} {
+		conf = &Config{
+			ResetPin: &resetPin,
+			NetID:    netID,
+		}
+		_, err = conf.Validate("")
+		test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errInvalidNetID))
+	}
+}
+
+// testABPNodeMap is the register_device docommand map of an ABP node with the test session.
+func testABPNodeMap(name string, addr []byte, decoderPath string) map[string]interface{} {
+	return map[string]interface{}{
+		"NodeName":    name,
+		"JoinType":    "ABP",
+		"DecoderPath": decoderPath,
+		"AppKey":      []interface{}{},
+		"DevEui":      []interface{}{},
+		"AppSKey":     toInterfaceBytes(testAppSKey),
+		"NwkSKey":     toInterfaceBytes(testNwkSKey),
+		"Addr":        toInterfaceBytes(addr),
+	}
+}
+
+func TestDeregisterDevice(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	decoderPath := g.devices["test-device"].DecoderPath
+	g.devices = map[string]*node.Node{}
+
+	_, err := g.DoCommand(ctx, map[string]interface{}{"register_device": testABPNodeMap("abp-node", testDevAddr, decoderPath)})
+	test.That(t, err, test.ShouldBeNil)
+
+	name, readings, err := g.parseDataUplink(ctx, createTestUplink(t, 1, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, name, test.ShouldEqual, "abp-node")
+	g.updateReadings(name, readings)
+	err = g.SendDownlink(ctx, testDevAddr, 1, []byte{0x01})
+	test.That(t, err, test.ShouldBeNil)
+
+	// deregistering removes the device, its readings and queued downlinks.
+	_, err = g.DoCommand(ctx, map[string]interface{}{"deregister_device": "abp-node"})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, g.devices, test.ShouldBeEmpty)
+	test.That(t, g.lastReadings, test.ShouldNotContainKey, "abp-node")
+	test.That(t, g.downlinks, test.ShouldNotContainKey, "abp-node")
+
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 2, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, errors.Is(err, errNoDevice), test.ShouldBeTrue)
+
+	// deregister by dev addr.
+	_, err = g.DoCommand(ctx, map[string]interface{}{"register_device": testABPNodeMap("abp-node", testDevAddr, decoderPath)})
+	test.That(t, err, test.ShouldBeNil)
+	_, err = g.DoCommand(ctx, map[string]interface{}{"deregister_device": map[string]interface{}{"dev_addr": "01020304"}})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, g.devices, test.ShouldBeEmpty)
+
+	// unknown dev addr and invalid arguments.
+	_, err = g.DoCommand(ctx, map[string]interface{}{"deregister_device": map[string]interface{}{"dev_addr": "01020304"}})
+	test.That(t, err, test.ShouldBeError, errNoDevice)
+	_, err = g.DoCommand(ctx, map[string]interface{}{"deregister_device": 1})
+	test.That(t, err, test.ShouldBeError, errInvalidDeregister)
+}
+
+func TestConcurrentDeviceAccess(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	decoderPath := g.devices["test-device"].DecoderPath
+
+	// register and deregister another node while uplinks from test-device are parsed and downlinks are queued.
+	var wg sync.WaitGroup
+	errs := make(chan error, 150)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			_, err := g.DoCommand(ctx, map[string]interface{}{
+				"register_device": testABPNodeMap("other-node", []byte{0x0A, 0x0B, 0x0C, 0x0D}, decoderPath),
+			})
+			errs <- err
+			_, err = g.DoCommand(ctx, map[string]interface{}{"deregister_device": "other-node"})
+			errs <- err
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			_, err := g.DoCommand(ctx, map[string]interface{}{
+				"send_downlink": map[string]interface{}{"device": "test-device", "fport": 2.0, "payload": "01"},
+			})
+			errs <- err
+		}
+	}()
+
+	for i := 1; i <= 50; i++ {
+		name, readings, err := g.parseDataUplink(ctx, createTestUplink(t, uint32(i), 1, []byte{0x15, 0x05}), testRxInfo)
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, name, test.ShouldEqual, "test-device")
+		g.updateReadings(name, readings)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		test.That(t, err, test.ShouldBeNil)
+	}
+
+	test.That(t, g.devices, test.ShouldNotContainKey, "other-node")
+	test.That(t, len(g.downlinks["test-device"]), test.ShouldEqual, 50)
+}
+
+func TestRegisterDuplicateDevAddr(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	decoderPath := g.devices["test-device"].DecoderPath
+	g.devices = map[string]*node.Node{}
+
+	_, err := g.DoCommand(ctx, map[string]interface{}{"register_device": testABPNodeMap("node-1", testDevAddr, decoderPath)})
+	test.That(t, err, test.ShouldBeNil)
+
+	// a second node with the same dev addr is rejected.
+	_, err = g.DoCommand(ctx, map[string]interface{}{"register_device": testABPNodeMap("node-2", testDevAddr, decoderPath)})
+	test.That(t, err, test.ShouldBeError)
+	test.That(t, errors.Is(err, errDuplicateDevAddr), test.ShouldBeTrue)
+	test.That(t, errors.Is(err, node.ErrDeviceRejected), test.ShouldBeTrue)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "node-1")
+	test.That(t, err.Error(), test.ShouldContainSubstring, "node-2")
+	test.That(t, g.devices, test.ShouldNotContainKey, "node-2")
+
+	// the same node registering again is merged.
+	_, err = g.DoCommand(ctx, map[string]interface{}{"register_device": testABPNodeMap("node-1", testDevAddr, decoderPath)})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(g.devices), test.ShouldEqual, 1)
+
+	// OTAA addresses don't collide with registered nodes.
+	for i := 0; i < 200; i++ {
+		_, err = g.DoCommand(ctx, map[string]interface{}{
+			"register_device": testABPNodeMap(fmt.Sprintf("node-%d", i+2), []byte{0x06, 0, 0, byte(i)}, decoderPath),
+		})
+		test.That(t, err, test.ShouldBeNil)
+	}
+	for i := 0; i < 100; i++ {
+		devAddr, err := g.newDevAddr()
+		test.That(t, err, test.ShouldBeNil)
+		_, err = matchDeviceAddr(devAddr, g.devices)
+		test.That(t, err, test.ShouldNotBeNil)
+	}
+}
+
+func TestRegisterDevicePortDecoders(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	decoderPath := g.devices["test-device"].DecoderPath
+
+	nodeMap := testABPNodeMap("port-node", []byte{0x0A, 0x0B, 0x0C, 0x0D}, decoderPath)
+	nodeMap["PortDecoders"] = map[string]interface{}{"10": "/path/to/config.js"}
+	_, err := g.DoCommand(ctx, map[string]interface{}{"register_device": nodeMap})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, g.devices["port-node"].PortDecoders, test.ShouldResemble, map[string]string{"10": "/path/to/config.js"})
+}
+
+func TestRegisterDeviceNwkSKey(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	decoderPath := g.devices["test-device"].DecoderPath
+
+	// ABP nodes send the NwkSKey from their config, it verifies the MIC of their uplinks.
+	_, err := g.DoCommand(ctx, map[string]interface{}{
+		"register_device": testABPNodeMap("abp-node", []byte{0x0A, 0x0B, 0x0C, 0x0D}, decoderPath),
+	})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, g.devices["abp-node"].NwkSKey, test.ShouldResemble, testNwkSKey)
+
+	// OTAA nodes get the NwkSKey derived in the join, it is kept when the node registers again.
+	device := addTestOTAADevice(g)
+	jr, matched, err := g.parseJoinRequestPacket(createTestJoinRequest(t, 0x0102))
+	test.That(t, err, test.ShouldBeNil)
+	joinAccept, err := generateJoinAccept(ctx, jr, matched, testJoinDevAddr, g.netID, g.region)
+	test.That(t, err, test.ShouldBeNil)
+	session, _ := acceptTestJoin(t, joinAccept, 0x0102)
+
+	_, err = g.DoCommand(ctx, map[string]interface{}{
+		"register_device": map[string]interface{}{
+			"NodeName":    device.NodeName,
+			"JoinType":    "OTAA",
+			"DecoderPath": decoderPath,
+			"AppKey":      toInterfaceBytes(testAppKey),
+			"DevEui":      toInterfaceBytes(testDevEUI),
+			"AppSKey":     []interface{}{},
+			"NwkSKey":     []interface{}{},
+			"Addr":        []interface{}{},
+		},
+	})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, g.devices[device.NodeName].NwkSKey, test.ShouldResemble, session.nwkSKey)
+}
+
+func TestRegisterDeviceMap(t *testing.T) {
+	// nodes in another process send their device map as a structpb, an OTAA node with the default rx
+	// settings has no addr and no rx fields.
+	otaa := &node.Node{
+		NodeName:       "otaa-node",
+		JoinType:       "OTAA",
+		LorawanVersion: "1.0.3",
+		Class:          "C",
+		AppKey:         testAppKey,
+		DevEui:         testDevEUI,
+		DecoderPath:    "/path/to/decoder.js",
+		DecoderTimeout: 200 * time.Millisecond,
+	}
+	pb, err := protoutils.StructToStructPb(otaa.DeviceMap())
+	test.That(t, err, test.ShouldBeNil)
+	converted, err := convertToNode(pb.AsMap())
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, converted.NodeName, test.ShouldEqual, "otaa-node")
+	test.That(t, converted.JoinType, test.ShouldEqual, "OTAA")
+	test.That(t, converted.Class, test.ShouldEqual, "C")
+	test.That(t, converted.AppKey, test.ShouldResemble, testAppKey)
+	test.That(t, converted.DevEui, test.ShouldResemble, testDevEUI)
+	test.That(t, converted.Addr, test.ShouldBeEmpty)
+	test.That(t, converted.NwkKey, test.ShouldBeNil)
+	test.That(t, converted.DecoderTimeout, test.ShouldEqual, 200*time.Millisecond)
+	test.That(t, converted.RX1DROffset, test.ShouldBeNil)
+	test.That(t, converted.RX2DataRate, test.ShouldBeNil)
+	test.That(t, converted.RXDelay, test.ShouldBeNil)
+	test.That(t, converted.RX2Frequency, test.ShouldBeNil)
+
+	rx1DROffset, rx2DataRate, rxDelay, rx2Frequency := uint8(1), uint8(8), uint8(5), uint32(923300000)
+	abp := &node.Node{
+		NodeName:              "abp-node",
+		JoinType:              "ABP",
+		LorawanVersion:        "1.1.0",
+		Class:                 "A",
+		Addr:                  testDevAddr,
+		AppSKey:               testAppSKey,
+		FNwkSIntKey:           testNwkSKey,
+		SNwkSIntKey:           testNwkSKey,
+		NwkSEncKey:            testNwkSKey,
+		RelaxFCntCheck:        true,
+		DecoderFormat:         "fields",
+		DecoderFields:         []node.DecoderField{{Name: "temperature", Offset: 0, Length: 2, Type: "int", Scale: 0.01}},
+		PortDecoders:          map[string]string{"10": "/path/to/config.js"},
+		DecoderStages:         []string{"/path/to/stage.js"},
+		DecoderVars:           map[string]interface{}{"offset": 2.5},
+		DecoderHelpers:        true,
+		PortDenylist:          []int{2},
+		DecoderMaxOutputBytes: 1024,
+		HistorySize:           5,
+		RX1DROffset:           &rx1DROffset,
+		RX2DataRate:           &rx2DataRate,
+		RXDelay:               &rxDelay,
+		RX2Frequency:          &rx2Frequency,
+		// session state of the gateway isn't sent.
+		RXTimingDelay: &rxDelay,
+		TxParams:      &rxDelay,
+	}
+	pb, err = protoutils.StructToStructPb(abp.DeviceMap())
+	test.That(t, err, test.ShouldBeNil)
+	converted, err = convertToNode(pb.AsMap())
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, converted.Addr, test.ShouldResemble, testDevAddr)
+	test.That(t, converted.AppSKey, test.ShouldResemble, testAppSKey)
+	test.That(t, converted.FNwkSIntKey, test.ShouldResemble, testNwkSKey)
+	test.That(t, converted.SNwkSIntKey, test.ShouldResemble, testNwkSKey)
+	test.That(t, converted.NwkSEncKey, test.ShouldResemble, testNwkSKey)
+	test.That(t, converted.LorawanVersion, test.ShouldEqual, "1.1.0")
+	test.That(t, converted.RelaxFCntCheck, test.ShouldBeTrue)
+	test.That(t, converted.DecoderFormat, test.ShouldEqual, "fields")
+	test.That(t, converted.DecoderFields, test.ShouldResemble, abp.DecoderFields)
+	test.That(t, converted.PortDecoders, test.ShouldResemble, abp.PortDecoders)
+	test.That(t, converted.DecoderStages, test.ShouldResemble, abp.DecoderStages)
+	test.That(t, converted.DecoderVars, test.ShouldResemble, abp.DecoderVars)
+	test.That(t, converted.DecoderHelpers, test.ShouldBeTrue)
+	test.That(t, converted.PortDenylist, test.ShouldResemble, []int{2})
+	test.That(t, converted.DecoderMaxOutputBytes, test.ShouldEqual, 1024)
+	test.That(t, converted.HistorySize, test.ShouldEqual, 5)
+	test.That(t, *converted.RX1DROffset, test.ShouldEqual, 1)
+	test.That(t, *converted.RX2DataRate, test.ShouldEqual, 8)
+	test.That(t, *converted.RXDelay, test.ShouldEqual, 5)
+	test.That(t, *converted.RX2Frequency, test.ShouldEqual, 923300000)
+	test.That(t, converted.RXTimingDelay, test.ShouldBeNil)
+	test.That(t, converted.TxParams, test.ShouldBeNil)
+}
+
+func TestAddDevice(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	decoderPath := g.devices["test-device"].DecoderPath
+	g.devices = map[string]*node.Node{}
+
+	abp := &node.Node{
+		NodeName:    "abp-node",
+		JoinType:    "ABP",
+		DecoderPath: decoderPath,
+		Addr:        testDevAddr,
+		AppSKey:     testAppSKey,
+		NwkSKey:     testNwkSKey,
+	}
+	err := g.AddDevice(abp)
+	test.That(t, err, test.ShouldBeNil)
+	name, _, err := g.parseDataUplink(ctx, createTestUplink(t, 1, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, name, test.ShouldEqual, "abp-node")
+
+	otaa := &node.Node{NodeName: "otaa-node", JoinType: "OTAA", DecoderScript: testDecoderScript, AppKey: testAppKey, DevEui: testDevEUI}
+	err = g.AddDevice(otaa)
+	test.That(t, err, test.ShouldBeNil)
+
+	// devices with the same dev addr or dev EUI as another device are rejected.
+	err = g.AddDevice(&node.Node{
+		NodeName: "abp-node-2", JoinType: "ABP", DecoderPath: decoderPath, Addr: testDevAddr, AppSKey: testAppSKey, NwkSKey: testNwkSKey,
+	})
+	test.That(t, errors.Is(err, errDuplicateDevAddr), test.ShouldBeTrue)
+	err = g.AddDevice(&node.Node{NodeName: "otaa-node-2", JoinType: "OTAA", DecoderFormat: "cayenne", AppKey: testAppKey, DevEui: testDevEUI})
+	test.That(t, errors.Is(err, errDuplicateDevEUI), test.ShouldBeTrue)
+	test.That(t, len(g.devices), test.ShouldEqual, 2)
+
+	// invalid devices are rejected.
+	for _, device := range []*node.Node{
+		{JoinType: "ABP", DecoderPath: decoderPath, Addr: testDevAddr, AppSKey: testAppSKey, NwkSKey: testNwkSKey},
+		{NodeName: "no-decoder", JoinType: "OTAA", AppKey: testAppKey, DevEui: testDevEUI},
+		{NodeName: "short-key", JoinType: "OTAA", DecoderPath: decoderPath, AppKey: testAppKey[:8], DevEui: testDevEUI},
+		{NodeName: "no-nwk-key", JoinType: "OTAA", LorawanVersion: "1.1.0", DecoderPath: decoderPath, AppKey: testAppKey, DevEui: testDevEUI},
+		{NodeName: "no-addr", JoinType: "ABP", DecoderPath: decoderPath, AppSKey: testAppSKey, NwkSKey: testNwkSKey},
+		{NodeName: "no-1.1-keys", JoinType: "ABP", LorawanVersion: "1.1.0", DecoderPath: decoderPath, Addr: testDevAddr, AppSKey: testAppSKey, NwkSKey: testNwkSKey},
+	} {
+		err = g.AddDevice(device)
+		test.That(t, errors.Is(err, errInvalidDevice), test.ShouldBeTrue)
+	}
+	err = g.AddDevice(&node.Node{NodeName: "bad-join-type", JoinType: "OTA", DecoderPath: decoderPath})
+	test.That(t, errors.Is(err, errUnexpectedJoinType), test.ShouldBeTrue)
+	test.That(t, len(g.devices), test.ShouldEqual, 2)
+
+	// adding a device again updates it.
+	err = g.AddDevice(&node.Node{
+		NodeName: "abp-node", JoinType: "ABP", Class: "C", DecoderPath: decoderPath, Addr: testDevAddr, AppSKey: testAppSKey, NwkSKey: testNwkSKey,
+	})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, g.devices["abp-node"].Class, test.ShouldEqual, "C")
+	test.That(t, g.devices["abp-node"].FCntUp, test.ShouldEqual, 1)
+
+	// removed devices no longer get uplinks.
+	g.RemoveDevice("abp-node")
+	g.RemoveDevice("unknown-node")
+	test.That(t, g.devices, test.ShouldNotContainKey, "abp-node")
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 2, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, errors.Is(err, errNoDevice), test.ShouldBeTrue)
+}
+
+func TestListDevices(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	err := g.AddDevice(&node.Node{NodeName: "otaa-node", JoinType: "OTAA", Class: "A", DecoderScript: testDecoderScript, AppKey: testAppKey, DevEui: testDevEUI})
+	test.That(t, err, test.ShouldBeNil)
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 7, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+
+	resp, err := g.DoCommand(ctx, map[string]interface{}{"list_devices": true})
+	test.That(t, err, test.ShouldBeNil)
+	devices := resp["devices"].([]interface{})
+	test.That(t, len(devices), test.ShouldEqual, 2)
+
+	// the OTAA device hasn't joined, so it has no dev addr, frame counter or last seen time.
+	otaa := devices[0].(map[string]interface{})
+	test.That(t, otaa["name"], test.ShouldEqual, "otaa-node")
+	test.That(t, otaa["join_type"], test.ShouldEqual, "OTAA")
+	test.That(t, otaa["dev_addr"], test.ShouldEqual, "")
+	test.That(t, otaa, test.ShouldNotContainKey, "fcnt_up")
+	test.That(t, otaa, test.ShouldNotContainKey, "last_seen")
+
+	abp := devices[1].(map[string]interface{})
+	test.That(t, abp["name"], test.ShouldEqual, "test-device")
+	test.That(t, abp["join_type"], test.ShouldEqual, "ABP")
+	test.That(t, abp["dev_addr"], test.ShouldEqual, hex.EncodeToString(testDevAddr))
+	test.That(t, abp["fcnt_up"], test.ShouldEqual, 7)
+	test.That(t, abp["fcnt_down"], test.ShouldEqual, 0)
+	test.That(t, abp, test.ShouldContainKey, "last_seen")
+}
+
+func TestRoutePacket(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	// downlinks go to a packet forwarder that isn't connected, so the acks of confirmed uplinks fail to send.
+	rx := testRxInfo
+	rx.forwarder = &forwarderRx{gatewayEUI: "aa555a0000000101"}
+
+	// data uplinks are parsed and update the readings.
+	err := g.routePacket(ctx, createTestUplink(t, 1, 1, []byte{0x15, 0x05}), rx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, g.lastReadings, test.ShouldContainKey, "test-device")
+	err = g.routePacket(ctx, createUplinkWithMHDR(t, confirmedDataUp, testNwkSKey, testAppSKey, testDevAddr, 2, nil, 1, []byte{0x15, 0x05}), rx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, g.devices["test-device"].FCntUp, test.ShouldEqual, 2)
+
+	// uplinks that fail to decode are still routed so their downlinks are sent.
+	g.routes = nil
+	g.devices["test-device"].DecoderPath = writeTestDecoder(t, `function Decode(fPort, bytes) { throw new Error("bad payload"); }`)
+	err = g.routePacket(ctx, createTestUplink(t, 3, 1, []byte{0x15, 0x05}), rx)
+	test.That(t, errors.Is(err, lorawan.ErrDecodeFailed), test.ShouldBeTrue)
+	test.That(t, g.routes, test.ShouldContainKey, "test-device")
+
+	// join requests go to the join handler.
+	err = g.routePacket(ctx, []byte{joinRequestType, 0x01, 0x02}, rx)
+	test.That(t, errors.Is(err, errInvalidJoinRequest), test.ShouldBeTrue)
+
+	// devices don't send the other message types.
+	for _, mhdr := range []byte{joinAcceptType, unconfirmedDataDown, confirmedDataDown, rejoinRequestType, proprietaryType} {
+		err = g.routePacket(ctx, []byte{mhdr, 0x01, 0x02, 0x03}, rx)
+		test.That(t, errors.Is(err, errUnsupportedMType), test.ShouldBeTrue)
+		test.That(t, err.Error(), test.ShouldContainSubstring, mTypeNames[mhdr])
+	}
+
+	err = g.routePacket(ctx, []byte{unconfirmedDataUp | 0x01, 0x01, 0x02, 0x03}, rx)
+	test.That(t, errors.Is(err, errUnsupportedMajor), test.ShouldBeTrue)
+	err = g.routePacket(ctx, []byte{}, rx)
+	test.That(t, err, test.ShouldBeError, errEmptyPacket)
+}
+
+func TestRoutePacketTrace(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	logger, logs := logging.NewObservedTestLogger(t)
+	g.logger = logger
+	uplink := createTestUplink(t, 1, 1, []byte{0x15, 0x05})
+
+	// the trace is silent unless debug_uplinks is set.
+	err := g.routePacket(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, logs.FilterMessageSnippet("uplink trace").Len(), test.ShouldEqual, 0)
+
+	g.debugUplinks = true
+	uplink = createTestUplink(t, 2, 1, []byte{0x15, 0x05})
+	err = g.routePacket(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+
+	received := logs.FilterMessage("uplink trace: received packet").All()
+	test.That(t, len(received), test.ShouldEqual, 1)
+	test.That(t, received[0].ContextMap()["phy_payload"], test.ShouldEqual, hex.EncodeToString(uplink))
+	authenticated := logs.FilterMessage("uplink trace: authenticated data uplink").All()
+	test.That(t, len(authenticated), test.ShouldEqual, 1)
+	test.That(t, authenticated[0].ContextMap()["dev_addr"], test.ShouldEqual, hex.EncodeToString(testDevAddr))
+	test.That(t, authenticated[0].ContextMap()["fcnt"], test.ShouldEqual, uint32(2))
+	frame := logs.FilterMessage("uplink trace: frame payload").All()
+	test.That(t, len(frame), test.ShouldEqual, 1)
+	test.That(t, frame[0].ContextMap()["fport"], test.ShouldEqual, uint8(1))
+	decrypted := logs.FilterMessage("uplink trace: decrypted payload").All()
+	test.That(t, len(decrypted), test.ShouldEqual, 1)
+	test.That(t, decrypted[0].ContextMap()["payload"], test.ShouldEqual, "1505")
+}
+
+func TestUpdateKeys(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	_, _, err := g.parseDataUplink(ctx, createTestUplink(t, 5, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	g.devices["test-device"].FCntDown = 3
+
+	newAppSKey := []byte{0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1A, 0x1B, 0x1C, 0x1D, 0x1E, 0x1F}
+	newNwkSKey := []byte{0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x27, 0x28, 0x29, 0x2A, 0x2B, 0x2C, 0x2D, 0x2E, 0x2F}
+	resp, err := g.DoCommand(ctx, map[string]interface{}{"update_keys": map[string]interface{}{
+		"device":        "test-device",
+		"app_s_key":     hex.EncodeToString(newAppSKey),
+		"network_s_key": hex.EncodeToString(newNwkSKey),
+	}})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, resp["update_keys"], test.ShouldEqual, "updated")
+	test.That(t, g.devices["test-device"].FCntUpValid, test.ShouldBeFalse)
+	test.That(t, g.devices["test-device"].FCntDown, test.ShouldEqual, 0)
+
+	// frames with the old keys are rejected, the new session starts its frame counter over.
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 6, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrInvalidMIC), test.ShouldBeTrue)
+	uplink := createUplink(t, newNwkSKey, newAppSKey, testDevAddr, 1, nil, 1, []byte{0x15, 0x05})
+	_, readings, err := g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+
+	// invalid keys don't change the device.
+	err = g.updateKeysCommand(map[string]interface{}{"device": "test-device", "app_s_key": "0102"})
+	test.That(t, errors.Is(err, errInvalidDevice), test.ShouldBeTrue)
+	test.That(t, g.devices["test-device"].AppSKey, test.ShouldResemble, newAppSKey)
+	err = g.updateKeysCommand(map[string]interface{}{"device": "test-device"})
+	test.That(t, err, test.ShouldBeError, errInvalidUpdateKeys)
+	err = g.updateKeysCommand(map[string]interface{}{"device": "unknown", "app_s_key": hex.EncodeToString(newAppSKey)})
+	test.That(t, err, test.ShouldBeError, errNoDevice)
+
+	addTestOTAADevice(g)
+	err = g.updateKeysCommand(map[string]interface{}{"device": "test-otaa-device", "app_s_key": hex.EncodeToString(newAppSKey)})
+	test.That(t, err, test.ShouldBeError, errUpdateKeysOTAA)
+}
+
+func TestUpdateKeysGracePeriod(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	_, _, err := g.parseDataUplink(ctx, createTestUplink(t, 5, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+
+	newAppSKey := []byte{0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1A, 0x1B, 0x1C, 0x1D, 0x1E, 0x1F}
+	newNwkSKey := []byte{0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x27, 0x28, 0x29, 0x2A, 0x2B, 0x2C, 0x2D, 0x2E, 0x2F}
+	err = g.updateKeysCommand(map[string]interface{}{
+		"device":         "test-device",
+		"app_s_key":      hex.EncodeToString(newAppSKey),
+		"network_s_key":  hex.EncodeToString(newNwkSKey),
+		"grace_period_s": 60.0,
+	})
+	test.That(t, err, test.ShouldBeNil)
+
+	// during the grace period frames with the old keys decode, along with frames with the new keys.
+	_, readings, err := g.parseDataUplink(ctx, createTestUplink(t, 6, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+	_, readings, err = g.parseDataUplink(ctx, createUplink(t, newNwkSKey, newAppSKey, testDevAddr, 1, nil, 1, []byte{0x15, 0x06}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.6)
+	test.That(t, g.devices["test-device"].FCntUp, test.ShouldEqual, 1)
+
+	// each session has its own frame counter.
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 6, 1, []byte{0x15, 0x06}), testRxInfo)
+	test.That(t, errors.Is(err, errInvalidFCnt), test.ShouldBeTrue)
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 7, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+
+	// after the grace period frames with the old keys are rejected.
+	g.devices["test-device"].PreviousSessionExpires = time.Now().Add(-time.Second)
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 8, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrInvalidMIC), test.ShouldBeTrue)
+	test.That(t, g.devices["test-device"].PreviousSession, test.ShouldBeNil)
+	_, _, err = g.parseDataUplink(ctx, createUplink(t, newNwkSKey, newAppSKey, testDevAddr, 2, nil, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+
+	// the MIC can't tell the sessions apart if only the app session key changes.
+	err = g.updateKeysCommand(map[string]interface{}{"device": "test-device", "app_s_key": hex.EncodeToString(testAppSKey), "grace_period_s": 60.0})
+	test.That(t, err, test.ShouldBeError, errKeyGraceMIC)
+	test.That(t, g.devices["test-device"].AppSKey, test.ShouldResemble, newAppSKey)
+	err = g.updateKeysCommand(map[string]interface{}{"device": "test-device", "network_s_key": hex.EncodeToString(testNwkSKey), "grace_period_s": 0.0})
+	test.That(t, err, test.ShouldBeError, errInvalidKeyGrace)
+}
+
+func TestCloseWhileDecoding(t *testing.T) {
+	ctx := context.Background()
+	goroutines := runtime.NumGoroutine()
+
+	g := createTestGateway(t)
+	g.workers = utils.NewBackgroundStoppableWorkers()
+	device := g.devices["test-device"]
+	device.DecoderPath = writeTestDecoder(t, `function Decode(fPort, bytes) { while (true) {} }`)
+	device.DecoderTimeout = time.Minute
+
+	g.handlePacket(ctx, createTestUplink(t, 1, 1, []byte{0x15, 0x05}), testRxInfo)
+	for g.lastPacket.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// the decoder is interrupted instead of running until its timeout.
+	start := time.Now()
+	err := g.Close(ctx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, time.Since(start), test.ShouldBeLessThan, time.Second)
+
+	// the workers and decoder interrupts have all returned.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.That(t, runtime.NumGoroutine(), test.ShouldBeLessThanOrEqualTo, goroutines)
 }
@@ -0,0 +1,46 @@
+package gateway
+
+import (
+	"time"
+)
+
+// healthCommand returns the state of the gateway for the health docommand, so a supervisor can tell if the gateway
+// stopped receiving. Times are RFC 3339 strings, empty if nothing was received yet.
+// last_packet is any packet the gateway received, last_uplink an authenticated uplink from one of its devices.
+func (g *Gateway) healthCommand() map[string]interface{} {
+	now := time.Now()
+
+	g.mu.Lock()
+	devices := len(g.devices)
+	g.mu.Unlock()
+
+	health := map[string]interface{}{
+		"devices":      devices,
+		"concentrator": g.started,
+	}
+	addTime := func(name string, nanos int64) {
+		health[name] = ""
+		if nanos != 0 {
+			t := time.Unix(0, nanos)
+			health[name] = t.UTC().Format(time.RFC3339Nano)
+			health["seconds_since_"+name] = now.Sub(t).Seconds()
+		}
+	}
+	addTime("last_packet", g.lastPacket.Load())
+	addTime("last_uplink", g.lastUplink.Load())
+
+	// the listeners are only in the health if they are configured.
+	if g.udp != nil {
+		g.udp.mu.Lock()
+		health["udp_listen_addr"] = g.udp.conn.LocalAddr().String()
+		health["forwarders"] = len(g.udp.pullAddrs)
+		g.udp.mu.Unlock()
+	}
+	if g.station != nil {
+		g.station.mu.Lock()
+		health["station_listen_addr"] = g.station.ln.Addr().String()
+		health["stations"] = len(g.station.conns)
+		g.station.mu.Unlock()
+	}
+	return health
+}
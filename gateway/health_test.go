@@ -0,0 +1,68 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"go.viam.com/test"
+	"go.viam.com/utils"
+)
+
+func TestHealth(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	g.workers = utils.NewBackgroundStoppableWorkers()
+	err := g.startUDPServer("127.0.0.1:0")
+	test.That(t, err, test.ShouldBeNil)
+	defer g.Close(ctx)
+
+	// nothing was received yet.
+	health, err := g.DoCommand(ctx, map[string]interface{}{"health": true})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, health["devices"], test.ShouldEqual, 1)
+	test.That(t, health["concentrator"], test.ShouldBeFalse)
+	test.That(t, health["udp_listen_addr"], test.ShouldEqual, g.udp.conn.LocalAddr().String())
+	test.That(t, health["forwarders"], test.ShouldEqual, 0)
+	test.That(t, health["last_packet"], test.ShouldEqual, "")
+	test.That(t, health["last_uplink"], test.ShouldEqual, "")
+	test.That(t, health, test.ShouldNotContainKey, "seconds_since_last_uplink")
+	test.That(t, health, test.ShouldNotContainKey, "station_listen_addr")
+
+	// a forwarder connects.
+	conn, err := net.DialUDP("udp", nil, g.udp.conn.LocalAddr().(*net.UDPAddr))
+	test.That(t, err, test.ShouldBeNil)
+	defer conn.Close()
+	_, err = conn.Write(append([]byte{0x02, 0x12, 0x34, udpPullData}, testGatewayEUI...))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)), test.ShouldBeNil)
+	_, err = conn.Read(make([]byte, 4))
+	test.That(t, err, test.ShouldBeNil)
+
+	// a packet from an unknown device is received but isn't an uplink.
+	unknown := createUplink(t, testNwkSKey, testAppSKey, []byte{0x0A, 0x0B, 0x0C, 0x0D}, 1, nil, 1, []byte{0x15, 0x05})
+	err = g.routePacket(ctx, unknown, testRxInfo)
+	test.That(t, err, test.ShouldNotBeNil)
+	health, err = g.DoCommand(ctx, map[string]interface{}{"health": true})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, health["forwarders"], test.ShouldEqual, 1)
+	test.That(t, health["seconds_since_last_packet"], test.ShouldBeBetweenOrEqual, 0, 1)
+	test.That(t, health["last_uplink"], test.ShouldEqual, "")
+
+	err = g.routePacket(ctx, createTestUplink(t, 1, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	health, err = g.DoCommand(ctx, map[string]interface{}{"health": true})
+	test.That(t, err, test.ShouldBeNil)
+	lastUplink, err := time.Parse(time.RFC3339Nano, health["last_uplink"].(string))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, time.Since(lastUplink), test.ShouldBeLessThan, time.Second)
+	test.That(t, health["seconds_since_last_uplink"], test.ShouldBeBetweenOrEqual, 0, 1)
+
+	// the last uplink is kept after its device is removed.
+	g.RemoveDevice("test-device")
+	health, err = g.DoCommand(ctx, map[string]interface{}{"health": true})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, health["devices"], test.ShouldEqual, 0)
+	test.That(t, health["last_uplink"], test.ShouldEqual, lastUplink.UTC().Format(time.RFC3339Nano))
+}
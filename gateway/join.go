@@ -1,19 +1,11 @@
 package gateway
 
-/*
-#cgo CFLAGS: -I./sx1302/libloragw/inc -I./sx1302/libtools/inc
-#cgo LDFLAGS: -L./sx1302/libloragw -lloragw -L./sx1302/libtools -lbase64 -lparson -ltinymt32  -lm
-
-#include "../sx1302/libloragw/inc/loragw_hal.h"
-#include "gateway.h"
-#include <stdlib.h>
-
-*/
-import "C"
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
+	"gateway/lorawan"
 	"gateway/node"
 	"math/rand"
 	"time"
@@ -22,7 +14,6 @@ import (
 	"go.thethings.network/lorawan-stack/v3/pkg/crypto/cryptoservices"
 	"go.thethings.network/lorawan-stack/v3/pkg/ttnpb"
 	"go.thethings.network/lorawan-stack/v3/pkg/types"
-	"go.viam.com/utils"
 )
 
 type joinRequest struct {
@@ -33,55 +24,50 @@ type joinRequest struct {
 }
 
 const (
-	joinRx2WindowSec = 6         // rx2 delay for sending join accept message.
-	rx2Frequenecy    = 923300000 // Frequency to send downlinks on rx2 window
-	rx2SF            = 12        // spreading factor for rx2 window
-	rx2Bandwidth     = 0x06      // 500k bandwidth
+	joinRequestLength  = 23   // length of the join request payload.
+	maxDevAddrAttempts = 1000 // number of dev addrs tried before giving up on finding an unused one.
 )
 
-// network id for the device to identify the network. Must be 3 bytes.
-var netID = []byte{1, 2, 3}
+// defaultNetID is the network id sent in join accepts if net_id isn't set, a type 0 NetID with NwkID 0x03.
+var defaultNetID = []byte{1, 2, 3}
+
+// devAddrBits are the NwkID and NwkAddr bit lengths of the dev addrs of each NetID type, from the
+// LoRaWAN backend interfaces spec. The dev addr starts with type 1 bits followed by a 0 bit,
+// then the NwkID, which is the low bits of the NetID, then the NwkAddr picked for the device.
+var devAddrBits = [8]struct{ nwkID, nwkAddr int }{
+	{6, 25}, {6, 24}, {9, 20}, {11, 17}, {12, 15}, {13, 13}, {15, 10}, {17, 7},
+}
 
-func (g *Gateway) handleJoin(ctx context.Context, payload []byte) error {
+func (g *Gateway) handleJoin(ctx context.Context, payload []byte, rx rxInfo) error {
 	jr, device, err := g.parseJoinRequestPacket(payload)
 	if err != nil {
 		return err
 	}
 
-	joinAccept, err := generateJoinAccept(ctx, jr, device)
+	// the join accept resets the device's session.
+	g.mu.Lock()
+	devAddr, err := g.newDevAddr()
 	if err != nil {
+		g.mu.Unlock()
 		return err
 	}
-
-	txPkt := C.struct_lgw_pkt_tx_s{
-		freq_hz:    C.uint32_t(rx2Frequenecy),
-		tx_mode:    C.uint8_t(0), // immediate mode
-		rf_chain:   C.uint8_t(0),
-		rf_power:   C.int8_t(26),    // tx power in dbm
-		modulation: C.uint8_t(0x10), // LORA modulation
-		bandwidth:  C.uint8_t(rx2Bandwidth),
-		datarate:   C.uint32_t(rx2SF),
-		coderate:   C.uint8_t(0x01), // code rate 4/5
-		invert_pol: C.bool(true),    // Downlinks are always reverse polarity.
-		size:       C.uint16_t(len(joinAccept)),
+	joinAccept, err := generateJoinAccept(ctx, jr, device, devAddr, g.netID, g.region)
+	if err == nil {
+		g.saveSessionLocked(device)
 	}
-
-	var cPayload [256]C.uchar
-	for i, b := range joinAccept {
-		cPayload[i] = C.uchar(b)
+	g.mu.Unlock()
+	if err != nil {
+		return err
 	}
-	txPkt.payload = cPayload
 
-	// send on rx2 window - opens 6 seconds after join request.
-	if !utils.SelectContextOrWait(ctx, time.Second*joinRx2WindowSec) {
-		return nil
+	// send in the rx1 window 5 seconds after the join request, or in rx2 a second later if rx1 can't be used.
+	var rx1 *rxWindow
+	window1, rx2, ok := g.region.joinAcceptWindows(device, rx)
+	if ok {
+		rx1 = &window1
 	}
-
-	// lock so there is not two sends at the same time.
-	g.mu.Lock()
-	defer g.mu.Unlock()
-	errCode := int(C.send(&txPkt))
-	if errCode != 0 {
+	err = g.transmit(ctx, joinAccept, rx1, rx2, rx)
+	if err != nil {
 		return errSendJoinAccept
 	}
 
@@ -95,6 +81,10 @@ func (g *Gateway) handleJoin(ctx context.Context, payload []byte) error {
 func (g *Gateway) parseJoinRequestPacket(payload []byte) (joinRequest, *node.Node, error) {
 	var joinRequest joinRequest
 
+	if len(payload) != joinRequestLength {
+		return joinRequest, nil, errInvalidJoinRequest
+	}
+
 	// everything in the join request payload is little endian
 	joinRequest.joinEUI = payload[1:9]
 	joinRequest.devEUI = payload[9:17]
@@ -106,6 +96,9 @@ func (g *Gateway) parseJoinRequestPacket(payload []byte) (joinRequest, *node.Nod
 	// device.devEUI is in big endian - reverse to compare and find device.
 	devEUIBE := reverseByteArray(joinRequest.devEUI)
 
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
 	// match the dev eui to gateway device
 	for _, device := range g.devices {
 		if bytes.Equal(device.DevEui, devEUIBE) {
@@ -118,11 +111,31 @@ func (g *Gateway) parseJoinRequestPacket(payload []byte) (joinRequest, *node.Nod
 		return joinRequest, nil, errNoDevice
 	}
 
-	err := validateMIC(types.AES128Key(matched.AppKey), payload)
+	// LoRaWAN 1.1 devices sign the join request with the network key.
+	rootKey := matched.AppKey
+	if matched.LorawanVersion == "1.1.0" {
+		rootKey = matched.NwkKey
+	}
+	if len(rootKey) != 16 {
+		return joinRequest, nil, lorawan.ErrInvalidMIC
+	}
+
+	err := validateMIC(types.AES128Key(rootKey), payload)
 	if err != nil {
 		return joinRequest, nil, err
 	}
 
+	// a captured join request could be replayed to reset the device's session, so each dev nonce can only be used once.
+	devNonce := binary.LittleEndian.Uint16(joinRequest.devNonce)
+	if matched.DevNonces[devNonce] {
+		g.logger.Warnf("received join request from dev EUI %x with reused dev nonce %x, ignoring", devEUIBE, devNonce)
+		return joinRequest, nil, errDevNonceReused
+	}
+	if matched.DevNonces == nil {
+		matched.DevNonces = make(map[uint16]bool)
+	}
+	matched.DevNonces[devNonce] = true
+
 	return joinRequest, matched, nil
 }
 
@@ -130,12 +143,29 @@ func (g *Gateway) parseJoinRequestPacket(payload []byte) (joinRequest, *node.Nod
 // | MHDR | JOIN NONCE | NETID |   DEV ADDR  | DL | RX DELAY |   CFLIST   | MIC  |
 // | 1 B  |     3 B    |   3 B |     4 B     | 1B |    1B    |  0 or 16   | 4 B  |
 // https://lora-alliance.org/wp-content/uploads/2020/11/lorawan1.0.3.pdf page 35 for more info on join accept.
-func generateJoinAccept(ctx context.Context, jr joinRequest, d *node.Node) ([]byte, error) {
+// devAddr is the address assigned to the device, used by the network to identify its uplinks.
+// The receive window settings and CFList come from the region r, the node can override the receive windows.
+// The caller must hold the gateway mutex.
+func generateJoinAccept(ctx context.Context, jr joinRequest, d *node.Node, devAddr, netID []byte, r *region) ([]byte, error) {
+	lorawan11 := d.LorawanVersion == "1.1.0"
+
 	// generate random join nonce.
 	jn := generateJoinNonce()
+	if lorawan11 {
+		// 1.1 devices reject join nonces that aren't greater than the last one.
+		d.JoinNonce++
+		jn = []byte{byte(d.JoinNonce >> 16), byte(d.JoinNonce >> 8), byte(d.JoinNonce)}
+	}
 
-	// generate a random device address to identify uplinks.
-	d.Addr = generateDevAddr()
+	d.Addr = devAddr
+	// the device gets the configured receive windows in the join accept.
+	d.RXTimingDelay = nil
+	d.PendingRXTimingDelay = nil
+	// the device drops the duty cycle limit when it joins.
+	d.MaxDutyCycle = nil
+	d.PendingMaxDutyCycle = nil
+	d.TxParams = nil
+	d.PendingTxParams = nil
 
 	// the join accept payload needs everything to be LE, so reverse the BE fields.
 	netIDLE := reverseByteArray(netID)
@@ -149,37 +179,29 @@ func generateJoinAccept(ctx context.Context, jr joinRequest, d *node.Node) ([]by
 	payload = append(payload, dAddrLE[:]...)
 
 	// DLSettings byte:
-	// Bit 7: OptNeg (0)
-	// Bits 6-4: RX1DROffset - setting default - offset 0
-	// Bits 3-0: RX2DR - setting default - equal to uplink DR
-	payload = append(payload, 0x00)
-	payload = append(payload, 0x01) // rx delay: 1 second
-
-	// CFList for US915 using Channel Mask
-	// This tells the device to only transmit on channels 0-7
-	cfList := []byte{
-		0xFF, // Enable channels 0-7
-		0x00, // Disable channels 8-15
-		0x00, // Disable channels 16-23
-		0x00, // Disable channels 24-31
-		0x00, // Disable channels 32-39
-		0x00, // Disable channels 40-47
-		0x00, // Disable channels 48-55
-		0x00, // Disable channels 56-63
-		0x00, // Disable channels 64-71
-		0x00, // Disbale channels 72-79
-		0x00, // RFU (reserved for future use)
-		0x00, // RFU
-		0x00, // RFU
-		0x00, // RFU
-		0x00, // RFU
-		0x01, // CFList Type = 1 (Channel Mask)
+	// Bit 7: OptNeg - set for 1.1 devices to use the 1.1 session keys.
+	// Bits 6-4: RX1DROffset - the rx1 data rate is the uplink DR lowered by the offset.
+	// Bits 3-0: RX2DR - the data rate of the rx2 window.
+	rx := r.rxSettings(d)
+	dlSettings := rx.rx1DROffset<<4&0x70 | rx.rx2DataRate&0x0F
+	if lorawan11 {
+		dlSettings |= 0x80
 	}
+	payload = append(payload, dlSettings)
+	// RxDelay is the rx1 delay in seconds, 0 also means 1 second.
+	payload = append(payload, byte(rx.rx1Delay/time.Second)&0x0F)
 
-	payload = append(payload, cfList...)
+	// CFList configures the channels the device uses, this is specific to the region.
+	payload = append(payload, r.cfList()...)
 
 	// generate MIC
-	resMIC, err := crypto.ComputeLegacyJoinAcceptMIC(types.AES128Key(d.AppKey), payload)
+	var resMIC [4]byte
+	var err error
+	if lorawan11 {
+		resMIC, err = computeJoinAcceptMIC11(jr, d, payload)
+	} else {
+		resMIC, err = crypto.ComputeLegacyJoinAcceptMIC(types.AES128Key(d.AppKey), payload)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -189,7 +211,13 @@ func generateJoinAccept(ctx context.Context, jr joinRequest, d *node.Node) ([]by
 
 	payload = append(payload, resMIC[:]...)
 
-	enc, err := crypto.EncryptJoinAccept(types.AES128Key(d.AppKey), payload)
+	// the join accept is encrypted with an AES decrypt in ECB mode, so devices only need AES encrypt to read it.
+	// 1.1 join accepts in response to join requests are encrypted with the network key.
+	encKey := d.AppKey
+	if lorawan11 {
+		encKey = d.NwkKey
+	}
+	enc, err := crypto.EncryptJoinAccept(types.AES128Key(encKey), payload)
 	if err != nil {
 		return nil, err
 	}
@@ -200,27 +228,52 @@ func generateJoinAccept(ctx context.Context, jr joinRequest, d *node.Node) ([]by
 	ja = append(ja, enc...)
 
 	// generate the session keys
-	appsKey, err := generateKeys(ctx, jr.devNonce, jr.joinEUI, jn, jr.devEUI, netID, types.AES128Key(d.AppKey))
-	if err != nil {
-		return nil, err
+	if lorawan11 {
+		generateKeys11(jr, jn, d)
+	} else {
+		appsKey, nwksKey, err := generateKeys(ctx, jr.devNonce, jr.joinEUI, jn, jr.devEUI, netID, types.AES128Key(d.AppKey))
+		if err != nil {
+			return nil, err
+		}
+
+		d.AppSKey = appsKey[:]
+		d.NwkSKey = nwksKey[:]
 	}
 
-	d.AppSKey = appsKey[:]
+	// a new session starts the frame counters over.
+	d.FCntUp = 0
+	d.FCntUpValid = false
+	d.FCntDown = 0
 
 	// return the encrypted join accept message
 	return ja, nil
 }
 
-// Generates random 4 byte dev addr. This is used for the network to identify device's data uplinks.
-func generateDevAddr() []byte {
-	source := rand.NewSource(time.Now().UnixNano())
-	rand := rand.New(source)
+// devAddrBlock returns the block of dev addrs OTAA devices are given for the NetID: the first dev addr of the
+// block, which is the type prefix and NwkID with a zero NwkAddr, and the number of NwkAddrs in it.
+func devAddrBlock(netID []byte) (uint32, uint32) {
+	id := uint32(netID[0])<<16 | uint32(netID[1])<<8 | uint32(netID[2])
+	netType := id >> 21
+	bits := devAddrBits[netType]
 
-	num1 := rand.Intn(255)
-	num2 := rand.Intn(255)
+	typePrefix := uint32(0xFF<<(8-netType)) & 0xFF
+	nwkID := id & (1<<bits.nwkID - 1)
+	return typePrefix<<24 | nwkID<<bits.nwkAddr, 1 << bits.nwkAddr
+}
 
-	// first 7 MSB of devAddr is the network ID.
-	return []byte{1, 2, byte(num1), byte(num2)}
+// newDevAddr picks a dev addr in the NetID's block that isn't used by any registered device.
+// The NwkAddrs are tried in order from a random one, so a nearly full block still finds the free ones.
+// The caller must hold the gateway mutex.
+func (g *Gateway) newDevAddr() ([]byte, error) {
+	prefix, size := devAddrBlock(g.netID)
+	start := rand.Uint32() % size
+	for i := uint32(0); i < min(size, maxDevAddrAttempts); i++ {
+		devAddr := binary.BigEndian.AppendUint32(nil, prefix|(start+i)%size)
+		if _, err := matchDeviceAddr(devAddr, g.devices); err != nil {
+			return devAddr, nil
+		}
+	}
+	return nil, errNoDevAddr
 }
 
 // Validates the message integrity code sent in the join request.
@@ -232,12 +285,13 @@ func validateMIC(appKey types.AES128Key, payload []byte) error {
 	}
 
 	if !bytes.Equal(payload[19:], mic[:]) {
-		return errInvalidMIC
+		return lorawan.ErrInvalidMIC
 	}
 	return nil
 }
 
-func generateKeys(ctx context.Context, devNonce, joinEUI, jn, devEUI, networkID []byte, appKey types.AES128Key) (types.AES128Key, error) {
+// generateKeys derives the AppSKey and NwkSKey for the session from the join request and join accept fields.
+func generateKeys(ctx context.Context, devNonce, joinEUI, jn, devEUI, networkID []byte, appKey types.AES128Key) (types.AES128Key, types.AES128Key, error) {
 	cryptoDev := &ttnpb.EndDevice{
 		Ids: &ttnpb.EndDeviceIdentifiers{JoinEui: joinEUI, DevEui: devEUI},
 	}
@@ -257,10 +311,48 @@ func generateKeys(ctx context.Context, devNonce, joinEUI, jn, devEUI, networkID
 		types.NetID(networkID),
 	)
 	if err != nil {
-		return types.AES128Key{}, fmt.Errorf("failed to generate AppSKey: %w", err)
+		return types.AES128Key{}, types.AES128Key{}, fmt.Errorf("failed to generate AppSKey: %w", err)
 	}
 
-	return appsKey, nil
+	// In LoRaWAN 1.0.x the NwkSKey is also derived from the AppKey. It is used to verify the uplink MIC.
+	nwksKey := crypto.DeriveLegacyNwkSKey(appKey, types.JoinNonce(jn), types.NetID(networkID), types.DevNonce(devNonceBE))
+
+	return appsKey, nwksKey, nil
+}
+
+// computeJoinAcceptMIC11 computes the MIC of a LoRaWAN 1.1 join accept with the JSIntKey.
+// The MIC covers the join request type, JoinEUI and DevNonce along with the join accept payload.
+func computeJoinAcceptMIC11(jr joinRequest, d *node.Node, payload []byte) ([4]byte, error) {
+	jsIntKey := crypto.DeriveJSIntKey(types.AES128Key(d.NwkKey), types.EUI64(reverseByteArray(jr.devEUI)))
+
+	// 0xFF is the join request type for a join request, rejoin requests are not supported.
+	return crypto.ComputeJoinAcceptMIC(
+		jsIntKey,
+		0xFF,
+		types.EUI64(reverseByteArray(jr.joinEUI)),
+		types.DevNonce(reverseByteArray(jr.devNonce)),
+		payload,
+	)
+}
+
+// generateKeys11 derives the LoRaWAN 1.1 session keys for the device.
+// The AppSKey is derived from the AppKey and the network session keys from the NwkKey.
+func generateKeys11(jr joinRequest, jn []byte, d *node.Node) {
+	// all inputs here are big endian.
+	joinNonce := types.JoinNonce(jn)
+	joinEUI := types.EUI64(reverseByteArray(jr.joinEUI))
+	devNonce := types.DevNonce(reverseByteArray(jr.devNonce))
+	nwkKey := types.AES128Key(d.NwkKey)
+
+	appSKey := crypto.DeriveAppSKey(types.AES128Key(d.AppKey), joinNonce, joinEUI, devNonce)
+	fNwkSIntKey := crypto.DeriveFNwkSIntKey(nwkKey, joinNonce, joinEUI, devNonce)
+	sNwkSIntKey := crypto.DeriveSNwkSIntKey(nwkKey, joinNonce, joinEUI, devNonce)
+	nwkSEncKey := crypto.DeriveNwkSEncKey(nwkKey, joinNonce, joinEUI, devNonce)
+
+	d.AppSKey = appSKey[:]
+	d.FNwkSIntKey = fNwkSIntKey[:]
+	d.SNwkSIntKey = sNwkSIntKey[:]
+	d.NwkSEncKey = nwkSEncKey[:]
 }
 
 // generates random 3 byte join nonce
@@ -275,8 +367,8 @@ func generateJoinNonce() []byte {
 	return []byte{byte(num1), byte(num2), byte(num3)}
 }
 
-// reverseByteArray creates a new array reversed of the input.
-// Used to convert little endian fields to big endian and vice versa.
+// reverseByteArray returns a new slice with the bytes of arr in reverse order, arr is not modified.
+// Used to convert little endian fields to big endian and vice versa, such as the dev addr of a frame.
 func reverseByteArray(arr []byte) []byte {
 	reversed := make([]byte, len(arr))
 
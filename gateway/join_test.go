@@ -0,0 +1,421 @@
+package gateway
+
+import (
+	"context"
+	"crypto/aes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gateway/lorawan"
+	"gateway/node"
+	"testing"
+
+	"go.thethings.network/lorawan-stack/v3/pkg/crypto"
+	"go.thethings.network/lorawan-stack/v3/pkg/types"
+	"go.viam.com/test"
+)
+
+var (
+	testDevEUI  = []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xAB, 0xCD, 0xEF}
+	testJoinEUI = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}
+	testAppKey  = []byte{
+		0x01, 0x23, 0x45, 0x67, 0x89, 0xAB, 0xCD, 0xEF,
+		0x01, 0x23, 0x45, 0x67, 0x89, 0xAB, 0xAA, 0xAA,
+	}
+	// testJoinDevAddr is a dev addr in the block of the default NetID.
+	testJoinDevAddr = []byte{0x06, 0x00, 0x00, 0x01}
+)
+
+// addTestOTAADevice registers an OTAA device that has not joined yet to the test gateway.
+func addTestOTAADevice(g *Gateway) *node.Node {
+	device := &node.Node{
+		NodeName:    "test-otaa-device",
+		JoinType:    "OTAA",
+		DecoderPath: g.devices["test-device"].DecoderPath,
+		AppKey:      testAppKey,
+		DevEui:      testDevEUI,
+	}
+	g.devices[device.NodeName] = device
+	return device
+}
+
+// createTestJoinRequest builds a join request for the test OTAA device with a valid MIC.
+func createTestJoinRequest(t *testing.T, devNonce uint16) []byte {
+	payload := []byte{0x00}
+	payload = append(payload, reverseByteArray(testJoinEUI)...)
+	payload = append(payload, reverseByteArray(testDevEUI)...)
+	payload = binary.LittleEndian.AppendUint16(payload, devNonce)
+
+	mic, err := crypto.ComputeJoinRequestMIC(types.AES128Key(testAppKey), payload)
+	test.That(t, err, test.ShouldBeNil)
+	return append(payload, mic[:]...)
+}
+
+// testSession holds the session the test device derives from the join accept.
+type testSession struct {
+	devAddr []byte
+	appSKey []byte
+	nwkSKey []byte
+}
+
+// acceptTestJoin decrypts the join accept the way the device would and derives the session keys.
+func acceptTestJoin(t *testing.T, joinAccept []byte, devNonce uint16) (testSession, []byte) {
+	test.That(t, joinAccept[0], test.ShouldEqual, 0x20)
+
+	dec, err := crypto.DecryptJoinAccept(types.AES128Key(testAppKey), joinAccept[1:])
+	test.That(t, err, test.ShouldBeNil)
+
+	mic, err := crypto.ComputeLegacyJoinAcceptMIC(types.AES128Key(testAppKey), append([]byte{0x20}, dec[:len(dec)-4]...))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, dec[len(dec)-4:], test.ShouldResemble, mic[:])
+
+	joinNonce := types.JoinNonce(reverseByteArray(dec[0:3]))
+	nID := types.NetID(reverseByteArray(dec[3:6]))
+	dn := types.DevNonce(reverseByteArray(binary.LittleEndian.AppendUint16(nil, devNonce)))
+
+	appSKey := crypto.DeriveLegacyAppSKey(types.AES128Key(testAppKey), joinNonce, nID, dn)
+	nwkSKey := crypto.DeriveLegacyNwkSKey(types.AES128Key(testAppKey), joinNonce, nID, dn)
+
+	return testSession{
+		devAddr: reverseByteArray(dec[6:10]),
+		appSKey: appSKey[:],
+		nwkSKey: nwkSKey[:],
+	}, dec[:len(dec)-4]
+}
+
+func TestJoinThenUplink(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := addTestOTAADevice(g)
+
+	jr, matched, err := g.parseJoinRequestPacket(createTestJoinRequest(t, 0x1234))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, matched.NodeName, test.ShouldEqual, "test-otaa-device")
+
+	joinAccept, err := generateJoinAccept(ctx, jr, matched, testJoinDevAddr, g.netID, g.region)
+	test.That(t, err, test.ShouldBeNil)
+
+	session, _ := acceptTestJoin(t, joinAccept, 0x1234)
+	test.That(t, session.devAddr, test.ShouldResemble, device.Addr)
+	test.That(t, session.appSKey, test.ShouldResemble, device.AppSKey)
+	test.That(t, session.nwkSKey, test.ShouldResemble, device.NwkSKey)
+
+	// the device sends its first uplink with the derived session.
+	uplink := createUplink(t, session.nwkSKey, session.appSKey, session.devAddr, 0, nil, 1, []byte{0x15, 0x05})
+	name, readings, err := g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, name, test.ShouldEqual, "test-otaa-device")
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+}
+
+func TestJoinDevAddrReadings(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	addTestOTAADevice(g)
+
+	// OTAA nodes have no dev addr until they join.
+	readings, err := g.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldNotContainKey, "test-otaa-device")
+	test.That(t, readings["test-device"], test.ShouldResemble, map[string]interface{}{"dev_addr": "01020304"})
+
+	jr, matched, err := g.parseJoinRequestPacket(createTestJoinRequest(t, 0x1234))
+	test.That(t, err, test.ShouldBeNil)
+	joinAccept, err := generateJoinAccept(ctx, jr, matched, testJoinDevAddr, g.netID, g.region)
+	test.That(t, err, test.ShouldBeNil)
+	session, _ := acceptTestJoin(t, joinAccept, 0x1234)
+
+	// the node gets the assigned dev addr from the readings.
+	readings, err = g.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["test-otaa-device"], test.ShouldResemble, map[string]interface{}{
+		"dev_addr": hex.EncodeToString(testJoinDevAddr),
+	})
+
+	// uplinks sent from the dev addr match the node.
+	uplink := createUplink(t, session.nwkSKey, session.appSKey, session.devAddr, 0, nil, 1, []byte{0x15, 0x05})
+	err = g.routePacket(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	readings, err = g.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	nodeReadings := readings["test-otaa-device"].(map[string]interface{})
+	test.That(t, nodeReadings["dev_addr"], test.ShouldEqual, hex.EncodeToString(testJoinDevAddr))
+	test.That(t, nodeReadings["temperature"], test.ShouldEqual, 21.5)
+}
+
+func TestJoinAcceptEncryption(t *testing.T) {
+	ctx := context.Background()
+
+	// the join accept is "encrypted" with an AES decrypt, so the ciphertext of the FIPS-197 AES-128 example
+	// encrypts to its plaintext.
+	key := types.AES128Key{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F}
+	ciphertext, err := hex.DecodeString("69c4e0d86a7b0430d8cdb78070b4c55a")
+	test.That(t, err, test.ShouldBeNil)
+	enc, err := crypto.EncryptJoinAccept(key, ciphertext)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, hex.EncodeToString(enc), test.ShouldEqual, "00112233445566778899aabbccddeeff")
+
+	g := createTestGateway(t)
+	addTestOTAADevice(g)
+	jr, matched, err := g.parseJoinRequestPacket(createTestJoinRequest(t, 0x1234))
+	test.That(t, err, test.ShouldBeNil)
+	joinAccept, err := generateJoinAccept(ctx, jr, matched, testJoinDevAddr, g.netID, g.region)
+	test.That(t, err, test.ShouldBeNil)
+	// the MHDR, 16 bytes of fields, the US915 CFList and the MIC.
+	test.That(t, len(joinAccept), test.ShouldEqual, 33)
+
+	// the device reads the join accept by AES encrypting each block with its AppKey.
+	block, err := aes.NewCipher(testAppKey)
+	test.That(t, err, test.ShouldBeNil)
+	dec := make([]byte, len(joinAccept)-1)
+	for i := 0; i < len(dec); i += aes.BlockSize {
+		block.Encrypt(dec[i:i+aes.BlockSize], joinAccept[1+i:1+i+aes.BlockSize])
+	}
+
+	// the fields are little endian.
+	test.That(t, dec[3:6], test.ShouldResemble, reverseByteArray(g.netID))
+	test.That(t, dec[6:10], test.ShouldResemble, reverseByteArray(testJoinDevAddr))
+	test.That(t, dec[10], test.ShouldEqual, 0x08)
+	test.That(t, dec[11], test.ShouldEqual, 1)
+	test.That(t, dec[12:28], test.ShouldResemble, g.region.cfList())
+	mic, err := crypto.ComputeLegacyJoinAcceptMIC(types.AES128Key(testAppKey), append([]byte{0x20}, dec[:28]...))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, dec[28:], test.ShouldResemble, mic[:])
+
+	// the join nonce derives the session keys the gateway uses.
+	session, _ := acceptTestJoin(t, joinAccept, 0x1234)
+	test.That(t, session.appSKey, test.ShouldResemble, matched.AppSKey)
+	test.That(t, session.nwkSKey, test.ShouldResemble, matched.NwkSKey)
+}
+
+func TestJoin11(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	nwkKey := []byte{
+		0x0F, 0x0E, 0x0D, 0x0C, 0x0B, 0x0A, 0x09, 0x08,
+		0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01, 0x00,
+	}
+	device := addTestOTAADevice(g)
+	device.LorawanVersion = "1.1.0"
+	device.NwkKey = nwkKey
+
+	// a join request signed with the AppKey is rejected, 1.1 devices use the NwkKey.
+	_, _, err := g.parseJoinRequestPacket(createTestJoinRequest(t, 1))
+	test.That(t, err, test.ShouldBeError, lorawan.ErrInvalidMIC)
+
+	payload := []byte{0x00}
+	payload = append(payload, reverseByteArray(testJoinEUI)...)
+	payload = append(payload, reverseByteArray(testDevEUI)...)
+	payload = binary.LittleEndian.AppendUint16(payload, 2)
+	mic, err := crypto.ComputeJoinRequestMIC(types.AES128Key(nwkKey), payload)
+	test.That(t, err, test.ShouldBeNil)
+
+	jr, matched, err := g.parseJoinRequestPacket(append(payload, mic[:]...))
+	test.That(t, err, test.ShouldBeNil)
+
+	joinAccept, err := generateJoinAccept(ctx, jr, matched, testJoinDevAddr, g.netID, g.region)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, device.JoinNonce, test.ShouldEqual, 1)
+
+	// the device decrypts the join accept with the NwkKey and checks the MIC with the JSIntKey.
+	dec, err := crypto.DecryptJoinAccept(types.AES128Key(nwkKey), joinAccept[1:])
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, dec[10]&0x80, test.ShouldEqual, 0x80) // OptNeg
+
+	joinEUI := types.EUI64(testJoinEUI)
+	dn := types.DevNonce{0x00, 0x02}
+	jsIntKey := crypto.DeriveJSIntKey(types.AES128Key(nwkKey), types.EUI64(testDevEUI))
+	expectedMIC, err := crypto.ComputeJoinAcceptMIC(jsIntKey, 0xFF, joinEUI, dn, append([]byte{0x20}, dec[:len(dec)-4]...))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, dec[len(dec)-4:], test.ShouldResemble, expectedMIC[:])
+
+	joinNonce := types.JoinNonce(reverseByteArray(dec[0:3]))
+	test.That(t, joinNonce, test.ShouldResemble, types.JoinNonce{0x00, 0x00, 0x01})
+
+	appSKey := crypto.DeriveAppSKey(types.AES128Key(testAppKey), joinNonce, joinEUI, dn)
+	fNwkSIntKey := crypto.DeriveFNwkSIntKey(types.AES128Key(nwkKey), joinNonce, joinEUI, dn)
+	sNwkSIntKey := crypto.DeriveSNwkSIntKey(types.AES128Key(nwkKey), joinNonce, joinEUI, dn)
+	nwkSEncKey := crypto.DeriveNwkSEncKey(types.AES128Key(nwkKey), joinNonce, joinEUI, dn)
+	test.That(t, device.AppSKey, test.ShouldResemble, appSKey[:])
+	test.That(t, device.FNwkSIntKey, test.ShouldResemble, fNwkSIntKey[:])
+	test.That(t, device.SNwkSIntKey, test.ShouldResemble, sNwkSIntKey[:])
+	test.That(t, device.NwkSEncKey, test.ShouldResemble, nwkSEncKey[:])
+}
+
+func TestJoinAcceptRXSettings(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := addTestOTAADevice(g)
+
+	// joinAcceptRX returns the DLSettings and RxDelay of the join accept for the join request.
+	joinAcceptRX := func(devNonce uint16) (byte, byte) {
+		jr, matched, err := g.parseJoinRequestPacket(createTestJoinRequest(t, devNonce))
+		test.That(t, err, test.ShouldBeNil)
+		joinAccept, err := generateJoinAccept(ctx, jr, matched, testJoinDevAddr, g.netID, g.region)
+		test.That(t, err, test.ShouldBeNil)
+		_, dec := acceptTestJoin(t, joinAccept, devNonce)
+		return dec[10], dec[11]
+	}
+
+	// the region defaults are used if the node doesn't set them, US915 has rx2 at DR8.
+	dlSettings, rxDelay := joinAcceptRX(1)
+	test.That(t, dlSettings, test.ShouldEqual, 0x08)
+	test.That(t, rxDelay, test.ShouldEqual, 1)
+
+	rx1DROffset, rx2DataRate, delay := uint8(2), uint8(10), uint8(3)
+	device.RX1DROffset = &rx1DROffset
+	device.RX2DataRate = &rx2DataRate
+	device.RXDelay = &delay
+	dlSettings, rxDelay = joinAcceptRX(2)
+	test.That(t, dlSettings, test.ShouldEqual, 0x2A)
+	test.That(t, rxDelay, test.ShouldEqual, 3)
+
+	g.region = regions["EU868"]
+	device.RX1DROffset = nil
+	device.RX2DataRate = nil
+	dlSettings, rxDelay = joinAcceptRX(3)
+	test.That(t, dlSettings, test.ShouldEqual, 0x00)
+	test.That(t, rxDelay, test.ShouldEqual, 3)
+}
+
+func TestRegisterDeviceRX2DataRate(t *testing.T) {
+	g := createTestGateway(t)
+	dr := uint8(5)
+	device := &node.Node{NodeName: "rx2", JoinType: "OTAA", DevEui: []byte{1, 2, 3, 4, 5, 6, 7, 8}, RX2DataRate: &dr}
+
+	// US915 has no DR5.
+	err := g.registerDevice(device)
+	test.That(t, errors.Is(err, errInvalidRX2DataRate), test.ShouldBeTrue)
+	dr = 12
+	err = g.registerDevice(device)
+	test.That(t, err, test.ShouldBeNil)
+}
+
+func TestRegisterDeviceRX2Frequency(t *testing.T) {
+	g := createTestGateway(t)
+	freq := uint32(869525000)
+	device := &node.Node{NodeName: "rx2", JoinType: "OTAA", DevEui: []byte{1, 2, 3, 4, 5, 6, 7, 8}, RX2Frequency: &freq}
+
+	// 869.525 MHz is outside of the US915 band.
+	err := g.registerDevice(device)
+	test.That(t, errors.Is(err, errInvalidRX2Frequency), test.ShouldBeTrue)
+	freq = 923900000
+	err = g.registerDevice(device)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, g.region.rx2Freq(g.devices["rx2"]), test.ShouldEqual, 923900000)
+	test.That(t, g.region.rx2Freq(g.devices["test-device"]), test.ShouldEqual, g.region.rx2Frequency)
+}
+
+func TestParseJoinRequestPacket(t *testing.T) {
+	g := createTestGateway(t)
+	addTestOTAADevice(g)
+
+	// wrong length
+	_, _, err := g.parseJoinRequestPacket(createTestJoinRequest(t, 1)[:20])
+	test.That(t, err, test.ShouldBeError, errInvalidJoinRequest)
+
+	// bad MIC
+	jr := createTestJoinRequest(t, 1)
+	jr[len(jr)-1] ^= 0xFF
+	_, _, err = g.parseJoinRequestPacket(jr)
+	test.That(t, err, test.ShouldBeError, lorawan.ErrInvalidMIC)
+
+	// unknown device
+	jr = createTestJoinRequest(t, 1)
+	jr[9] ^= 0xFF
+	_, _, err = g.parseJoinRequestPacket(jr)
+	test.That(t, err, test.ShouldBeError, errNoDevice)
+}
+
+func TestJoinDevNonceReuse(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	addTestOTAADevice(g)
+
+	joinRequest := createTestJoinRequest(t, 0xBEEF)
+	_, _, err := g.parseJoinRequestPacket(joinRequest)
+	test.That(t, err, test.ShouldBeNil)
+
+	// replaying the same join request is rejected.
+	_, _, err = g.parseJoinRequestPacket(joinRequest)
+	test.That(t, err, test.ShouldBeError, errDevNonceReused)
+
+	// a new dev nonce is accepted.
+	_, _, err = g.parseJoinRequestPacket(createTestJoinRequest(t, 0xBEF0))
+	test.That(t, err, test.ShouldBeNil)
+
+	// the used nonces are kept when the node is reconfigured.
+	_, err = g.DoCommand(ctx, map[string]interface{}{"register_device": map[string]interface{}{
+		"NodeName":    "test-otaa-device",
+		"JoinType":    "OTAA",
+		"DecoderPath": g.devices["test-device"].DecoderPath,
+		"AppKey":      toInterfaceBytes(testAppKey),
+		"DevEui":      toInterfaceBytes(testDevEUI),
+		"AppSKey":     []interface{}{},
+		"NwkSKey":     []interface{}{},
+		"Addr":        []interface{}{},
+	}})
+	test.That(t, err, test.ShouldBeNil)
+	_, _, err = g.parseJoinRequestPacket(joinRequest)
+	test.That(t, err, test.ShouldBeError, errDevNonceReused)
+}
+
+// toInterfaceBytes converts bytes into the form they are received in from the register_device docommand.
+func toInterfaceBytes(b []byte) []interface{} {
+	res := make([]interface{}, 0, len(b))
+	for _, v := range b {
+		res = append(res, float64(v))
+	}
+	return res
+}
+
+func TestNewDevAddr(t *testing.T) {
+	g := createTestGateway(t)
+
+	// the dev addr starts with the NetID type prefix and NwkID.
+	for _, tc := range []struct {
+		netID       []byte
+		nwkAddrBits int
+		prefix      uint32
+	}{
+		{defaultNetID, 25, 0x03},
+		{[]byte{0x60, 0x00, 0x2D}, 17, 0b1110<<11 | 0x2D},
+		{[]byte{0xC0, 0x00, 0x53}, 10, 0b1111110<<15 | 0x53},
+	} {
+		g.netID = tc.netID
+		for i := 0; i < 20; i++ {
+			devAddr, err := g.newDevAddr()
+			test.That(t, err, test.ShouldBeNil)
+			test.That(t, binary.BigEndian.Uint32(devAddr)>>tc.nwkAddrBits, test.ShouldEqual, tc.prefix)
+		}
+	}
+
+	// a type 7 NetID has 128 dev addrs, the last free one is found and then there are none left.
+	g.netID = []byte{0xE0, 0x00, 0x01}
+	for i := 0; i < 127; i++ {
+		addr := binary.BigEndian.AppendUint32(nil, 0xFE<<24|1<<7|uint32(i))
+		g.devices[fmt.Sprintf("node-%d", i)] = &node.Node{NodeName: fmt.Sprintf("node-%d", i), JoinType: "ABP", Addr: addr}
+	}
+	devAddr, err := g.newDevAddr()
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, devAddr, test.ShouldResemble, []byte{0xFE, 0x00, 0x00, 0xFF})
+	g.devices["node-127"] = &node.Node{NodeName: "node-127", JoinType: "ABP", Addr: devAddr}
+	_, err = g.newDevAddr()
+	test.That(t, err, test.ShouldBeError, errNoDevAddr)
+}
+
+func TestReverseByteArray(t *testing.T) {
+	test.That(t, reverseByteArray([]byte{}), test.ShouldResemble, []byte{})
+	test.That(t, reverseByteArray(nil), test.ShouldResemble, []byte{})
+	test.That(t, reverseByteArray([]byte{0x01}), test.ShouldResemble, []byte{0x01})
+	test.That(t, reverseByteArray([]byte{0x01, 0x02, 0x03, 0x04}), test.ShouldResemble, []byte{0x04, 0x03, 0x02, 0x01})
+	test.That(t, reverseByteArray([]byte{0x01, 0x02, 0x03}), test.ShouldResemble, []byte{0x03, 0x02, 0x01})
+
+	// the input is not modified and the result doesn't share its memory.
+	in := []byte{0x01, 0x02, 0x03, 0x04}
+	out := reverseByteArray(in)
+	test.That(t, in, test.ShouldResemble, []byte{0x01, 0x02, 0x03, 0x04})
+	out[0] = 0xFF
+	test.That(t, in, test.ShouldResemble, []byte{0x01, 0x02, 0x03, 0x04})
+}
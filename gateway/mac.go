@@ -0,0 +1,311 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"fmt"
+	"gateway/lorawan"
+	"gateway/node"
+	"math"
+	"time"
+)
+
+// lorawanMinor is the LoRaWAN minor version the gateway answers ResetInd and RekeyInd with, 1 for LoRaWAN 1.1.
+const lorawanMinor = 1
+
+// gpsEpoch is the start of GPS time, DeviceTimeAns sends the time since then.
+var gpsEpoch = time.Date(1980, time.January, 6, 0, 0, 0, 0, time.UTC)
+
+// gpsLeapSeconds is the number of leap seconds GPS time is ahead of UTC, as of 2017.
+const gpsLeapSeconds = 18
+
+// answerMACCommands queues the answers to the MAC commands sent by the device that need one.
+// rx is the radio metadata of the uplink the commands were sent in and key identifies it in the dedup cache.
+func (g *Gateway) answerMACCommands(device *node.Node, commands []lorawan.MACCommand, rx rxInfo, key uplinkKey) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, c := range commands {
+		// a command cut off at the end of the frame is only returned in the readings.
+		if !c.Complete() {
+			continue
+		}
+		switch c.CID {
+		case lorawan.CIDLinkCheck:
+			// the gateway count is set when the downlink is sent, once the other gateways forwarded the uplink.
+			dl := g.queueMACCommandLocked(device, linkCheckAns(rx, 1))
+			dl.linkChecks = append(dl.linkChecks, linkCheck{key: key, offset: len(dl.fOpts) - 1})
+		case lorawan.CIDDeviceTime:
+			// the answer should hold the time the uplink was sent, the uplink was just received so use now.
+			g.queueMACCommandLocked(device, deviceTimeAns(time.Now()))
+		case lorawan.CIDReset:
+			// an ABP device that restarted goes back to its default MAC settings, the frame counters are kept.
+			// It sends ResetInd in every uplink until it gets the ResetConf.
+			device.RXTimingDelay = nil
+			device.PendingRXTimingDelay = nil
+			device.MaxDutyCycle = nil
+			device.PendingMaxDutyCycle = nil
+			device.TxParams = nil
+			device.PendingTxParams = nil
+			g.saveSessionLocked(device)
+			g.queueMACCommandLocked(device, versionConf(lorawan.CIDReset, c.Payload[0]))
+		case lorawan.CIDRekey:
+			// an OTAA device sends RekeyInd in every uplink after it joins until it gets the RekeyConf.
+			g.queueMACCommandLocked(device, versionConf(lorawan.CIDRekey, c.Payload[0]))
+		case lorawan.CIDNewChannel:
+			if drOK, freqOK := lorawan.NewChannelAnsStatus(c.Payload[0]); !drOK || !freqOK {
+				g.logger.Warnf("node %s rejected NewChannelReq, data rate range ok: %t, channel frequency ok: %t", device.NodeName, drOK, freqOK)
+			}
+		case lorawan.CIDDutyCycle:
+			if device.PendingMaxDutyCycle != nil {
+				g.logger.Debugf("node %s changed its max duty cycle to 1/%d", device.NodeName, 1<<*device.PendingMaxDutyCycle)
+				device.MaxDutyCycle = device.PendingMaxDutyCycle
+				device.PendingMaxDutyCycle = nil
+			}
+		case lorawan.CIDTxParamSetup:
+			if device.PendingTxParams != nil {
+				g.logger.Debugf("node %s changed its max EIRP to %d dBm", device.NodeName, maxEIRPs[*device.PendingTxParams&0x0F])
+				device.TxParams = device.PendingTxParams
+				device.PendingTxParams = nil
+			}
+		case lorawan.CIDRXTimingSetup:
+			// the device uses the new delay from now on, so do the same for its downlinks.
+			if device.PendingRXTimingDelay != nil {
+				g.logger.Debugf("node %s changed its rx1 delay to %ds", device.NodeName, *device.PendingRXTimingDelay)
+				device.RXTimingDelay = device.PendingRXTimingDelay
+				device.PendingRXTimingDelay = nil
+				g.saveSessionLocked(device)
+			}
+		}
+	}
+}
+
+// setRXDelayCommand queues a RXTimingSetupReq changing the rx1 delay of the device from the set_rx_delay
+// docommand. The gateway keeps using the old delay until the device acknowledges the request.
+func (g *Gateway) setRXDelayCommand(cmd map[string]interface{}) error {
+	name, ok := cmd["device"].(string)
+	if !ok {
+		return errInvalidSetRXDelay
+	}
+	delay, ok := cmd["rx_delay_s"].(float64)
+	if !ok || delay < 1 || delay > 15 || delay != math.Trunc(delay) {
+		return errInvalidSetRXDelay
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	device, ok := g.devices[name]
+	if !ok {
+		return errNoDevice
+	}
+	if len(device.Addr) == 0 {
+		return errNotJoined
+	}
+	pending := uint8(delay)
+	device.PendingRXTimingDelay = &pending
+	g.queueMACCommandLocked(device, rxTimingSetupReq(pending))
+	return nil
+}
+
+// setDutyCycleCommand queues a DutyCycleReq limiting the aggregated duty cycle of the device from the
+// set_duty_cycle docommand. An exponent of 0 removes the limit beyond the regional duty cycle.
+func (g *Gateway) setDutyCycleCommand(cmd map[string]interface{}) error {
+	name, ok := cmd["device"].(string)
+	if !ok {
+		return errInvalidSetDutyCycle
+	}
+	exponent, ok := cmd["max_duty_cycle"].(float64)
+	if !ok || exponent < 0 || exponent > 15 || exponent != math.Trunc(exponent) {
+		return errInvalidSetDutyCycle
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	device, ok := g.devices[name]
+	if !ok {
+		return errNoDevice
+	}
+	if len(device.Addr) == 0 {
+		return errNotJoined
+	}
+	pending := uint8(exponent)
+	device.PendingMaxDutyCycle = &pending
+	g.queueMACCommandLocked(device, dutyCycleReq(pending))
+	return nil
+}
+
+// setTxParamsCommand queues a TxParamSetupReq setting the max EIRP and dwell times of the device from the
+// set_tx_params docommand. Only some regions implement the command, in the others devices ignore it.
+func (g *Gateway) setTxParamsCommand(cmd map[string]interface{}) error {
+	name, ok := cmd["device"].(string)
+	if !ok {
+		return errInvalidSetTxParams
+	}
+	index, ok := cmd["max_eirp_index"].(float64)
+	if !ok || index < 0 || index > 15 || index != math.Trunc(index) {
+		return errInvalidSetTxParams
+	}
+	var dwellTimes [2]bool
+	for i, key := range []string{"uplink_dwell_time", "downlink_dwell_time"} {
+		if v, ok := cmd[key]; ok {
+			if dwellTimes[i], ok = v.(bool); !ok {
+				return errInvalidSetTxParams
+			}
+		}
+	}
+
+	if g.region.maxEIRP == 0 {
+		return fmt.Errorf("%w: %s", errTxParamsRegion, g.region.name)
+	}
+	if eirp := maxEIRPs[uint8(index)]; eirp > g.region.maxEIRP {
+		return fmt.Errorf("%w: max EIRP %d dBm is above the %d dBm of %s", errInvalidSetTxParams, eirp, g.region.maxEIRP, g.region.name)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	device, ok := g.devices[name]
+	if !ok {
+		return errNoDevice
+	}
+	if len(device.Addr) == 0 {
+		return errNotJoined
+	}
+	req := txParamSetupReq(uint8(index), dwellTimes[0], dwellTimes[1])
+	pending := req[1]
+	device.PendingTxParams = &pending
+	g.queueMACCommandLocked(device, req)
+	return nil
+}
+
+// newChannelCommand queues a NewChannelReq adding or changing a channel of the device from the new_channel
+// docommand. A frequency of 0 disables the channel.
+func (g *Gateway) newChannelCommand(cmd map[string]interface{}) error {
+	name, ok := cmd["device"].(string)
+	if !ok {
+		return errInvalidNewChannel
+	}
+	var values [4]uint32
+	for i, key := range []string{"channel", "frequency", "min_dr", "max_dr"} {
+		v, ok := cmd[key].(float64)
+		if !ok || v < 0 || v > math.MaxUint32 || v != math.Trunc(v) {
+			return errInvalidNewChannel
+		}
+		values[i] = uint32(v)
+	}
+	channel, freq, minDR, maxDR := values[0], values[1], values[2], values[3]
+
+	// only regions with a frequency CFList let devices add channels, the others have a fixed channel plan.
+	if g.region.cfListType != cfListFrequencies {
+		return fmt.Errorf("%w: %s has a fixed channel plan", errNewChannelRegion, g.region.name)
+	}
+	if channel < uint32(g.region.defaultChannels) || channel > 15 {
+		return fmt.Errorf("%w: channel must be between %d and 15, the default channels can't be changed", errInvalidNewChannel, g.region.defaultChannels)
+	}
+	if freq != 0 && (freq < g.region.freqRange[0] || freq > g.region.freqRange[1] || freq%100 != 0) {
+		return fmt.Errorf("%w: frequency %d Hz is not a multiple of 100 Hz in the %s band", errInvalidNewChannel, freq, g.region.name)
+	}
+	_, minOK := g.region.dataRates[uint8(minDR)]
+	_, maxOK := g.region.dataRates[uint8(maxDR)]
+	if !minOK || !maxOK || minDR > maxDR || maxDR > uint32(g.region.maxUplinkDataRate) {
+		return fmt.Errorf("%w: DR%d to DR%d is not an uplink data rate range of %s", errInvalidNewChannel, minDR, maxDR, g.region.name)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	device, ok := g.devices[name]
+	if !ok {
+		return errNoDevice
+	}
+	if len(device.Addr) == 0 {
+		return errNotJoined
+	}
+	g.queueMACCommandLocked(device, newChannelReq(uint8(channel), freq, uint8(minDR), uint8(maxDR)))
+	return nil
+}
+
+// Structure of a NewChannelReq:
+// | CID | ChIndex | Freq | DrRange |
+// | 1 B |   1 B   | 3 B  |   1 B   |
+// newChannelReq builds a NewChannelReq defining the channel at freq in Hz for uplinks from minDR to maxDR.
+// The frequency is in 100 Hz steps, little endian, and the DrRange has the max DR in the high nibble.
+func newChannelReq(channel uint8, freq uint32, minDR, maxDR uint8) []byte {
+	step := freq / 100
+	return []byte{lorawan.CIDNewChannel, channel, byte(step), byte(step >> 8), byte(step >> 16), maxDR<<4 | minDR&0x0F}
+}
+
+// Structure of a DutyCycleReq:
+// | CID | DutyCyclePL |
+// | 1 B |     1 B     |
+// dutyCycleReq builds a DutyCycleReq limiting the device to transmit 1/2^exponent of the time on all channels.
+func dutyCycleReq(exponent uint8) []byte {
+	return []byte{lorawan.CIDDutyCycle, exponent & 0x0F}
+}
+
+// maxEIRPs are the max EIRP in dBm of each index of a TxParamSetupReq.
+var maxEIRPs = [16]int8{8, 10, 12, 13, 14, 16, 18, 20, 21, 24, 26, 27, 29, 30, 33, 36}
+
+// Structure of a TxParamSetupReq:
+// | CID | EIRP_DwellTime |
+// | 1 B |      1 B       |
+// txParamSetupReq builds a TxParamSetupReq with the max EIRP index in the low nibble, bit 4 limits the uplink
+// dwell time and bit 5 the downlink dwell time to 400 ms.
+func txParamSetupReq(maxEIRP uint8, uplinkDwellTime, downlinkDwellTime bool) []byte {
+	b := maxEIRP & 0x0F
+	if uplinkDwellTime {
+		b |= 0x10
+	}
+	if downlinkDwellTime {
+		b |= 0x20
+	}
+	return []byte{lorawan.CIDTxParamSetup, b}
+}
+
+// txParamsMap converts the EIRP_DwellTime byte of a TxParamSetupReq into a map for list_devices.
+func txParamsMap(b uint8) map[string]interface{} {
+	return map[string]interface{}{
+		"max_eirp_dbm":        int(maxEIRPs[b&0x0F]),
+		"uplink_dwell_time":   b&0x10 != 0,
+		"downlink_dwell_time": b&0x20 != 0,
+	}
+}
+
+// Structure of a RXTimingSetupReq:
+// | CID | RxTimingSettings |
+// | 1 B |       1 B        |
+// rxTimingSetupReq builds a RXTimingSetupReq setting the rx1 delay in seconds, rx2 opens a second after rx1.
+func rxTimingSetupReq(delay uint8) []byte {
+	return []byte{lorawan.CIDRXTimingSetup, delay & 0x0F}
+}
+
+// Structure of a LinkCheckAns:
+// | CID | MARGIN | GW CNT |
+// | 1 B |  1 B   |  1 B   |
+// linkCheckAns builds a LinkCheckAns with the link margin of the uplink, the dB its SNR is above the demodulation floor
+// of its spreading factor, and the number of gateways that received it.
+func linkCheckAns(rx rxInfo, gwCount int) []byte {
+	margin := math.Round(float64(rx.snr) - requiredSNR(rx.sf))
+	// the margin is 0-254, 255 is reserved.
+	margin = min(max(margin, 0), 254)
+	return []byte{lorawan.CIDLinkCheck, byte(margin), byte(min(max(gwCount, 1), 255))}
+}
+
+// Structure of a ResetConf and a RekeyConf:
+// | CID | SERV LORAWAN VERSION |
+// | 1 B |         1 B          |
+// versionConf builds the ResetConf or RekeyConf answering the ResetInd or RekeyInd with the device's version.
+// The minor version in the low nibble is the highest one both the device and the gateway support.
+func versionConf(cid, devVersion byte) []byte {
+	return []byte{cid, min(devVersion&0x0F, lorawanMinor)}
+}
+
+// Structure of a DeviceTimeAns:
+// | CID | GPS SECONDS | FRACTIONAL SECONDS |
+// | 1 B |     4 B     |        1 B         |
+// deviceTimeAns builds a DeviceTimeAns with the GPS time at now, the fraction is in 1/256 second steps.
+func deviceTimeAns(now time.Time) []byte {
+	gpsTime := now.Sub(gpsEpoch) + gpsLeapSeconds*time.Second
+	seconds := gpsTime / time.Second
+	fraction := (gpsTime % time.Second) * 256 / time.Second
+
+	cmd := []byte{lorawan.CIDDeviceTime}
+	cmd = binary.LittleEndian.AppendUint32(cmd, uint32(seconds))
+	return append(cmd, byte(fraction))
+}
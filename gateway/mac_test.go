@@ -0,0 +1,366 @@
+package gateway
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"gateway/lorawan"
+	"gateway/node"
+	"testing"
+	"time"
+
+	"go.viam.com/rdk/logging"
+	"go.viam.com/test"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestDeviceTimeAns(t *testing.T) {
+	// 2024-01-01 00:00:00.5 UTC is 1388102418.5 seconds of GPS time, including 18 leap seconds.
+	now := time.Date(2024, time.January, 1, 0, 0, 0, 500000000, time.UTC)
+	ans := deviceTimeAns(now)
+	test.That(t, len(ans), test.ShouldEqual, 6)
+	test.That(t, ans[0], test.ShouldEqual, lorawan.CIDDeviceTime)
+	test.That(t, binary.LittleEndian.Uint32(ans[1:5]), test.ShouldEqual, 1388102418)
+	test.That(t, ans[5], test.ShouldEqual, 128)
+}
+
+func TestDeviceTimeReq(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+
+	// a DeviceTimeReq in FOpts queues a DeviceTimeAns.
+	before := time.Now()
+	uplink := createTestUplinkWithFOpts(t, 1, []byte{lorawan.CIDDeviceTime}, 1, []byte{0x15, 0x05})
+	_, _, err := g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+
+	queue := g.downlinks["test-device"]
+	test.That(t, len(queue), test.ShouldEqual, 1)
+	test.That(t, len(queue[0].fOpts), test.ShouldEqual, 6)
+	test.That(t, queue[0].fOpts[0], test.ShouldEqual, lorawan.CIDDeviceTime)
+	gpsSeconds := binary.LittleEndian.Uint32(queue[0].fOpts[1:5])
+	test.That(t, gpsSeconds, test.ShouldBeGreaterThanOrEqualTo, binary.LittleEndian.Uint32(deviceTimeAns(before)[1:5]))
+	test.That(t, gpsSeconds, test.ShouldBeLessThanOrEqualTo, binary.LittleEndian.Uint32(deviceTimeAns(time.Now())[1:5]))
+}
+
+func TestLinkCheckReq(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+
+	// 2.5 dB SNR at SF7 is 10 dB above the -7.5 dB demodulation floor.
+	rx := testRxInfo
+	rx.snr = 2.5
+	uplink := createTestUplinkWithFOpts(t, 1, []byte{lorawan.CIDLinkCheck}, 1, []byte{0x15, 0x05})
+	_, _, err := g.parseDataUplink(ctx, uplink, rx)
+	test.That(t, err, test.ShouldBeNil)
+
+	queue := g.downlinks["test-device"]
+	test.That(t, len(queue), test.ShouldEqual, 1)
+	test.That(t, queue[0].fOpts, test.ShouldResemble, []byte{lorawan.CIDLinkCheck, 10, 1})
+
+	// the gateway count is the number of receptions of the uplink when the downlink is sent.
+	g, conn := startTestStation(t)
+	for i := 0; i < 2; i++ {
+		err = wsjson.Write(ctx, conn, toStationUplink(uplink))
+		test.That(t, err, test.ShouldBeNil)
+	}
+	frame, err := hex.DecodeString(readTestDownlink(t, conn).PDU)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, frame[5]&0x0F, test.ShouldEqual, 3)
+	test.That(t, frame[8], test.ShouldEqual, lorawan.CIDLinkCheck)
+	test.That(t, frame[10], test.ShouldEqual, 2)
+	test.That(t, g.dedup.receptions(newUplinkKey(uplink)), test.ShouldEqual, 2)
+
+	// the margin can't be negative.
+	rx.snr = -10
+	test.That(t, linkCheckAns(rx, 1), test.ShouldResemble, []byte{lorawan.CIDLinkCheck, 0, 1})
+}
+
+func TestResetAndRekeyInd(t *testing.T) {
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+	device.LorawanVersion = "1.1.0"
+	delay, exponent := uint8(5), uint8(3)
+	device.RXTimingDelay = &delay
+	device.MaxDutyCycle = &exponent
+
+	commands := lorawan.ParseMACCommands([]byte{lorawan.CIDReset, 0x01})
+	test.That(t, lorawan.MACCommandsToReadings(commands), test.ShouldResemble, []interface{}{
+		map[string]interface{}{"command": "ResetInd", "minor_version": 1},
+	})
+
+	// a ResetInd is confirmed and the device's MAC settings go back to their defaults.
+	g.answerMACCommands(device, commands, testRxInfo, uplinkKey{})
+	queue := g.downlinks["test-device"]
+	test.That(t, len(queue), test.ShouldEqual, 1)
+	test.That(t, queue[0].fOpts, test.ShouldResemble, []byte{lorawan.CIDReset, 0x01})
+	test.That(t, device.RXTimingDelay, test.ShouldBeNil)
+	test.That(t, device.MaxDutyCycle, test.ShouldBeNil)
+
+	// the RekeyConf has the highest version both support.
+	g.downlinks = nil
+	g.answerMACCommands(device, lorawan.ParseMACCommands([]byte{lorawan.CIDRekey, 0x02}), testRxInfo, uplinkKey{})
+	test.That(t, g.downlinks["test-device"][0].fOpts, test.ShouldResemble, []byte{lorawan.CIDRekey, 0x01})
+}
+
+func TestSetRXDelay(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+
+	for _, cmd := range []interface{}{
+		"test-device",
+		map[string]interface{}{"rx_delay_s": 3.0},
+		map[string]interface{}{"device": "test-device", "rx_delay_s": 0.0},
+		map[string]interface{}{"device": "test-device", "rx_delay_s": 16.0},
+		map[string]interface{}{"device": "test-device", "rx_delay_s": 2.5},
+	} {
+		_, err := g.DoCommand(ctx, map[string]interface{}{"set_rx_delay": cmd})
+		test.That(t, err, test.ShouldBeError, errInvalidSetRXDelay)
+	}
+	_, err := g.DoCommand(ctx, map[string]interface{}{"set_rx_delay": map[string]interface{}{"device": "unknown", "rx_delay_s": 3.0}})
+	test.That(t, err, test.ShouldBeError, errNoDevice)
+	addTestOTAADevice(g)
+	_, err = g.DoCommand(ctx, map[string]interface{}{"set_rx_delay": map[string]interface{}{"device": "test-otaa-device", "rx_delay_s": 3.0}})
+	test.That(t, err, test.ShouldBeError, errNotJoined)
+
+	// the request is queued and the old delay is used until the device acknowledges it.
+	resp, err := g.DoCommand(ctx, map[string]interface{}{"set_rx_delay": map[string]interface{}{"device": "test-device", "rx_delay_s": 3.0}})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, resp, test.ShouldResemble, map[string]interface{}{"set_rx_delay": "queued"})
+	queue := g.downlinks["test-device"]
+	test.That(t, len(queue), test.ShouldEqual, 1)
+	test.That(t, queue[0].fOpts, test.ShouldResemble, []byte{lorawan.CIDRXTimingSetup, 0x03})
+	test.That(t, *device.PendingRXTimingDelay, test.ShouldEqual, 3)
+	test.That(t, g.region.rxSettings(device).rx1Delay, test.ShouldEqual, time.Second)
+	test.That(t, g.listDevices()[0].(map[string]interface{})["pending_rx_delay_s"], test.ShouldEqual, 3)
+
+	// an uplink without the answer keeps the request pending.
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 1, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, device.PendingRXTimingDelay, test.ShouldNotBeNil)
+
+	// the RXTimingSetupAns clears the request and the new delay is used.
+	_, _, err = g.parseDataUplink(ctx, createTestUplinkWithFOpts(t, 2, []byte{lorawan.CIDRXTimingSetup}, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, device.PendingRXTimingDelay, test.ShouldBeNil)
+	test.That(t, *device.RXTimingDelay, test.ShouldEqual, 3)
+	test.That(t, g.region.rxSettings(device).rx1Delay, test.ShouldEqual, 3*time.Second)
+	test.That(t, g.listDevices()[0].(map[string]interface{}), test.ShouldNotContainKey, "pending_rx_delay_s")
+
+	// the delay is kept when the node registers again.
+	err = g.AddDevice(&node.Node{
+		NodeName:    device.NodeName,
+		JoinType:    "ABP",
+		DecoderPath: device.DecoderPath,
+		Addr:        testDevAddr,
+		AppSKey:     testAppSKey,
+		NwkSKey:     testNwkSKey,
+	})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, *g.devices["test-device"].RXTimingDelay, test.ShouldEqual, 3)
+}
+
+func TestDutyCycleReq(t *testing.T) {
+	test.That(t, dutyCycleReq(0), test.ShouldResemble, []byte{lorawan.CIDDutyCycle, 0x00})
+	test.That(t, dutyCycleReq(7), test.ShouldResemble, []byte{lorawan.CIDDutyCycle, 0x07})
+	test.That(t, dutyCycleReq(15), test.ShouldResemble, []byte{lorawan.CIDDutyCycle, 0x0F})
+}
+
+func TestSetDutyCycle(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+
+	for _, cmd := range []interface{}{
+		"test-device",
+		map[string]interface{}{"max_duty_cycle": 3.0},
+		map[string]interface{}{"device": "test-device"},
+		map[string]interface{}{"device": "test-device", "max_duty_cycle": -1.0},
+		map[string]interface{}{"device": "test-device", "max_duty_cycle": 16.0},
+		map[string]interface{}{"device": "test-device", "max_duty_cycle": 1.5},
+	} {
+		_, err := g.DoCommand(ctx, map[string]interface{}{"set_duty_cycle": cmd})
+		test.That(t, err, test.ShouldBeError, errInvalidSetDutyCycle)
+	}
+	_, err := g.DoCommand(ctx, map[string]interface{}{"set_duty_cycle": map[string]interface{}{"device": "unknown", "max_duty_cycle": 3.0}})
+	test.That(t, err, test.ShouldBeError, errNoDevice)
+	addTestOTAADevice(g)
+	_, err = g.DoCommand(ctx, map[string]interface{}{"set_duty_cycle": map[string]interface{}{"device": "test-otaa-device", "max_duty_cycle": 3.0}})
+	test.That(t, err, test.ShouldBeError, errNotJoined)
+
+	resp, err := g.DoCommand(ctx, map[string]interface{}{"set_duty_cycle": map[string]interface{}{"device": "test-device", "max_duty_cycle": 4.0}})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, resp, test.ShouldResemble, map[string]interface{}{"set_duty_cycle": "queued"})
+	queue := g.downlinks["test-device"]
+	test.That(t, len(queue), test.ShouldEqual, 1)
+	test.That(t, queue[0].fOpts, test.ShouldResemble, []byte{lorawan.CIDDutyCycle, 0x04})
+	test.That(t, *device.PendingMaxDutyCycle, test.ShouldEqual, 4)
+	test.That(t, device.MaxDutyCycle, test.ShouldBeNil)
+
+	// an uplink without the answer keeps the request pending.
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 1, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, device.PendingMaxDutyCycle, test.ShouldNotBeNil)
+
+	// the DutyCycleAns acknowledges the new limit.
+	_, readings, err := g.parseDataUplink(ctx, createTestUplinkWithFOpts(t, 2, []byte{lorawan.CIDDutyCycle}, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["mac_commands"], test.ShouldResemble, []interface{}{map[string]interface{}{"command": "DutyCycleAns"}})
+	test.That(t, device.PendingMaxDutyCycle, test.ShouldBeNil)
+	test.That(t, *device.MaxDutyCycle, test.ShouldEqual, 4)
+	var listed map[string]interface{}
+	for _, d := range g.listDevices() {
+		if d.(map[string]interface{})["name"] == "test-device" {
+			listed = d.(map[string]interface{})
+		}
+	}
+	test.That(t, listed["max_duty_cycle"], test.ShouldEqual, 4)
+	test.That(t, listed, test.ShouldNotContainKey, "pending_max_duty_cycle")
+}
+
+func TestTxParamSetupReq(t *testing.T) {
+	test.That(t, txParamSetupReq(13, false, false), test.ShouldResemble, []byte{lorawan.CIDTxParamSetup, 0x0D})
+	test.That(t, txParamSetupReq(5, true, false), test.ShouldResemble, []byte{lorawan.CIDTxParamSetup, 0x15})
+	test.That(t, txParamSetupReq(0, false, true), test.ShouldResemble, []byte{lorawan.CIDTxParamSetup, 0x20})
+	test.That(t, txParamSetupReq(15, true, true), test.ShouldResemble, []byte{lorawan.CIDTxParamSetup, 0x3F})
+
+	test.That(t, txParamsMap(0x1D), test.ShouldResemble, map[string]interface{}{
+		"max_eirp_dbm":        30,
+		"uplink_dwell_time":   true,
+		"downlink_dwell_time": false,
+	})
+}
+
+func TestSetTxParams(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+
+	// US915 doesn't implement TxParamSetupReq.
+	_, err := g.DoCommand(ctx, map[string]interface{}{"set_tx_params": map[string]interface{}{"device": "test-device", "max_eirp_index": 5.0}})
+	test.That(t, errors.Is(err, errTxParamsRegion), test.ShouldBeTrue)
+
+	g.region = regions["AU915"]
+	for _, cmd := range []interface{}{
+		"test-device",
+		map[string]interface{}{"max_eirp_index": 5.0},
+		map[string]interface{}{"device": "test-device"},
+		map[string]interface{}{"device": "test-device", "max_eirp_index": -1.0},
+		map[string]interface{}{"device": "test-device", "max_eirp_index": 16.0},
+		map[string]interface{}{"device": "test-device", "max_eirp_index": 1.5},
+		map[string]interface{}{"device": "test-device", "max_eirp_index": 5.0, "uplink_dwell_time": "yes"},
+	} {
+		_, err := g.DoCommand(ctx, map[string]interface{}{"set_tx_params": cmd})
+		test.That(t, err, test.ShouldBeError, errInvalidSetTxParams)
+	}
+	// 33 dBm is above the max EIRP of AU915.
+	_, err = g.DoCommand(ctx, map[string]interface{}{"set_tx_params": map[string]interface{}{"device": "test-device", "max_eirp_index": 14.0}})
+	test.That(t, errors.Is(err, errInvalidSetTxParams), test.ShouldBeTrue)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "33 dBm")
+	_, err = g.DoCommand(ctx, map[string]interface{}{"set_tx_params": map[string]interface{}{"device": "unknown", "max_eirp_index": 5.0}})
+	test.That(t, err, test.ShouldBeError, errNoDevice)
+	addTestOTAADevice(g)
+	_, err = g.DoCommand(ctx, map[string]interface{}{"set_tx_params": map[string]interface{}{"device": "test-otaa-device", "max_eirp_index": 5.0}})
+	test.That(t, err, test.ShouldBeError, errNotJoined)
+
+	resp, err := g.DoCommand(ctx, map[string]interface{}{"set_tx_params": map[string]interface{}{
+		"device": "test-device", "max_eirp_index": 13.0, "uplink_dwell_time": true,
+	}})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, resp, test.ShouldResemble, map[string]interface{}{"set_tx_params": "queued"})
+	queue := g.downlinks["test-device"]
+	test.That(t, len(queue), test.ShouldEqual, 1)
+	test.That(t, queue[0].fOpts, test.ShouldResemble, []byte{lorawan.CIDTxParamSetup, 0x1D})
+	test.That(t, *device.PendingTxParams, test.ShouldEqual, 0x1D)
+	test.That(t, device.TxParams, test.ShouldBeNil)
+
+	// an uplink without the answer keeps the request pending.
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 1, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, device.PendingTxParams, test.ShouldNotBeNil)
+
+	// the TxParamSetupAns acknowledges the new parameters.
+	_, readings, err := g.parseDataUplink(ctx, createTestUplinkWithFOpts(t, 2, []byte{lorawan.CIDTxParamSetup}, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["mac_commands"], test.ShouldResemble, []interface{}{map[string]interface{}{"command": "TxParamSetupAns"}})
+	test.That(t, device.PendingTxParams, test.ShouldBeNil)
+	test.That(t, *device.TxParams, test.ShouldEqual, 0x1D)
+	var listed map[string]interface{}
+	for _, d := range g.listDevices() {
+		if d.(map[string]interface{})["name"] == "test-device" {
+			listed = d.(map[string]interface{})
+		}
+	}
+	test.That(t, listed["tx_params"], test.ShouldResemble, map[string]interface{}{
+		"max_eirp_dbm":        30,
+		"uplink_dwell_time":   true,
+		"downlink_dwell_time": false,
+	})
+	test.That(t, listed, test.ShouldNotContainKey, "pending_tx_params")
+}
+
+func TestNewChannelReq(t *testing.T) {
+	// 867.1 MHz is 8671000 steps of 100 Hz.
+	test.That(t, newChannelReq(3, 867100000, 0, 5), test.ShouldResemble, []byte{lorawan.CIDNewChannel, 3, 0x18, 0x4F, 0x84, 0x50})
+	// a frequency of 0 disables the channel.
+	test.That(t, newChannelReq(8, 0, 0, 0), test.ShouldResemble, []byte{lorawan.CIDNewChannel, 8, 0, 0, 0, 0})
+
+	for status, expected := range map[byte][2]bool{0x00: {false, false}, 0x01: {false, true}, 0x02: {true, false}, 0x03: {true, true}} {
+		drOK, freqOK := lorawan.NewChannelAnsStatus(status)
+		test.That(t, [2]bool{drOK, freqOK}, test.ShouldResemble, expected)
+	}
+	commands := lorawan.ParseMACCommands([]byte{lorawan.CIDNewChannel, 0x02})
+	test.That(t, lorawan.MACCommandsToReadings(commands)[0], test.ShouldResemble, map[string]interface{}{
+		"command":              "NewChannelAns",
+		"data_rate_range_ok":   true,
+		"channel_frequency_ok": false,
+	})
+}
+
+func TestNewChannelCommand(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	newChannel := func(channel, freq, minDR, maxDR float64) map[string]interface{} {
+		return map[string]interface{}{"new_channel": map[string]interface{}{
+			"device": "test-device", "channel": channel, "frequency": freq, "min_dr": minDR, "max_dr": maxDR,
+		}}
+	}
+
+	// US915 has a fixed channel plan.
+	_, err := g.DoCommand(ctx, newChannel(8, 903900000, 0, 3))
+	test.That(t, errors.Is(err, errNewChannelRegion), test.ShouldBeTrue)
+
+	g.region = regions["EU868"]
+	for _, cmd := range []map[string]interface{}{
+		{"new_channel": "test-device"},
+		{"new_channel": map[string]interface{}{"device": "test-device", "channel": 3.0}},
+		newChannel(1, 867100000, 0, 5),
+		newChannel(16, 867100000, 0, 5),
+		newChannel(3, 902300000, 0, 5),
+		newChannel(3, 867100050, 0, 5),
+		newChannel(3, 867100000, 5, 0),
+		newChannel(3, 867100000, 0, 8),
+	} {
+		_, err = g.DoCommand(ctx, cmd)
+		test.That(t, errors.Is(err, errInvalidNewChannel), test.ShouldBeTrue)
+	}
+	test.That(t, g.downlinks["test-device"], test.ShouldBeEmpty)
+
+	resp, err := g.DoCommand(ctx, newChannel(3, 867100000, 0, 5))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, resp, test.ShouldResemble, map[string]interface{}{"new_channel": "queued"})
+	_, err = g.DoCommand(ctx, newChannel(4, 0, 0, 0))
+	test.That(t, err, test.ShouldBeNil)
+	queue := g.downlinks["test-device"]
+	test.That(t, len(queue), test.ShouldEqual, 1)
+	test.That(t, queue[0].fOpts, test.ShouldResemble, append(newChannelReq(3, 867100000, 0, 5), newChannelReq(4, 0, 0, 0)...))
+
+	// a rejected channel is logged.
+	logger, logs := logging.NewObservedTestLogger(t)
+	g.logger = logger
+	_, _, err = g.parseDataUplink(ctx, createTestUplinkWithFOpts(t, 1, []byte{lorawan.CIDNewChannel, 0x02}, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, logs.FilterMessageSnippet("rejected NewChannelReq").Len(), test.ShouldEqual, 1)
+}
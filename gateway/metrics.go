@@ -0,0 +1,52 @@
+package gateway
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Uplink counters exported through the default Prometheus registry.
+// Only counters of uplinks matched to a registered device are labeled by device name, the
+// others can come from any device in range and would have unbounded label values.
+var (
+	uplinksReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "lorawan",
+		Name:      "uplinks_received_total",
+		Help:      "Data uplinks received by the gateway.",
+	})
+	uplinksInvalidMIC = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "lorawan",
+		Name:      "uplinks_invalid_mic_total",
+		Help:      "Data uplinks dropped because the MIC did not match the device's session keys.",
+	}, []string{"device"})
+	uplinksDecodeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "lorawan",
+		Name:      "uplinks_decode_failures_total",
+		Help:      "Data uplinks the device's decoder failed to decode.",
+	}, []string{"device"})
+	uplinksUnknownDevice = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "lorawan",
+		Name:      "uplinks_unknown_device_total",
+		Help:      "Data uplinks dropped because no registered device has the dev addr.",
+	})
+	uplinksDuplicate = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "lorawan",
+		Name:      "uplinks_duplicate_total",
+		Help:      "Data uplinks dropped because they were already received.",
+	})
+	uplinksFiltered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "lorawan",
+		Name:      "uplinks_filtered_total",
+		Help:      "Data uplinks dropped because their fPort is filtered by the device's port allowlist or denylist.",
+	}, []string{"device"})
+)
+
+func init() {
+	prometheus.MustRegister(uplinksReceived, uplinksInvalidMIC, uplinksDecodeFailures, uplinksUnknownDevice, uplinksDuplicate, uplinksFiltered)
+}
+
+// deleteDeviceMetrics removes the counters labeled with the device name when the device is removed.
+func deleteDeviceMetrics(name string) {
+	uplinksInvalidMIC.DeleteLabelValues(name)
+	uplinksDecodeFailures.DeleteLabelValues(name)
+	uplinksFiltered.DeleteLabelValues(name)
+}
@@ -0,0 +1,53 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"gateway/lorawan"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.viam.com/test"
+)
+
+func TestUplinkMetrics(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+
+	// the counters are shared by every gateway, compare against the values before the test.
+	received := testutil.ToFloat64(uplinksReceived)
+	duplicate := testutil.ToFloat64(uplinksDuplicate)
+	unknown := testutil.ToFloat64(uplinksUnknownDevice)
+	invalidMIC := testutil.ToFloat64(uplinksInvalidMIC.WithLabelValues("test-device"))
+	decodeFailures := testutil.ToFloat64(uplinksDecodeFailures.WithLabelValues("test-device"))
+
+	uplink := createTestUplink(t, 1, 1, []byte{0x15, 0x05})
+	_, _, err := g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	_, _, err = g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, errors.Is(err, errDuplicateUplink), test.ShouldBeTrue)
+
+	uplink = createTestUplink(t, 2, 1, []byte{0x15, 0x05})
+	uplink[len(uplink)-1] ^= 0xFF
+	_, _, err = g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrInvalidMIC), test.ShouldBeTrue)
+
+	uplink = createUplink(t, testNwkSKey, testAppSKey, []byte{0x0A, 0x0B, 0x0C, 0x0D}, 1, nil, 1, []byte{0x15, 0x05})
+	_, _, err = g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, errors.Is(err, errNoDevice), test.ShouldBeTrue)
+
+	g.devices["test-device"].DecoderPath = writeTestDecoder(t, `function Decode(fPort, bytes) { throw new Error("bad payload"); }`)
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 3, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldNotBeNil)
+
+	test.That(t, testutil.ToFloat64(uplinksReceived)-received, test.ShouldEqual, 5)
+	test.That(t, testutil.ToFloat64(uplinksDuplicate)-duplicate, test.ShouldEqual, 1)
+	test.That(t, testutil.ToFloat64(uplinksUnknownDevice)-unknown, test.ShouldEqual, 1)
+	test.That(t, testutil.ToFloat64(uplinksInvalidMIC.WithLabelValues("test-device"))-invalidMIC, test.ShouldEqual, 1)
+	test.That(t, testutil.ToFloat64(uplinksDecodeFailures.WithLabelValues("test-device"))-decodeFailures, test.ShouldEqual, 1)
+
+	// removing the device removes its labeled counters.
+	g.RemoveDevice("test-device")
+	test.That(t, uplinksInvalidMIC.DeleteLabelValues("test-device"), test.ShouldBeFalse)
+	test.That(t, uplinksDecodeFailures.DeleteLabelValues("test-device"), test.ShouldBeFalse)
+}
@@ -0,0 +1,314 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.viam.com/rdk/logging"
+)
+
+// MQTT 3.1.1 control packet types, in the high nibble of the fixed header.
+// https://docs.oasis-open.org/mqtt/mqtt/v3.1.1/os/mqtt-v3.1.1-os.html section 2.2.1.
+const (
+	mqttConnect    = 0x10
+	mqttConnAck    = 0x20
+	mqttPublish    = 0x30
+	mqttPingReq    = 0xC0
+	mqttDisconnect = 0xE0
+)
+
+const (
+	// defaultMQTTTopic is the topic uplinks are published to if the topic is not set, {device} is the node name.
+	defaultMQTTTopic = "lorawan/{device}/up"
+	// mqttQueueSize is how many uplinks wait to be published while the broker is slow or unreachable,
+	// newer uplinks are dropped when it is full.
+	mqttQueueSize = 256
+	// mqttKeepAlive is the keep alive sent in the CONNECT, pings are sent at half of it.
+	mqttKeepAlive = 60 * time.Second
+	// mqttTimeout bounds connecting to the broker and each write to it.
+	mqttTimeout = 10 * time.Second
+	// the reconnect backoff doubles after each failed attempt.
+	mqttInitialBackoff = time.Second
+	mqttMaxBackoff     = time.Minute
+)
+
+// mqttConfig is the broker decoded uplinks are published to.
+type mqttConfig struct {
+	// URL is the broker, such as mqtt://broker:1883 or mqtts://broker:8883 for TLS.
+	URL      string `json:"url"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Topic is the topic of each uplink, {device} is replaced with the node name.
+	Topic string `json:"topic,omitempty"`
+	// ClientID identifies the gateway to the broker, it defaults to viam-lorawan- and the gateway name.
+	ClientID string `json:"client_id,omitempty"`
+}
+
+// brokerAddr returns the host:port of the broker and whether it uses TLS.
+func (c *mqttConfig) brokerAddr() (string, bool, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Hostname() == "" {
+		return "", false, errInvalidMQTT
+	}
+	var useTLS bool
+	port := "1883"
+	switch u.Scheme {
+	case "mqtt", "tcp":
+	case "mqtts", "ssl", "tls":
+		useTLS = true
+		port = "8883"
+	default:
+		return "", false, errInvalidMQTT
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return net.JoinHostPort(u.Hostname(), port), useTLS, nil
+}
+
+// validate checks the broker URL and that the topic has no wildcards, which can't be published to.
+func (c *mqttConfig) validate() error {
+	if _, _, err := c.brokerAddr(); err != nil {
+		return err
+	}
+	if strings.ContainsAny(c.Topic, "+#") {
+		return errInvalidMQTTTopic
+	}
+	if c.Password != "" && c.Username == "" {
+		return errMQTTPassword
+	}
+	return nil
+}
+
+// mqttMessage is a decoded uplink waiting to be published.
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// mqttPublisher publishes decoded uplinks to an MQTT broker as QoS 0 messages. Uplinks are queued so a slow or
+// unreachable broker doesn't block uplink processing, and the publisher reconnects when the connection drops.
+type mqttPublisher struct {
+	logger   logging.Logger
+	addr     string
+	useTLS   bool
+	username string
+	password string
+	clientID string
+	topic    string
+	queue    chan mqttMessage
+}
+
+// newMQTTPublisher returns the publisher for the broker config, it connects once run is started.
+func newMQTTPublisher(cfg mqttConfig, gatewayName string, logger logging.Logger) (*mqttPublisher, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	addr, useTLS, _ := cfg.brokerAddr()
+	p := &mqttPublisher{
+		logger:   logger,
+		addr:     addr,
+		useTLS:   useTLS,
+		username: cfg.Username,
+		password: cfg.Password,
+		clientID: cfg.ClientID,
+		topic:    cfg.Topic,
+		queue:    make(chan mqttMessage, mqttQueueSize),
+	}
+	if p.clientID == "" {
+		p.clientID = "viam-lorawan-" + gatewayName
+	}
+	if p.topic == "" {
+		p.topic = defaultMQTTTopic
+	}
+	return p, nil
+}
+
+// publish queues the decoded uplink of the device as JSON, it never blocks. A nil publisher does nothing.
+// The readings are encoded right away so they can change after it returns.
+func (p *mqttPublisher) publish(device string, readings map[string]interface{}) {
+	if p == nil {
+		return
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"device":   device,
+		"received": time.Now().UTC().Format(time.RFC3339Nano),
+		"readings": readings,
+	})
+	if err != nil {
+		p.logger.Warnf("failed to encode the uplink of %s for mqtt: %s", device, err)
+		return
+	}
+	select {
+	case p.queue <- mqttMessage{topic: strings.ReplaceAll(p.topic, "{device}", device), payload: payload}:
+	default:
+		p.logger.Warnf("mqtt queue is full, dropping the uplink of %s", device)
+	}
+}
+
+// run publishes the queued uplinks until ctx is done, reconnecting to the broker with a backoff.
+func (p *mqttPublisher) run(ctx context.Context) {
+	backoff := mqttInitialBackoff
+	for {
+		connected, err := p.publishSession(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = mqttInitialBackoff
+		}
+		p.logger.Warnf("mqtt connection to %s failed, reconnecting in %s: %s", p.addr, backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if !connected {
+			backoff = min(backoff*2, mqttMaxBackoff)
+		}
+	}
+}
+
+// publishSession connects to the broker and publishes queued uplinks until the connection fails or ctx is done.
+// It returns whether the broker accepted the connection.
+func (p *mqttPublisher) publishSession(ctx context.Context) (bool, error) {
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if err := p.connect(conn); err != nil {
+		return false, err
+	}
+	p.logger.Infof("connected to mqtt broker %s", p.addr)
+
+	// the broker only sends ping responses, reading them notices when the connection drops.
+	readErr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			if err := conn.SetReadDeadline(time.Now().Add(mqttKeepAlive)); err != nil {
+				readErr <- err
+				return
+			}
+			if _, err := conn.Read(buf); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return true, p.write(conn, mqttPacket(mqttDisconnect, nil))
+		case err = <-readErr:
+			return true, err
+		case msg := <-p.queue:
+			err = p.write(conn, mqttPacket(mqttPublish, append(mqttString(msg.topic), msg.payload...)))
+		case <-ping.C:
+			err = p.write(conn, mqttPacket(mqttPingReq, nil))
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+}
+
+func (p *mqttPublisher) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: mqttTimeout}
+	if !p.useTLS {
+		return dialer.DialContext(ctx, "tcp", p.addr)
+	}
+	host, _, _ := net.SplitHostPort(p.addr)
+	tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}}
+	return tlsDialer.DialContext(ctx, "tcp", p.addr)
+}
+
+// Structure of the variable header of a CONNECT:
+// | PROTOCOL NAME | LEVEL | FLAGS | KEEP ALIVE |
+// |      6 B      |  1 B  |  1 B  |    2 B     |
+// The payload has the client id, then the username and password if their flags are set.
+// connect sends the CONNECT with a clean session and waits for the broker to accept it.
+func (p *mqttPublisher) connect(conn net.Conn) error {
+	body := append(mqttString("MQTT"), 0x04)
+	flags := byte(0x02)
+	if p.username != "" {
+		flags |= 0x80
+	}
+	if p.password != "" {
+		flags |= 0x40
+	}
+	body = append(body, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive/time.Second))
+	body = append(body, mqttString(p.clientID)...)
+	if p.username != "" {
+		body = append(body, mqttString(p.username)...)
+	}
+	if p.password != "" {
+		body = append(body, mqttString(p.password)...)
+	}
+	if err := p.write(conn, mqttPacket(mqttConnect, body)); err != nil {
+		return err
+	}
+
+	// CONNACK: | TYPE | LENGTH | FLAGS | RETURN CODE |
+	connAck := make([]byte, 4)
+	if err := conn.SetReadDeadline(time.Now().Add(mqttTimeout)); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, connAck); err != nil {
+		return fmt.Errorf("failed to read CONNACK: %w", err)
+	}
+	if connAck[0] != mqttConnAck || connAck[1] != 2 {
+		return errors.New("mqtt broker didn't answer with a CONNACK")
+	}
+	if connAck[3] != 0 {
+		return fmt.Errorf("%w: return code %d", errMQTTRefused, connAck[3])
+	}
+	return nil
+}
+
+func (p *mqttPublisher) write(conn net.Conn, packet []byte) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(mqttTimeout)); err != nil {
+		return err
+	}
+	_, err := conn.Write(packet)
+	return err
+}
+
+// mqttPacket returns the control packet with its fixed header, the remaining length is encoded in
+// 7 bit groups with the high bit set if more follow.
+func mqttPacket(packetType byte, body []byte) []byte {
+	packet := []byte{packetType}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// mqttString returns the string prefixed with its 2 byte big endian length.
+func mqttString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
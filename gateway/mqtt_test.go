@@ -0,0 +1,233 @@
+package gateway
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go.viam.com/test"
+	"go.viam.com/utils"
+)
+
+// testBrokerPacket is a control packet received by the test broker.
+type testBrokerPacket struct {
+	packetType byte
+	body       []byte
+}
+
+// readTestMQTTPacket reads a control packet with its variable length fixed header.
+func readTestMQTTPacket(r io.Reader) (testBrokerPacket, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return testBrokerPacket{}, err
+	}
+	packetType := b[0]
+	length, multiplier := 0, 1
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return testBrokerPacket{}, err
+		}
+		length += int(b[0]&0x7F) * multiplier
+		multiplier *= 128
+		if b[0]&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return testBrokerPacket{}, err
+	}
+	return testBrokerPacket{packetType: packetType, body: body}, nil
+}
+
+// startTestBroker accepts MQTT connections, answers each CONNECT with a CONNACK and sends the
+// CONNECTs and PUBLISHes it receives on the returned channels.
+func startTestBroker(t *testing.T) (net.Listener, chan testBrokerPacket, chan testBrokerPacket, chan net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	test.That(t, err, test.ShouldBeNil)
+	t.Cleanup(func() { ln.Close() })
+
+	connects := make(chan testBrokerPacket, 10)
+	publishes := make(chan testBrokerPacket, 100)
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go func() {
+				defer conn.Close()
+				for {
+					packet, err := readTestMQTTPacket(conn)
+					if err != nil {
+						return
+					}
+					switch packet.packetType {
+					case mqttConnect:
+						connects <- packet
+						if _, err := conn.Write([]byte{mqttConnAck, 0x02, 0x00, 0x00}); err != nil {
+							return
+						}
+					case mqttPublish:
+						publishes <- packet
+					}
+				}
+			}()
+		}
+	}()
+	return ln, connects, publishes, conns
+}
+
+func receiveTestPacket(t *testing.T, packets chan testBrokerPacket) testBrokerPacket {
+	t.Helper()
+	select {
+	case packet := <-packets:
+		return packet
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an mqtt packet")
+		return testBrokerPacket{}
+	}
+}
+
+// testMQTTString reads a length prefixed string and returns the rest of the body.
+func testMQTTString(t *testing.T, body []byte) (string, []byte) {
+	t.Helper()
+	test.That(t, len(body), test.ShouldBeGreaterThanOrEqualTo, 2)
+	length := int(binary.BigEndian.Uint16(body))
+	test.That(t, len(body), test.ShouldBeGreaterThanOrEqualTo, 2+length)
+	return string(body[2 : 2+length]), body[2+length:]
+}
+
+func TestMQTTPublish(t *testing.T) {
+	ctx := context.Background()
+	ln, connects, publishes, conns := startTestBroker(t)
+
+	g := createTestGateway(t)
+	g.workers = utils.NewBackgroundStoppableWorkers()
+	defer g.Close(ctx)
+	var err error
+	g.mqtt, err = newMQTTPublisher(mqttConfig{
+		URL:      "mqtt://" + ln.Addr().String(),
+		Username: "user",
+		Password: "secret",
+	}, "test-gateway", g.logger)
+	test.That(t, err, test.ShouldBeNil)
+	g.workers.Add(g.mqtt.run)
+
+	// the CONNECT has a clean session, the default client id and the credentials.
+	connect := receiveTestPacket(t, connects)
+	protocol, rest := testMQTTString(t, connect.body)
+	test.That(t, protocol, test.ShouldEqual, "MQTT")
+	test.That(t, rest[0], test.ShouldEqual, 0x04)
+	test.That(t, rest[1], test.ShouldEqual, 0xC2)
+	test.That(t, binary.BigEndian.Uint16(rest[2:]), test.ShouldEqual, 60)
+	clientID, rest := testMQTTString(t, rest[4:])
+	test.That(t, clientID, test.ShouldEqual, "viam-lorawan-test-gateway")
+	username, rest := testMQTTString(t, rest)
+	test.That(t, username, test.ShouldEqual, "user")
+	password, _ := testMQTTString(t, rest)
+	test.That(t, password, test.ShouldEqual, "secret")
+
+	// each decoded uplink is published once.
+	for fCnt := uint32(1); fCnt <= 3; fCnt++ {
+		err := g.routePacket(ctx, createTestUplink(t, fCnt, 1, []byte{0x15, byte(fCnt)}), testRxInfo)
+		test.That(t, err, test.ShouldBeNil)
+	}
+	for i := 0; i < 3; i++ {
+		publish := receiveTestPacket(t, publishes)
+		test.That(t, publish.packetType, test.ShouldEqual, mqttPublish)
+		topic, payload := testMQTTString(t, publish.body)
+		test.That(t, topic, test.ShouldEqual, "lorawan/test-device/up")
+
+		var msg map[string]interface{}
+		test.That(t, json.Unmarshal(payload, &msg), test.ShouldBeNil)
+		test.That(t, msg["device"], test.ShouldEqual, "test-device")
+		received, err := time.Parse(time.RFC3339Nano, msg["received"].(string))
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, time.Since(received), test.ShouldBeLessThan, 5*time.Second)
+		readings := msg["readings"].(map[string]interface{})
+		test.That(t, readings["temperature"], test.ShouldEqual, 21+float64(i+1)/10)
+	}
+	select {
+	case publish := <-publishes:
+		t.Fatalf("unexpected extra publish %v", publish)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the publisher reconnects after the broker drops the connection.
+	(<-conns).Close()
+	receiveTestPacket(t, connects)
+	err = g.routePacket(ctx, createTestUplink(t, 4, 1, []byte{0x15, 0x04}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	publish := receiveTestPacket(t, publishes)
+	topic, _ := testMQTTString(t, publish.body)
+	test.That(t, topic, test.ShouldEqual, "lorawan/test-device/up")
+}
+
+func TestMQTTPublishNeverBlocks(t *testing.T) {
+	g := createTestGateway(t)
+	var err error
+	g.mqtt, err = newMQTTPublisher(mqttConfig{URL: "mqtt://127.0.0.1:1", Topic: "gateway/{device}"}, "test-gateway", g.logger)
+	test.That(t, err, test.ShouldBeNil)
+
+	// without a connection to the broker uplinks are dropped once the queue is full.
+	for i := 0; i < mqttQueueSize+10; i++ {
+		g.updateReadings("test-device", map[string]interface{}{"temperature": i})
+	}
+	test.That(t, len(g.mqtt.queue), test.ShouldEqual, mqttQueueSize)
+	msg := <-g.mqtt.queue
+	test.That(t, msg.topic, test.ShouldEqual, "gateway/test-device")
+}
+
+func TestMQTTConfig(t *testing.T) {
+	for _, tc := range []struct {
+		url    string
+		addr   string
+		useTLS bool
+	}{
+		{"mqtt://broker", "broker:1883", false},
+		{"tcp://broker:1884", "broker:1884", false},
+		{"mqtts://broker", "broker:8883", true},
+		{"ssl://10.0.0.1:8884", "10.0.0.1:8884", true},
+	} {
+		cfg := mqttConfig{URL: tc.url}
+		test.That(t, cfg.validate(), test.ShouldBeNil)
+		addr, useTLS, err := cfg.brokerAddr()
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, addr, test.ShouldEqual, tc.addr)
+		test.That(t, useTLS, test.ShouldEqual, tc.useTLS)
+	}
+
+	for _, url := range []string{"", "broker:1883", "http://broker", "mqtt://"} {
+		cfg := mqttConfig{URL: url}
+		test.That(t, errors.Is(cfg.validate(), errInvalidMQTT), test.ShouldBeTrue)
+	}
+	cfg := mqttConfig{URL: "mqtt://broker", Topic: "lorawan/+/up"}
+	test.That(t, cfg.validate(), test.ShouldBeError, errInvalidMQTTTopic)
+	// the password flag can't be set without the username flag.
+	cfg = mqttConfig{URL: "mqtt://broker", Password: "secret"}
+	test.That(t, cfg.validate(), test.ShouldBeError, errMQTTPassword)
+	cfg.Username = "gateway"
+	test.That(t, cfg.validate(), test.ShouldBeNil)
+
+	conf := &Config{UDPListenAddr: ":1700", MQTT: &mqttConfig{URL: "http://broker"}}
+	_, err := conf.Validate("")
+	test.That(t, errors.Is(err, errInvalidMQTT), test.ShouldBeTrue)
+}
+
+func TestMQTTPacket(t *testing.T) {
+	test.That(t, mqttPacket(mqttPingReq, nil), test.ShouldResemble, []byte{0xC0, 0x00})
+	// remaining lengths above 127 take more than one byte.
+	packet := mqttPacket(mqttPublish, make([]byte, 321))
+	test.That(t, packet[:3], test.ShouldResemble, []byte{0x30, 0xC1, 0x02})
+	test.That(t, len(packet), test.ShouldEqual, 324)
+	test.That(t, mqttString("ab"), test.ShouldResemble, []byte{0x00, 0x02, 'a', 'b'})
+}
@@ -0,0 +1,422 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"gateway/node"
+	"time"
+)
+
+// bandwidths as defined by the sx1302 HAL.
+const (
+	bandwidth125k = 0x04
+	bandwidth250k = 0x05
+	bandwidth500k = 0x06
+)
+
+// bandwidthsKHz maps the bandwidth in kHz to the sx1302 HAL value.
+var bandwidthsKHz = map[int]uint8{
+	125: bandwidth125k,
+	250: bandwidth250k,
+	500: bandwidth500k,
+}
+
+// bandwidthKHz returns the bandwidth in kHz of the sx1302 HAL value.
+func bandwidthKHz(bandwidth uint8) int {
+	for khz, bw := range bandwidthsKHz {
+		if bw == bandwidth {
+			return khz
+		}
+	}
+	return 0
+}
+
+// dataRate is the modulation parameters of a LoRaWAN data rate.
+type dataRate struct {
+	sf        uint8 // spreading factor
+	bandwidth uint8
+	// max size of the FRMPayload at this data rate, assuming no FOpts.
+	maxPayloadSize int
+}
+
+// ifChain is an intermediate frequency chain, each one listens on a single uplink channel.
+type ifChain struct {
+	rfChain    uint8
+	freqOffset int32 // offset in Hz from the frequency of the rf chain
+}
+
+// region is the channel plan and timing for a LoRaWAN region.
+// https://lora-alliance.org/wp-content/uploads/2020/11/rp_2-1.0.2.pdf for the regional parameters.
+type region struct {
+	name string
+	// stationRegion and freqRange are the region name and frequency range in Hz Basics Station expects.
+	stationRegion string
+	freqRange     [2]uint32
+
+	// center frequencies of the two radios, the if chains listen relative to these.
+	radioFrequencies [2]uint32
+	ifChains         [8]ifChain
+	// channel index of the first if chain, the if chains listen on consecutive channels.
+	firstChannel uint8
+
+	// data rates indexed by DR.
+	dataRates map[uint8]dataRate
+	// maxUplinkDataRate is the fastest data rate uplinks can use, higher DRs are downlink only.
+	maxUplinkDataRate uint8
+	// maxADRDataRate is the fastest data rate ADR moves devices to.
+	maxADRDataRate uint8
+	// channelMask enables the channels 0-15 the if chains listen on, it is sent with ADR requests.
+	channelMask uint16
+
+	// the rx1 downlink channel and data rate are derived from the uplink.
+	rx1Frequency func(uplinkFreq uint32) uint32
+	rx1DataRate  func(uplinkDR uint8) uint8
+
+	// rx2 uses a fixed frequency and data rate.
+	rx2Frequency uint32
+	rx2DataRate  uint8
+
+	// delays from the end of the uplink until the receive windows open.
+	rx1Delay         time.Duration
+	rx2Delay         time.Duration
+	joinAcceptDelay1 time.Duration
+	joinAcceptDelay2 time.Duration
+
+	txPower int8 // tx power in dbm
+	// maxEIRP is the highest max EIRP in dBm a TxParamSetupReq can set, zero if the region doesn't implement it.
+	maxEIRP int8
+
+	// class B beacons and ping slots are sent on beaconFrequency at beaconDataRate by default.
+	// US915 and AU915 hop over beaconChannels channels with 600 kHz spacing, EU868 has a single channel.
+	beaconFrequency uint32
+	beaconChannels  uint32
+	beaconDataRate  uint8
+
+	// cfListType is the type of CFList sent in the join accept to configure the device's channels.
+	cfListType byte
+	// defaultChannels is how many of the if chains listen on the region's default channels, which devices
+	// know without a CFList. Only used with frequency CFLists.
+	defaultChannels int
+}
+
+// CFList types, a list of channel frequencies or a mask of the enabled channels.
+const (
+	cfListFrequencies = 0x00
+	cfListChannelMask = 0x01
+)
+
+// cfList returns the CFList sent in the join accept to configure the device's channels.
+// With frequencies the CFList adds the channels of the if chains after the default channels, with a channel mask
+// it enables the channels in the region's channel mask.
+func (r *region) cfList() []byte {
+	if r.cfListType == cfListChannelMask {
+		return channelMaskCFList(r.channelMask)
+	}
+	var freqs []uint32
+	for _, chain := range r.ifChains[r.defaultChannels:] {
+		freqs = append(freqs, r.ifChainFrequency(chain))
+	}
+	return frequencyCFList(freqs)
+}
+
+// frequencyCFList returns a type 0 CFList with the frequencies of up to 5 channels after the default channels.
+//
+// | Freq Ch3 | Freq Ch4 | Freq Ch5 | Freq Ch6 | Freq Ch7 | CFListType |
+// |   3 B    |   3 B    |   3 B    |   3 B    |   3 B    |    1 B     |
+// Each frequency is in 100 Hz steps, little endian. Unused channels have a frequency of 0.
+func frequencyCFList(freqs []uint32) []byte {
+	cfList := make([]byte, 16)
+	for i, freq := range freqs[:min(len(freqs), 5)] {
+		step := freq / 100
+		cfList[i*3] = byte(step)
+		cfList[i*3+1] = byte(step >> 8)
+		cfList[i*3+2] = byte(step >> 16)
+	}
+	cfList[15] = cfListFrequencies
+	return cfList
+}
+
+// channelMaskCFList returns a type 1 CFList enabling the channels 0-15 set in mask, channels 16-79 are disabled.
+//
+// | ChMask0 | ChMask1 | ChMask2 | ChMask3 | ChMask4 | RFU | CFListType |
+// |   2 B   |   2 B   |   2 B   |   2 B   |   2 B   | 5 B |    1 B     |
+// Each mask enables 16 channels, the lowest bit is the lowest channel.
+func channelMaskCFList(mask uint16) []byte {
+	cfList := make([]byte, 16)
+	binary.LittleEndian.PutUint16(cfList[0:2], mask)
+	cfList[15] = cfListChannelMask
+	return cfList
+}
+
+// rx2 returns the data rate used in the rx2 window.
+func (r *region) rx2() dataRate {
+	return r.dataRates[r.rx2DataRate]
+}
+
+// maxPayloadSize returns the largest FRMPayload in bytes a frame at the data rate can carry along with
+// fOptsLength bytes of MAC commands in FOpts.
+func (r *region) maxPayloadSize(dataRate uint8, fOptsLength int) int {
+	return max(r.dataRates[dataRate].maxPayloadSize-fOptsLength, 0)
+}
+
+// rxSettings are the receive window settings of a device.
+type rxSettings struct {
+	rx1DROffset uint8
+	rx2DataRate uint8
+	rx1Delay    time.Duration // rx2 opens 1 second after rx1
+}
+
+// rxSettings returns the receive window settings of the device, the node's settings override the region defaults.
+func (r *region) rxSettings(device *node.Node) rxSettings {
+	s := rxSettings{rx2DataRate: r.rx2DataRate, rx1Delay: r.rx1Delay}
+	if device.RX1DROffset != nil {
+		s.rx1DROffset = *device.RX1DROffset
+	}
+	if device.RX2DataRate != nil {
+		s.rx2DataRate = *device.RX2DataRate
+	}
+	if device.RXDelay != nil {
+		s.rx1Delay = time.Duration(*device.RXDelay) * time.Second
+	}
+	if device.RXTimingDelay != nil {
+		s.rx1Delay = time.Duration(*device.RXTimingDelay) * time.Second
+	}
+	return s
+}
+
+// rx2Freq returns the rx2 frequency of the device, the node's frequency overrides the region's.
+func (r *region) rx2Freq(device *node.Node) uint32 {
+	if device.RX2Frequency != nil {
+		return *device.RX2Frequency
+	}
+	return r.rx2Frequency
+}
+
+// rxWindow is a receive window of the device, the downlink frequency and data rate and the delay after the
+// end of the uplink until the window opens.
+type rxWindow struct {
+	frequency uint32
+	dataRate  uint8
+	delay     time.Duration
+}
+
+// joinAcceptWindows returns the rx1 and rx2 windows of the join accept for the join request received with rx.
+// The device doesn't have the settings from the join accept yet, so both use the region's defaults, except the rx2
+// frequency of the device which isn't sent in the join accept.
+// ok is false if the join request's data rate isn't known, then only rx2 can be used.
+func (r *region) joinAcceptWindows(device *node.Node, rx rxInfo) (rx1, rx2 rxWindow, ok bool) {
+	rx2 = rxWindow{frequency: r.rx2Freq(device), dataRate: r.rx2DataRate, delay: r.joinAcceptDelay2}
+	uplinkDR, ok := r.uplinkDataRate(rx.sf, rx.bandwidth)
+	if !ok || rx.frequency == 0 {
+		return rxWindow{}, rx2, false
+	}
+	rx1 = rxWindow{frequency: r.rx1Frequency(rx.frequency), dataRate: r.rx1DataRate(uplinkDR), delay: r.joinAcceptDelay1}
+	return rx1, rx2, true
+}
+
+// uplinkDataRate returns the DR of an uplink received with the spreading factor and bandwidth.
+// Uplinks use the lowest DR with the modulation, higher DRs with the same modulation are downlink only.
+func (r *region) uplinkDataRate(sf, bandwidth uint8) (uint8, bool) {
+	for dr := uint8(0); dr < 16; dr++ {
+		rate, ok := r.dataRates[dr]
+		if ok && rate.sf == sf && rate.bandwidth == bandwidth {
+			return dr, true
+		}
+	}
+	return 0, false
+}
+
+// ifChainFrequency returns the frequency in Hz the if chain listens on.
+func (r *region) ifChainFrequency(chain ifChain) uint32 {
+	return uint32(int64(r.radioFrequencies[chain.rfChain]) + int64(chain.freqOffset))
+}
+
+// uplinkChannel returns the channel index of an uplink received on freq.
+func (r *region) uplinkChannel(freq uint32) (uint8, bool) {
+	for i, chain := range r.ifChains {
+		if r.ifChainFrequency(chain) == freq {
+			return r.firstChannel + uint8(i), true
+		}
+	}
+	return 0, false
+}
+
+// beaconChannel returns the frequency of the beacon sent at the start of the beacon period,
+// the channel hops with each beacon period.
+func (r *region) beaconChannel(beaconTime uint32) uint32 {
+	channel := (beaconTime / uint32(beaconPeriod/time.Second)) % r.beaconChannels
+	return r.beaconFrequency + channel*600000
+}
+
+// pingSlotChannel returns the default frequency of the device's ping slots in the beacon period,
+// devices are spread over the beacon channels by dev addr.
+func (r *region) pingSlotChannel(beaconTime uint32, devAddr []byte) uint32 {
+	channel := (beaconTime/uint32(beaconPeriod/time.Second) + binary.BigEndian.Uint32(devAddr)) % r.beaconChannels
+	return r.beaconFrequency + channel*600000
+}
+
+const defaultRegion = "US915"
+
+// getRegion returns the channel plan for the region name, an empty name is the default region.
+func getRegion(name string) *region {
+	if r, ok := regions[name]; ok {
+		return r
+	}
+	return regions[defaultRegion]
+}
+
+// regions maps the region name to its channel plan.
+var regions = map[string]*region{
+	"US915": {
+		name:          "US915",
+		stationRegion: "US902",
+		freqRange:     [2]uint32{902000000, 928000000},
+		// listens on sub-band 1 - channels 0-7, 902.3 - 903.7 MHz.
+		radioFrequencies: [2]uint32{902700000, 903700000},
+		ifChains:         usAUIFChains,
+		dataRates: map[uint8]dataRate{
+			0:  {sf: 10, bandwidth: bandwidth125k, maxPayloadSize: 11},
+			1:  {sf: 9, bandwidth: bandwidth125k, maxPayloadSize: 53},
+			2:  {sf: 8, bandwidth: bandwidth125k, maxPayloadSize: 125},
+			3:  {sf: 7, bandwidth: bandwidth125k, maxPayloadSize: 242},
+			4:  {sf: 8, bandwidth: bandwidth500k, maxPayloadSize: 242},
+			8:  {sf: 12, bandwidth: bandwidth500k, maxPayloadSize: 53},
+			9:  {sf: 11, bandwidth: bandwidth500k, maxPayloadSize: 129},
+			10: {sf: 10, bandwidth: bandwidth500k, maxPayloadSize: 242},
+			11: {sf: 9, bandwidth: bandwidth500k, maxPayloadSize: 242},
+			12: {sf: 8, bandwidth: bandwidth500k, maxPayloadSize: 242},
+			13: {sf: 7, bandwidth: bandwidth500k, maxPayloadSize: 242},
+		},
+		maxUplinkDataRate: 4,
+		maxADRDataRate:    3,
+		channelMask:       0x00FF,
+		rx1Frequency: func(uplinkFreq uint32) uint32 {
+			return usAURX1Frequency(uplinkFreq, 902300000)
+		},
+		rx1DataRate: func(uplinkDR uint8) uint8 {
+			// DR0-3 map to DR10-13, DR4 maps to DR13.
+			return min(uplinkDR+10, 13)
+		},
+		rx2Frequency:     923300000,
+		rx2DataRate:      8,
+		rx1Delay:         time.Second,
+		rx2Delay:         2 * time.Second,
+		joinAcceptDelay1: 5 * time.Second,
+		joinAcceptDelay2: 6 * time.Second,
+		txPower:          26,
+		beaconFrequency:  923300000,
+		beaconChannels:   8,
+		beaconDataRate:   8,
+		cfListType:       cfListChannelMask,
+	},
+	"AU915": {
+		name:          "AU915",
+		stationRegion: "AU915",
+		freqRange:     [2]uint32{915000000, 928000000},
+		// listens on sub-band 2 - channels 8-15, 916.8 - 918.2 MHz.
+		radioFrequencies: [2]uint32{917200000, 918200000},
+		ifChains:         usAUIFChains,
+		firstChannel:     8,
+		dataRates: map[uint8]dataRate{
+			0:  {sf: 12, bandwidth: bandwidth125k, maxPayloadSize: 51},
+			1:  {sf: 11, bandwidth: bandwidth125k, maxPayloadSize: 51},
+			2:  {sf: 10, bandwidth: bandwidth125k, maxPayloadSize: 51},
+			3:  {sf: 9, bandwidth: bandwidth125k, maxPayloadSize: 115},
+			4:  {sf: 8, bandwidth: bandwidth125k, maxPayloadSize: 222},
+			5:  {sf: 7, bandwidth: bandwidth125k, maxPayloadSize: 222},
+			6:  {sf: 8, bandwidth: bandwidth500k, maxPayloadSize: 222},
+			8:  {sf: 12, bandwidth: bandwidth500k, maxPayloadSize: 33},
+			9:  {sf: 11, bandwidth: bandwidth500k, maxPayloadSize: 109},
+			10: {sf: 10, bandwidth: bandwidth500k, maxPayloadSize: 222},
+			11: {sf: 9, bandwidth: bandwidth500k, maxPayloadSize: 222},
+			12: {sf: 8, bandwidth: bandwidth500k, maxPayloadSize: 222},
+			13: {sf: 7, bandwidth: bandwidth500k, maxPayloadSize: 222},
+		},
+		maxUplinkDataRate: 6,
+		maxADRDataRate:    5,
+		channelMask:       0xFF00,
+		rx1Frequency: func(uplinkFreq uint32) uint32 {
+			return usAURX1Frequency(uplinkFreq, 915200000)
+		},
+		rx1DataRate: func(uplinkDR uint8) uint8 {
+			// DR0-5 map to DR8-13, DR6 maps to DR13.
+			return min(uplinkDR+8, 13)
+		},
+		rx2Frequency:     923300000,
+		rx2DataRate:      8,
+		rx1Delay:         time.Second,
+		rx2Delay:         2 * time.Second,
+		joinAcceptDelay1: 5 * time.Second,
+		joinAcceptDelay2: 6 * time.Second,
+		txPower:          26,
+		maxEIRP:          30,
+		beaconFrequency:  923300000,
+		beaconChannels:   8,
+		beaconDataRate:   8,
+		cfListType:       cfListChannelMask,
+	},
+	"EU868": {
+		name:          "EU868",
+		stationRegion: "EU863",
+		freqRange:     [2]uint32{863000000, 870000000},
+		// listens on the 3 default channels (868.1, 868.3, 868.5 MHz) and 867.1 - 867.9 MHz.
+		radioFrequencies: [2]uint32{867500000, 868500000},
+		ifChains: [8]ifChain{
+			{rfChain: 1, freqOffset: -400000},
+			{rfChain: 1, freqOffset: -200000},
+			{rfChain: 1, freqOffset: 0},
+			{rfChain: 0, freqOffset: -400000},
+			{rfChain: 0, freqOffset: -200000},
+			{rfChain: 0, freqOffset: 0},
+			{rfChain: 0, freqOffset: 200000},
+			{rfChain: 0, freqOffset: 400000},
+		},
+		dataRates: map[uint8]dataRate{
+			0: {sf: 12, bandwidth: bandwidth125k, maxPayloadSize: 51},
+			1: {sf: 11, bandwidth: bandwidth125k, maxPayloadSize: 51},
+			2: {sf: 10, bandwidth: bandwidth125k, maxPayloadSize: 51},
+			3: {sf: 9, bandwidth: bandwidth125k, maxPayloadSize: 115},
+			4: {sf: 8, bandwidth: bandwidth125k, maxPayloadSize: 222},
+			5: {sf: 7, bandwidth: bandwidth125k, maxPayloadSize: 222},
+			6: {sf: 7, bandwidth: bandwidth250k, maxPayloadSize: 222},
+		},
+		maxUplinkDataRate: 7,
+		maxADRDataRate:    5,
+		channelMask:       0x00FF,
+		// rx1 uses the same channel and data rate as the uplink.
+		rx1Frequency:     func(uplinkFreq uint32) uint32 { return uplinkFreq },
+		rx1DataRate:      func(uplinkDR uint8) uint8 { return uplinkDR },
+		rx2Frequency:     869525000,
+		rx2DataRate:      0,
+		rx1Delay:         time.Second,
+		rx2Delay:         2 * time.Second,
+		joinAcceptDelay1: 5 * time.Second,
+		joinAcceptDelay2: 6 * time.Second,
+		txPower:          14,
+		beaconFrequency:  869525000,
+		beaconChannels:   1,
+		beaconDataRate:   3,
+		cfListType:       cfListFrequencies,
+		defaultChannels:  3,
+	},
+}
+
+// usAUIFChains are the if chains for 8 125 kHz channels with 200 kHz spacing.
+// The first radio listens on the lower 5 channels and the second on the upper 3.
+var usAUIFChains = [8]ifChain{
+	{rfChain: 0, freqOffset: -400000},
+	{rfChain: 0, freqOffset: -200000},
+	{rfChain: 0, freqOffset: 0},
+	{rfChain: 0, freqOffset: 200000},
+	{rfChain: 0, freqOffset: 400000},
+	{rfChain: 1, freqOffset: -400000},
+	{rfChain: 1, freqOffset: -200000},
+	{rfChain: 1, freqOffset: 0},
+}
+
+// usAURX1Frequency returns the rx1 downlink frequency for a 125 kHz uplink channel in US915 and AU915.
+// There are 8 downlink channels starting at 923.3 MHz with 600 kHz spacing,
+// the downlink channel is the uplink channel modulo 8.
+func usAURX1Frequency(uplinkFreq, firstChannelFreq uint32) uint32 {
+	channel := (uplinkFreq - firstChannelFreq) / 200000
+	return 923300000 + (channel%8)*600000
+}
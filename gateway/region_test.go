@@ -0,0 +1,177 @@
+package gateway
+
+import (
+	"context"
+	"gateway/node"
+	"testing"
+	"time"
+
+	"go.thethings.network/lorawan-stack/v3/pkg/crypto"
+	"go.thethings.network/lorawan-stack/v3/pkg/types"
+	"go.viam.com/test"
+)
+
+func TestGetRegion(t *testing.T) {
+	test.That(t, getRegion("").name, test.ShouldEqual, "US915")
+	test.That(t, getRegion("US915").name, test.ShouldEqual, "US915")
+	test.That(t, getRegion("EU868").name, test.ShouldEqual, "EU868")
+	test.That(t, getRegion("AU915").name, test.ShouldEqual, "AU915")
+}
+
+func TestRegionUS915(t *testing.T) {
+	r := getRegion("US915")
+
+	// rx2 is 923.3 MHz at DR8.
+	test.That(t, r.rx2Frequency, test.ShouldEqual, 923300000)
+	test.That(t, r.rx2().sf, test.ShouldEqual, 12)
+	test.That(t, r.rx2().bandwidth, test.ShouldEqual, bandwidth500k)
+	test.That(t, r.rx2().maxPayloadSize, test.ShouldEqual, 53)
+
+	// rx1 uses the downlink channel of the uplink channel modulo 8.
+	test.That(t, r.rx1Frequency(902300000), test.ShouldEqual, 923300000)
+	test.That(t, r.rx1Frequency(903700000), test.ShouldEqual, 927500000)
+	test.That(t, r.rx1Frequency(903900000), test.ShouldEqual, 923300000)
+	test.That(t, r.rx1DataRate(0), test.ShouldEqual, 10)
+	test.That(t, r.rx1DataRate(3), test.ShouldEqual, 13)
+	test.That(t, r.rx1DataRate(4), test.ShouldEqual, 13)
+
+	test.That(t, r.rx2Delay.Seconds(), test.ShouldEqual, 2)
+	test.That(t, r.joinAcceptDelay2.Seconds(), test.ShouldEqual, 6)
+
+	// the if chains listen on channels 0-7.
+	for i, chain := range r.ifChains {
+		freq := int64(r.radioFrequencies[chain.rfChain]) + int64(chain.freqOffset)
+		test.That(t, freq, test.ShouldEqual, 902300000+int64(i)*200000)
+	}
+}
+
+func TestRegionEU868(t *testing.T) {
+	r := getRegion("EU868")
+
+	// rx2 is 869.525 MHz at DR0.
+	test.That(t, r.rx2Frequency, test.ShouldEqual, 869525000)
+	test.That(t, r.rx2().sf, test.ShouldEqual, 12)
+	test.That(t, r.rx2().bandwidth, test.ShouldEqual, bandwidth125k)
+	test.That(t, r.rx2().maxPayloadSize, test.ShouldEqual, 51)
+
+	// rx1 uses the uplink channel and data rate.
+	test.That(t, r.rx1Frequency(868100000), test.ShouldEqual, 868100000)
+	test.That(t, r.rx1DataRate(5), test.ShouldEqual, 5)
+
+	test.That(t, r.rx2Delay.Seconds(), test.ShouldEqual, 2)
+	test.That(t, r.joinAcceptDelay2.Seconds(), test.ShouldEqual, 6)
+
+	// the if chains listen on the 3 default channels and 867.1 - 867.9 MHz.
+	expected := []int64{868100000, 868300000, 868500000, 867100000, 867300000, 867500000, 867700000, 867900000}
+	for i, chain := range r.ifChains {
+		freq := int64(r.radioFrequencies[chain.rfChain]) + int64(chain.freqOffset)
+		test.That(t, freq, test.ShouldEqual, expected[i])
+	}
+}
+
+func TestJoinAcceptWindows(t *testing.T) {
+	// US915 join accepts are sent on the rx1 channel of the uplink channel at DR10 for a DR0 join request,
+	// or on 923.3 MHz at DR8 in rx2.
+	r := getRegion("US915")
+	rx1, rx2, ok := r.joinAcceptWindows(&node.Node{}, rxInfo{frequency: 903100000, sf: 10, bandwidth: bandwidth125k})
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, rx1, test.ShouldResemble, rxWindow{frequency: 925700000, dataRate: 10, delay: 5 * time.Second})
+	test.That(t, rx2, test.ShouldResemble, rxWindow{frequency: 923300000, dataRate: 8, delay: 6 * time.Second})
+
+	// EU868 join accepts are sent on the uplink channel and data rate in rx1, or on 869.525 MHz at DR0 in rx2.
+	r = getRegion("EU868")
+	rx1, rx2, ok = r.joinAcceptWindows(&node.Node{}, rxInfo{frequency: 868300000, sf: 9, bandwidth: bandwidth125k})
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, rx1, test.ShouldResemble, rxWindow{frequency: 868300000, dataRate: 3, delay: 5 * time.Second})
+	test.That(t, rx2, test.ShouldResemble, rxWindow{frequency: 869525000, dataRate: 0, delay: 6 * time.Second})
+
+	// only rx2 can be used if the join request's data rate isn't known.
+	_, rx2, ok = r.joinAcceptWindows(&node.Node{}, rxInfo{frequency: 868300000, sf: 6, bandwidth: bandwidth125k})
+	test.That(t, ok, test.ShouldBeFalse)
+	test.That(t, rx2.frequency, test.ShouldEqual, 869525000)
+
+	// the device's rx2 frequency is used at the region's rx2 data rate.
+	freq := uint32(869000000)
+	_, rx2, _ = r.joinAcceptWindows(&node.Node{RX2Frequency: &freq}, rxInfo{frequency: 868300000, sf: 9, bandwidth: bandwidth125k})
+	test.That(t, rx2, test.ShouldResemble, rxWindow{frequency: 869000000, dataRate: 0, delay: 6 * time.Second})
+}
+
+func TestRegionUplinkDataRateChannel(t *testing.T) {
+	r := getRegion("US915")
+	dr, ok := r.uplinkDataRate(7, bandwidth125k)
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, dr, test.ShouldEqual, 3)
+	// SF8 500 kHz is DR4 for uplinks, DR12 is downlink only.
+	dr, ok = r.uplinkDataRate(8, bandwidth500k)
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, dr, test.ShouldEqual, 4)
+	_, ok = r.uplinkDataRate(12, bandwidth125k)
+	test.That(t, ok, test.ShouldBeFalse)
+
+	ch, ok := r.uplinkChannel(903700000)
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, ch, test.ShouldEqual, 7)
+	_, ok = r.uplinkChannel(904100000)
+	test.That(t, ok, test.ShouldBeFalse)
+
+	// AU915 listens on channels 8-15.
+	ch, ok = getRegion("AU915").uplinkChannel(916800000)
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, ch, test.ShouldEqual, 8)
+}
+
+func TestRegionDownlinkSize(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+
+	// 52 bytes fits in US915 DR8 but not EU868 DR0.
+	err := g.SendDownlink(ctx, testDevAddr, 1, make([]byte, 52))
+	test.That(t, err, test.ShouldBeNil)
+
+	g.region = getRegion("EU868")
+	err = g.SendDownlink(ctx, testDevAddr, 1, make([]byte, 52))
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestRegionJoinAcceptCFList(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	g.region = getRegion("EU868")
+	addTestOTAADevice(g)
+
+	jr, matched, err := g.parseJoinRequestPacket(createTestJoinRequest(t, 0x0001))
+	test.That(t, err, test.ShouldBeNil)
+
+	joinAccept, err := generateJoinAccept(ctx, jr, matched, testJoinDevAddr, g.netID, g.region)
+	test.That(t, err, test.ShouldBeNil)
+
+	dec, err := crypto.DecryptJoinAccept(types.AES128Key(testAppKey), joinAccept[1:])
+	test.That(t, err, test.ShouldBeNil)
+
+	// the CFList is the 16 bytes before the MIC.
+	test.That(t, dec[len(dec)-20:len(dec)-4], test.ShouldResemble, g.region.cfList())
+	test.That(t, dec[len(dec)-5], test.ShouldEqual, 0x00)
+}
+
+func TestCFList(t *testing.T) {
+	// the extra EU868 channels 867.1 - 867.9 MHz.
+	cfList := frequencyCFList([]uint32{867100000, 867300000, 867500000, 867700000, 867900000})
+	test.That(t, cfList, test.ShouldResemble, []byte{
+		0x18, 0x4F, 0x84,
+		0xE8, 0x56, 0x84,
+		0xB8, 0x5E, 0x84,
+		0x88, 0x66, 0x84,
+		0x58, 0x6E, 0x84,
+		0x00,
+	})
+	test.That(t, getRegion("EU868").cfList(), test.ShouldResemble, cfList)
+
+	// unused channels are left at 0.
+	cfList = frequencyCFList([]uint32{868800000})
+	test.That(t, cfList[:3], test.ShouldResemble, []byte{0x80, 0x91, 0x84})
+	test.That(t, cfList[3:], test.ShouldResemble, make([]byte, 13))
+
+	// US915 enables channels 0-7 and AU915 channels 8-15.
+	test.That(t, getRegion("US915").cfList(), test.ShouldResemble, append([]byte{0xFF, 0x00}, append(make([]byte, 13), 0x01)...))
+	test.That(t, getRegion("AU915").cfList(), test.ShouldResemble, append([]byte{0x00, 0xFF}, append(make([]byte, 13), 0x01)...))
+}
@@ -11,11 +11,20 @@ package gateway
 */
 import "C"
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"gateway/gpio"
+	"gateway/lorawan"
 	"gateway/node"
+	"maps"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.viam.com/rdk/components/sensor"
@@ -27,17 +36,63 @@ import (
 // Error variables for validation and operations
 var (
 	// Config validation errors
-	errResetPinRequired = errors.New("reset pin is required")
+	errResetPinRequired = errors.New("reset pin is required unless udp_listen_addr or station_listen_addr is set")
 	errInvalidSpiBus    = errors.New("spi bus can be 0 or 1 - default 0")
+	errInvalidRegion    = errors.New("region must be US915, EU868 or AU915 - default US915")
+	errDedupWindow      = errors.New("dedup_window_ms must be greater than zero")
+	errADRMargin        = errors.New("adr_margin_db must be greater than zero")
+	errADRHistory       = errors.New("adr_uplink_history must be greater than zero")
+	errInvalidNetID     = errors.New("net_id must be 3 bytes (hex)")
+	errUDPListenAddr    = errors.New("udp_listen_addr must be a host or host:port to listen on, such as :1700 or [::]:1700")
 
 	// Gateway operation errors
-	errStartGateway       = errors.New("failed to start the gateway")
-	errUnexpectedJoinType = errors.New("unexpected join type when adding node to gateway")
-	errInvalidNodeMapType = errors.New("expected node map val to be type []interface{}, but it wasn't")
-	errInvalidByteType    = errors.New("expected node byte array val to be float64, but it wasn't")
-	errNoDevice           = errors.New("received packet from unknown device")
-	errInvalidMIC         = errors.New("invalid MIC")
-	errSendJoinAccept     = errors.New("failed to send join accept packet")
+	errStartGateway        = errors.New("failed to start the gateway")
+	errUnexpectedJoinType  = errors.New("unexpected join type when adding node to gateway")
+	errInvalidNodeMapType  = errors.New("expected node map val to be type []interface{}, but it wasn't")
+	errInvalidByteType     = errors.New("expected node byte array val to be float64, but it wasn't")
+	errNoDevice            = errors.New("received packet from unknown device")
+	errInvalidFCnt         = errors.New("frame counter is not greater than the last accepted frame counter")
+	errSendJoinAccept      = errors.New("failed to send join accept packet")
+	errInvalidJoinRequest  = errors.New("join request must be 23 bytes")
+	errDevNonceReused      = errors.New("dev nonce was already used by a previous join request")
+	errSendDownlink        = errors.New("failed to send downlink packet")
+	errInvalidFPort        = errors.New("fport must be between 1 and 223")
+	errPayloadTooLarge     = errors.New("downlink payload exceeds the max payload size of the data rate")
+	errInvalidDownlink     = errors.New("send_downlink expects a map with device or dev_addr, fport and payload (hex) or object")
+	errDuplicateUplink     = errors.New("uplink was already received")
+	errInvalidDeregister   = errors.New("deregister_device expects a node name or a map with name or dev_addr (hex)")
+	errDuplicateDevAddr    = errors.New("dev addr is already used by another node")
+	errDuplicateDevEUI     = errors.New("dev EUI is already used by another node")
+	errInvalidRX2DataRate  = errors.New("rx2 data rate is not a data rate of the region")
+	errInvalidRX2Frequency = errors.New("rx2 frequency is not in the band of the region")
+	errInvalidDevice       = errors.New("invalid device")
+	errNoDevAddr           = errors.New("failed to find an unused dev addr")
+	errNoPullData          = errors.New("no PULL_DATA received from the packet forwarder to send the downlink to")
+	errEmptyPacket         = errors.New("received empty packet")
+	errUnsupportedMType    = errors.New("unsupported message type")
+	errUnsupportedMajor    = errors.New("unsupported LoRaWAN major version")
+	errInvalidUpdateKeys   = errors.New("update_keys expects a map with device and the new session keys (hex)")
+	errInvalidSetRXDelay   = errors.New("set_rx_delay expects a map with device and rx_delay_s between 1 and 15")
+	errNotJoined           = errors.New("device has not joined yet")
+	errInvalidDevAddr      = errors.New("dev addr must be 4 bytes")
+	errInvalidSetDutyCycle = errors.New("set_duty_cycle expects a map with device and max_duty_cycle between 0 and 15")
+	errInvalidSetTxParams  = errors.New("set_tx_params expects a map with device, max_eirp_index between 0 and 15 and optional dwell time flags")
+	errTxParamsRegion      = errors.New("set_tx_params is only supported in regions that implement TxParamSetupReq, such as AU915")
+	errInvalidNewChannel   = errors.New("new_channel expects a map with device, channel, frequency (Hz), min_dr and max_dr")
+	errNewChannelRegion    = errors.New("new_channel is only supported in regions with dynamic channels, such as EU868")
+	errUpdateKeysOTAA      = errors.New("session keys can only be updated for ABP devices, OTAA devices get new keys when they join")
+	errInvalidKeyGrace     = errors.New("grace_period_s must be a positive number of seconds")
+	errKeyGraceMIC         = errors.New("grace_period_s needs new network session keys, the MIC tells which keys an uplink uses")
+	errPingPeriodicity     = errors.New("ping slot periodicity must be between 0 and 7")
+	errInvalidGetUplinks   = errors.New("get_uplinks expects a map with device and optionally after and wait_ms")
+	errInvalidHistory      = errors.New("history expects a map with device")
+	errInvalidDecode       = errors.New("decode expects a map with device, fport and payload")
+	errReloadDecoder       = errors.New("reload_decoder expects a map with device or path")
+	errInvalidEncoding     = errors.New("encoding must be hex or base64 - default hex")
+	errInvalidMQTT         = errors.New("mqtt url must be a mqtt://, tcp://, mqtts://, ssl:// or tls:// url with a host")
+	errInvalidMQTTTopic    = errors.New("mqtt topic can't have the wildcards + or #")
+	errMQTTPassword        = errors.New("mqtt password needs a username, MQTT 3.1.1 doesn't allow a password without one")
+	errMQTTRefused         = errors.New("mqtt broker refused the connection")
 )
 
 // Model represents a lorawan gateway model.
@@ -45,9 +100,35 @@ var Model = resource.NewModel("viam", "lorawan", "sx1302-gateway")
 
 // Config describes the configuration of the gateway
 type Config struct {
-	Bus      int  `json:"spi_bus,omitempty"`
-	PowerPin *int `json:"power_en_pin,omitempty"`
-	ResetPin *int `json:"reset_pin"`
+	Bus      int    `json:"spi_bus,omitempty"`
+	PowerPin *int   `json:"power_en_pin,omitempty"`
+	ResetPin *int   `json:"reset_pin"`
+	Region   string `json:"region,omitempty"`
+
+	// NetID is the network id sent to OTAA devices in the join accept, their dev addrs are allocated from its block.
+	NetID string `json:"net_id,omitempty"`
+
+	// DedupWindowMs is how long a received uplink is remembered to drop duplicates of it.
+	DedupWindowMs *int `json:"dedup_window_ms,omitempty"`
+
+	// ADR thresholds, the SNR margin kept for the installation and the number of uplinks the SNR is measured over.
+	ADRMarginDB      *float64 `json:"adr_margin_db,omitempty"`
+	ADRUplinkHistory *int     `json:"adr_uplink_history,omitempty"`
+
+	// UDPListenAddr is the address to receive packets from Semtech UDP packet forwarders on, such as ":1700".
+	// The port defaults to 1700 if only a host is set, such as "::".
+	UDPListenAddr string `json:"udp_listen_addr,omitempty"`
+	// StationListenAddr is the address of the LoRa Basics Station LNS endpoint, such as ":8887".
+	StationListenAddr string `json:"station_listen_addr,omitempty"`
+
+	// SessionStorePath is the file the session state of the devices is saved to.
+	SessionStorePath string `json:"session_store_path,omitempty"`
+
+	// DebugUplinks logs every received packet and each step of parsing its uplink, for debugging devices in the field.
+	DebugUplinks bool `json:"debug_uplinks,omitempty"`
+
+	// MQTT is the broker the decoded uplinks are published to, they aren't published if it is not set.
+	MQTT *mqttConfig `json:"mqtt,omitempty"`
 }
 
 func init() {
@@ -61,12 +142,36 @@ func init() {
 
 // Validate ensures all parts of the config are valid.
 func (conf *Config) Validate(path string) ([]string, error) {
-	if conf.ResetPin == nil {
+	// without a local concentrator packets are only received from packet forwarders.
+	if conf.ResetPin == nil && conf.UDPListenAddr == "" && conf.StationListenAddr == "" {
 		return nil, resource.NewConfigValidationError(path, errResetPinRequired)
 	}
 	if conf.Bus != 0 && conf.Bus != 1 {
 		return nil, resource.NewConfigValidationError(path, errInvalidSpiBus)
 	}
+	if _, ok := regions[conf.Region]; conf.Region != "" && !ok {
+		return nil, resource.NewConfigValidationError(path, errInvalidRegion)
+	}
+	if conf.DedupWindowMs != nil && *conf.DedupWindowMs <= 0 {
+		return nil, resource.NewConfigValidationError(path, errDedupWindow)
+	}
+	if conf.ADRMarginDB != nil && *conf.ADRMarginDB <= 0 {
+		return nil, resource.NewConfigValidationError(path, errADRMargin)
+	}
+	if conf.ADRUplinkHistory != nil && *conf.ADRUplinkHistory <= 0 {
+		return nil, resource.NewConfigValidationError(path, errADRHistory)
+	}
+	if id, err := hex.DecodeString(conf.NetID); conf.NetID != "" && (err != nil || len(id) != 3) {
+		return nil, resource.NewConfigValidationError(path, errInvalidNetID)
+	}
+	if _, err := udpListenAddr(conf.UDPListenAddr); conf.UDPListenAddr != "" && err != nil {
+		return nil, resource.NewConfigValidationError(path, err)
+	}
+	if conf.MQTT != nil {
+		if err := conf.MQTT.validate(); err != nil {
+			return nil, resource.NewConfigValidationError(path, err)
+		}
+	}
 	return nil, nil
 }
 
@@ -76,14 +181,39 @@ type Gateway struct {
 	logger logging.Logger
 
 	workers *utils.StoppableWorkers
-	mu      sync.Mutex
+	// mu guards devices, downlinks and the session state of the devices, and serializes sends to the radio.
+	mu sync.Mutex
 
-	lastReadings map[string]interface{} // map of devices to readings
+	lastReadings map[string]interface{}  // map of devices to readings
+	stats        map[string]*deviceStats // map of devices to their uplink counts, guarded by readingsMu
 	readingsMu   sync.Mutex
+	uplinks      uplinkLog     // recent decoded uplinks of each device, for callers waiting on new data
+	fragments    fragmentStore // fragmented data blocks being reassembled
+
+	devices   map[string]*node.Node  // map of node name to node struct
+	downlinks map[string][]*downlink // map of node name to queued downlinks
+	routes    map[string]rxInfo      // map of node name to the radio metadata of its last uplink
+
+	decoders lorawan.DecoderCache // compiled decoder scripts
+	dedup    dedupCache           // recently received uplinks
+	adr      adrConfig            // adaptive data rate settings
+	sessions *sessionStore        // saved frame counters and sessions of the devices
+	warnings warnLimiter          // recent decoder warnings, so repeated ones aren't all logged
+
+	region *region // channel plan and rx window timing
+	netID  []byte  // network id of the join accepts and dev addrs
 
-	devices map[string]*node.Node // map of node name to node struct
+	debugUplinks bool // log the trace of each received packet
+
+	udp     *udpServer     // packet forwarder listener, nil if udp_listen_addr is not set
+	station *stationServer // Basics Station endpoint, nil if station_listen_addr is not set
+	mqtt    *mqttPublisher // publishes the decoded uplinks, nil if mqtt is not set
 
 	started bool
+
+	// unix nanos of the last packet received and the last uplink from a device, for the health docommand.
+	lastPacket atomic.Int64
+	lastUplink atomic.Int64
 }
 
 func newGateway(
@@ -117,7 +247,7 @@ func (g *Gateway) Reconfigure(ctx context.Context, deps resource.Dependencies, c
 	// errors will occur.
 	// Unexpected behavior will also occur if you call stopGateway() when the gateway hasn't been
 	// started, so only call stopGateway if this module already started the gateway.
-	if g.started {
+	if g.started || g.udp != nil || g.station != nil {
 		err = g.Close(ctx)
 		if err != nil {
 			return err
@@ -134,10 +264,96 @@ func (g *Gateway) Reconfigure(ctx context.Context, deps resource.Dependencies, c
 		g.lastReadings = make(map[string]interface{})
 	}
 
+	if g.downlinks == nil {
+		g.downlinks = make(map[string][]*downlink)
+	}
+
+	g.region = getRegion(cfg.Region)
+	g.debugUplinks = cfg.DebugUplinks
+	g.netID = defaultNetID
+	if cfg.NetID != "" {
+		g.netID, _ = hex.DecodeString(cfg.NetID)
+	}
+
+	storePath := cfg.SessionStorePath
+	if storePath == "" {
+		storePath = defaultSessionStorePath(g.Name().Name)
+	}
+	g.sessions, err = openSessionStore(storePath)
+	if err != nil {
+		return err
+	}
+
+	if cfg.DedupWindowMs != nil {
+		g.dedup.setWindow(time.Duration(*cfg.DedupWindowMs) * time.Millisecond)
+	} else {
+		g.dedup.setWindow(defaultDedupWindow)
+	}
+
+	g.adr = adrConfig{}
+	if cfg.ADRMarginDB != nil {
+		g.adr.margin = *cfg.ADRMarginDB
+	}
+	if cfg.ADRUplinkHistory != nil {
+		g.adr.history = *cfg.ADRUplinkHistory
+	}
+
+	g.workers = utils.NewBackgroundStoppableWorkers()
+
+	g.mqtt = nil
+	if cfg.MQTT != nil {
+		g.mqtt, err = newMQTTPublisher(*cfg.MQTT, g.Name().Name, g.logger)
+		if err != nil {
+			return err
+		}
+		g.workers.Add(g.mqtt.run)
+	}
+
+	// a gateway only receiving from packet forwarders has no concentrator of its own.
+	if cfg.ResetPin != nil {
+		if err := g.startConcentrator(cfg); err != nil {
+			return err
+		}
+	}
+
+	if cfg.UDPListenAddr != "" {
+		err = g.startUDPServer(cfg.UDPListenAddr)
+	}
+	if err == nil && cfg.StationListenAddr != "" {
+		err = g.startStationServer(cfg.StationListenAddr)
+	}
+	if err != nil {
+		// stop the concentrator and listeners that were started.
+		if closeErr := g.Close(ctx); closeErr != nil {
+			g.logger.Errorf("error closing gateway: %s", closeErr)
+		}
+		g.started = false
+		return err
+	}
+
+	return nil
+}
+
+// startConcentrator starts the sx1302 and receiving packets from it.
+func (g *Gateway) startConcentrator(cfg *Config) error {
 	// init the gateway
-	gpio.InitGateway(cfg.ResetPin, cfg.PowerPin)
+	gpio.InitGateway(g.logger, cfg.ResetPin, cfg.PowerPin)
 
-	errCode := C.setUpGateway(C.int(cfg.Bus))
+	// the if chains listen on the region's uplink channels.
+	var ifFrequencies [8]C.int32_t
+	var ifRFChains [8]C.int32_t
+	for i, chain := range g.region.ifChains {
+		ifFrequencies[i] = C.int32_t(chain.freqOffset)
+		ifRFChains[i] = C.int32_t(chain.rfChain)
+	}
+
+	errCode := C.setUpGateway(
+		C.int(cfg.Bus),
+		C.uint32_t(g.region.radioFrequencies[0]),
+		C.uint32_t(g.region.radioFrequencies[1]),
+		&ifFrequencies[0],
+		&ifRFChains[0],
+	)
 	if errCode != 0 {
 		return errStartGateway
 	}
@@ -151,7 +367,7 @@ func (g *Gateway) Reconfigure(ctx context.Context, deps resource.Dependencies, c
 func (g *Gateway) receivePackets() {
 	// receive the radio packets
 	packet := C.createRxPacketArray()
-	g.workers = utils.NewBackgroundStoppableWorkers(func(ctx context.Context) {
+	g.workers.Add(func(ctx context.Context) {
 		for {
 			select {
 			case <-ctx.Done():
@@ -178,7 +394,15 @@ func (g *Gateway) receivePackets() {
 					for i := 0; i < int(packet.size); i++ {
 						payload = append(payload, byte(packet.payload[i]))
 					}
-					g.handlePacket(ctx, payload)
+					rx := rxInfo{
+						frequency: uint32(packet.freq_hz),
+						sf:        uint8(packet.datarate),
+						bandwidth: uint8(packet.bandwidth),
+						rssi:      float32(packet.rssic),
+						snr:       float32(packet.snr),
+						received:  time.Now(),
+					}
+					g.handlePacket(ctx, payload, rx)
 				}
 			default:
 				g.logger.Errorf("error receiving lora packet")
@@ -187,41 +411,93 @@ func (g *Gateway) receivePackets() {
 	})
 }
 
-func (g *Gateway) handlePacket(ctx context.Context, payload []byte) {
+func (g *Gateway) handlePacket(ctx context.Context, payload []byte, rx rxInfo) {
 	g.workers.Add(func(ctx context.Context) {
-		// first byte is MHDR - specifies message type
-		switch payload[0] {
-		case 0x0:
-			g.logger.Infof("received join request")
-			err := g.handleJoin(ctx, payload)
-			if err != nil {
-				// don't log as error if it was a request from unknown device.
-				if errors.Is(errNoDevice, err) {
-					return
-				}
-				g.logger.Errorf("couldn't handle join request: %s", err)
-			}
-		case 0x40:
-			g.logger.Infof("received data uplink")
-			name, readings, err := g.parseDataUplink(ctx, payload)
-			if err != nil {
-				// don't log as error if it was a request from unknown device.
-				if errors.Is(errNoDevice, err) {
-					return
-				}
-				g.logger.Errorf("error parsing uplink message: %s", err)
-				return
-			}
-			g.updateReadings(name, readings)
+		err := g.routePacket(ctx, payload, rx)
+		switch {
+		case err != nil && ctx.Err() != nil:
+			g.logger.Debugf("gateway closed while handling packet: %s", err)
+		case err == nil, errors.Is(err, errNoDevice):
+			// don't log as error if it was a request from unknown device.
+		case errors.Is(err, errDuplicateUplink):
+			g.logger.Debugf("received duplicate data uplink, ignoring")
+		case errors.Is(err, errUnsupportedMType), errors.Is(err, errUnsupportedMajor):
+			g.logger.Warnf("ignoring packet: %s", err)
 		default:
-			g.logger.Warnf("received unsupported packet type")
+			g.logger.Errorf("%s", err)
 		}
 	})
 }
 
+// routePacket handles the packet by the message type in its MHDR.
+// Only join requests and data uplinks are sent by devices to the network, other message types are rejected.
+func (g *Gateway) routePacket(ctx context.Context, payload []byte, rx rxInfo) error {
+	if len(payload) == 0 {
+		return errEmptyPacket
+	}
+	g.lastPacket.Store(time.Now().UnixNano())
+	g.traceUplink("received packet",
+		"phy_payload", hex.EncodeToString(payload),
+		"frequency", rx.frequency,
+		"rssi", rx.rssi,
+		"snr", rx.snr,
+	)
+	// first byte is MHDR - specifies message type
+	mhdr := payload[0]
+	if mhdr&majorMask != 0 {
+		return fmt.Errorf("%w %d", errUnsupportedMajor, mhdr&majorMask)
+	}
+
+	mType := mhdr & mTypeMask
+	switch mType {
+	case joinRequestType:
+		g.logger.Infof("received join request")
+		if err := g.handleJoin(ctx, payload, rx); err != nil {
+			return fmt.Errorf("couldn't handle join request: %w", err)
+		}
+		return nil
+	case unconfirmedDataUp, confirmedDataUp:
+		g.logger.Debugf("received data uplink")
+		name, readings, err := g.parseDataUplink(ctx, payload, rx)
+		// the name is returned with errors decoding the payload, the device still listens for a downlink.
+		if name == "" {
+			return fmt.Errorf("error parsing uplink message: %w", err)
+		}
+		switch {
+		case err != nil:
+			g.logger.Debugf("couldn't decode data uplink from %s, dropping its readings", name)
+		case readings == nil:
+			// uplinks on filtered ports and retransmitted confirmed uplinks have no readings,
+			// but the device still listens for a downlink.
+			g.logger.Debugf("received data uplink from %s without readings, dropping it", name)
+		default:
+			g.logger.Infof("received data uplink from %s", name)
+			g.updateReadings(name, readings)
+		}
+		g.setRoute(name, rx)
+		// the device opens its receive windows after the uplink, send any queued downlink.
+		if dlErr := g.sendQueuedDownlink(ctx, name, rx); dlErr != nil {
+			g.logger.Errorf("error sending downlink to %s: %s", name, dlErr)
+		}
+		if err != nil {
+			return fmt.Errorf("error decoding uplink message: %w", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", errUnsupportedMType, mTypeNames[mType])
+	}
+}
+
+// uplinkOnlyReadings describe the uplink they came with, they are dropped from the device's readings by a later
+// uplink without them instead of being kept like the decoded values.
+var uplinkOnlyReadings = []string{"mac_commands"}
+
 func (g *Gateway) updateReadings(name string, newReadings map[string]interface{}) {
 	g.readingsMu.Lock()
 	defer g.readingsMu.Unlock()
+	// the first readings of a device are merged into later, so the uplink keeps its own copy.
+	g.uplinks.add(name, maps.Clone(newReadings))
+	g.mqtt.publish(name, newReadings)
 	readings, ok := g.lastReadings[name].(map[string]interface{})
 	if !ok {
 		// readings for this device does not exist yet
@@ -232,6 +508,9 @@ func (g *Gateway) updateReadings(name string, newReadings map[string]interface{}
 	if readings == nil {
 		g.lastReadings[name] = make(map[string]interface{})
 	}
+	for _, key := range uplinkOnlyReadings {
+		delete(readings, key)
+	}
 	for key, val := range newReadings {
 		readings[key] = val
 	}
@@ -247,59 +526,691 @@ func (g *Gateway) DoCommand(ctx context.Context, cmd map[string]interface{}) (ma
 	// Add the nodes to the list of devices.
 	if newNode, ok := cmd["register_device"]; ok {
 		if newN, ok := newNode.(map[string]interface{}); ok {
-			node, err := convertToNode(newN)
+			// the node doesn't retry registering when its config is rejected.
+			device, err := convertToNode(newN)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("%w: %w", node.ErrDeviceRejected, err)
 			}
 
-			oldNode, exists := g.devices[node.NodeName]
-			if !exists {
-				g.devices[node.NodeName] = node
-				return map[string]interface{}{}, nil
-			}
-			// node with that name already exists, merge them
-			mergedNode, err := mergeNodes(node, oldNode)
-			if err != nil {
-				return nil, err
+			if err := g.AddDevice(device); err != nil {
+				return nil, fmt.Errorf("%w: %w", node.ErrDeviceRejected, err)
 			}
-			g.devices[node.NodeName] = mergedNode
+			return map[string]interface{}{}, nil
 		}
 	}
 	// Remove a node from the device map and readings map.
+	// remove_device is kept for nodes from older versions of the module.
 	if name, ok := cmd["remove_device"]; ok {
 		if n, ok := name.(string); ok {
-			delete(g.devices, n)
-			g.readingsMu.Lock()
-			delete(g.lastReadings, n)
-			g.readingsMu.Unlock()
+			g.RemoveDevice(n)
 		}
 	}
+	if dev, ok := cmd["deregister_device"]; ok {
+		err := g.deregisterDeviceCommand(dev)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Queue a downlink to send to a node.
+	if dl, ok := cmd["send_downlink"]; ok {
+		dlMap, ok := dl.(map[string]interface{})
+		if !ok {
+			return nil, errInvalidDownlink
+		}
+		err := g.sendDownlinkCommand(ctx, dlMap)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"send_downlink": "queued"}, nil
+	}
+	// Get the recent uplinks of a node, waiting for a new one.
+	if up, ok := cmd["get_uplinks"]; ok {
+		upMap, ok := up.(map[string]interface{})
+		if !ok {
+			return nil, errInvalidGetUplinks
+		}
+		return g.getUplinksCommand(ctx, upMap)
+	}
+	// Get the kept uplinks of a node with the times they were received.
+	if hist, ok := cmd["history"]; ok {
+		histMap, ok := hist.(map[string]interface{})
+		if !ok {
+			return nil, errInvalidHistory
+		}
+		return g.historyCommand(histMap)
+	}
+	// Decode a payload with a node's decoder without receiving an uplink.
+	if dec, ok := cmd["decode"]; ok {
+		decMap, ok := dec.(map[string]interface{})
+		if !ok {
+			return nil, errInvalidDecode
+		}
+		return g.decodeCommand(ctx, decMap)
+	}
+	// Replace the session keys of an ABP node.
+	if keys, ok := cmd["update_keys"]; ok {
+		keysMap, ok := keys.(map[string]interface{})
+		if !ok {
+			return nil, errInvalidUpdateKeys
+		}
+		if err := g.updateKeysCommand(keysMap); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"update_keys": "updated"}, nil
+	}
+	// Change the rx1 delay of a joined device with a RXTimingSetupReq.
+	if req, ok := cmd["set_rx_delay"]; ok {
+		reqMap, ok := req.(map[string]interface{})
+		if !ok {
+			return nil, errInvalidSetRXDelay
+		}
+		if err := g.setRXDelayCommand(reqMap); err != nil {
+			return nil, err
+		}
+		if err := g.dispatchDownlinks(ctx, reqMap["device"].(string)); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"set_rx_delay": "queued"}, nil
+	}
+	// Limit the duty cycle of a joined device with a DutyCycleReq.
+	if req, ok := cmd["set_duty_cycle"]; ok {
+		reqMap, ok := req.(map[string]interface{})
+		if !ok {
+			return nil, errInvalidSetDutyCycle
+		}
+		if err := g.setDutyCycleCommand(reqMap); err != nil {
+			return nil, err
+		}
+		if err := g.dispatchDownlinks(ctx, reqMap["device"].(string)); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"set_duty_cycle": "queued"}, nil
+	}
+	// Change the max EIRP and dwell times of a joined device with a TxParamSetupReq.
+	if req, ok := cmd["set_tx_params"]; ok {
+		reqMap, ok := req.(map[string]interface{})
+		if !ok {
+			return nil, errInvalidSetTxParams
+		}
+		if err := g.setTxParamsCommand(reqMap); err != nil {
+			return nil, err
+		}
+		if err := g.dispatchDownlinks(ctx, reqMap["device"].(string)); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"set_tx_params": "queued"}, nil
+	}
+	// Add or change a channel of a joined device with a NewChannelReq.
+	if req, ok := cmd["new_channel"]; ok {
+		reqMap, ok := req.(map[string]interface{})
+		if !ok {
+			return nil, errInvalidNewChannel
+		}
+		if err := g.newChannelCommand(reqMap); err != nil {
+			return nil, err
+		}
+		if err := g.dispatchDownlinks(ctx, reqMap["device"].(string)); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"new_channel": "queued"}, nil
+	}
+	// Read the decoders of a device or path again after they were changed.
+	if req, ok := cmd["reload_decoder"]; ok {
+		reqMap, ok := req.(map[string]interface{})
+		if !ok {
+			return nil, errReloadDecoder
+		}
+		if err := g.reloadDecoderCommand(reqMap); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"reload_decoder": "reloaded"}, nil
+	}
+	// List the registered devices with their session state.
+	if _, ok := cmd["list_devices"]; ok {
+		return map[string]interface{}{"devices": g.listDevices()}, nil
+	}
+	// Report whether the gateway is receiving, for supervisors to detect a wedged gateway.
+	if _, ok := cmd["health"]; ok {
+		return g.healthCommand(), nil
+	}
 
 	return map[string]interface{}{}, nil
 }
 
+// deregisterDeviceCommand removes the device from the deregister_device docommand.
+// The device is identified by node name, either as a string or a map with name or hex dev_addr.
+func (g *Gateway) deregisterDeviceCommand(dev interface{}) error {
+	switch d := dev.(type) {
+	case string:
+		g.RemoveDevice(d)
+		return nil
+	case map[string]interface{}:
+		if name, ok := d["name"].(string); ok {
+			g.RemoveDevice(name)
+			return nil
+		}
+		addrHex, ok := d["dev_addr"].(string)
+		if !ok {
+			return errInvalidDeregister
+		}
+		addr, err := hex.DecodeString(addrHex)
+		if err != nil {
+			return fmt.Errorf("invalid dev_addr: %w", err)
+		}
+		g.mu.Lock()
+		device, err := matchDeviceAddr(addr, g.devices)
+		g.mu.Unlock()
+		if err != nil {
+			return errNoDevice
+		}
+		g.RemoveDevice(device.NodeName)
+		return nil
+	default:
+		return errInvalidDeregister
+	}
+}
+
+// updateKeysCommand replaces the session keys of the ABP device from the update_keys docommand.
+// Only the keys in the command are replaced. The device starts a new session with the keys, so its frame counters
+// are reset and uplinks with the old keys are rejected, unless grace_period_s is set to accept them for a while
+// from devices that haven't switched to the new keys yet.
+func (g *Gateway) updateKeysCommand(cmd map[string]interface{}) error {
+	name, ok := cmd["device"].(string)
+	if !ok {
+		return errInvalidUpdateKeys
+	}
+	var grace time.Duration
+	if value, ok := cmd["grace_period_s"]; ok {
+		seconds, ok := value.(float64)
+		if !ok || seconds <= 0 {
+			return errInvalidKeyGrace
+		}
+		grace = time.Duration(seconds * float64(time.Second))
+	}
+	keys := make(map[string][]byte)
+	for _, attribute := range []string{"app_s_key", "network_s_key", "f_nwk_s_int_key", "s_nwk_s_int_key", "nwk_s_enc_key"} {
+		value, ok := cmd[attribute]
+		if !ok {
+			continue
+		}
+		hexKey, ok := value.(string)
+		if !ok {
+			return errInvalidUpdateKeys
+		}
+		key, err := hex.DecodeString(hexKey)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", attribute, err)
+		}
+		keys[attribute] = key
+	}
+	if len(keys) == 0 {
+		return errInvalidUpdateKeys
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	device, ok := g.devices[name]
+	if !ok {
+		return errNoDevice
+	}
+	if device.JoinType != "ABP" {
+		return errUpdateKeysOTAA
+	}
+
+	// validate the keys on a copy so the device isn't changed if one is invalid.
+	updated := &node.Node{
+		NodeName:       device.NodeName,
+		JoinType:       device.JoinType,
+		LorawanVersion: device.LorawanVersion,
+		DecoderPath:    device.DecoderPath,
+		DecoderScript:  device.DecoderScript,
+		DecoderFormat:  device.DecoderFormat,
+		Addr:           device.Addr,
+		AppSKey:        device.AppSKey,
+		NwkSKey:        device.NwkSKey,
+		FNwkSIntKey:    device.FNwkSIntKey,
+		SNwkSIntKey:    device.SNwkSIntKey,
+		NwkSEncKey:     device.NwkSEncKey,
+	}
+	for attribute, key := range keys {
+		switch attribute {
+		case "app_s_key":
+			updated.AppSKey = key
+		case "network_s_key":
+			updated.NwkSKey = key
+		case "f_nwk_s_int_key":
+			updated.FNwkSIntKey = key
+		case "s_nwk_s_int_key":
+			updated.SNwkSIntKey = key
+		case "nwk_s_enc_key":
+			updated.NwkSEncKey = key
+		}
+	}
+	if err := validateDevice(updated); err != nil {
+		return err
+	}
+
+	// uplinks are matched to the old or new session by their MIC, so it must be computed with a new key.
+	if grace > 0 && !micKeysChanged(device, updated) {
+		return errKeyGraceMIC
+	}
+
+	device.PreviousSession = nil
+	if grace > 0 {
+		device.PreviousSession = &node.Node{
+			NodeName:       device.NodeName,
+			LorawanVersion: device.LorawanVersion,
+			AppSKey:        device.AppSKey,
+			NwkSKey:        device.NwkSKey,
+			FNwkSIntKey:    device.FNwkSIntKey,
+			SNwkSIntKey:    device.SNwkSIntKey,
+			NwkSEncKey:     device.NwkSEncKey,
+			FCntUp:         device.FCntUp,
+			FCntUpValid:    device.FCntUpValid,
+		}
+		device.PreviousSessionExpires = time.Now().Add(grace)
+	}
+	device.AppSKey = updated.AppSKey
+	device.NwkSKey = updated.NwkSKey
+	device.FNwkSIntKey = updated.FNwkSIntKey
+	device.SNwkSIntKey = updated.SNwkSIntKey
+	device.NwkSEncKey = updated.NwkSEncKey
+	device.FCntUp = 0
+	device.FCntUpValid = false
+	device.FCntDown = 0
+	g.saveSessionLocked(device)
+	g.logger.Infof("updated session keys of node %s", name)
+	return nil
+}
+
+// micKeysChanged returns true if the updated device computes the uplink MIC with a different key than the device.
+func micKeysChanged(device, updated *node.Node) bool {
+	if device.LorawanVersion != "1.1.0" {
+		return !bytes.Equal(device.NwkSKey, updated.NwkSKey)
+	}
+	return !bytes.Equal(device.SNwkSIntKey, updated.SNwkSIntKey) || !bytes.Equal(device.FNwkSIntKey, updated.FNwkSIntKey)
+}
+
+// listDevices returns the registered devices sorted by name for the list_devices docommand.
+// OTAA devices that haven't joined have no dev addr, devices the gateway hasn't received an uplink from have no last_seen.
+func (g *Gateway) listDevices() []interface{} {
+	g.mu.Lock()
+	devices := make([]map[string]interface{}, 0, len(g.devices))
+	for _, device := range g.devices {
+		d := map[string]interface{}{
+			"name":            device.NodeName,
+			"dev_addr":        hex.EncodeToString(device.Addr),
+			"join_type":       device.JoinType,
+			"class":           device.Class,
+			"lorawan_version": device.LorawanVersion,
+			"fcnt_down":       int(device.FCntDown),
+		}
+		if device.FCntUpValid {
+			d["fcnt_up"] = int(device.FCntUp)
+		}
+		if device.PendingRXTimingDelay != nil {
+			d["pending_rx_delay_s"] = int(*device.PendingRXTimingDelay)
+		}
+		if device.MaxDutyCycle != nil {
+			d["max_duty_cycle"] = int(*device.MaxDutyCycle)
+		}
+		if device.PendingMaxDutyCycle != nil {
+			d["pending_max_duty_cycle"] = int(*device.PendingMaxDutyCycle)
+		}
+		if device.TxParams != nil {
+			d["tx_params"] = txParamsMap(*device.TxParams)
+		}
+		if device.PendingTxParams != nil {
+			d["pending_tx_params"] = txParamsMap(*device.PendingTxParams)
+		}
+		devices = append(devices, d)
+	}
+	g.mu.Unlock()
+
+	g.readingsMu.Lock()
+	for _, d := range devices {
+		if stats, ok := g.stats[d["name"].(string)]; ok {
+			d["last_seen"] = stats.lastUplink.Format(time.RFC3339)
+		}
+	}
+	g.readingsMu.Unlock()
+
+	slices.SortFunc(devices, func(a, b map[string]interface{}) int {
+		return strings.Compare(a["name"].(string), b["name"].(string))
+	})
+	list := make([]interface{}, len(devices))
+	for i, d := range devices {
+		list[i] = d
+	}
+	return list
+}
+
+// AddDevice adds the device to the gateway, so uplinks from it are decoded and downlinks can be sent to it.
+// Devices can be added while the gateway is running. If a device with the same name was already added it is
+// updated, keeping its session. It is an error for two devices to have the same dev addr or dev EUI.
+func (g *Gateway) AddDevice(device *node.Node) error {
+	if err := validateDevice(device); err != nil {
+		return err
+	}
+	return g.registerDevice(device)
+}
+
+// validateDevice checks the device has a name, a decoder and the keys of its join type and LoRaWAN version.
+func validateDevice(device *node.Node) error {
+	if device.NodeName == "" {
+		return fmt.Errorf("%w: name is required", errInvalidDevice)
+	}
+	if device.DecoderPath == "" && device.DecoderScript == "" && device.DecoderFormat == "" {
+		return fmt.Errorf("%w: %s has no decoder", errInvalidDevice, device.NodeName)
+	}
+
+	type key struct {
+		name   string
+		value  []byte
+		length int
+	}
+	var keys []key
+	switch device.JoinType {
+	case "OTAA":
+		keys = []key{{"dev EUI", device.DevEui, 8}, {"app key", device.AppKey, 16}}
+		if device.LorawanVersion == "1.1.0" {
+			keys = append(keys, key{"network key", device.NwkKey, 16})
+		}
+	case "ABP":
+		keys = []key{{"dev addr", device.Addr, 4}, {"app session key", device.AppSKey, 16}}
+		if device.LorawanVersion == "1.1.0" {
+			keys = append(keys,
+				key{"f_nwk_s_int_key", device.FNwkSIntKey, 16},
+				key{"s_nwk_s_int_key", device.SNwkSIntKey, 16},
+				key{"nwk_s_enc_key", device.NwkSEncKey, 16},
+			)
+		} else {
+			keys = append(keys, key{"network session key", device.NwkSKey, 16})
+		}
+	default:
+		return fmt.Errorf("%w: %s", errUnexpectedJoinType, device.JoinType)
+	}
+	for _, k := range keys {
+		if len(k.value) != k.length {
+			return fmt.Errorf("%w: %s of %s must be %d bytes", errInvalidDevice, k.name, device.NodeName, k.length)
+		}
+	}
+	return nil
+}
+
+// registerDevice adds the device without validating it.
+func (g *Gateway) registerDevice(newNode *node.Node) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if newNode.RX2DataRate != nil {
+		if _, ok := g.region.dataRates[*newNode.RX2DataRate]; !ok {
+			return fmt.Errorf("%w: DR%d in %s", errInvalidRX2DataRate, *newNode.RX2DataRate, g.region.name)
+		}
+	}
+	if f := newNode.RX2Frequency; f != nil && (*f < g.region.freqRange[0] || *f > g.region.freqRange[1]) {
+		return fmt.Errorf("%w: %d Hz in %s", errInvalidRX2Frequency, *f, g.region.name)
+	}
+
+	oldNode, exists := g.devices[newNode.NodeName]
+	if exists {
+		// joined devices keep the receive windows of their join accept until they join again.
+		if newNode.JoinType == "OTAA" && len(oldNode.Addr) > 0 && g.region.rxSettings(newNode) != g.region.rxSettings(oldNode) {
+			g.logger.Warnf("receive window settings of node %s changed, they apply once the device joins again", newNode.NodeName)
+		}
+		// node with that name already exists, merge them
+		mergedNode, err := mergeNodes(newNode, oldNode)
+		if err != nil {
+			return err
+		}
+		newNode = mergedNode
+	} else if g.sessions.restore(newNode) {
+		// the gateway restarted, continue the session the device had before.
+		g.logger.Debugf("restored session of node %s", newNode.NodeName)
+	}
+
+	// uplinks are matched to nodes by dev addr, so two nodes can't share one.
+	// OTAA nodes that haven't joined yet have no dev addr.
+	if len(newNode.Addr) > 0 {
+		for name, device := range g.devices {
+			if name != newNode.NodeName && bytes.Equal(device.Addr, newNode.Addr) {
+				return fmt.Errorf("%w: %s and %s both use dev addr %x", errDuplicateDevAddr, newNode.NodeName, name, newNode.Addr)
+			}
+		}
+	}
+	// join requests are matched to nodes by dev EUI.
+	if newNode.JoinType == "OTAA" && len(newNode.DevEui) > 0 {
+		for name, device := range g.devices {
+			if name != newNode.NodeName && device.JoinType == "OTAA" && bytes.Equal(device.DevEui, newNode.DevEui) {
+				return fmt.Errorf("%w: %s and %s both use dev EUI %x", errDuplicateDevEUI, newNode.NodeName, name, newNode.DevEui)
+			}
+		}
+	}
+
+	g.devices[newNode.NodeName] = newNode
+	g.uplinks.setSize(newNode.NodeName, newNode.HistorySize)
+	return nil
+}
+
+// RemoveDevice removes the device along with its readings and queued downlinks.
+// Nothing happens if no device has the name.
+func (g *Gateway) RemoveDevice(name string) {
+	g.mu.Lock()
+	delete(g.devices, name)
+	delete(g.downlinks, name)
+	delete(g.routes, name)
+	g.mu.Unlock()
+
+	g.readingsMu.Lock()
+	delete(g.lastReadings, name)
+	delete(g.stats, name)
+	g.readingsMu.Unlock()
+	g.uplinks.remove(name)
+	g.warnings.remove(name)
+	g.fragments.remove(name)
+
+	deleteDeviceMetrics(name)
+}
+
+// sendDownlinkCommand queues the downlink from the send_downlink docommand.
+// The device is identified by node name (device) or by hex dev_addr.
+// The payload is either hex (payload) or an object (object) encoded with the Encode function of the device's decoder.
+func (g *Gateway) sendDownlinkCommand(ctx context.Context, cmd map[string]interface{}) error {
+	var devAddr []byte
+	switch {
+	case cmd["dev_addr"] != nil:
+		addr, ok := cmd["dev_addr"].(string)
+		if !ok {
+			return errInvalidDownlink
+		}
+		var err error
+		devAddr, err = hex.DecodeString(addr)
+		if err != nil {
+			return fmt.Errorf("invalid dev_addr: %w", err)
+		}
+	case cmd["device"] != nil:
+		name, ok := cmd["device"].(string)
+		if !ok {
+			return errInvalidDownlink
+		}
+		g.mu.Lock()
+		device, ok := g.devices[name]
+		if ok {
+			devAddr = device.Addr
+		}
+		g.mu.Unlock()
+		if !ok {
+			return errNoDevice
+		}
+		// an OTAA device has no dev addr until it joins.
+		if len(devAddr) == 0 {
+			return errNotJoined
+		}
+	default:
+		return errInvalidDownlink
+	}
+
+	fPort, ok := cmd["fport"].(float64)
+	if !ok {
+		return errInvalidDownlink
+	}
+
+	var payload []byte
+	switch {
+	case cmd["object"] != nil:
+		// encode the object with the Encode function from the device's decoder file.
+		obj, ok := cmd["object"].(map[string]interface{})
+		if !ok {
+			return errInvalidDownlink
+		}
+		g.mu.Lock()
+		device, err := matchDeviceAddr(devAddr, g.devices)
+		g.mu.Unlock()
+		if err != nil {
+			return errNoDevice
+		}
+		payload, err = g.encodePayload(ctx, uint8(fPort), device, obj)
+		if err != nil {
+			return fmt.Errorf("error encoding downlink: %w", err)
+		}
+	case cmd["payload"] != nil:
+		payloadHex, ok := cmd["payload"].(string)
+		if !ok {
+			return errInvalidDownlink
+		}
+		var err error
+		payload, err = hex.DecodeString(payloadHex)
+		if err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+	default:
+		return errInvalidDownlink
+	}
+
+	return g.SendDownlink(ctx, devAddr, uint8(fPort), payload)
+}
+
+// decodeCommand runs the device's decoder on the payload from the decode docommand, so decoders can be
+// tested against captured payloads. The payload is hex or base64 encoded.
+func (g *Gateway) decodeCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	name, ok := cmd["device"].(string)
+	if !ok {
+		return nil, errInvalidDecode
+	}
+	fPort, ok := cmd["fport"].(float64)
+	if !ok {
+		return nil, errInvalidDecode
+	}
+	if fPort < 1 || fPort > 223 {
+		return nil, errInvalidFPort
+	}
+	encoded, ok := cmd["payload"].(string)
+	if !ok {
+		return nil, errInvalidDecode
+	}
+
+	var payload []byte
+	var err error
+	switch cmd["encoding"] {
+	case nil, "hex":
+		payload, err = hex.DecodeString(encoded)
+	case "base64":
+		payload, err = base64.StdEncoding.DecodeString(encoded)
+	default:
+		return nil, errInvalidEncoding
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload: %w", err)
+	}
+
+	g.mu.Lock()
+	device, ok := g.devices[name]
+	g.mu.Unlock()
+	if !ok {
+		return nil, errNoDevice
+	}
+
+	readings, err := g.decodePayload(ctx, uint8(fPort), device, payload)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding payload: %w", err)
+	}
+	return readings, nil
+}
+
 // mergeNodes merge the fields from the oldNode and the newNode sent from reconfigure.
 func mergeNodes(newNode, oldNode *node.Node) (*node.Node, error) {
 	mergedNode := &node.Node{}
 	mergedNode.DecoderPath = newNode.DecoderPath
+	mergedNode.DecoderScript = newNode.DecoderScript
+	mergedNode.DecoderFormat = newNode.DecoderFormat
+	mergedNode.DecoderFunction = newNode.DecoderFunction
+	mergedNode.PortDecoders = newNode.PortDecoders
+	mergedNode.DecoderFields = newNode.DecoderFields
+	mergedNode.DecoderStages = newNode.DecoderStages
+	mergedNode.DecoderVars = newNode.DecoderVars
+	mergedNode.DecoderHelpers = newNode.DecoderHelpers
+	mergedNode.PortAllowlist = newNode.PortAllowlist
+	mergedNode.PortDenylist = newNode.PortDenylist
+	mergedNode.DecoderTimeout = newNode.DecoderTimeout
+	mergedNode.DecoderMaxOutputBytes = newNode.DecoderMaxOutputBytes
+	mergedNode.HistorySize = newNode.HistorySize
+	mergedNode.LorawanVersion = newNode.LorawanVersion
+	mergedNode.Class = newNode.Class
+	mergedNode.RX1DROffset = newNode.RX1DROffset
+	mergedNode.RX2DataRate = newNode.RX2DataRate
+	mergedNode.RXDelay = newNode.RXDelay
+	mergedNode.RX2Frequency = newNode.RX2Frequency
+	// the device keeps the rx1 delay it was sent after joining until it joins again.
+	mergedNode.RXTimingDelay = oldNode.RXTimingDelay
+	mergedNode.PendingRXTimingDelay = oldNode.PendingRXTimingDelay
+	mergedNode.MaxDutyCycle = oldNode.MaxDutyCycle
+	mergedNode.PendingMaxDutyCycle = oldNode.PendingMaxDutyCycle
+	mergedNode.TxParams = oldNode.TxParams
+	mergedNode.PendingTxParams = oldNode.PendingTxParams
 	mergedNode.NodeName = newNode.NodeName
 	mergedNode.JoinType = newNode.JoinType
+	mergedNode.RelaxFCntCheck = newNode.RelaxFCntCheck
 
 	switch mergedNode.JoinType {
 	case "OTAA":
-		// if join type is OTAA - keep the appSKey, dev addr from the old node.
+		// if join type is OTAA - keep the session keys, dev addr from the old node.
 		// These fields were determined by the gateway if the join procedure was done.
 		mergedNode.Addr = oldNode.Addr
 		mergedNode.AppSKey = oldNode.AppSKey
+		mergedNode.NwkSKey = oldNode.NwkSKey
+		mergedNode.FNwkSIntKey = oldNode.FNwkSIntKey
+		mergedNode.SNwkSIntKey = oldNode.SNwkSIntKey
+		mergedNode.NwkSEncKey = oldNode.NwkSEncKey
+		mergedNode.JoinNonce = oldNode.JoinNonce
+		mergedNode.FCntUp = oldNode.FCntUp
+		mergedNode.FCntUpValid = oldNode.FCntUpValid
+		mergedNode.FCntDown = oldNode.FCntDown
 		// The appkey and deveui are obtained by the config in OTAA,
 		// if these were changed during reconfigure the join procedure needs to be redone
 		mergedNode.AppKey = newNode.AppKey
+		mergedNode.NwkKey = newNode.NwkKey
 		mergedNode.DevEui = newNode.DevEui
+		// keep the dev nonces used by the device so old join requests can't be replayed after a reconfigure.
+		if bytes.Equal(newNode.DevEui, oldNode.DevEui) {
+			mergedNode.DevNonces = oldNode.DevNonces
+		}
 	case "ABP":
-		// if join type is ABP get the new appSKey and addr from the new config.
+		// if join type is ABP get the new session keys and addr from the new config.
 		// Don't need appkey and DevEui for ABP.
 		mergedNode.Addr = newNode.Addr
 		mergedNode.AppSKey = newNode.AppSKey
+		mergedNode.NwkSKey = newNode.NwkSKey
+		mergedNode.FNwkSIntKey = newNode.FNwkSIntKey
+		mergedNode.SNwkSIntKey = newNode.SNwkSIntKey
+		mergedNode.NwkSEncKey = newNode.NwkSEncKey
+		// The frame counters only carry over if the device is still using the same session.
+		if bytes.Equal(newNode.Addr, oldNode.Addr) {
+			mergedNode.FCntUp = oldNode.FCntUp
+			mergedNode.FCntUpValid = oldNode.FCntUpValid
+			mergedNode.FCntDown = oldNode.FCntDown
+			mergedNode.PreviousSession = oldNode.PreviousSession
+			mergedNode.PreviousSessionExpires = oldNode.PreviousSessionExpires
+		}
 	default:
 		return nil, errUnexpectedJoinType
 	}
@@ -320,6 +1231,27 @@ func convertToNode(mapNode map[string]interface{}) (*node.Node, error) {
 	if err != nil {
 		return nil, err
 	}
+	node.NwkSKey, err = convertToBytes(mapNode["NwkSKey"])
+	if err != nil {
+		return nil, err
+	}
+	// the LoRaWAN 1.1 keys are only set for 1.1 devices.
+	node.NwkKey, err = convertToOptionalBytes(mapNode["NwkKey"])
+	if err != nil {
+		return nil, err
+	}
+	node.FNwkSIntKey, err = convertToOptionalBytes(mapNode["FNwkSIntKey"])
+	if err != nil {
+		return nil, err
+	}
+	node.SNwkSIntKey, err = convertToOptionalBytes(mapNode["SNwkSIntKey"])
+	if err != nil {
+		return nil, err
+	}
+	node.NwkSEncKey, err = convertToOptionalBytes(mapNode["NwkSEncKey"])
+	if err != nil {
+		return nil, err
+	}
 	node.DevEui, err = convertToBytes(mapNode["DevEui"])
 	if err != nil {
 		return nil, err
@@ -331,10 +1263,133 @@ func convertToNode(mapNode map[string]interface{}) (*node.Node, error) {
 
 	node.NodeName = mapNode["NodeName"].(string)
 	node.JoinType = mapNode["JoinType"].(string)
+	node.LorawanVersion, _ = mapNode["LorawanVersion"].(string)
+	// nodes from older versions of the module don't send a class.
+	node.Class, _ = mapNode["Class"].(string)
+	if node.Class == "" {
+		node.Class = "A"
+	}
+	node.DecoderScript, _ = mapNode["DecoderScript"].(string)
+	node.DecoderFormat, _ = mapNode["DecoderFormat"].(string)
+	node.DecoderFunction, _ = mapNode["DecoderFunction"].(string)
+	if ports, ok := mapNode["PortDecoders"].(map[string]interface{}); ok {
+		node.PortDecoders = make(map[string]string, len(ports))
+		for port, path := range ports {
+			node.PortDecoders[port], _ = path.(string)
+		}
+	}
+
+	// the timeout is sent as nanoseconds.
+	if timeout, ok := mapNode["DecoderTimeout"].(float64); ok {
+		node.DecoderTimeout = time.Duration(timeout)
+	}
+	if maxOutput, ok := mapNode["DecoderMaxOutputBytes"].(float64); ok {
+		node.DecoderMaxOutputBytes = int(maxOutput)
+	}
+	if size, ok := mapNode["HistorySize"].(float64); ok {
+		node.HistorySize = int(size)
+	}
+	node.DecoderStages = convertToStrings(mapNode["DecoderStages"])
+	node.DecoderVars, _ = mapNode["DecoderVars"].(map[string]interface{})
+	node.DecoderHelpers, _ = mapNode["DecoderHelpers"].(bool)
+	node.RelaxFCntCheck, _ = mapNode["RelaxFCntCheck"].(bool)
+	node.DecoderFields = convertToDecoderFields(mapNode["DecoderFields"])
+	node.PortAllowlist = convertToInts(mapNode["PortAllowlist"])
+	node.PortDenylist = convertToInts(mapNode["PortDenylist"])
+	node.RX1DROffset = convertToOptionalUint8(mapNode["RX1DROffset"])
+	node.RX2DataRate = convertToOptionalUint8(mapNode["RX2DataRate"])
+	node.RX2Frequency = convertToOptionalUint32(mapNode["RX2Frequency"])
+	node.RXDelay = convertToOptionalUint8(mapNode["RXDelay"])
 
 	return node, nil
 }
 
+// convertToDecoderFields converts the fields decoder format's fields from the docommand map.
+func convertToDecoderFields(v interface{}) []node.DecoderField {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	fields := make([]node.DecoderField, 0, len(list))
+	for _, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var field node.DecoderField
+		field.Name, _ = m["name"].(string)
+		field.Type, _ = m["type"].(string)
+		field.Endianness, _ = m["endianness"].(string)
+		if offset, ok := m["offset"].(float64); ok {
+			field.Offset = int(offset)
+		}
+		if length, ok := m["length"].(float64); ok {
+			field.Length = int(length)
+		}
+		field.Scale, _ = m["scale"].(float64)
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// convertToInts converts the list of numbers from the docommand map, a missing field is returned as nil.
+func convertToInts(v interface{}) []int {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	ints := make([]int, 0, len(list))
+	for _, item := range list {
+		if f, ok := item.(float64); ok {
+			ints = append(ints, int(f))
+		}
+	}
+	return ints
+}
+
+// convertToStrings converts the list of strings from the docommand map, a missing field is returned as nil.
+func convertToStrings(v interface{}) []string {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	strs := make([]string, 0, len(list))
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
+
+// convertToOptionalUint8 converts the number from the docommand map, a missing field is returned as nil.
+func convertToOptionalUint8(v interface{}) *uint8 {
+	f, ok := v.(float64)
+	if !ok {
+		return nil
+	}
+	b := uint8(f)
+	return &b
+}
+
+// convertToOptionalUint32 converts the number from the docommand map, a missing field is returned as nil.
+func convertToOptionalUint32(v interface{}) *uint32 {
+	f, ok := v.(float64)
+	if !ok {
+		return nil
+	}
+	u := uint32(f)
+	return &u
+}
+
+// convertToOptionalBytes converts the field like convertToBytes, a missing field is returned as nil.
+func convertToOptionalBytes(key interface{}) ([]byte, error) {
+	if key == nil {
+		return nil, nil
+	}
+	return convertToBytes(key)
+}
+
 // convertToBytes converts the interface{} field from the docommand map into a byte array.
 func convertToBytes(key interface{}) ([]byte, error) {
 	bytes, ok := key.([]interface{})
@@ -356,19 +1411,88 @@ func convertToBytes(key interface{}) ([]byte, error) {
 	return res, nil
 }
 
+// max time Close waits for the in-flight uplinks and downlinks to finish.
+const closeTimeout = 5 * time.Second
+
+// stopWorkers cancels the context of the workers, which interrupts running decoders and downlinks waiting for
+// their receive window, and waits for the workers to return.
+// Workers still running after closeTimeout are abandoned so a stuck worker doesn't block the close.
+func (g *Gateway) stopWorkers() {
+	done := make(chan struct{})
+	go func() {
+		g.workers.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(closeTimeout):
+		g.logger.Warnf("in-flight uplinks didn't finish within %s, abandoning them", closeTimeout)
+	}
+}
+
 func (g *Gateway) Close(ctx context.Context) error {
+	// closing the listeners unblocks their receive loops so the workers can stop.
+	if g.udp != nil {
+		if err := g.udp.close(); err != nil {
+			g.logger.Errorf("error closing packet forwarder listener: %s", err)
+		}
+		g.udp = nil
+	}
+	if g.station != nil {
+		if err := g.station.close(); err != nil {
+			g.logger.Errorf("error closing basics station server: %s", err)
+		}
+		g.station = nil
+	}
 	if g.workers != nil {
-		g.workers.Stop()
+		g.stopWorkers()
 	}
-	errCode := C.stopGateway()
-	if errCode != 0 {
-		g.logger.Errorf("error stopping gateway")
+	if g.started {
+		errCode := C.stopGateway()
+		if errCode != 0 {
+			g.logger.Errorf("error stopping gateway")
+		}
 	}
 	return nil
 }
 
 func (g *Gateway) Readings(ctx context.Context, extra map[string]interface{}) (map[string]interface{}, error) {
+	// nodes get the dev addr of their session from the readings, OTAA nodes are only assigned one when they join.
+	g.mu.Lock()
+	devAddrs := make(map[string]string, len(g.devices))
+	for name, device := range g.devices {
+		if len(device.Addr) > 0 {
+			devAddrs[name] = hex.EncodeToString(device.Addr)
+		}
+	}
+	g.mu.Unlock()
+
 	g.readingsMu.Lock()
 	defer g.readingsMu.Unlock()
-	return g.lastReadings, nil
+
+	// each node's readings have a stats reading with its uplink counts.
+	readings := make(map[string]interface{}, len(g.lastReadings))
+	for name, r := range g.lastReadings {
+		readings[name] = r
+	}
+	now := time.Now()
+	for name, stats := range g.stats {
+		r, _ := readings[name].(map[string]interface{})
+		r = maps.Clone(r)
+		if r == nil {
+			r = map[string]interface{}{}
+		}
+		r["stats"] = stats.readings(now)
+		readings[name] = r
+	}
+	for name, devAddr := range devAddrs {
+		r, _ := readings[name].(map[string]interface{})
+		r = maps.Clone(r)
+		if r == nil {
+			r = map[string]interface{}{}
+		}
+		r["dev_addr"] = devAddr
+		readings[name] = r
+	}
+	return readings, nil
 }
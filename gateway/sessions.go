@@ -0,0 +1,148 @@
+package gateway
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gateway/node"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// deviceSession is the session state of a device that is kept across restarts.
+type deviceSession struct {
+	Addr        []byte          `json:"dev_addr,omitempty"`
+	AppSKey     []byte          `json:"app_s_key,omitempty"`
+	NwkSKey     []byte          `json:"network_s_key,omitempty"`
+	FNwkSIntKey []byte          `json:"f_nwk_s_int_key,omitempty"`
+	SNwkSIntKey []byte          `json:"s_nwk_s_int_key,omitempty"`
+	NwkSEncKey  []byte          `json:"nwk_s_enc_key,omitempty"`
+	JoinNonce   uint32          `json:"join_nonce,omitempty"`
+	FCntUp      uint32          `json:"fcnt_up"`
+	FCntUpValid bool            `json:"fcnt_up_valid"`
+	FCntDown    uint32          `json:"fcnt_down"`
+	DevNonces   map[uint16]bool `json:"dev_nonces,omitempty"`
+	RXDelay     *uint8          `json:"rx_delay,omitempty"`
+}
+
+// sessionStore persists the session state of devices to a file, so frame counters, OTAA sessions and
+// used dev nonces survive restarts. A nil store doesn't persist anything.
+type sessionStore struct {
+	mu       sync.Mutex
+	path     string
+	sessions map[string]deviceSession
+}
+
+// defaultSessionStorePath returns the session file of the gateway in the module's data directory.
+func defaultSessionStorePath(gatewayName string) string {
+	return filepath.Join(os.Getenv("VIAM_MODULE_DATA"), gatewayName+"-sessions.json")
+}
+
+// openSessionStore loads the sessions saved at path, the file is created on the first save.
+func openSessionStore(path string) (*sessionStore, error) {
+	s := &sessionStore{path: path, sessions: map[string]deviceSession{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session store: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.sessions); err != nil {
+		return nil, fmt.Errorf("failed to parse session store %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// sessionKey identifies the device in the store.
+// OTAA devices keep their dev EUI across joins, ABP sessions are tied to the dev addr.
+func sessionKey(device *node.Node) string {
+	if device.JoinType == "ABP" {
+		return "abp-" + hex.EncodeToString(device.Addr)
+	}
+	return "otaa-" + hex.EncodeToString(device.DevEui)
+}
+
+// restore sets the saved session state on the device, it returns false if the device has none.
+// ABP devices only restore their frame counters and rx1 delay, their session keys come from the config.
+func (s *sessionStore) restore(device *node.Node) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[sessionKey(device)]
+	if !ok {
+		return false
+	}
+
+	device.FCntUp = session.FCntUp
+	device.FCntUpValid = session.FCntUpValid
+	device.FCntDown = session.FCntDown
+	device.RXTimingDelay = session.RXDelay
+	if device.JoinType == "ABP" {
+		return true
+	}
+	device.Addr = session.Addr
+	device.AppSKey = session.AppSKey
+	device.NwkSKey = session.NwkSKey
+	device.FNwkSIntKey = session.FNwkSIntKey
+	device.SNwkSIntKey = session.SNwkSIntKey
+	device.NwkSEncKey = session.NwkSEncKey
+	device.JoinNonce = session.JoinNonce
+	device.DevNonces = maps.Clone(session.DevNonces)
+	return true
+}
+
+// save writes the session state of the device to the store.
+// The caller must hold the gateway mutex so the device isn't modified while it is copied.
+func (s *sessionStore) save(device *node.Node) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session := deviceSession{
+		FCntUp:      device.FCntUp,
+		FCntUpValid: device.FCntUpValid,
+		FCntDown:    device.FCntDown,
+		RXDelay:     device.RXTimingDelay,
+	}
+	if device.JoinType != "ABP" {
+		session.Addr = device.Addr
+		session.AppSKey = device.AppSKey
+		session.NwkSKey = device.NwkSKey
+		session.FNwkSIntKey = device.FNwkSIntKey
+		session.SNwkSIntKey = device.SNwkSIntKey
+		session.NwkSEncKey = device.NwkSEncKey
+		session.JoinNonce = device.JoinNonce
+		session.DevNonces = maps.Clone(device.DevNonces)
+	}
+	s.sessions[sessionKey(device)] = session
+
+	data, err := json.Marshal(s.sessions)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	// write to a temporary file first so a crash mid write doesn't corrupt the store.
+	tmp := s.path + ".tmp"
+	// the file has the session keys of the devices.
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// saveSessionLocked persists the session state of the device. The caller must hold the gateway mutex.
+func (g *Gateway) saveSessionLocked(device *node.Node) {
+	if err := g.sessions.save(device); err != nil {
+		g.logger.Warnf("failed to save session of node %s: %s", device.NodeName, err)
+	}
+}
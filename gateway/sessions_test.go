@@ -0,0 +1,162 @@
+package gateway
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"gateway/node"
+	"path/filepath"
+	"testing"
+
+	"go.viam.com/rdk/logging"
+	"go.viam.com/test"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// restartTestGateway returns a new gateway with no devices using the session store at path.
+func restartTestGateway(t *testing.T, path string) *Gateway {
+	sessions, err := openSessionStore(path)
+	test.That(t, err, test.ShouldBeNil)
+	return &Gateway{
+		logger:       logging.NewTestLogger(t),
+		devices:      map[string]*node.Node{},
+		lastReadings: map[string]interface{}{},
+		region:       regions[defaultRegion],
+		netID:        defaultNetID,
+		sessions:     sessions,
+	}
+}
+
+// toStationUplink splits the data uplink into the fields of an updf message.
+func toStationUplink(phyPayload []byte) interface{} {
+	fOptsLength := int(phyPayload[5] & 0x0F)
+	up := stationUplink{
+		MHdr:       phyPayload[0],
+		DevAddr:    int32(binary.LittleEndian.Uint32(phyPayload[1:5])),
+		FCtrl:      phyPayload[5],
+		FCnt:       binary.LittleEndian.Uint16(phyPayload[6:8]),
+		FOpts:      hex.EncodeToString(phyPayload[8 : 8+fOptsLength]),
+		FPort:      int(phyPayload[8+fOptsLength]),
+		FRMPayload: hex.EncodeToString(phyPayload[9+fOptsLength : len(phyPayload)-4]),
+		MIC:        int32(binary.LittleEndian.Uint32(phyPayload[len(phyPayload)-4:])),
+		DR:         3,
+		Freq:       902300000,
+	}
+	return struct {
+		MsgType string `json:"msgtype"`
+		stationUplink
+	}{"updf", up}
+}
+
+func TestSessionStoreRestartABP(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	g := createTestGateway(t)
+	var err error
+	g.sessions, err = openSessionStore(path)
+	test.That(t, err, test.ShouldBeNil)
+	device := g.devices["test-device"]
+
+	for fCnt := uint32(1); fCnt <= 3; fCnt++ {
+		_, _, err := g.parseDataUplink(ctx, createTestUplink(t, fCnt, 1, []byte{0x15, 0x05}), testRxInfo)
+		test.That(t, err, test.ShouldBeNil)
+	}
+
+	// the restarted gateway gets the ABP node from its config, with the frame counters reset.
+	g = restartTestGateway(t, path)
+	restarted := &node.Node{
+		NodeName:    device.NodeName,
+		JoinType:    "ABP",
+		DecoderPath: device.DecoderPath,
+		Addr:        testDevAddr,
+		AppSKey:     testAppSKey,
+		NwkSKey:     testNwkSKey,
+	}
+	err = g.registerDevice(restarted)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, restarted.FCntUp, test.ShouldEqual, 3)
+
+	// a replay of the last frame is still rejected and the next frame is accepted.
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 3, 1, []byte{0x15, 0x06}), testRxInfo)
+	test.That(t, errors.Is(err, errInvalidFCnt), test.ShouldBeTrue)
+	_, readings, err := g.parseDataUplink(ctx, createTestUplink(t, 4, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+
+	// a node with a different dev addr is a new session.
+	other := &node.Node{NodeName: "other", JoinType: "ABP", Addr: []byte{0x0A, 0x0B, 0x0C, 0x0D}}
+	err = g.registerDevice(other)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, other.FCntUpValid, test.ShouldBeFalse)
+}
+
+func TestSessionStoreRestartOTAA(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "sessions.json")
+
+	// join and send an uplink through a station so the join accept and downlink are sent.
+	g, conn := startTestStation(t)
+	var err error
+	g.sessions, err = openSessionStore(path)
+	test.That(t, err, test.ShouldBeNil)
+	device := addTestOTAADevice(g)
+
+	err = conn.Write(ctx, websocket.MessageText, []byte(testStationJoinRequest))
+	test.That(t, err, test.ShouldBeNil)
+	joinAccept, err := hex.DecodeString(readTestDownlink(t, conn).PDU)
+	test.That(t, err, test.ShouldBeNil)
+	session, _ := acceptTestJoin(t, joinAccept, 0x0102)
+
+	err = g.SendDownlink(ctx, session.devAddr, 10, []byte{0x01})
+	test.That(t, err, test.ShouldBeNil)
+	uplink := createUplink(t, session.nwkSKey, session.appSKey, session.devAddr, 0, nil, 1, []byte{0x15, 0x05})
+	err = wsjson.Write(ctx, conn, toStationUplink(uplink))
+	test.That(t, err, test.ShouldBeNil)
+	readTestDownlink(t, conn)
+
+	// the restarted gateway only has the OTAA node's config, the session comes from the store.
+	g = restartTestGateway(t, path)
+	restarted := &node.Node{
+		NodeName:    device.NodeName,
+		JoinType:    "OTAA",
+		DecoderPath: device.DecoderPath,
+		AppKey:      testAppKey,
+		DevEui:      testDevEUI,
+	}
+	err = g.registerDevice(restarted)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, restarted.Addr, test.ShouldResemble, session.devAddr)
+	test.That(t, restarted.FCntDown, test.ShouldEqual, 1)
+
+	uplink = createUplink(t, session.nwkSKey, session.appSKey, session.devAddr, 1, nil, 1, []byte{0x15, 0x05})
+	name, _, err := g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, name, test.ShouldEqual, device.NodeName)
+
+	// the join request can't be replayed to reset the session.
+	_, _, err = g.parseJoinRequestPacket(createTestJoinRequest(t, 0x0102))
+	test.That(t, err, test.ShouldBeError, errDevNonceReused)
+
+	// the next downlink continues the frame counter.
+	frame, err := buildDownlink(restarted, &downlink{fPort: 10, payload: []byte{0x02}})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, binary.LittleEndian.Uint16(frame[6:8]), test.ShouldEqual, 1)
+}
+
+func TestOpenSessionStoreInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	s, err := openSessionStore(path)
+	test.That(t, err, test.ShouldBeNil)
+	// the file is created on the first save.
+	err = s.save(&node.Node{JoinType: "ABP", Addr: testDevAddr, FCntUp: 1, FCntUpValid: true})
+	test.That(t, err, test.ShouldBeNil)
+
+	s, err = openSessionStore(path)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, s.sessions["abp-01020304"].FCntUp, test.ShouldEqual, 1)
+
+	_, err = openSessionStore(t.TempDir())
+	test.That(t, err, test.ShouldNotBeNil)
+}
@@ -0,0 +1,452 @@
+package gateway
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// LoRa Basics Station LNS protocol.
+// https://doc.sm.tc/station/tcproto.html
+const (
+	// stationDiscoveryPath is where stations ask for the URI of their data connection.
+	stationDiscoveryPath = "/router-info"
+	// stationTrafficPath is the prefix of the data connection, followed by the router id.
+	stationTrafficPath = "/traffic/"
+)
+
+// stationUpInfo is the radio metadata of an uplink received by a station.
+type stationUpInfo struct {
+	RCtx    int64   `json:"rctx"`
+	XTime   int64   `json:"xtime"`
+	GPSTime int64   `json:"gpstime"`
+	RSSI    float32 `json:"rssi"` // dBm
+	SNR     float32 `json:"snr"`  // dB
+}
+
+// stationJoinRequest is a jreq message, a join request split into its fields.
+type stationJoinRequest struct {
+	MHdr     uint8         `json:"MHdr"`
+	JoinEUI  string        `json:"JoinEui"`
+	DevEUI   string        `json:"DevEui"`
+	DevNonce uint16        `json:"DevNonce"`
+	MIC      int32         `json:"MIC"`
+	DR       uint8         `json:"DR"`
+	Freq     uint32        `json:"Freq"` // Hz
+	UpInfo   stationUpInfo `json:"upinfo"`
+}
+
+// stationUplink is an updf message, a data uplink split into its fields.
+type stationUplink struct {
+	MHdr       uint8         `json:"MHdr"`
+	DevAddr    int32         `json:"DevAddr"`
+	FCtrl      uint8         `json:"FCtrl"`
+	FCnt       uint16        `json:"FCnt"`
+	FOpts      string        `json:"FOpts"` // hex
+	FPort      int           `json:"FPort"` // -1 if the uplink has no port
+	FRMPayload string        `json:"FRMPayload"`
+	MIC        int32         `json:"MIC"`
+	DR         uint8         `json:"DR"`
+	Freq       uint32        `json:"Freq"` // Hz
+	UpInfo     stationUpInfo `json:"upinfo"`
+}
+
+// stationDownlink is a dnmsg message, a class A downlink sent in the rx2 window
+// or a class C downlink sent right away.
+type stationDownlink struct {
+	MsgType  string `json:"msgtype"`
+	DevEUI   string `json:"DevEui"`
+	DC       int    `json:"dC"` // device class, 0 is class A and 2 is class C
+	DIID     int64  `json:"diid"`
+	PDU      string `json:"pdu"` // hex
+	RxDelay  int    `json:"RxDelay,omitempty"`
+	RX1DR    *uint8 `json:"RX1DR,omitempty"` // rx1 is only set if the downlink can be sent in rx1
+	RX1Freq  uint32 `json:"RX1Freq,omitempty"`
+	RX2DR    uint8  `json:"RX2DR"`
+	RX2Freq  uint32 `json:"RX2Freq"`
+	Priority int    `json:"priority"`
+	XTime    int64  `json:"xtime,omitempty"` // class C downlinks without xtime are sent right away
+	RCtx     int64  `json:"rctx"`
+}
+
+// routerConfig is the router_config message that configures the station's channel plan.
+type routerConfig struct {
+	MsgType    string                   `json:"msgtype"`
+	Region     string                   `json:"region"`
+	HWSpec     string                   `json:"hwspec"`
+	FreqRange  [2]uint32                `json:"freq_range"`
+	DRs        [16][3]int               `json:"DRs"`
+	SX1301Conf []map[string]interface{} `json:"sx1301_conf"`
+	NoCCA      bool                     `json:"nocca"`
+	NoDC       bool                     `json:"nodc"`
+	NoDwell    bool                     `json:"nodwell"`
+}
+
+// stationRx is where a packet received by a station came from.
+type stationRx struct {
+	conn   *websocket.Conn
+	devEUI string // set for join requests
+	xtime  int64
+	rctx   int64
+}
+
+// stationServer is the Basics Station LNS endpoint.
+type stationServer struct {
+	srv  *http.Server
+	ln   net.Listener
+	diid atomic.Int64 // id of the last downlink
+
+	mu    sync.Mutex
+	conns map[string]*websocket.Conn // map of router id to the station's connection
+}
+
+// startStationServer listens for Basics Station connections on addr, such as ":8887".
+func (g *Gateway) startStationServer(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for basics stations: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(stationDiscoveryPath, g.handleStationDiscovery)
+	mux.HandleFunc(stationTrafficPath, g.handleStationTraffic)
+	g.station = &stationServer{
+		srv:   &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second},
+		ln:    ln,
+		conns: map[string]*websocket.Conn{},
+	}
+	g.logger.Infof("listening for basics stations on %s", ln.Addr())
+
+	server := g.station
+	g.workers.Add(func(ctx context.Context) {
+		if err := server.srv.Serve(server.ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			g.logger.Errorf("basics station server stopped: %s", err)
+		}
+	})
+	return nil
+}
+
+// handleStationDiscovery replies to a station's {"router": id} with the URI of its data connection.
+func (g *Gateway) handleStationDiscovery(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		g.logger.Warnf("failed to accept basics station discovery: %s", err)
+		return
+	}
+	defer conn.CloseNow()
+
+	ctx := g.workers.Context()
+	var req struct {
+		Router interface{} `json:"router"`
+	}
+	if err := wsjson.Read(ctx, conn, &req); err != nil {
+		g.logger.Warnf("invalid basics station discovery request: %s", err)
+		return
+	}
+
+	// the router id is an int or an EUI string.
+	var id string
+	switch router := req.Router.(type) {
+	case string:
+		id = router
+	case float64:
+		id = strconv.FormatUint(uint64(router), 10)
+	default:
+		_ = wsjson.Write(ctx, conn, map[string]interface{}{"router": req.Router, "error": "invalid router id"})
+		return
+	}
+
+	resp := map[string]interface{}{
+		"router": req.Router,
+		"muxs":   "viam-lorawan",
+		"uri":    fmt.Sprintf("ws://%s%s%s", r.Host, stationTrafficPath, url.PathEscape(id)),
+	}
+	if err := wsjson.Write(ctx, conn, resp); err != nil {
+		g.logger.Warnf("failed to reply to basics station discovery: %s", err)
+		return
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+}
+
+// handleStationTraffic reads the messages of a station's data connection until it closes.
+func (g *Gateway) handleStationTraffic(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		g.logger.Warnf("failed to accept basics station connection: %s", err)
+		return
+	}
+	defer conn.CloseNow()
+
+	router := strings.TrimPrefix(r.URL.Path, stationTrafficPath)
+	g.logger.Infof("basics station %s connected", router)
+	g.station.addConn(router, conn)
+	defer g.station.removeConn(router, conn)
+
+	// the connection is closed when the gateway is closed.
+	ctx := g.workers.Context()
+	for {
+		_, msg, err := conn.Read(ctx)
+		if err != nil {
+			g.logger.Infof("basics station %s disconnected: %s", router, err)
+			return
+		}
+		if err := g.handleStationMessage(ctx, conn, msg); err != nil {
+			g.logger.Warnf("error handling message from basics station %s: %s", router, err)
+		}
+	}
+}
+
+func (g *Gateway) handleStationMessage(ctx context.Context, conn *websocket.Conn, msg []byte) error {
+	var header struct {
+		MsgType string `json:"msgtype"`
+	}
+	if err := json.Unmarshal(msg, &header); err != nil {
+		return err
+	}
+
+	switch header.MsgType {
+	case "version":
+		// the station sends its version when it connects and waits for the channel plan.
+		return wsjson.Write(ctx, conn, g.routerConfig())
+	case "jreq":
+		var jr stationJoinRequest
+		if err := json.Unmarshal(msg, &jr); err != nil {
+			return err
+		}
+		payload, err := jr.phyPayload()
+		if err != nil {
+			return err
+		}
+		rx, err := g.stationRxInfo(jr.DR, jr.Freq, jr.UpInfo)
+		if err != nil {
+			return err
+		}
+		rx.station = &stationRx{conn: conn, devEUI: jr.DevEUI, xtime: jr.UpInfo.XTime, rctx: jr.UpInfo.RCtx}
+		g.handlePacket(ctx, payload, rx)
+	case "updf":
+		var up stationUplink
+		if err := json.Unmarshal(msg, &up); err != nil {
+			return err
+		}
+		payload, err := up.phyPayload()
+		if err != nil {
+			return err
+		}
+		rx, err := g.stationRxInfo(up.DR, up.Freq, up.UpInfo)
+		if err != nil {
+			return err
+		}
+		rx.station = &stationRx{conn: conn, xtime: up.UpInfo.XTime, rctx: up.UpInfo.RCtx}
+		g.handlePacket(ctx, payload, rx)
+	case "timesync":
+		var ts struct {
+			TxTime float64 `json:"txtime"`
+		}
+		if err := json.Unmarshal(msg, &ts); err != nil {
+			return err
+		}
+		// gpstime is in microseconds.
+		gpsTime := time.Since(gpsEpoch).Microseconds() + gpsLeapSeconds*int64(time.Second/time.Microsecond)
+		return wsjson.Write(ctx, conn, map[string]interface{}{"msgtype": "timesync", "txtime": ts.TxTime, "gpstime": gpsTime})
+	case "dntxed":
+		g.logger.Debugf("basics station sent downlink")
+	default:
+		g.logger.Debugf("ignoring unsupported basics station message %s", header.MsgType)
+	}
+	return nil
+}
+
+// routerConfig builds the router_config message from the region's channel plan.
+func (g *Gateway) routerConfig() routerConfig {
+	conf := routerConfig{
+		MsgType:   "router_config",
+		Region:    g.region.stationRegion,
+		HWSpec:    "sx1301/1",
+		FreqRange: g.region.freqRange,
+		NoCCA:     true,
+		NoDC:      true,
+		NoDwell:   true,
+	}
+
+	for dr := range conf.DRs {
+		rate, ok := g.region.dataRates[uint8(dr)]
+		if !ok {
+			// unused data rates have a spreading factor of -1.
+			conf.DRs[dr] = [3]int{-1, 0, 0}
+			continue
+		}
+		dnOnly := 0
+		if uint8(dr) > g.region.maxUplinkDataRate {
+			dnOnly = 1
+		}
+		conf.DRs[dr] = [3]int{int(rate.sf), bandwidthKHz(rate.bandwidth), dnOnly}
+	}
+
+	sx1301 := map[string]interface{}{
+		"chan_Lora_std": map[string]interface{}{"enable": false},
+		"chan_FSK":      map[string]interface{}{"enable": false},
+	}
+	for i, freq := range g.region.radioFrequencies {
+		sx1301[fmt.Sprintf("radio_%d", i)] = map[string]interface{}{"enable": true, "freq": freq}
+	}
+	for i, chain := range g.region.ifChains {
+		sx1301[fmt.Sprintf("chan_multiSF_%d", i)] = map[string]interface{}{
+			"enable": true,
+			"radio":  chain.rfChain,
+			"if":     chain.freqOffset,
+		}
+	}
+	conf.SX1301Conf = []map[string]interface{}{sx1301}
+
+	return conf
+}
+
+// stationRxInfo returns the radio metadata of an uplink received at the data rate and frequency.
+func (g *Gateway) stationRxInfo(dr uint8, freq uint32, info stationUpInfo) (rxInfo, error) {
+	rate, ok := g.region.dataRates[dr]
+	if !ok {
+		return rxInfo{}, fmt.Errorf("unknown data rate DR%d", dr)
+	}
+	return rxInfo{
+		frequency: freq,
+		sf:        rate.sf,
+		bandwidth: rate.bandwidth,
+		rssi:      info.RSSI,
+		snr:       info.SNR,
+	}, nil
+}
+
+// phyPayload rebuilds the join request the station split into fields.
+func (jr stationJoinRequest) phyPayload() ([]byte, error) {
+	joinEUI, err := parseStationEUI(jr.JoinEUI)
+	if err != nil {
+		return nil, err
+	}
+	devEUI, err := parseStationEUI(jr.DevEUI)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := []byte{jr.MHdr}
+	payload = append(payload, reverseByteArray(joinEUI)...)
+	payload = append(payload, reverseByteArray(devEUI)...)
+	payload = binary.LittleEndian.AppendUint16(payload, jr.DevNonce)
+	return binary.LittleEndian.AppendUint32(payload, uint32(jr.MIC)), nil
+}
+
+// phyPayload rebuilds the data uplink the station split into fields.
+func (up stationUplink) phyPayload() ([]byte, error) {
+	fOpts, err := hex.DecodeString(up.FOpts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FOpts: %w", err)
+	}
+	frmPayload, err := hex.DecodeString(up.FRMPayload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FRMPayload: %w", err)
+	}
+
+	payload := []byte{up.MHdr}
+	payload = binary.LittleEndian.AppendUint32(payload, uint32(up.DevAddr))
+	payload = append(payload, up.FCtrl)
+	payload = binary.LittleEndian.AppendUint16(payload, up.FCnt)
+	payload = append(payload, fOpts...)
+	if up.FPort >= 0 {
+		payload = append(payload, uint8(up.FPort))
+		payload = append(payload, frmPayload...)
+	}
+	return binary.LittleEndian.AppendUint32(payload, uint32(up.MIC)), nil
+}
+
+// parseStationEUI parses an EUI such as 00-00-00-00-00-00-00-01 into big endian bytes.
+func parseStationEUI(s string) ([]byte, error) {
+	eui, err := hex.DecodeString(strings.NewReplacer("-", "", ":", "").Replace(s))
+	if err != nil || len(eui) != 8 {
+		return nil, fmt.Errorf("invalid EUI %s", s)
+	}
+	return eui, nil
+}
+
+// transmitStation sends the payload in a dnmsg to the station the uplink was received by.
+// The station schedules it in the rx1 window if it is set and in rx2 if rx1 can't be used, or sends it right away
+// as a class C downlink if immediate is set.
+func (g *Gateway) transmitStation(ctx context.Context, payload []byte, rx1 *rxWindow, rx2 rxWindow, s *stationRx, immediate bool) error {
+	if g.station == nil {
+		return errSendDownlink
+	}
+	devEUI := s.devEUI
+	if devEUI == "" {
+		devEUI = "00-00-00-00-00-00-00-00"
+	}
+	dn := stationDownlink{
+		MsgType: "dnmsg",
+		DevEUI:  devEUI,
+		DC:      0,
+		DIID:    g.station.diid.Add(1),
+		PDU:     hex.EncodeToString(payload),
+		// RxDelay is the rx1 delay in seconds, rx2 opens 1 second after rx1.
+		RxDelay: int((rx2.delay - time.Second) / time.Second),
+		RX2DR:   rx2.dataRate,
+		RX2Freq: rx2.frequency,
+		XTime:   s.xtime,
+		RCtx:    s.rctx,
+	}
+	if rx1 != nil {
+		dn.RX1DR = &rx1.dataRate
+		dn.RX1Freq = rx1.frequency
+	}
+	if immediate {
+		dn.DC = 2
+		dn.RxDelay = 0
+		dn.XTime = 0
+	}
+	if err := wsjson.Write(ctx, s.conn, dn); err != nil {
+		return fmt.Errorf("%w: %w", errSendDownlink, err)
+	}
+	return nil
+}
+
+func (s *stationServer) addConn(router string, conn *websocket.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[router] = conn
+}
+
+// removeConn removes the connection of the station, unless the station has already reconnected.
+func (s *stationServer) removeConn(router string, conn *websocket.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns[router] == conn {
+		delete(s.conns, router)
+	}
+}
+
+// anyConn returns the connection of a station downlinks can be sent through.
+func (s *stationServer) anyConn() (*websocket.Conn, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		return conn, true
+	}
+	return nil, false
+}
+
+func (s *stationServer) close() error {
+	return s.srv.Close()
+}
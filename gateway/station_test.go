@@ -0,0 +1,170 @@
+package gateway
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"go.viam.com/test"
+	"go.viam.com/utils"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+const (
+	// jreq for the test OTAA device with dev nonce 0x0102.
+	testStationJoinRequest = `{"msgtype":"jreq","MHdr":0,"JoinEui":"00-00-00-00-00-00-00-01","DevEui":"01-23-45-67-89-AB-CD-EF",` +
+		`"DevNonce":258,"MIC":-430004378,"RefTime":1714670494.835544,"DR":0,"Freq":902300000,` +
+		`"upinfo":{"rctx":0,"xtime":40250921680313459,"gpstime":0,"fts":-1,"rssi":-60,"snr":8.5,"rxtime":1714670494.8}}`
+	// updf from the test ABP device with frame counter 1 and temperature 21.5 on port 1.
+	testStationUplink = `{"msgtype":"updf","MHdr":64,"DevAddr":16909060,"FCtrl":0,"FCnt":1,"FOpts":"","FPort":1,` +
+		`"FRMPayload":"D268","MIC":1370371555,"RefTime":1714670494.835544,"DR":3,"Freq":902300000,` +
+		`"upinfo":{"rctx":0,"xtime":40250921680313460,"gpstime":0,"fts":-1,"rssi":-42,"snr":9.5,"rxtime":1714670494.8}}`
+)
+
+// startTestStation starts the Basics Station endpoint of the test gateway and connects a station to it.
+func startTestStation(t *testing.T) (*Gateway, *websocket.Conn) {
+	g := createTestGateway(t)
+	g.workers = utils.NewBackgroundStoppableWorkers()
+	err := g.startStationServer("127.0.0.1:0")
+	test.That(t, err, test.ShouldBeNil)
+	t.Cleanup(func() { g.Close(context.Background()) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws://"+g.station.ln.Addr().String()+stationTrafficPath+"b827:ebff:fe61:51a1", nil)
+	test.That(t, err, test.ShouldBeNil)
+	t.Cleanup(func() { conn.CloseNow() })
+	return g, conn
+}
+
+func readTestDownlink(t *testing.T, conn *websocket.Conn) stationDownlink {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var dn stationDownlink
+	err := wsjson.Read(ctx, conn, &dn)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, dn.MsgType, test.ShouldEqual, "dnmsg")
+	return dn
+}
+
+func TestRouterConfig(t *testing.T) {
+	g := createTestGateway(t)
+	conf := g.routerConfig()
+	test.That(t, conf.Region, test.ShouldEqual, "US902")
+	test.That(t, conf.FreqRange, test.ShouldResemble, [2]uint32{902000000, 928000000})
+	test.That(t, conf.DRs[0], test.ShouldResemble, [3]int{10, 125, 0})
+	test.That(t, conf.DRs[4], test.ShouldResemble, [3]int{8, 500, 0})
+	test.That(t, conf.DRs[5], test.ShouldResemble, [3]int{-1, 0, 0})
+	// DR8-13 are downlink only.
+	test.That(t, conf.DRs[8], test.ShouldResemble, [3]int{12, 500, 1})
+	test.That(t, conf.DRs[12], test.ShouldResemble, [3]int{8, 500, 1})
+
+	sx1301 := conf.SX1301Conf[0]
+	test.That(t, sx1301["radio_0"], test.ShouldResemble, map[string]interface{}{"enable": true, "freq": uint32(902700000)})
+	test.That(t, sx1301["radio_1"], test.ShouldResemble, map[string]interface{}{"enable": true, "freq": uint32(903700000)})
+	test.That(t, sx1301["chan_multiSF_0"], test.ShouldResemble, map[string]interface{}{
+		"enable": true, "radio": g.region.ifChains[0].rfChain, "if": g.region.ifChains[0].freqOffset,
+	})
+
+	g.region = regions["EU868"]
+	conf = g.routerConfig()
+	test.That(t, conf.Region, test.ShouldEqual, "EU863")
+	test.That(t, conf.DRs[0], test.ShouldResemble, [3]int{12, 125, 0})
+}
+
+func TestStationDiscovery(t *testing.T) {
+	g, _ := startTestStation(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws://"+g.station.ln.Addr().String()+stationDiscoveryPath, nil)
+	test.That(t, err, test.ShouldBeNil)
+	defer conn.CloseNow()
+
+	err = wsjson.Write(ctx, conn, map[string]interface{}{"router": "b827:ebff:fe61:51a1"})
+	test.That(t, err, test.ShouldBeNil)
+	var resp map[string]interface{}
+	err = wsjson.Read(ctx, conn, &resp)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, resp["router"], test.ShouldEqual, "b827:ebff:fe61:51a1")
+	test.That(t, resp["uri"], test.ShouldEqual, "ws://"+g.station.ln.Addr().String()+"/traffic/b827:ebff:fe61:51a1")
+}
+
+func TestStationJoin(t *testing.T) {
+	g, conn := startTestStation(t)
+	addTestOTAADevice(g)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// the station gets the channel plan after sending its version.
+	err := conn.Write(ctx, websocket.MessageText, []byte(`{"msgtype":"version","station":"2.0.6","protocol":2}`))
+	test.That(t, err, test.ShouldBeNil)
+	var conf routerConfig
+	err = wsjson.Read(ctx, conn, &conf)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, conf.MsgType, test.ShouldEqual, "router_config")
+	test.That(t, conf.Region, test.ShouldEqual, "US902")
+
+	err = conn.Write(ctx, websocket.MessageText, []byte(testStationJoinRequest))
+	test.That(t, err, test.ShouldBeNil)
+
+	// the join accept is sent in the join accept rx1 window, the station falls back to rx2.
+	dn := readTestDownlink(t, conn)
+	test.That(t, dn.DevEUI, test.ShouldEqual, "01-23-45-67-89-AB-CD-EF")
+	test.That(t, dn.DC, test.ShouldEqual, 0)
+	test.That(t, dn.RxDelay, test.ShouldEqual, 5)
+	test.That(t, *dn.RX1DR, test.ShouldEqual, 10)
+	test.That(t, dn.RX1Freq, test.ShouldEqual, uint32(923300000))
+	test.That(t, dn.RX2DR, test.ShouldEqual, 8)
+	test.That(t, dn.RX2Freq, test.ShouldEqual, uint32(923300000))
+	test.That(t, dn.XTime, test.ShouldEqual, int64(40250921680313459))
+
+	joinAccept, err := hex.DecodeString(dn.PDU)
+	test.That(t, err, test.ShouldBeNil)
+	session, _ := acceptTestJoin(t, joinAccept, 0x0102)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	test.That(t, g.devices["test-otaa-device"].Addr, test.ShouldResemble, session.devAddr)
+}
+
+func TestStationUplink(t *testing.T) {
+	g, conn := startTestStation(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	err := g.SendDownlink(ctx, testDevAddr, 10, []byte{0x01})
+	test.That(t, err, test.ShouldBeNil)
+
+	err = conn.Write(ctx, websocket.MessageText, []byte(testStationUplink))
+	test.That(t, err, test.ShouldBeNil)
+
+	// the queued downlink is sent in the rx2 window.
+	dn := readTestDownlink(t, conn)
+	test.That(t, dn.RxDelay, test.ShouldEqual, 1)
+	test.That(t, dn.XTime, test.ShouldEqual, int64(40250921680313460))
+	frame, err := hex.DecodeString(dn.PDU)
+	test.That(t, err, test.ShouldBeNil)
+	fPort, payload := decryptTestDownlink(t, frame)
+	test.That(t, fPort, test.ShouldEqual, 10)
+	test.That(t, payload, test.ShouldResemble, []byte{0x01})
+
+	g.readingsMu.Lock()
+	readings := g.lastReadings["test-device"].(map[string]interface{})
+	g.readingsMu.Unlock()
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+	test.That(t, readings["snr"], test.ShouldEqual, 9.5)
+}
+
+func TestStationUplinkPhyPayload(t *testing.T) {
+	// FPort -1 is an uplink with only MAC commands in FOpts.
+	up := stationUplink{MHdr: unconfirmedDataUp, DevAddr: 16909060, FCtrl: 1, FCnt: 2, FOpts: "02", FPort: -1, MIC: 1}
+	payload, err := up.phyPayload()
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, payload, test.ShouldResemble, []byte{0x40, 0x04, 0x03, 0x02, 0x01, 0x01, 0x02, 0x00, 0x02, 0x01, 0x00, 0x00, 0x00})
+
+	_, err = stationJoinRequest{JoinEUI: "00-01", DevEUI: "01-23-45-67-89-AB-CD-EF"}.phyPayload()
+	test.That(t, err, test.ShouldNotBeNil)
+}
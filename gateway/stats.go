@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"time"
+)
+
+// deviceStats counts the uplinks of a device, they are returned in the stats reading of the node.
+type deviceStats struct {
+	uplinks      int
+	decodeErrors int
+	filtered     int
+	lastFCnt     uint32
+	lastUplink   time.Time
+}
+
+// readings returns the stats reading of the device.
+func (s *deviceStats) readings(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"uplinks":                   s.uplinks,
+		"decode_errors":             s.decodeErrors,
+		"filtered_uplinks":          s.filtered,
+		"last_fcnt":                 int(s.lastFCnt),
+		"seconds_since_last_uplink": now.Sub(s.lastUplink).Seconds(),
+	}
+}
+
+// recordUplink counts an authenticated uplink from the device, whether or not it is decoded.
+func (g *Gateway) recordUplink(name string, fCnt uint32) {
+	g.readingsMu.Lock()
+	defer g.readingsMu.Unlock()
+	if g.stats == nil {
+		g.stats = make(map[string]*deviceStats)
+	}
+	stats, ok := g.stats[name]
+	if !ok {
+		stats = &deviceStats{}
+		g.stats[name] = stats
+	}
+	stats.uplinks++
+	stats.lastFCnt = fCnt
+	stats.lastUplink = time.Now()
+	g.lastUplink.Store(stats.lastUplink.UnixNano())
+}
+
+// recordDecodeError counts an uplink from the device that its decoder failed to decode.
+func (g *Gateway) recordDecodeError(name string) {
+	g.readingsMu.Lock()
+	defer g.readingsMu.Unlock()
+	if stats, ok := g.stats[name]; ok {
+		stats.decodeErrors++
+	}
+}
+
+// recordFiltered counts an uplink from the device that was dropped because its fPort is filtered.
+func (g *Gateway) recordFiltered(name string) {
+	g.readingsMu.Lock()
+	defer g.readingsMu.Unlock()
+	if stats, ok := g.stats[name]; ok {
+		stats.filtered++
+	}
+}
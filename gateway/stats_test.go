@@ -0,0 +1,49 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+
+	"go.viam.com/test"
+)
+
+func TestDeviceStats(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+
+	for fCnt := uint32(1); fCnt <= 3; fCnt++ {
+		name, readings, err := g.parseDataUplink(ctx, createTestUplink(t, fCnt, 1, []byte{0x15, 0x05}), testRxInfo)
+		test.That(t, err, test.ShouldBeNil)
+		g.updateReadings(name, readings)
+	}
+
+	// uplinks the decoder fails on are counted as decode errors, and duplicates aren't counted.
+	g.devices["test-device"].DecoderPath = writeTestDecoder(t, `function Decode(fPort, bytes) { throw new Error("bad payload"); }`)
+	_, _, err := g.parseDataUplink(ctx, createTestUplink(t, 4, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldNotBeNil)
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 4, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldNotBeNil)
+
+	allReadings, err := g.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	readings := allReadings["test-device"].(map[string]interface{})
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+	stats := readings["stats"].(map[string]interface{})
+	test.That(t, stats["uplinks"], test.ShouldEqual, 4)
+	test.That(t, stats["decode_errors"], test.ShouldEqual, 1)
+	test.That(t, stats["last_fcnt"], test.ShouldEqual, 4)
+	test.That(t, stats["seconds_since_last_uplink"], test.ShouldBeBetweenOrEqual, 0, 1)
+	// the stats are added to a copy of the readings.
+	test.That(t, g.lastReadings["test-device"], test.ShouldNotContainKey, "stats")
+
+	// a device with only failed uplinks still has stats.
+	g.lastReadings = map[string]interface{}{}
+	allReadings, err = g.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, allReadings["test-device"], test.ShouldContainKey, "stats")
+
+	g.RemoveDevice("test-device")
+	allReadings, err = g.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, allReadings, test.ShouldBeEmpty)
+}
@@ -0,0 +1,311 @@
+package gateway
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Semtech UDP packet forwarder protocol.
+// https://github.com/Lora-net/packet_forwarder/blob/master/PROTOCOL.TXT
+const (
+	udpProtocolVersion = 2
+
+	udpPushData = 0x00
+	udpPushAck  = 0x01
+	udpPullData = 0x02
+	udpPullResp = 0x03
+	udpPullAck  = 0x04
+	udpTxAck    = 0x05
+
+	// udpHeaderLength is the version, token and identifier that start every message.
+	udpHeaderLength = 4
+	// PUSH_DATA, PULL_DATA and TX_ACK have the 8 byte gateway EUI after the header.
+	udpEUILength = 8
+
+	// defaultUDPPort is the port packet forwarders send to by default.
+	defaultUDPPort = "1700"
+)
+
+// udpListenAddr returns the address to listen on for udp_listen_addr, adding the default port if it only has a host,
+// such as "0.0.0.0" or "::". The empty host, "0.0.0.0" and "::" all listen on IPv4 and IPv6.
+func udpListenAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// a bare IPv6 address has colons but no brackets.
+		host, port = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), defaultUDPPort
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > math.MaxUint16 {
+		return "", fmt.Errorf("%w: %s", errUDPListenAddr, addr)
+	}
+	if strings.ContainsAny(host, "[]") {
+		return "", fmt.Errorf("%w: %s", errUDPListenAddr, addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// rxpk is a packet received by a packet forwarder.
+type rxpk struct {
+	Tmst uint32  `json:"tmst"` // concentrator counter in µs at the end of the reception
+	Freq float64 `json:"freq"` // MHz
+	Chan int     `json:"chan"`
+	RFCh int     `json:"rfch"`
+	Stat int     `json:"stat"` // CRC status: 1 ok, -1 failed, 0 no CRC
+	Modu string  `json:"modu"`
+	Datr string  `json:"datr"` // LoRa data rate such as SF7BW125
+	Codr string  `json:"codr"`
+	RSSI float32 `json:"rssi"` // dBm
+	LSNR float32 `json:"lsnr"` // dB
+	Size int     `json:"size"`
+	Data string  `json:"data"` // base64 phyPayload
+}
+
+// txpk is a packet for a packet forwarder to send.
+type txpk struct {
+	Imme bool    `json:"imme,omitempty"` // send right away instead of at tmst
+	Tmst uint32  `json:"tmst"`           // concentrator counter in µs to send at
+	Freq float64 `json:"freq"`           // MHz
+	RFCh int     `json:"rfch"`
+	Powe int8    `json:"powe"` // dBm
+	Modu string  `json:"modu"`
+	Datr string  `json:"datr"`
+	Codr string  `json:"codr"`
+	IPol bool    `json:"ipol"`
+	Size int     `json:"size"`
+	Data string  `json:"data"`
+}
+
+type pushData struct {
+	RXPK []rxpk `json:"rxpk"`
+}
+
+type pullResp struct {
+	TXPK txpk `json:"txpk"`
+}
+
+type txAck struct {
+	TXPKAck struct {
+		Error string `json:"error"`
+	} `json:"txpk_ack"`
+}
+
+// forwarderRx is where a packet received by a packet forwarder came from.
+type forwarderRx struct {
+	gatewayEUI string // hex
+	tmst       uint32
+}
+
+// udpServer receives packets from Semtech UDP packet forwarders and sends downlinks back to them.
+type udpServer struct {
+	conn *net.UDPConn
+
+	mu sync.Mutex
+	// map of gateway EUI to the address of its last PULL_DATA, downlinks are sent there.
+	pullAddrs map[string]*net.UDPAddr
+}
+
+// startUDPServer listens for packet forwarders on addr, such as ":1700".
+func (g *Gateway) startUDPServer(addr string) error {
+	addr, err := udpListenAddr(addr)
+	if err != nil {
+		return err
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return fmt.Errorf("invalid udp_listen_addr: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for packet forwarders: %w", err)
+	}
+	g.udp = &udpServer{conn: conn, pullAddrs: map[string]*net.UDPAddr{}}
+	g.logger.Infof("listening for packet forwarders on %s", conn.LocalAddr())
+
+	server := g.udp
+	g.workers.Add(func(ctx context.Context) {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := server.conn.ReadFromUDP(buf)
+			if err != nil {
+				if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+					return
+				}
+				g.logger.Errorf("error receiving from packet forwarder: %s", err)
+				continue
+			}
+			msg := make([]byte, n)
+			copy(msg, buf[:n])
+			g.handleUDPMessage(ctx, server, msg, from)
+		}
+	})
+	return nil
+}
+
+// Structure of a message from a packet forwarder:
+// | VERSION | TOKEN | IDENTIFIER | GATEWAY EUI |    JSON    |
+// |   1 B   |  2 B  |     1 B    |     8 B     |  variable  |
+func (g *Gateway) handleUDPMessage(ctx context.Context, server *udpServer, msg []byte, from *net.UDPAddr) {
+	if len(msg) < udpHeaderLength+udpEUILength || msg[0] != udpProtocolVersion {
+		g.logger.Debugf("ignoring invalid packet forwarder message from %s", from)
+		return
+	}
+	token := msg[1:3]
+	eui := hex.EncodeToString(msg[udpHeaderLength : udpHeaderLength+udpEUILength])
+	body := msg[udpHeaderLength+udpEUILength:]
+
+	switch msg[3] {
+	case udpPushData:
+		server.send([]byte{udpProtocolVersion, token[0], token[1], udpPushAck}, from)
+		var data pushData
+		if err := json.Unmarshal(body, &data); err != nil {
+			g.logger.Warnf("invalid PUSH_DATA from gateway %s: %s", eui, err)
+			return
+		}
+		for _, pk := range data.RXPK {
+			payload, rx, err := parseRxpk(pk)
+			if err != nil {
+				g.logger.Debugf("ignoring packet from gateway %s: %s", eui, err)
+				continue
+			}
+			rx.forwarder = &forwarderRx{gatewayEUI: eui, tmst: pk.Tmst}
+			g.handlePacket(ctx, payload, rx)
+		}
+	case udpPullData:
+		// the forwarder sends PULL_DATA periodically so downlinks can reach it through NAT.
+		server.mu.Lock()
+		server.pullAddrs[eui] = from
+		server.mu.Unlock()
+		server.send([]byte{udpProtocolVersion, token[0], token[1], udpPullAck}, from)
+	case udpTxAck:
+		// an empty TX_ACK or error NONE means the downlink was sent.
+		var ack txAck
+		if len(body) == 0 || json.Unmarshal(body, &ack) != nil || ack.TXPKAck.Error == "" || ack.TXPKAck.Error == "NONE" {
+			return
+		}
+		g.logger.Errorf("gateway %s failed to send downlink: %s", eui, ack.TXPKAck.Error)
+	default:
+		g.logger.Debugf("ignoring unsupported packet forwarder message type %d", msg[3])
+	}
+}
+
+// parseRxpk returns the phyPayload and radio metadata of a packet received by a packet forwarder.
+func parseRxpk(pk rxpk) ([]byte, rxInfo, error) {
+	if pk.Stat != 1 {
+		return nil, rxInfo{}, errors.New("packet failed CRC check")
+	}
+	if pk.Modu != "LORA" {
+		return nil, rxInfo{}, fmt.Errorf("unsupported modulation %s", pk.Modu)
+	}
+	var sf, bw int
+	if _, err := fmt.Sscanf(pk.Datr, "SF%dBW%d", &sf, &bw); err != nil {
+		return nil, rxInfo{}, fmt.Errorf("invalid datr %s", pk.Datr)
+	}
+	bandwidth, ok := bandwidthsKHz[bw]
+	if !ok || sf < 5 || sf > 12 {
+		return nil, rxInfo{}, fmt.Errorf("invalid datr %s", pk.Datr)
+	}
+	payload, err := base64.StdEncoding.DecodeString(pk.Data)
+	if err != nil {
+		return nil, rxInfo{}, fmt.Errorf("invalid data: %w", err)
+	}
+	if len(payload) == 0 {
+		return nil, rxInfo{}, errors.New("empty payload")
+	}
+
+	rx := rxInfo{
+		frequency: uint32(math.Round(pk.Freq * 1e6)),
+		sf:        uint8(sf),
+		bandwidth: bandwidth,
+		rssi:      pk.RSSI,
+		snr:       pk.LSNR,
+	}
+	return payload, rx, nil
+}
+
+// formatDatr returns the datr field of the spreading factor and bandwidth.
+func formatDatr(sf, bandwidth uint8) string {
+	return fmt.Sprintf("SF%dBW%d", sf, bandwidthKHz(bandwidth))
+}
+
+// transmitUDP sends the payload through the packet forwarder the uplink was received by.
+// The forwarder schedules it in the receive window w, timed from the end of the uplink,
+// or sends it right away if immediate is set.
+func (g *Gateway) transmitUDP(payload []byte, w rxWindow, f *forwarderRx, immediate bool) error {
+	if g.udp == nil {
+		return errSendDownlink
+	}
+	dr := g.region.dataRates[w.dataRate]
+	resp := pullResp{TXPK: txpk{
+		Imme: immediate,
+		// the concentrator counter wraps around, so does the scheduled time.
+		Tmst: f.tmst + uint32(w.delay/time.Microsecond),
+		Freq: float64(w.frequency) / 1e6,
+		RFCh: 0,
+		Powe: g.region.txPower,
+		Modu: "LORA",
+		Datr: formatDatr(dr.sf, dr.bandwidth),
+		Codr: "4/5",
+		IPol: true, // Downlinks are always reverse polarity.
+		Size: len(payload),
+		Data: base64.StdEncoding.EncodeToString(payload),
+	}}
+	return g.udp.sendPullResp(f.gatewayEUI, resp)
+}
+
+// Structure of a PULL_RESP:
+// | VERSION | TOKEN | IDENTIFIER |    JSON    |
+// |   1 B   |  2 B  |     1 B    |  variable  |
+func (s *udpServer) sendPullResp(eui string, resp pullResp) error {
+	s.mu.Lock()
+	addr, ok := s.pullAddrs[eui]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: gateway %s", errNoPullData, eui)
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	msg := []byte{udpProtocolVersion}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(rand.Intn(math.MaxUint16)))
+	msg = append(msg, udpPullResp)
+	msg = append(msg, body...)
+	if _, err := s.conn.WriteToUDP(msg, addr); err != nil {
+		return fmt.Errorf("%w: %w", errSendDownlink, err)
+	}
+	return nil
+}
+
+// anyForwarder returns the EUI of a packet forwarder downlinks can be sent to.
+func (s *udpServer) anyForwarder() (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for eui := range s.pullAddrs {
+		return eui, true
+	}
+	return "", false
+}
+
+func (s *udpServer) send(msg []byte, addr *net.UDPAddr) {
+	// acks are best effort, the forwarder resends if it doesn't get one.
+	_, _ = s.conn.WriteToUDP(msg, addr)
+}
+
+func (s *udpServer) close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,253 @@
+package gateway
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"go.viam.com/test"
+	"go.viam.com/utils"
+)
+
+var testGatewayEUI = []byte{0xAA, 0x55, 0x5A, 0x00, 0x00, 0x00, 0x01, 0x01}
+
+// captured from a RAK7248 running the Semtech UDP packet forwarder.
+const testPushData = `{"rxpk":[{"jver":1,"tmst":3512348611,"time":"2024-05-02T17:21:34.835544Z","tmms":1398705712835,` +
+	`"chan":2,"rfch":0,"freq":902.700000,"mid":8,"stat":1,"modu":"LORA","datr":"SF10BW125","codr":"4/5",` +
+	`"rssis":-91,"lsnr":-3.2,"foff":-1228,"rssi":-90,"size":15,"data":"QAQDAgGAAQABqwvU+hWt"}]}`
+
+func TestParseRxpk(t *testing.T) {
+	var data pushData
+	err := json.Unmarshal([]byte(testPushData), &data)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, len(data.RXPK), test.ShouldEqual, 1)
+
+	payload, rx, err := parseRxpk(data.RXPK[0])
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, payload[0], test.ShouldEqual, unconfirmedDataUp)
+	test.That(t, reverseByteArray(payload[1:5]), test.ShouldResemble, testDevAddr)
+	test.That(t, rx.frequency, test.ShouldEqual, uint32(902700000))
+	test.That(t, rx.sf, test.ShouldEqual, 10)
+	test.That(t, rx.bandwidth, test.ShouldEqual, bandwidth125k)
+	test.That(t, rx.rssi, test.ShouldEqual, -90)
+	test.That(t, rx.snr, test.ShouldAlmostEqual, -3.2, 0.001)
+
+	// packets that failed the CRC check are dropped.
+	pk := data.RXPK[0]
+	pk.Stat = -1
+	_, _, err = parseRxpk(pk)
+	test.That(t, err, test.ShouldNotBeNil)
+
+	pk = data.RXPK[0]
+	pk.Datr = "50000"
+	pk.Modu = "FSK"
+	_, _, err = parseRxpk(pk)
+	test.That(t, err, test.ShouldNotBeNil)
+
+	pk = data.RXPK[0]
+	pk.Datr = "SF10BW300"
+	_, _, err = parseRxpk(pk)
+	test.That(t, err, test.ShouldNotBeNil)
+
+	test.That(t, formatDatr(12, bandwidth500k), test.ShouldEqual, "SF12BW500")
+}
+
+func TestUDPPacketForwarder(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	g.workers = utils.NewBackgroundStoppableWorkers()
+	err := g.startUDPServer("127.0.0.1:0")
+	test.That(t, err, test.ShouldBeNil)
+	defer g.Close(ctx)
+
+	conn, err := net.DialUDP("udp", nil, g.udp.conn.LocalAddr().(*net.UDPAddr))
+	test.That(t, err, test.ShouldBeNil)
+	defer conn.Close()
+
+	read := func() []byte {
+		test.That(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)), test.ShouldBeNil)
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		test.That(t, err, test.ShouldBeNil)
+		return buf[:n]
+	}
+
+	// PULL_DATA is acked with the same token.
+	_, err = conn.Write(append([]byte{0x02, 0x12, 0x34, udpPullData}, testGatewayEUI...))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, read(), test.ShouldResemble, []byte{0x02, 0x12, 0x34, udpPullAck})
+
+	err = g.SendDownlink(ctx, testDevAddr, 10, []byte{0x01})
+	test.That(t, err, test.ShouldBeNil)
+
+	uplink := createTestUplink(t, 1, 1, []byte{0x15, 0x05})
+	rxpk := fmt.Sprintf(`{"rxpk":[{"tmst":3512348611,"chan":0,"rfch":0,"freq":902.300000,"stat":1,"modu":"LORA",`+
+		`"datr":"SF7BW125","codr":"4/5","lsnr":9.5,"rssi":-42,"size":%d,"data":"%s"}]}`,
+		len(uplink), base64.StdEncoding.EncodeToString(uplink))
+	msg := append([]byte{0x02, 0xAB, 0xCD, udpPushData}, testGatewayEUI...)
+	_, err = conn.Write(append(msg, rxpk...))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, read(), test.ShouldResemble, []byte{0x02, 0xAB, 0xCD, udpPushAck})
+
+	// the queued downlink is sent back to the forwarder, scheduled for the rx2 window.
+	resp := read()
+	test.That(t, resp[0], test.ShouldEqual, udpProtocolVersion)
+	test.That(t, resp[3], test.ShouldEqual, udpPullResp)
+	var pull pullResp
+	err = json.Unmarshal(resp[4:], &pull)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, pull.TXPK.Tmst, test.ShouldEqual, uint32(3512348611+2000000))
+	test.That(t, pull.TXPK.Freq, test.ShouldEqual, 923.3)
+	test.That(t, pull.TXPK.Datr, test.ShouldEqual, "SF12BW500")
+	test.That(t, pull.TXPK.IPol, test.ShouldBeTrue)
+
+	frame, err := base64.StdEncoding.DecodeString(pull.TXPK.Data)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, pull.TXPK.Size, test.ShouldEqual, len(frame))
+	fPort, payload := decryptTestDownlink(t, frame)
+	test.That(t, fPort, test.ShouldEqual, 10)
+	test.That(t, payload, test.ShouldResemble, []byte{0x01})
+
+	g.readingsMu.Lock()
+	readings := g.lastReadings["test-device"].(map[string]interface{})
+	g.readingsMu.Unlock()
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+	test.That(t, readings["rssi"], test.ShouldEqual, -42)
+}
+
+func TestUDPListenAddr(t *testing.T) {
+	for addr, expected := range map[string]string{
+		":1700":          ":1700",
+		"0.0.0.0:1680":   "0.0.0.0:1680",
+		"[::]:1700":      "[::]:1700",
+		"0.0.0.0":        "0.0.0.0:1700",
+		"::":             "[::]:1700",
+		"[::]":           "[::]:1700",
+		"fd00::1":        "[fd00::1]:1700",
+		"gateway.local":  "gateway.local:1700",
+		"127.0.0.1:0":    "127.0.0.1:0",
+		"[fd00::1]:1701": "[fd00::1]:1701",
+	} {
+		listen, err := udpListenAddr(addr)
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, listen, test.ShouldEqual, expected)
+	}
+	for _, addr := range []string{":port", "[::]:70000", "[[::]]"} {
+		_, err := udpListenAddr(addr)
+		test.That(t, errors.Is(err, errUDPListenAddr), test.ShouldBeTrue)
+	}
+}
+
+func TestUDPDualStack(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	g.workers = utils.NewBackgroundStoppableWorkers()
+	err := g.startUDPServer("[::]:0")
+	if err != nil {
+		t.Skipf("IPv6 isn't available: %s", err)
+	}
+	defer g.Close(ctx)
+	port := g.udp.conn.LocalAddr().(*net.UDPAddr).Port
+
+	// the listener receives PUSH_DATA from forwarders on IPv4 and IPv6.
+	fCnt := uint32(0)
+	for _, network := range []string{"udp4", "udp6"} {
+		loopback := net.IPv4(127, 0, 0, 1)
+		if network == "udp6" {
+			loopback = net.IPv6loopback
+		}
+		conn, err := net.DialUDP(network, nil, &net.UDPAddr{IP: loopback, Port: port})
+		if err != nil {
+			t.Logf("skipping %s: %s", network, err)
+			continue
+		}
+		defer conn.Close()
+
+		fCnt++
+		uplink := createTestUplink(t, fCnt, 1, []byte{0x15, byte(fCnt)})
+		rxpk := fmt.Sprintf(`{"rxpk":[{"tmst":3512348611,"chan":0,"rfch":0,"freq":902.300000,"stat":1,"modu":"LORA",`+
+			`"datr":"SF7BW125","codr":"4/5","lsnr":9.5,"rssi":-42,"size":%d,"data":"%s"}]}`,
+			len(uplink), base64.StdEncoding.EncodeToString(uplink))
+		msg := append([]byte{0x02, 0xAB, byte(fCnt), udpPushData}, testGatewayEUI...)
+		_, err = conn.Write(append(msg, rxpk...))
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)), test.ShouldBeNil)
+		buf := make([]byte, 4)
+		_, err = conn.Read(buf)
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, buf, test.ShouldResemble, []byte{0x02, 0xAB, byte(fCnt), udpPushAck})
+
+		// the uplink is handled in the background.
+		temperature := func() interface{} {
+			readings, err := g.Readings(ctx, nil)
+			test.That(t, err, test.ShouldBeNil)
+			device, _ := readings["test-device"].(map[string]interface{})
+			return device["temperature"]
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for temperature() != 21+float64(fCnt)/10 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		test.That(t, temperature(), test.ShouldEqual, 21+float64(fCnt)/10)
+	}
+	test.That(t, fCnt, test.ShouldBeGreaterThan, 0)
+}
+
+func TestUDPPullRespWithoutPullData(t *testing.T) {
+	g := createTestGateway(t)
+	g.workers = utils.NewBackgroundStoppableWorkers()
+	err := g.startUDPServer("127.0.0.1:0")
+	test.That(t, err, test.ShouldBeNil)
+	defer g.Close(context.Background())
+
+	// downlinks can't be sent until the forwarder has sent PULL_DATA.
+	err = g.transmitUDP([]byte{0x60}, rxWindow{frequency: g.region.rx2Frequency, dataRate: g.region.rx2DataRate, delay: time.Second}, &forwarderRx{gatewayEUI: "aa555a0000000101"}, false)
+	test.That(t, err, test.ShouldWrap, errNoPullData)
+}
+
+func TestUDPJoinAccept(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	addTestOTAADevice(g)
+	g.workers = utils.NewBackgroundStoppableWorkers()
+	err := g.startUDPServer("127.0.0.1:0")
+	test.That(t, err, test.ShouldBeNil)
+	defer g.Close(ctx)
+
+	conn, err := net.DialUDP("udp", nil, g.udp.conn.LocalAddr().(*net.UDPAddr))
+	test.That(t, err, test.ShouldBeNil)
+	defer conn.Close()
+	read := func() []byte {
+		test.That(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)), test.ShouldBeNil)
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		test.That(t, err, test.ShouldBeNil)
+		return buf[:n]
+	}
+
+	_, err = conn.Write(append([]byte{0x02, 0x12, 0x34, udpPullData}, testGatewayEUI...))
+	test.That(t, err, test.ShouldBeNil)
+	read()
+
+	joinRequest := createTestJoinRequest(t, 0x0102)
+	rxpk := fmt.Sprintf(`{"rxpk":[{"tmst":1000000,"chan":2,"rfch":0,"freq":902.700000,"stat":1,"modu":"LORA",`+
+		`"datr":"SF10BW125","codr":"4/5","lsnr":9.5,"rssi":-42,"size":%d,"data":"%s"}]}`,
+		len(joinRequest), base64.StdEncoding.EncodeToString(joinRequest))
+	_, err = conn.Write(append(append([]byte{0x02, 0xAB, 0xCD, udpPushData}, testGatewayEUI...), rxpk...))
+	test.That(t, err, test.ShouldBeNil)
+	read()
+
+	// the join accept is scheduled in the join accept rx1 window, on the downlink channel of the uplink
+	// channel at DR10.
+	var pull pullResp
+	err = json.Unmarshal(read()[4:], &pull)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, pull.TXPK.Tmst, test.ShouldEqual, uint32(1000000+5000000))
+	test.That(t, pull.TXPK.Freq, test.ShouldEqual, 924.5)
+	test.That(t, pull.TXPK.Datr, test.ShouldEqual, "SF10BW500")
+}
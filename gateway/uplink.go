@@ -4,78 +4,180 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"gateway/lorawan"
 	"gateway/node"
-	"os"
-	"reflect"
 	"time"
 
-	"github.com/robertkrimen/otto"
-	"go.thethings.network/lorawan-stack/v3/pkg/crypto"
 	"go.thethings.network/lorawan-stack/v3/pkg/types"
 )
 
-// Structure of phyPayload:
-// | MHDR | DEV ADDR|  FCTL |   FCnt  | FPort   |  FOpts     |  FRM Payload | MIC |
-// | 1 B  |   4 B    | 1 B   |  2 B   |   1 B   | variable    |  variable   | 4B  |
-func (g *Gateway) parseDataUplink(ctx context.Context, phyPayload []byte) (string, map[string]interface{}, error) {
+// MType of each message, the top 3 bits of the MHDR.
+//
+// | MType | RFU | Major |
+// |  7-5  | 4-2 |  1-0  |
+const (
+	joinRequestType     = 0x00
+	joinAcceptType      = 0x20
+	unconfirmedDataUp   = 0x40
+	unconfirmedDataDown = 0x60
+	confirmedDataUp     = 0x80
+	confirmedDataDown   = 0xA0
+	rejoinRequestType   = 0xC0
+	proprietaryType     = 0xE0
+
+	mTypeMask = 0xE0
+	majorMask = 0x03
+)
 
-	devAddr := phyPayload[1:5]
+// mTypeNames are the names of the MTypes, used in errors for packets that aren't handled.
+var mTypeNames = map[byte]string{
+	joinRequestType:     "join request",
+	joinAcceptType:      "join accept",
+	unconfirmedDataUp:   "unconfirmed data uplink",
+	unconfirmedDataDown: "unconfirmed data downlink",
+	confirmedDataUp:     "confirmed data uplink",
+	confirmedDataDown:   "confirmed data downlink",
+	rejoinRequestType:   "rejoin request",
+	proprietaryType:     "proprietary",
+}
 
-	// need to reserve the bytes since payload is in LE.
-	devAddrBE := reverseByteArray(devAddr)
+// rxInfo is the radio metadata of a received packet.
+type rxInfo struct {
+	frequency uint32 // Hz
+	sf        uint8  // spreading factor
+	bandwidth uint8
+	rssi      float32 // dBm
+	snr       float32 // dB
+	// forwarder is set if the packet was received by a packet forwarder, downlinks are sent back through it.
+	forwarder *forwarderRx
+	// station is set if the packet was received by a Basics Station, downlinks are sent back through it.
+	station *stationRx
+	// received is when the gateway's radio received the packet, the receive windows are timed from it.
+	// Packet forwarders and Basics Stations time the windows themselves.
+	received time.Time
+	// immediate is set for downlinks to class C devices, they are sent right away instead of in the rx2 window.
+	immediate bool
+}
 
-	device, err := matchDeviceAddr(devAddrBE, g.devices)
-	if err != nil {
-		g.logger.Infof("received packet from unknown device, ignoring")
-		return "", map[string]interface{}{}, errNoDevice
+// traceUplink logs a step of receiving a packet if debug_uplinks is set, with the values of the step as fields.
+// The trace is logged at info level so it shows without changing the module's log level.
+func (g *Gateway) traceUplink(msg string, keysAndValues ...interface{}) {
+	if g.debugUplinks {
+		g.logger.Infow("uplink trace: "+msg, keysAndValues...)
 	}
-	// Frame control byte contains various settings
-	// the last 4 bits is the fopts length
-	fctrl := phyPayload[5]
-	foptsLength := fctrl & 0x0F
+}
 
-	// frame count - should increase by 1 with each packet sent
-	frameCnt := binary.LittleEndian.Uint16(phyPayload[6:8])
+// parseDataUplink authenticates the data uplink and decodes its payload into the readings of its device.
+// If only the payload fails to decode, the device name is returned with the error since the device still
+// listens for a downlink.
+// Structure of phyPayload:
+// | MHDR | DEV ADDR|  FCTL |   FCnt  | FPort   |  FOpts     |  FRM Payload | MIC |
+// | 1 B  |   4 B    | 1 B   |  2 B   |   1 B   | variable    |  variable   | 4B  |
+func (g *Gateway) parseDataUplink(
+	ctx context.Context, phyPayload []byte, rx rxInfo,
+) (name string, readings map[string]interface{}, err error) {
+	uplinksReceived.Inc()
 
-	// fopts not supported in this module yet.
-	if foptsLength != 0 {
-		_ = phyPayload[8 : 8+foptsLength]
+	if err := lorawan.ValidateDataUplinkLength(phyPayload); err != nil {
+		return "", map[string]interface{}{}, err
 	}
 
-	// frame port specifies application port - 0 is for MAC commands 1-255 for device messages.
-	fPort := phyPayload[8+foptsLength]
+	// errors have the dev addr of the uplink, and the device once it is matched.
+	var device *node.Node
+	defer func() {
+		if err != nil {
+			var matched string
+			if device != nil {
+				matched = device.NodeName
+			}
+			err = lorawan.NewUplinkError(phyPayload, matched, err)
+		}
+	}()
 
-	// Ensure there is a frame payload in the packet.
-	if int(8+foptsLength+1) >= (len(phyPayload) - 4) {
-		return "", map[string]interface{}{}, fmt.Errorf("device %s sent packet with no data", device.NodeName)
+	// the same transmission can be received more than once, only the first is decoded.
+	key := newUplinkKey(phyPayload)
+	if g.dedup.isDuplicate(key) {
+		uplinksDuplicate.Inc()
+		return "", map[string]interface{}{}, errDuplicateUplink
 	}
 
-	// framepayload is the device readings.
-	framePayload := phyPayload[8+foptsLength+1 : len(phyPayload)-4]
-
-	dAddr := types.MustDevAddr(devAddrBE)
-
-	// decrypt the frame payload
-	decryptedPayload, err := crypto.DecryptUplink(types.AES128Key(device.AppSKey), *dAddr, (uint32)(frameCnt), framePayload)
+	session, err := g.authenticateUplink(phyPayload, rx)
+	device = session.device
 	if err != nil {
-		return "", map[string]interface{}{}, fmt.Errorf("error while decrypting uplink message: %w", err)
+		return "", map[string]interface{}{}, err
 	}
+	g.dedup.add(key)
+	if session.retransmission {
+		g.queueAck(device, session.FCnt)
+		return device.NodeName, nil, nil
+	}
+	dAddr := session.DevAddr
+	frameCnt := session.FCnt
+	g.recordUplink(device.NodeName, frameCnt)
+	g.traceUplink("authenticated data uplink", "device", device.NodeName, "dev_addr", hex.EncodeToString(dAddr[:]), "fcnt", frameCnt)
 
-	// decode using the codec.
-	readings, err := decodePayload(ctx, fPort, device.DecoderPath, decryptedPayload)
+	frame, err := lorawan.DecryptDataFrame(session.Session, phyPayload)
 	if err != nil {
-		return "", map[string]interface{}{}, fmt.Errorf("error decoding payload: %w", err)
+		return "", map[string]interface{}{}, err
+	}
+	fPort := frame.FPort
+	if len(frame.MACCommands) > 0 && fPort != 0 {
+		g.traceUplink("decrypted fopts", "device", device.NodeName, "fopts", hex.EncodeToString(frame.MACCommands))
+	}
+	g.traceUplink("frame payload", "device", device.NodeName, "fport", fPort, "bytes", len(frame.Payload))
+
+	// uplinks on filtered ports aren't decoded, the MAC commands are still answered.
+	filtered := session.decoding.PortFiltered(fPort)
+
+	// logged with the readings, the length of a fragmented block is the length of the whole block.
+	payloadLength := len(frame.Payload)
+	var decodeDuration time.Duration
+
+	// a payload that fails to decode is reported after the MAC commands, ADR and ack are handled,
+	// since the device still listens for their downlink.
+	var payloadErr error
+	readings = map[string]interface{}{}
+	if fPort == 0 {
+		g.traceUplink("decrypted mac commands", "device", device.NodeName, "payload", hex.EncodeToString(frame.MACCommands))
+	} else if !filtered && len(frame.Payload) > 0 {
+		readings, payloadLength, decodeDuration, payloadErr = g.decodeFramePayload(ctx, session, frame)
+	}
+
+	macCommands := lorawan.ParseMACCommands(frame.MACCommands)
+	if len(macCommands) > 0 {
+		g.answerMACCommands(device, macCommands, rx, key)
+	}
+
+	// devices that set the ADR bit let the gateway choose their data rate.
+	// downlinks to them have the ADR bit set to tell them the gateway does.
+	adr := frame.FCtrl&fCtrlADR != 0
+	g.mu.Lock()
+	device.ADR = adr
+	g.mu.Unlock()
+	if adr {
+		g.adaptDataRate(device, rx)
+	}
+
+	// confirmed uplinks are retransmitted by the device until they are acknowledged.
+	if phyPayload[0]&mTypeMask == confirmedDataUp {
+		g.queueAck(device, frameCnt)
 	}
 
-	// payload was empty or unparsable
-	if len(readings) == 0 {
-		return "", map[string]interface{}{}, fmt.Errorf("data received by node %s was not parsable", device.NodeName)
+	if payloadErr != nil {
+		return device.NodeName, nil, payloadErr
+	}
+	if filtered {
+		uplinksFiltered.WithLabelValues(device.NodeName).Inc()
+		g.recordFiltered(device.NodeName)
+		return device.NodeName, nil, nil
 	}
 
-	// Ensure all types in map are protobuf compatiable.
-	readings = convertTo32Bit(readings)
+	if len(macCommands) > 0 {
+		readings["mac_commands"] = lorawan.MACCommandsToReadings(macCommands)
+	}
 
 	// add time to the readings map
 	// Note that this won't precisely reflect when the uplink was sent, but since lorawan uplinks are sent infrequently
@@ -84,123 +186,295 @@ func (g *Gateway) parseDataUplink(ctx context.Context, phyPayload []byte) (strin
 	t := time.Unix(int64(unix), 0)
 	timestamp := t.Format(time.RFC3339)
 	readings["time"] = timestamp
-
+	addSampleTimes(readings, t)
+
+	// link diagnostics for the node.
+	readings["last_seen"] = timestamp
+	readings["rssi"] = float64(rx.rssi)
+	readings["snr"] = float64(rx.snr)
+
+	g.logger.Debugw("decoded uplink",
+		"device", device.NodeName,
+		"dev_addr", hex.EncodeToString(device.Addr),
+		"fport", fPort,
+		"fcnt", frameCnt,
+		"bytes", payloadLength,
+		"decode_duration", decodeDuration,
+	)
 	return device.NodeName, readings, nil
 }
 
-// 8 and 16 bit integers are not supported in protobuf.
-// If the decoder returns those types, convert to 32 bit integer.
-func convertTo32Bit(readings map[string]interface{}) map[string]interface{} {
-	// Iterate over the map and convert uint8 values to uint32
-	for key, value := range readings {
-		if reflect.TypeOf(value).Kind() == reflect.Uint8 {
-			readings[key] = uint32(value.(uint8))
-		}
-		if reflect.TypeOf(value).Kind() == reflect.Uint16 {
-			readings[key] = uint32(value.(uint16))
-		}
-		if reflect.TypeOf(value).Kind() == reflect.Int16 {
-			readings[key] = int32(value.(int16))
-		}
-		if reflect.TypeOf(value).Kind() == reflect.Int8 {
-			readings[key] = int32(value.(int8))
-		}
+// decodeFramePayload decrypts the application payload of the frame and decodes it with the device's decoder.
+// The readings are empty until every fragment of a fragmented data block has been received.
+// It also returns the length of the decoded payload and how long decoding took.
+func (g *Gateway) decodeFramePayload(
+	ctx context.Context, session uplinkSession, frame lorawan.Frame,
+) (map[string]interface{}, int, time.Duration, error) {
+	device := session.device
+	decryptedPayload, err := session.DecryptPayload(frame)
+	if err != nil {
+		return nil, 0, 0, err
 	}
-	return readings
-}
+	g.traceUplink("decrypted payload", "device", device.NodeName, "payload", hex.EncodeToString(decryptedPayload))
 
-func matchDeviceAddr(devAddr []byte, devices map[string]*node.Node) (*node.Node, error) {
-	for _, dev := range devices {
-		if bytes.Equal(devAddr, dev.Addr) {
-			return dev, nil
+	// fragmented data blocks are decoded once every fragment has been received.
+	if frame.FPort == fragmentationPort {
+		decryptedPayload, err = g.fragments.add(device.NodeName, decryptedPayload)
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("error reassembling fragments: %w", err)
+		}
+		if decryptedPayload == nil {
+			return map[string]interface{}{}, len(frame.Payload), 0, nil
 		}
 	}
-	return nil, fmt.Errorf("no match for DeviceAddress %v", devAddr)
-}
 
-func decodePayload(ctx context.Context, fPort uint8, path string, data []byte) (map[string]interface{}, error) {
-	decoder, err := os.ReadFile(path)
+	// decode using the codec.
+	start := time.Now()
+	readings, err := g.decoders.DecodePayload(ctx, frame.FPort, session.decoding, decryptedPayload, g.decoderLogs(device))
+	decodeDuration := time.Since(start)
 	if err != nil {
-		return map[string]interface{}{}, err
+		uplinksDecodeFailures.WithLabelValues(device.NodeName).Inc()
+		g.recordDecodeError(device.NodeName)
+		return nil, len(decryptedPayload), decodeDuration, err
 	}
+	return readings, len(decryptedPayload), decodeDuration, nil
+}
 
-	// Convert the byte slice to a string
-	fileContent := string(decoder)
+// validateDeviceUplinkMIC verifies the MIC of the uplink with the session keys of the device's LoRaWAN version.
+func (g *Gateway) validateDeviceUplinkMIC(device *node.Node, devAddr types.DevAddr, fCnt uint32, phyPayload []byte, rx rxInfo) error {
+	if device.LorawanVersion != "1.1.0" {
+		return lorawan.ValidateUplinkMIC(device.NwkSKey, devAddr, fCnt, phyPayload)
+	}
 
-	readingsMap, err := convertBinaryToMap(ctx, fPort, fileContent, data)
+	// the 1.1 MIC includes the data rate and channel the uplink was sent on.
+	txDR, ok := g.region.uplinkDataRate(rx.sf, rx.bandwidth)
+	if !ok {
+		return fmt.Errorf("uplink received with unknown data rate SF%d bandwidth %d", rx.sf, rx.bandwidth)
+	}
+	txCh, ok := g.region.uplinkChannel(rx.frequency)
+	if !ok {
+		return fmt.Errorf("uplink received on unknown channel %d Hz", rx.frequency)
+	}
+	return lorawan.ValidateUplinkMIC11(device.SNwkSIntKey, device.FNwkSIntKey, txDR, txCh, devAddr, fCnt, phyPayload)
+}
 
-	return readingsMap, nil
+// uplinkSession is the device and session state of an authenticated data uplink.
+type uplinkSession struct {
+	device *node.Node
+	lorawan.Session
+	// decoding is the device's decoder config, copied with the session so it doesn't race with reconfiguring the node.
+	decoding lorawan.Device
+	// retransmission is set for a confirmed uplink sent again with the last accepted frame counter.
+	retransmission bool
 }
 
-func convertBinaryToMap(ctx context.Context, fPort uint8, decodeScript string, b []byte) (map[string]interface{}, error) {
+// authenticateUplink matches the data uplink to its device, verifies the MIC and checks the frame counter.
+// If the uplink is rejected after it was matched, the returned session only has the device.
+func (g *Gateway) authenticateUplink(phyPayload []byte, rx rxInfo) (uplinkSession, error) {
+	// need to reserve the bytes since payload is in LE.
+	devAddrBE := reverseByteArray(phyPayload[1:5])
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
 
-	decodeScript = decodeScript + "\n\nDecode(fPort, bytes);\n"
+	device, err := matchDeviceAddr(devAddrBE, g.devices)
+	if err != nil {
+		g.logger.Infof("received packet from unknown device, ignoring")
+		uplinksUnknownDevice.Inc()
+		return uplinkSession{}, errNoDevice
+	}
 
-	vars := make(map[string]interface{})
+	// frame count - should increase by 1 with each packet sent
+	// only the 16 LSB are sent in the uplink, reconstruct the full 32 bit counter.
+	fCnt := binary.LittleEndian.Uint16(phyPayload[6:8])
+	frameCnt := fullFrameCounter(device, fCnt)
 
-	vars["fPort"] = fPort
-	vars["bytes"] = b
+	dAddr := types.MustDevAddr(devAddrBE)
 
-	v, err := executeDecoder(ctx, decodeScript, vars)
+	// verify the MIC before decrypting so corrupted or spoofed frames are dropped.
+	// keys is the session the uplink was sent with, the device or the session before its keys were updated.
+	keys := device
+	err = g.validateDeviceUplinkMIC(device, *dAddr, frameCnt, phyPayload, rx)
+	if errors.Is(err, lorawan.ErrInvalidMIC) {
+		if previous := previousSessionLocked(device); previous != nil {
+			previousCnt := fullFrameCounter(previous, fCnt)
+			if g.validateDeviceUplinkMIC(previous, *dAddr, previousCnt, phyPayload, rx) == nil {
+				g.logger.Debugf("received packet from device %s with its previous session keys", device.NodeName)
+				keys, frameCnt, err = previous, previousCnt, nil
+			}
+		}
+	}
+	// a rebooted ABP device starts its frame counter over, which only matches the MIC without the extended 16 MSB.
+	if errors.Is(err, lorawan.ErrInvalidMIC) && frameCounterResetAllowed(device, fCnt) &&
+		g.validateDeviceUplinkMIC(device, *dAddr, uint32(fCnt), phyPayload, rx) == nil {
+		g.logger.Warnf("device %s reset its frame counter from %d to %d, accepting it since relax_fcnt_check is set",
+			device.NodeName, device.FCntUp, fCnt)
+		device.FCntUpValid = false
+		frameCnt, err = uint32(fCnt), nil
+	}
 	if err != nil {
-		return nil, err
+		g.logger.Warnf("received packet from device %s with invalid MIC, ignoring", device.NodeName)
+		if errors.Is(err, lorawan.ErrInvalidMIC) {
+			uplinksInvalidMIC.WithLabelValues(device.NodeName).Inc()
+		}
+		return uplinkSession{device: device}, err
+	}
+
+	// a device that didn't receive the ack of a confirmed uplink sends it again with the same frame counter.
+	// it is acknowledged again but not decoded, since its readings were already recorded.
+	if phyPayload[0]&mTypeMask == confirmedDataUp && keys.FCntUpValid && frameCnt == keys.FCntUp {
+		g.logger.Debugf("received retransmission of confirmed uplink %d from device %s", frameCnt, device.NodeName)
+		return uplinkSession{device: device, Session: lorawan.Session{DevAddr: *dAddr, FCnt: frameCnt}, retransmission: true}, nil
 	}
 
-	switch v.(type) {
-	case map[string]interface{}:
-	default:
-		return map[string]interface{}{}, errors.New("decoder returned unexpected data type")
+	// reject frames that were already received to protect against replay attacks.
+	err = checkFrameCounter(keys, frameCnt)
+	if err != nil {
+		g.logger.Warnf("received packet from device %s with frame counter %d, ignoring: %s", device.NodeName, frameCnt, err)
+		return uplinkSession{device: device}, err
+	}
+	// the frame counter of the previous session isn't saved, it is only kept for the grace period.
+	if keys == device {
+		g.saveSessionLocked(device)
 	}
 
-	readings := v.(map[string]interface{})
+	nwkSEncKey := keys.NwkSKey
+	if keys.LorawanVersion == "1.1.0" {
+		nwkSEncKey = keys.NwkSEncKey
+	}
 
-	return readings, nil
+	return uplinkSession{
+		device: device,
+		Session: lorawan.Session{
+			DevAddr:        *dAddr,
+			FCnt:           frameCnt,
+			AppSKey:        keys.AppSKey,
+			NwkSEncKey:     nwkSEncKey,
+			LorawanVersion: keys.LorawanVersion,
+		},
+		decoding: lorawanDevice(device),
+	}, nil
 }
 
-// struct to hold both value and error to send through channel.
-type result struct {
-	val otto.Value
-	err error
+// previousSessionLocked returns the session the device had before its keys were updated, or nil if it has none
+// or its grace period is over. The caller must hold the gateway mutex.
+func previousSessionLocked(device *node.Node) *node.Node {
+	if device.PreviousSession != nil && time.Now().After(device.PreviousSessionExpires) {
+		device.PreviousSession = nil
+	}
+	return device.PreviousSession
 }
 
-func executeDecoder(ctx context.Context, script string, vars map[string]interface{}) (out interface{}, err error) {
-	defer func() {
-		if caught := recover(); caught != nil {
-			err = fmt.Errorf("%s", caught)
-		}
-	}()
+// maxResetFCnt is the largest frame counter accepted as a reset of the counter of a node with relax_fcnt_check set.
+// A device that rebooted sends counters from 0, higher counters are more likely to be replays of old frames.
+const maxResetFCnt = 16
+
+// frameCounterResetAllowed returns true if the uplink frame counter fCnt is accepted as a reset of the device's
+// counter, for ABP devices with RelaxFCntCheck set. The caller must hold the gateway mutex.
+func frameCounterResetAllowed(device *node.Node, fCnt uint16) bool {
+	return device.RelaxFCntCheck && device.JoinType == "ABP" && device.FCntUpValid &&
+		uint32(fCnt) <= maxResetFCnt && uint32(fCnt) < device.FCntUp
+}
+
+// fullFrameCounter reconstructs the 32 bit uplink frame counter of the device from the 16 LSB sent in the frame.
+// The caller must hold the gateway mutex.
+func fullFrameCounter(device *node.Node, fCnt uint16) uint32 {
+	if !device.FCntUpValid {
+		return uint32(fCnt)
+	}
+	return lorawan.ExtendFrameCounter(device.FCntUp, fCnt)
+}
 
-	vm := otto.New()
-	vm.Interrupt = make(chan func(), 1)
-	vm.SetStackDepthLimit(32)
+// checkFrameCounter rejects uplinks with a frame counter less than or equal to the last accepted counter.
+// When there is no prior value (after startup or a new join), the first counter received is accepted.
+// The caller must hold the gateway mutex.
+func checkFrameCounter(device *node.Node, fCnt uint32) error {
+	if device.FCntUpValid && fCnt <= device.FCntUp {
+		return errInvalidFCnt
+	}
+	device.FCntUp = fCnt
+	device.FCntUpValid = true
+	return nil
+}
 
-	for k, v := range vars {
-		if err := vm.Set(k, v); err != nil {
-			return nil, err
+func matchDeviceAddr(devAddr []byte, devices map[string]*node.Node) (*node.Node, error) {
+	for _, dev := range devices {
+		if bytes.Equal(devAddr, dev.Addr) {
+			return dev, nil
 		}
 	}
+	return nil, fmt.Errorf("no match for DeviceAddress %v", devAddr)
+}
 
-	resultChan := make(chan result)
-	timeoutCtx, _ := context.WithTimeout(ctx, 10*time.Millisecond)
+// decodePayload runs the device's decoder on the uplink payload, followed by its decoder stages.
+func (g *Gateway) decodePayload(ctx context.Context, fPort uint8, device *node.Node, data []byte) (map[string]interface{}, error) {
+	g.mu.Lock()
+	decoding := lorawanDevice(device)
+	g.mu.Unlock()
+	return g.decoders.Decode(ctx, fPort, decoding, data, g.decoderLogs(device))
+}
 
-	go func() {
-		var res result
-		res.val, res.err = vm.Run(script)
-		resultChan <- res
-	}()
+// decoderLogs logs the messages of the device's decoder scripts.
+// Warnings returned by the decoders are logged at most once per warningInterval.
+func (g *Gateway) decoderLogs(device *node.Node) lorawan.DecoderLogs {
+	return lorawan.DecoderLogs{
+		Warn: func(warning string) {
+			g.logDecoderWarning(device.NodeName, warning)
+		},
+		Print: func(msg string) {
+			g.logger.Debugf("decoder for %s logged: %s", device.NodeName, msg)
+		},
+	}
+}
 
-	select {
-	case <-timeoutCtx.Done():
-		vm.Interrupt <- func() {
-			errors.New("ctx canceled")
+// lorawanDevice returns the session and decoder config of the node, for decoding its uplinks with the lorawan package.
+// The caller must hold the gateway mutex, joins change the dev addr and keys of the node.
+func lorawanDevice(device *node.Node) lorawan.Device {
+	return lorawan.Device{
+		Name:           device.NodeName,
+		DevEUI:         device.DevEui,
+		DevAddr:        device.Addr,
+		NwkSKey:        device.NwkSKey,
+		AppSKey:        device.AppSKey,
+		LorawanVersion: device.LorawanVersion,
+		FCntUp:         device.FCntUp,
+		FCntUpValid:    device.FCntUpValid,
+		PortAllowlist:  device.PortAllowlist,
+		PortDenylist:   device.PortDenylist,
+		Decoder: lorawan.DecoderConfig{
+			Path:           device.DecoderPath,
+			Script:         device.DecoderScript,
+			Format:         device.DecoderFormat,
+			Fields:         device.DecoderFields,
+			Function:       device.DecoderFunction,
+			PortDecoders:   device.PortDecoders,
+			Stages:         device.DecoderStages,
+			Vars:           device.DecoderVars,
+			Helpers:        device.DecoderHelpers,
+			Timeout:        device.DecoderTimeout,
+			MaxOutputBytes: device.DecoderMaxOutputBytes,
+		},
+	}
+}
+
+// addSampleTimes sets the time each sample was measured from its offset_s, the seconds before the uplink was
+// received. Samples without an offset_s don't get a time.
+func addSampleTimes(readings map[string]interface{}, received time.Time) {
+	samples, _ := readings["samples"].([]interface{})
+	for _, sample := range samples {
+		sample, ok := sample.(map[string]interface{})
+		if !ok {
+			continue
 		}
-		return nil, ctx.Err()
-	case res := <-resultChan:
-		// the decoder completed
-		if res.err != nil {
-			return nil, res.err
+		var offset float64
+		switch v := sample["offset_s"].(type) {
+		case int64:
+			offset = float64(v)
+		case float64:
+			offset = v
+		default:
+			continue
 		}
-		return res.val.Export()
+		sample["time"] = received.Add(-time.Duration(offset * float64(time.Second))).Format(time.RFC3339)
 	}
-
 }
@@ -1,52 +1,766 @@
 package gateway
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"gateway/lorawan"
+	"gateway/node"
+	"gateway/testutils"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"go.thethings.network/lorawan-stack/v3/pkg/crypto"
+	"go.thethings.network/lorawan-stack/v3/pkg/types"
+	"go.viam.com/rdk/logging"
 	"go.viam.com/test"
 )
 
-func TestConvertTo32Bit(t *testing.T) {
-	// Create test input with various integer types
-	input := map[string]interface{}{
-		"uint8_val":  uint8(255),
-		"uint16_val": uint16(65535),
-		"int8_val":   int8(-128),
-		"int16_val":  int16(-32768),
-		"other_val":  "string", // Should remain unchanged
-	}
-
-	// Convert the values
-	result := convertTo32Bit(input)
-
-	// Verify uint8 was converted to uint32
-	uint8Conv, ok := result["uint8_val"].(uint32)
-	test.That(t, ok, test.ShouldBeTrue)
-	test.That(t, uint8Conv, test.ShouldEqual, uint32(255))
-
-	// Verify uint16 was converted to uint32
-	uint16Conv, ok := result["uint16_val"].(uint32)
-	test.That(t, ok, test.ShouldBeTrue)
-	test.That(t, uint16Conv, test.ShouldEqual, uint32(65535))
-
-	// Verify int8 was converted to int32
-	int8Conv, ok := result["int8_val"].(int32)
-	test.That(t, ok, test.ShouldBeTrue)
-	test.That(t, int8Conv, test.ShouldEqual, int32(-128))
-
-	// Verify int16 was converted to int32
-	int16Conv, ok := result["int16_val"].(int32)
-	test.That(t, ok, test.ShouldBeTrue)
-	test.That(t, int16Conv, test.ShouldEqual, int32(-32768))
-
-	// Verify non-integer values remain unchanged
-	otherVal, ok := result["other_val"].(string)
-	test.That(t, ok, test.ShouldBeTrue)
-	test.That(t, otherVal, test.ShouldEqual, "string")
-
-	// Verify empty input does nothing.
-	input = map[string]interface{}{}
-	result = convertTo32Bit(input)
-	test.That(t, result, test.ShouldEqual, input)
+func TestParseDataUplinkNullReadings(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+	device.DecoderPath = writeTestDecoder(t, `function Decode(fPort, bytes) { return {a: null, b: 1, c: {d: null}}; }`)
 
+	_, readings, err := g.parseDataUplink(ctx, createTestUplink(t, 1, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldContainKey, "a")
+	test.That(t, readings["a"], test.ShouldBeNil)
+	test.That(t, readings["b"], test.ShouldEqual, 1)
+	test.That(t, readings["c"], test.ShouldResemble, map[string]interface{}{"d": nil})
+
+}
+
+const (
+	testDecoderScript = `function Decode(fPort, bytes) {
+	return {"temperature": bytes[0] + bytes[1] / 10};
+}`
+)
+
+var (
+	testDevAddr = []byte{0x01, 0x02, 0x03, 0x04}
+	testAppSKey = []byte{
+		0x01, 0x23, 0x45, 0x67, 0x89, 0xAB, 0xCD, 0xEF,
+		0x01, 0x23, 0x45, 0x67, 0x89, 0xAB, 0xCD, 0xEE,
+	}
+	testNwkSKey = []byte{
+		0x01, 0x23, 0x45, 0x67, 0x89, 0xAB, 0xCD, 0xEF,
+		0x01, 0x23, 0x45, 0x67, 0x89, 0xAB, 0xCD, 0xEF,
+	}
+	// US915 channel 0 at DR3.
+	testRxInfo = rxInfo{frequency: 902300000, sf: 7, bandwidth: bandwidth125k}
+)
+
+// createTestDevice returns an ABP device with the test session keys and decoder.
+func createTestDevice(t *testing.T) *node.Node {
+	decoderPath := filepath.Join(t.TempDir(), "decoder.js")
+	err := os.WriteFile(decoderPath, []byte(testDecoderScript), 0o600)
+	test.That(t, err, test.ShouldBeNil)
+	return &node.Node{
+		NodeName:    "test-device",
+		JoinType:    "ABP",
+		DecoderPath: decoderPath,
+		Addr:        testDevAddr,
+		AppSKey:     testAppSKey,
+		NwkSKey:     testNwkSKey,
+	}
+}
+
+// createTestGateway returns a gateway with a single ABP device registered, without starting the radio.
+func createTestGateway(t *testing.T) *Gateway {
+	device := createTestDevice(t)
+	return &Gateway{
+		logger:       logging.NewTestLogger(t),
+		devices:      map[string]*node.Node{device.NodeName: device},
+		lastReadings: map[string]interface{}{},
+		region:       regions[defaultRegion],
+		netID:        defaultNetID,
+	}
+}
+
+// createTestUplink builds an encrypted unconfirmed data uplink with a valid MIC.
+func createTestUplink(t *testing.T, fCnt uint32, fPort uint8, data []byte) []byte {
+	return createTestUplinkWithFOpts(t, fCnt, nil, fPort, data)
+}
+
+// createTestUplinkWithFOpts builds an encrypted unconfirmed data uplink carrying MAC commands in FOpts.
+func createTestUplinkWithFOpts(t *testing.T, fCnt uint32, fOpts []byte, fPort uint8, data []byte) []byte {
+	return createUplink(t, testNwkSKey, testAppSKey, testDevAddr, fCnt, fOpts, fPort, data)
+}
+
+// createUplink builds an encrypted unconfirmed data uplink for the device with the given session keys and addr.
+func createUplink(t *testing.T, nwkSKey, appSKey, addr []byte, fCnt uint32, fOpts []byte, fPort uint8, data []byte) []byte {
+	return createUplinkWithMHDR(t, unconfirmedDataUp, nwkSKey, appSKey, addr, fCnt, fOpts, fPort, data)
+}
+
+// createUplinkWithMHDR builds an encrypted data uplink with the given message type.
+func createUplinkWithMHDR(
+	t *testing.T, mhdr byte, nwkSKey, appSKey, addr []byte, fCnt uint32, fOpts []byte, fPort uint8, data []byte,
+) []byte {
+	device := testutils.Device{DevAddr: addr, NwkSKey: nwkSKey, AppSKey: appSKey}
+	frame, err := device.Frame(mhdr, fCnt, fOpts, fPort, data)
+	test.That(t, err, test.ShouldBeNil)
+	return frame
+}
+
+func TestParseDataUplinkMIC(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+
+	// valid MIC decodes normally.
+	uplink := createTestUplink(t, 1, 1, []byte{0x15, 0x05})
+	name, readings, err := g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, name, test.ShouldEqual, "test-device")
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+
+	// flipping a byte of the MIC should drop the frame.
+	uplink = createTestUplink(t, 2, 1, []byte{0x15, 0x05})
+	uplink[len(uplink)-1] ^= 0xFF
+	name, readings, err = g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrInvalidMIC), test.ShouldBeTrue)
+	test.That(t, name, test.ShouldEqual, "")
+	test.That(t, readings, test.ShouldBeEmpty)
+}
+
+func TestParseDataUplinkTruncated(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	uplink := createTestUplink(t, 1, 1, []byte{0x15, 0x05})
+	withFOpts := createUplink(t, testNwkSKey, testAppSKey, testDevAddr, 2, []byte{0x02}, 1, []byte{0x15, 0x05})
+
+	// frames cut off in the header, before the fport and in the fopts are dropped without panicking.
+	for _, frame := range [][]byte{
+		{},
+		uplink[:1],
+		uplink[:5],
+		uplink[:8],
+		uplink[:11],
+		uplink[:12],
+		withFOpts[:13],
+	} {
+		name, readings, err := g.parseDataUplink(ctx, frame, testRxInfo)
+		test.That(t, errors.Is(err, lorawan.ErrShortDataUplink), test.ShouldBeTrue)
+		test.That(t, name, test.ShouldEqual, "")
+		test.That(t, readings, test.ShouldBeEmpty)
+	}
+
+	// the fopts length in fctrl can claim more bytes than the frame has.
+	frame := append([]byte{}, uplink...)
+	frame[5] |= 0x0F
+	_, _, err := g.parseDataUplink(ctx, frame, testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrShortDataUplink), test.ShouldBeTrue)
+
+	_, _, err = g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+}
+
+// FuzzParseDataUplink checks malformed frames are rejected without panicking or hanging.
+// With sign set the frame is sent from the test device with a valid MIC, so the fuzzer gets past the MIC check
+// to the FOpts, FPort and payload.
+func FuzzParseDataUplink(f *testing.F) {
+	device := testutils.Device{DevAddr: testDevAddr, NwkSKey: testNwkSKey, AppSKey: testAppSKey}
+	for _, seed := range []struct {
+		fOpts   []byte
+		fPort   uint8
+		payload []byte
+	}{
+		{nil, 1, []byte{0x15, 0x05}},
+		{[]byte{lorawan.CIDLinkCheck, lorawan.CIDDeviceTime}, 1, []byte{0x15, 0x05}},
+		{[]byte{lorawan.CIDDevStatus, 0xFE, 0x05}, 2, nil},
+		{nil, 0, []byte{lorawan.CIDLinkADR, 0x07}},
+		{nil, fragmentationPort, testFragSessionSetup(2, 16, 2)},
+	} {
+		frame, err := device.Frame(unconfirmedDataUp, 1, seed.fOpts, seed.fPort, seed.payload)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(frame, false)
+		f.Add(frame[:len(frame)-4], true)
+	}
+	f.Add([]byte{}, false)
+
+	f.Fuzz(func(t *testing.T, frame []byte, sign bool) {
+		if sign && len(frame) >= 8 {
+			frame = append([]byte{}, frame...)
+			binary.LittleEndian.PutUint32(frame[1:5], binary.BigEndian.Uint32(testDevAddr))
+			fCnt := uint32(binary.LittleEndian.Uint16(frame[6:8]))
+			mic, err := crypto.ComputeLegacyUplinkMIC(types.AES128Key(testNwkSKey), *types.MustDevAddr(testDevAddr), fCnt, frame)
+			test.That(t, err, test.ShouldBeNil)
+			frame = append(frame, mic[:]...)
+		}
+
+		g := createTestGateway(t)
+		start := time.Now()
+		_, _, _ = g.parseDataUplink(context.Background(), frame, testRxInfo)
+		test.That(t, time.Since(start), test.ShouldBeLessThan, time.Second)
+	})
+}
+
+func TestParseDataUplinkRadioMetadata(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+
+	rx := testRxInfo
+	rx.rssi = -87.5
+	rx.snr = 7.25
+	before := time.Now().Truncate(time.Second)
+	name, readings, err := g.parseDataUplink(ctx, createTestUplink(t, 1, 1, []byte{0x15, 0x05}), rx)
+	test.That(t, err, test.ShouldBeNil)
+	g.updateReadings(name, readings)
+
+	allReadings, err := g.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	nodeReadings := allReadings["test-device"].(map[string]interface{})
+	test.That(t, nodeReadings["temperature"], test.ShouldEqual, 21.5)
+	test.That(t, nodeReadings["rssi"], test.ShouldEqual, -87.5)
+	test.That(t, nodeReadings["snr"], test.ShouldEqual, 7.25)
+
+	lastSeen, err := time.Parse(time.RFC3339, nodeReadings["last_seen"].(string))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, lastSeen, test.ShouldHappenOnOrBetween, before, time.Now())
+}
+
+func TestParseDataUplinkLog(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	logger, logs := logging.NewObservedTestLogger(t)
+	g.logger = logger
+
+	_, _, err := g.parseDataUplink(ctx, createTestUplink(t, 7, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+
+	// each decoded uplink logs one entry with structured fields.
+	entries := logs.FilterMessage("decoded uplink").All()
+	test.That(t, len(entries), test.ShouldEqual, 1)
+	fields := entries[0].ContextMap()
+	test.That(t, fields["device"], test.ShouldEqual, "test-device")
+	test.That(t, fields["dev_addr"], test.ShouldEqual, "01020304")
+	test.That(t, fields["fport"], test.ShouldEqual, uint8(1))
+	test.That(t, fields["fcnt"], test.ShouldEqual, uint32(7))
+	test.That(t, fields["bytes"], test.ShouldEqual, int64(2))
+	test.That(t, fields["decode_duration"], test.ShouldBeGreaterThan, time.Duration(0))
+
+	// uplinks that fail aren't logged as decoded.
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 7, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, logs.FilterMessage("decoded uplink").Len(), test.ShouldEqual, 1)
+}
+
+func TestParseDataUplinkFrameCounter(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	data := []byte{0x15, 0x05}
+
+	// in order frames are accepted, the first one is accepted with no prior value.
+	for fCnt := uint32(5); fCnt < 8; fCnt++ {
+		_, _, err := g.parseDataUplink(ctx, createTestUplink(t, fCnt, 1, data), testRxInfo)
+		test.That(t, err, test.ShouldBeNil)
+	}
+	test.That(t, g.devices["test-device"].FCntUp, test.ShouldEqual, 7)
+
+	// replaying the last frame is rejected, forget the received uplinks so the replay isn't dropped as a duplicate.
+	g.dedup = dedupCache{}
+	_, readings, err := g.parseDataUplink(ctx, createTestUplink(t, 7, 1, data), testRxInfo)
+	test.That(t, errors.Is(err, errInvalidFCnt), test.ShouldBeTrue)
+	test.That(t, readings, test.ShouldBeEmpty)
+
+	// an older frame is rejected, its counter is treated as a rollover so the MIC no longer matches.
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 3, 1, data), testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrInvalidMIC), test.ShouldBeTrue)
+
+	// skipping several counters is accepted since uplinks can be lost.
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 20, 1, data), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, g.devices["test-device"].FCntUp, test.ShouldEqual, 20)
+}
+
+func TestParseDataUplinkFrameCounterRollover(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+	device.FCntUp = 0xFFFE
+	device.FCntUpValid = true
+
+	_, readings, err := g.parseDataUplink(ctx, createTestUplink(t, 0xFFFF, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+
+	// the device's counter crosses 0xFFFF, only 0x0001 is sent over the air.
+	_, readings, err = g.parseDataUplink(ctx, createTestUplink(t, 0x10001, 1, []byte{0x16, 0x00}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 22)
+	test.That(t, device.FCntUp, test.ShouldEqual, 0x10001)
+
+	_, readings, err = g.parseDataUplink(ctx, createTestUplink(t, 0x10002, 1, []byte{0x17, 0x00}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 23)
+}
+
+func TestParseDataUplinkFrameCounterReset(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+	for fCnt := uint32(40); fCnt <= 42; fCnt++ {
+		_, _, err := g.parseDataUplink(ctx, createTestUplink(t, fCnt, 1, []byte{0x15, 0x05}), testRxInfo)
+		test.That(t, err, test.ShouldBeNil)
+	}
+
+	// the device reboots and starts its counter over, by default the frames are rejected.
+	_, _, err := g.parseDataUplink(ctx, createTestUplink(t, 0, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrInvalidMIC), test.ShouldBeTrue)
+	test.That(t, device.FCntUp, test.ShouldEqual, 42)
+
+	// with relax_fcnt_check the reset is accepted and the counter continues from it.
+	device.RelaxFCntCheck = true
+	_, readings, err := g.parseDataUplink(ctx, createTestUplink(t, 1, 1, []byte{0x16, 0x00}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 22)
+	test.That(t, device.FCntUp, test.ShouldEqual, 1)
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 2, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, device.FCntUp, test.ShouldEqual, 2)
+
+	// a replay of the last frame is still rejected, and so are resets to counters that aren't low.
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 2, 1, []byte{0x16, 0x00}), testRxInfo)
+	test.That(t, errors.Is(err, errInvalidFCnt), test.ShouldBeTrue)
+	for fCnt := uint32(3); fCnt <= 30; fCnt++ {
+		_, _, err = g.parseDataUplink(ctx, createTestUplink(t, fCnt, 1, []byte{0x15, 0x05}), testRxInfo)
+		test.That(t, err, test.ShouldBeNil)
+	}
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, maxResetFCnt+1, 1, []byte{0x16, 0x00}), testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrInvalidMIC), test.ShouldBeTrue)
+	test.That(t, device.FCntUp, test.ShouldEqual, 30)
+
+	// OTAA devices start a new session by joining instead.
+	device.JoinType = "OTAA"
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 0, 1, []byte{0x16, 0x00}), testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrInvalidMIC), test.ShouldBeTrue)
+}
+
+func TestParseDataUplinkFOpts(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+
+	// LinkCheckReq has no payload.
+	uplink := createTestUplinkWithFOpts(t, 1, []byte{lorawan.CIDLinkCheck}, 1, []byte{0x15, 0x05})
+	_, readings, err := g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+	test.That(t, readings["mac_commands"], test.ShouldResemble, []interface{}{
+		map[string]interface{}{"command": "LinkCheckReq"},
+	})
+
+	// no mac_commands key when FOpts is empty.
+	_, readings, err = g.parseDataUplink(ctx, createTestUplink(t, 2, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldNotContainKey, "mac_commands")
+}
+
+// testSession11 holds the LoRaWAN 1.1 session keys of a test device.
+type testSession11 struct {
+	fNwkSIntKey []byte
+	sNwkSIntKey []byte
+	nwkSEncKey  []byte
+	appSKey     []byte
+}
+
+// addTestDevice11 registers a LoRaWAN 1.1 ABP device to the test gateway.
+func addTestDevice11(g *Gateway, addr []byte, s testSession11) *node.Node {
+	device := &node.Node{
+		NodeName:       "test-device-11",
+		JoinType:       "ABP",
+		DecoderPath:    g.devices["test-device"].DecoderPath,
+		Addr:           addr,
+		AppSKey:        s.appSKey,
+		FNwkSIntKey:    s.fNwkSIntKey,
+		SNwkSIntKey:    s.sNwkSIntKey,
+		NwkSEncKey:     s.nwkSEncKey,
+		LorawanVersion: "1.1.0",
+	}
+	g.devices[device.NodeName] = device
+	return device
+}
+
+// createUplink11 builds a LoRaWAN 1.1 data uplink with encrypted FOpts, sent on txCh at txDR.
+func createUplink11(t *testing.T, s testSession11, addr []byte, txDR, txCh uint8, fCnt uint32, fOpts []byte, fPort uint8, data []byte) []byte {
+	devAddr := types.MustDevAddr(addr)
+
+	enc, err := crypto.EncryptUplink(types.AES128Key(s.appSKey), *devAddr, fCnt, data)
+	test.That(t, err, test.ShouldBeNil)
+	encFOpts, err := crypto.EncryptUplink(types.AES128Key(s.nwkSEncKey), *devAddr, fCnt, fOpts)
+	test.That(t, err, test.ShouldBeNil)
+
+	payload := []byte{0x40}
+	payload = append(payload, reverseByteArray(addr)...)
+	payload = append(payload, byte(len(fOpts))) // FCtrl
+	payload = binary.LittleEndian.AppendUint16(payload, uint16(fCnt))
+	payload = append(payload, encFOpts...)
+	payload = append(payload, fPort)
+	payload = append(payload, enc...)
+
+	mic, err := crypto.ComputeUplinkMIC(types.AES128Key(s.sNwkSIntKey), types.AES128Key(s.fNwkSIntKey), 0, txDR, txCh, *devAddr, fCnt, payload)
+	test.That(t, err, test.ShouldBeNil)
+
+	return append(payload, mic[:]...)
+}
+
+func TestParseDataUplinkPort0(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+
+	// port 0 carries a DeviceTimeReq encrypted with the NwkSKey, it isn't passed to the decoder.
+	uplink := createUplinkWithMHDR(t, unconfirmedDataUp, testNwkSKey, testNwkSKey, testDevAddr, 1, nil, 0, []byte{lorawan.CIDDeviceTime})
+	name, readings, err := g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, name, test.ShouldEqual, "test-device")
+	test.That(t, readings, test.ShouldNotContainKey, "temperature")
+	test.That(t, readings["mac_commands"], test.ShouldResemble, []interface{}{
+		map[string]interface{}{"command": "DeviceTimeReq"},
+	})
+
+	// MAC commands can't be in both FOpts and the port 0 payload.
+	uplink = createUplinkWithMHDR(t, unconfirmedDataUp, testNwkSKey, testNwkSKey, testDevAddr, 2, []byte{lorawan.CIDLinkCheck}, 0, []byte{lorawan.CIDDeviceTime})
+	_, _, err = g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrFOptsWithPort0), test.ShouldBeTrue)
+}
+
+func TestParseDataUplinkKeyPerPort(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	appSKey := []byte{0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1A, 0x1B, 0x1C, 0x1D, 0x1E, 0x1F}
+	g.devices["test-device"].AppSKey = appSKey
+
+	// port 0 is decrypted with the NwkSKey and the other ports with the AppSKey.
+	uplink := createUplink(t, testNwkSKey, appSKey, testDevAddr, 1, nil, 0, []byte{lorawan.CIDDeviceTime})
+	_, readings, err := g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["mac_commands"], test.ShouldResemble, []interface{}{
+		map[string]interface{}{"command": "DeviceTimeReq"},
+	})
+	uplink = createUplink(t, testNwkSKey, appSKey, testDevAddr, 2, nil, 1, []byte{0x15, 0x05})
+	_, readings, err = g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+
+	// a device without an AppSKey still gets its MAC commands, other ports can't be decrypted.
+	g.devices["test-device"].AppSKey = nil
+	uplink = createUplink(t, testNwkSKey, appSKey, testDevAddr, 3, nil, 0, []byte{lorawan.CIDLinkCheck})
+	_, readings, err = g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["mac_commands"], test.ShouldResemble, []interface{}{
+		map[string]interface{}{"command": "LinkCheckReq"},
+	})
+	uplink = createUplink(t, testNwkSKey, appSKey, testDevAddr, 4, nil, 1, []byte{0x15, 0x05})
+	_, _, err = g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrNoAppSKey), test.ShouldBeTrue)
+}
+
+func TestParseDataUplinkEmptyPayload(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	name, readings, err := g.parseDataUplink(ctx, createTestUplink(t, 1, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	g.updateReadings(name, readings)
+
+	// a frame without an application payload isn't decoded, the decoder would fail on zero bytes.
+	g.devices["test-device"].DecoderPath = writeTestDecoder(t, `function Decode(fPort, bytes) { throw new Error("no payload"); }`)
+	uplink := createTestUplinkWithFOpts(t, 2, []byte{lorawan.CIDLinkCheck}, 1, nil)
+	name, readings, err = g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, name, test.ShouldEqual, "test-device")
+	test.That(t, readings, test.ShouldNotContainKey, "temperature")
+	test.That(t, readings, test.ShouldContainKey, "last_seen")
+	test.That(t, readings["mac_commands"], test.ShouldResemble, []interface{}{
+		map[string]interface{}{"command": "LinkCheckReq"},
+	})
+	g.updateReadings(name, readings)
+
+	// the uplink is still counted and the readings of the last decoded uplink are kept.
+	allReadings, err := g.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	deviceReadings := allReadings["test-device"].(map[string]interface{})
+	test.That(t, deviceReadings["temperature"], test.ShouldEqual, 21.5)
+	stats := deviceReadings["stats"].(map[string]interface{})
+	test.That(t, stats["uplinks"], test.ShouldEqual, 2)
+	test.That(t, stats["decode_errors"], test.ShouldEqual, 0)
+	test.That(t, stats["last_fcnt"], test.ShouldEqual, 2)
+	test.That(t, deviceReadings, test.ShouldContainKey, "mac_commands")
+
+	// the frame counter of the empty frame is used, so it can't be replayed.
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 2, 1, nil), testRxInfo)
+	test.That(t, errors.Is(err, errInvalidFCnt), test.ShouldBeTrue)
+
+	// the mac commands of the empty frame are dropped by the next uplink without them.
+	g.devices["test-device"].DecoderPath = writeTestDecoder(t, testDecoderScript)
+	name, readings, err = g.parseDataUplink(ctx, createTestUplink(t, 3, 1, []byte{0x16, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	g.updateReadings(name, readings)
+	allReadings, err = g.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	deviceReadings = allReadings["test-device"].(map[string]interface{})
+	test.That(t, deviceReadings["temperature"], test.ShouldEqual, 22.5)
+	test.That(t, deviceReadings, test.ShouldNotContainKey, "mac_commands")
+}
+
+func TestParseDataUplinkPortFilter(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+
+	// with an allowlist only the listed ports are decoded.
+	device.PortAllowlist = []int{1}
+	_, readings, err := g.parseDataUplink(ctx, createTestUplink(t, 1, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+	name, readings, err := g.parseDataUplink(ctx, createTestUplink(t, 2, 2, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, name, test.ShouldEqual, "test-device")
+	test.That(t, readings, test.ShouldBeNil)
+
+	// with a denylist every port but the listed ones is decoded.
+	device.PortAllowlist = nil
+	device.PortDenylist = []int{1}
+	_, readings, err = g.parseDataUplink(ctx, createTestUplink(t, 3, 2, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+	_, readings, err = g.parseDataUplink(ctx, createTestUplink(t, 4, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldBeNil)
+
+	// filtered uplinks are counted, and still advance the frame counter.
+	test.That(t, g.stats["test-device"].filtered, test.ShouldEqual, 2)
+	test.That(t, g.stats["test-device"].uplinks, test.ShouldEqual, 4)
+	test.That(t, device.FCntUp, test.ShouldEqual, 4)
+}
+
+func TestParseDataUplink11(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	addr := []byte{0x01, 0x02, 0x03, 0x05}
+	session := testSession11{
+		fNwkSIntKey: bytes.Repeat([]byte{0x11}, 16),
+		sNwkSIntKey: bytes.Repeat([]byte{0x22}, 16),
+		nwkSEncKey:  bytes.Repeat([]byte{0x33}, 16),
+		appSKey:     bytes.Repeat([]byte{0x44}, 16),
+	}
+	addTestDevice11(g, addr, session)
+
+	// testRxInfo is DR3 on channel 0, the FOpts are decrypted with the NwkSEncKey.
+	uplink := createUplink11(t, session, addr, 3, 0, 1, []byte{lorawan.CIDLinkCheck}, 1, []byte{0x15, 0x05})
+	name, readings, err := g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, name, test.ShouldEqual, "test-device-11")
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+	test.That(t, readings["mac_commands"], test.ShouldResemble, []interface{}{
+		map[string]interface{}{"command": "LinkCheckReq"},
+	})
+
+	// the MIC covers the channel the uplink was sent on.
+	uplink = createUplink11(t, session, addr, 3, 1, 2, nil, 1, []byte{0x15, 0x05})
+	_, _, err = g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrInvalidMIC), test.ShouldBeTrue)
+
+	// a MIC computed with the wrong key is dropped.
+	wrongKey := session
+	wrongKey.fNwkSIntKey = bytes.Repeat([]byte{0x55}, 16)
+	uplink = createUplink11(t, wrongKey, addr, 3, 0, 3, nil, 1, []byte{0x15, 0x05})
+	_, _, err = g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrInvalidMIC), test.ShouldBeTrue)
+}
+
+func TestParseDataUplinkKeepsFrame(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	addr := []byte{0x01, 0x02, 0x03, 0x05}
+	session := testSession11{
+		fNwkSIntKey: bytes.Repeat([]byte{0x11}, 16),
+		sNwkSIntKey: bytes.Repeat([]byte{0x22}, 16),
+		nwkSEncKey:  bytes.Repeat([]byte{0x33}, 16),
+		appSKey:     bytes.Repeat([]byte{0x44}, 16),
+	}
+	addTestDevice11(g, addr, session)
+
+	// decrypting the payload and FOpts and reversing the dev addr must not modify the received frame,
+	// the same frame is kept for duplicate detection.
+	for _, uplink := range [][]byte{
+		createTestUplink(t, 1, 1, []byte{0x15, 0x05}),
+		createUplink(t, testNwkSKey, testAppSKey, testDevAddr, 2, []byte{lorawan.CIDLinkCheck}, 1, []byte{0x15, 0x05}),
+		createUplink11(t, session, addr, 3, 0, 1, []byte{lorawan.CIDLinkCheck}, 1, []byte{0x15, 0x05}),
+	} {
+		received := bytes.Clone(uplink)
+		_, _, err := g.parseDataUplink(ctx, uplink, testRxInfo)
+		test.That(t, err, test.ShouldBeNil)
+		test.That(t, uplink, test.ShouldResemble, received)
+	}
+}
+
+func TestParseDataUplinkSamples(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+
+	// the device sends a temperature every 10 minutes, oldest first.
+	err := os.WriteFile(device.DecoderPath, []byte(`function Decode(fPort, bytes) {
+	var samples = [];
+	for (var i = 0; i < bytes.length; i++) {
+		samples.push({"temperature": bytes[i], "offset_s": (bytes.length - 1 - i) * 600});
+	}
+	return samples;
+}`), 0o600)
+	test.That(t, err, test.ShouldBeNil)
+
+	_, readings, err := g.parseDataUplink(ctx, createTestUplink(t, 1, 1, []byte{20, 21, 22}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	received, err := time.Parse(time.RFC3339, readings["time"].(string))
+	test.That(t, err, test.ShouldBeNil)
+
+	// the readings are the latest sample, and every sample has the time it was measured.
+	test.That(t, readings["temperature"], test.ShouldEqual, 22)
+	samples := readings["samples"].([]interface{})
+	test.That(t, len(samples), test.ShouldEqual, 3)
+	for i, sample := range samples {
+		sample := sample.(map[string]interface{})
+		test.That(t, sample["temperature"], test.ShouldEqual, 20+i)
+		test.That(t, sample["time"], test.ShouldEqual, received.Add(time.Duration(i-2)*10*time.Minute).Format(time.RFC3339))
+	}
+}
+
+func TestParseDataUplinkDecoderTimeout(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+
+	// the device's timeout is used when decoding uplinks.
+	err := os.WriteFile(device.DecoderPath, []byte(`function Decode(fPort, bytes) {
+	var start = Date.now();
+	while (Date.now() - start < 20) {}
+	return {"temperature": bytes[0] + bytes[1] / 10};
+}`), 0o600)
+	test.That(t, err, test.ShouldBeNil)
+
+	device.DecoderTimeout = 200 * time.Millisecond
+	_, readings, err := g.parseDataUplink(ctx, createTestUplink(t, 1, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+}
+
+func TestParseDataUplinkDecoderOutputSize(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+	device.DecoderTimeout = time.Second
+
+	// a decoder returning a huge map is rejected instead of filling memory.
+	err := os.WriteFile(device.DecoderPath, []byte(`function Decode(fPort, bytes) {
+	var readings = {};
+	for (var i = 0; i < 20000; i++) {
+		readings["reading_" + i] = i;
+	}
+	return readings;
+}`), 0o600)
+	test.That(t, err, test.ShouldBeNil)
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 1, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeError)
+	test.That(t, errors.Is(err, lorawan.ErrDecoderOutputSize), test.ShouldBeTrue)
+
+	// the device's limit is used when decoding uplinks.
+	device.DecoderMaxOutputBytes = 16
+	err = os.WriteFile(device.DecoderPath, []byte(testDecoderScript), 0o600)
+	test.That(t, err, test.ShouldBeNil)
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 2, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrDecoderOutputSize), test.ShouldBeTrue)
+	device.DecoderMaxOutputBytes = 0
+	_, readings, err := g.parseDataUplink(ctx, createTestUplink(t, 3, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+}
+
+func TestParseDataUplinkDecoderError(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	device := g.devices["test-device"]
+
+	// a decoder that throws should surface the error instead of empty readings.
+	err := os.WriteFile(device.DecoderPath, []byte(`function Decode(fPort, bytes) {
+	throw new Error("unsupported payload");
+}`), 0o600)
+	test.That(t, err, test.ShouldBeNil)
+
+	_, readings, err := g.parseDataUplink(ctx, createTestUplink(t, 1, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "test-device")
+	test.That(t, err.Error(), test.ShouldContainSubstring, "unsupported payload")
+	test.That(t, readings, test.ShouldBeEmpty)
+
+	// malformed scripts fail as well.
+	err = os.WriteFile(device.DecoderPath, []byte(`function Decode(fPort, bytes) {`), 0o600)
+	test.That(t, err, test.ShouldBeNil)
+	modTime := time.Now().Add(time.Minute)
+	test.That(t, os.Chtimes(device.DecoderPath, modTime, modTime), test.ShouldBeNil)
+
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 2, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "test-device")
+}
+
+func TestParseDataUplinkErrorContext(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+
+	// errors from unknown devices only have the dev addr.
+	uplink := createUplink(t, testNwkSKey, testAppSKey, []byte{0x0A, 0x0B, 0x0C, 0x0D}, 1, nil, 1, []byte{0x15, 0x05})
+	_, _, err := g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, errors.Is(err, errNoDevice), test.ShouldBeTrue)
+	test.That(t, err.Error(), test.ShouldEqual, "uplink from dev addr 0a0b0c0d: "+errNoDevice.Error())
+
+	// errors from matched devices have the device name too.
+	uplink = createTestUplink(t, 1, 1, []byte{0x15, 0x05})
+	uplink[len(uplink)-1] ^= 0xFF
+	_, _, err = g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrInvalidMIC), test.ShouldBeTrue)
+	test.That(t, err.Error(), test.ShouldEqual, "uplink from device test-device with dev addr 01020304: "+lorawan.ErrInvalidMIC.Error())
+
+	g.devices["test-device"].DecoderPath = writeTestDecoder(t, `function Decode(fPort, bytes) { throw new Error("bad payload"); }`)
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 2, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrDecodeFailed), test.ShouldBeTrue)
+	test.That(t, errors.Is(err, lorawan.ErrInvalidMIC), test.ShouldBeFalse)
+	var uplinkErr *lorawan.UplinkError
+	test.That(t, errors.As(err, &uplinkErr), test.ShouldBeTrue)
+	test.That(t, uplinkErr.Device, test.ShouldEqual, "test-device")
+	test.That(t, uplinkErr.DevAddr, test.ShouldResemble, testDevAddr)
+
+	g.devices["test-device"].DecoderPath = writeTestDecoder(t, `function Decode(fPort, bytes) { return {}; }`)
+	_, _, err = g.parseDataUplink(ctx, createTestUplink(t, 3, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrDecodeFailed), test.ShouldBeTrue)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "01020304")
+}
+
+func TestParseDataUplinkDecodeFailure(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	g.devices["test-device"].DecoderPath = writeTestDecoder(t, `function Decode(fPort, bytes) { throw new Error("bad payload"); }`)
+
+	// the MAC commands and the ack of an uplink that fails to decode are still answered.
+	uplink := createUplinkWithMHDR(t, confirmedDataUp, testNwkSKey, testAppSKey, testDevAddr, 1, []byte{lorawan.CIDLinkCheck}, 1, []byte{0x15, 0x05})
+	name, readings, err := g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrDecodeFailed), test.ShouldBeTrue)
+	test.That(t, name, test.ShouldEqual, "test-device")
+	test.That(t, readings, test.ShouldBeNil)
+	queue := g.downlinks["test-device"]
+	test.That(t, len(queue), test.ShouldEqual, 1)
+	test.That(t, queue[0].ack, test.ShouldBeTrue)
+	test.That(t, queue[0].fOpts[0], test.ShouldEqual, lorawan.CIDLinkCheck)
+
+	// the decoder returning no readings is a decode failure too.
+	g.downlinks = nil
+	g.devices["test-device"].DecoderPath = writeTestDecoder(t, `function Decode(fPort, bytes) { return {}; }`)
+	uplink = createUplinkWithMHDR(t, confirmedDataUp, testNwkSKey, testAppSKey, testDevAddr, 2, nil, 1, []byte{0x15, 0x05})
+	name, _, err = g.parseDataUplink(ctx, uplink, testRxInfo)
+	test.That(t, errors.Is(err, lorawan.ErrDecodeFailed), test.ShouldBeTrue)
+	test.That(t, name, test.ShouldEqual, "test-device")
+	test.That(t, len(g.downlinks["test-device"]), test.ShouldEqual, 1)
 }
@@ -0,0 +1,83 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+)
+
+// warningInterval is how often an identical decoder warning of a device is logged.
+const warningInterval = time.Minute
+
+// warningKey identifies a decoder warning of a device.
+type warningKey struct {
+	device  string
+	warning string
+}
+
+// warnLimiter collapses identical decoder warnings of each device, so a decoder that warns on every
+// uplink doesn't flood the logs. The zero value is ready to use.
+type warnLimiter struct {
+	mu       sync.Mutex
+	warnings map[warningKey]*warningEntry
+}
+
+type warningEntry struct {
+	logged     time.Time // time the warning was last logged
+	suppressed int       // number of times the warning was seen since it was last logged
+}
+
+// allow returns true if the warning of the device should be logged now. It also returns how many identical
+// warnings were suppressed since it was last logged, they are counted until the warning is seen again after
+// the interval.
+func (l *warnLimiter) allow(device, warning string, now time.Time) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.warnings == nil {
+		l.warnings = make(map[warningKey]*warningEntry)
+	}
+
+	key := warningKey{device: device, warning: warning}
+	entry, ok := l.warnings[key]
+	if ok && now.Sub(entry.logged) < warningInterval {
+		entry.suppressed++
+		return false, 0
+	}
+	suppressed := 0
+	if ok {
+		suppressed = entry.suppressed
+	}
+	l.warnings[key] = &warningEntry{logged: now}
+
+	// forget warnings that would be logged again anyway, unless they have a suppressed count to report.
+	for k, e := range l.warnings {
+		if e.suppressed == 0 && now.Sub(e.logged) >= warningInterval {
+			delete(l.warnings, k)
+		}
+	}
+	return true, suppressed
+}
+
+// remove forgets the warnings of the device.
+func (l *warnLimiter) remove(device string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k := range l.warnings {
+		if k.device == device {
+			delete(l.warnings, k)
+		}
+	}
+}
+
+// logDecoderWarning logs the warning of the device's decoder, identical warnings are logged once per warningInterval
+// with the number of times they were repeated in between.
+func (g *Gateway) logDecoderWarning(device, warning string) {
+	ok, suppressed := g.warnings.allow(device, warning, time.Now())
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		g.logger.Warnf("%s (repeated %d more times since it was last logged)", warning, suppressed)
+		return
+	}
+	g.logger.Warn(warning)
+}
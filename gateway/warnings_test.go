@@ -0,0 +1,66 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.viam.com/rdk/logging"
+	"go.viam.com/test"
+)
+
+func TestDecoderWarningsThrottled(t *testing.T) {
+	ctx := context.Background()
+	g := createTestGateway(t)
+	logger, logs := logging.NewObservedTestLogger(t)
+	g.logger = logger
+	g.devices["test-device"].DecoderPath = writeTestDecoder(t, `
+function Decode(fPort, bytes) {
+	return {data: {"temperature": bytes[0]}, warnings: ["low battery"]};
+}`)
+
+	// identical warnings are only logged the first time.
+	for fCnt := uint32(1); fCnt <= 20; fCnt++ {
+		_, _, err := g.parseDataUplink(ctx, createTestUplink(t, fCnt, 1, []byte{0x15, 0x05}), testRxInfo)
+		test.That(t, err, test.ShouldBeNil)
+	}
+	entries := logs.FilterMessageSnippet("returned warnings: low battery").All()
+	test.That(t, len(entries), test.ShouldEqual, 1)
+	test.That(t, entries[0].Message, test.ShouldEqual, "decoder for test-device returned warnings: low battery")
+
+	// after the interval the warning is logged again with the number of repeats.
+	for _, entry := range g.warnings.warnings {
+		entry.logged = entry.logged.Add(-warningInterval)
+	}
+	_, _, err := g.parseDataUplink(ctx, createTestUplink(t, 21, 1, []byte{0x15, 0x05}), testRxInfo)
+	test.That(t, err, test.ShouldBeNil)
+	entries = logs.FilterMessageSnippet("returned warnings: low battery").All()
+	test.That(t, len(entries), test.ShouldEqual, 2)
+	test.That(t, entries[1].Message, test.ShouldContainSubstring, "repeated 19 more times")
+}
+
+func TestWarnLimiter(t *testing.T) {
+	var l warnLimiter
+	now := time.Now()
+
+	ok, _ := l.allow("a", "low battery", now)
+	test.That(t, ok, test.ShouldBeTrue)
+	ok, _ = l.allow("a", "low battery", now.Add(time.Second))
+	test.That(t, ok, test.ShouldBeFalse)
+
+	// other warnings and other devices are limited separately.
+	ok, _ = l.allow("a", "sensor fault", now.Add(time.Second))
+	test.That(t, ok, test.ShouldBeTrue)
+	ok, _ = l.allow("b", "low battery", now.Add(time.Second))
+	test.That(t, ok, test.ShouldBeTrue)
+
+	ok, suppressed := l.allow("a", "low battery", now.Add(warningInterval+time.Second))
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, suppressed, test.ShouldEqual, 1)
+
+	// warnings that weren't repeated are forgotten once they would be logged again.
+	test.That(t, len(l.warnings), test.ShouldEqual, 1)
+
+	l.remove("a")
+	test.That(t, l.warnings, test.ShouldBeEmpty)
+}
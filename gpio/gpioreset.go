@@ -1,47 +1,48 @@
 package gpio
 
 import (
-	"fmt"
 	"os/exec"
 	"strconv"
 	"time"
+
+	"go.viam.com/rdk/logging"
 )
 
 func waitGPIO() {
 	time.Sleep(100 * time.Millisecond)
 }
 
-func pinctrlSet(pin string, state string) {
+func pinctrlSet(logger logging.Logger, pin string, state string) {
 	cmd := exec.Command("pinctrl", "set", pin, state)
 	if err := cmd.Run(); err != nil {
-		fmt.Printf("Error setting GPIO %s to %s: %v\n", pin, state, err)
+		logger.Errorf("error setting GPIO %s to %s: %v", pin, state, err)
 	}
 }
 
-func InitGateway(resetPin, powerPin *int) {
+func InitGateway(logger logging.Logger, resetPin, powerPin *int) {
 	rst := strconv.Itoa(*resetPin)
 	var pwr string
 	if powerPin != nil {
 		pwr = strconv.Itoa(*powerPin)
 	}
-	initGPIO(rst, pwr)
-	resetGPIO(rst)
+	initGPIO(logger, rst, pwr)
+	resetGPIO(logger, rst)
 }
 
-func initGPIO(resetPin, powerPin string) {
+func initGPIO(logger logging.Logger, resetPin, powerPin string) {
 	// Set GPIOs as output
-	pinctrlSet(resetPin, "op")
+	pinctrlSet(logger, resetPin, "op")
 	waitGPIO()
 	if powerPin != "" {
-		pinctrlSet(powerPin, "op")
+		pinctrlSet(logger, powerPin, "op")
 		waitGPIO()
 	}
 }
 
-func resetGPIO(resetPin string) {
-	pinctrlSet(resetPin, "dh")
+func resetGPIO(logger logging.Logger, resetPin string) {
+	pinctrlSet(logger, resetPin, "dh")
 	waitGPIO()
-	pinctrlSet(resetPin, "dl")
+	pinctrlSet(logger, resetPin, "dl")
 	waitGPIO()
 
 }
@@ -0,0 +1,120 @@
+package lorawan
+
+import (
+	"fmt"
+)
+
+// Cayenne Low Power Payload data types.
+// https://docs.mydevices.com/docs/lorawan/cayenne-lpp
+const (
+	lppDigitalInput  = 0
+	lppDigitalOutput = 1
+	lppAnalogInput   = 2
+	lppAnalogOutput  = 3
+	lppIlluminance   = 101
+	lppPresence      = 102
+	lppTemperature   = 103
+	lppHumidity      = 104
+	lppAccelerometer = 113
+	lppBarometer     = 115
+	lppGyrometer     = 134
+	lppGPS           = 136
+)
+
+// lppType is the name and size in bytes of the value of a Cayenne LPP data type.
+type lppType struct {
+	name string
+	size int
+}
+
+var lppTypes = map[byte]lppType{
+	lppDigitalInput:  {"digital_input", 1},
+	lppDigitalOutput: {"digital_output", 1},
+	lppAnalogInput:   {"analog_input", 2},
+	lppAnalogOutput:  {"analog_output", 2},
+	lppIlluminance:   {"illuminance", 2},
+	lppPresence:      {"presence", 1},
+	lppTemperature:   {"temperature", 2},
+	lppHumidity:      {"humidity", 1},
+	lppAccelerometer: {"accelerometer", 6},
+	lppBarometer:     {"barometer", 2},
+	lppGyrometer:     {"gyrometer", 6},
+	lppGPS:           {"gps", 9},
+}
+
+// Structure of a Cayenne LPP payload, repeated for each value:
+// | CHANNEL | TYPE |   VALUE  |
+// |   1 B   |  1 B | variable |
+// decodeCayenneLPP decodes the payload into readings named by type and channel, such as temperature_1.
+// Values are big endian, accelerometer, gyrometer and gps values are maps of their axes.
+func decodeCayenneLPP(data []byte) (map[string]interface{}, error) {
+	readings := map[string]interface{}{}
+	for i := 0; i < len(data); {
+		if len(data)-i < 2 {
+			return map[string]interface{}{}, fmt.Errorf("%w: truncated header at byte %d", ErrInvalidCayenne, i)
+		}
+		channel, typeID := data[i], data[i+1]
+		typ, ok := lppTypes[typeID]
+		if !ok {
+			return map[string]interface{}{}, fmt.Errorf("%w: unknown type %d on channel %d", ErrInvalidCayenne, typeID, channel)
+		}
+		i += 2
+		if len(data)-i < typ.size {
+			return map[string]interface{}{}, fmt.Errorf("%w: truncated %s value on channel %d", ErrInvalidCayenne, typ.name, channel)
+		}
+		value := data[i : i+typ.size]
+		i += typ.size
+
+		var reading interface{}
+		switch typeID {
+		case lppDigitalInput, lppDigitalOutput, lppPresence:
+			reading = float64(value[0])
+		case lppAnalogInput, lppAnalogOutput:
+			reading = float64(lppInt(value)) / 100
+		case lppIlluminance:
+			reading = float64(lppUint(value))
+		case lppTemperature:
+			reading = float64(lppInt(value)) / 10
+		case lppHumidity:
+			reading = float64(value[0]) / 2
+		case lppBarometer:
+			reading = float64(lppUint(value)) / 10
+		case lppAccelerometer:
+			reading = map[string]interface{}{
+				"x": float64(lppInt(value[0:2])) / 1000,
+				"y": float64(lppInt(value[2:4])) / 1000,
+				"z": float64(lppInt(value[4:6])) / 1000,
+			}
+		case lppGyrometer:
+			reading = map[string]interface{}{
+				"x": float64(lppInt(value[0:2])) / 100,
+				"y": float64(lppInt(value[2:4])) / 100,
+				"z": float64(lppInt(value[4:6])) / 100,
+			}
+		case lppGPS:
+			reading = map[string]interface{}{
+				"latitude":  float64(lppInt(value[0:3])) / 10000,
+				"longitude": float64(lppInt(value[3:6])) / 10000,
+				"altitude":  float64(lppInt(value[6:9])) / 100,
+			}
+		}
+		readings[fmt.Sprintf("%s_%d", typ.name, channel)] = reading
+	}
+	return readings, nil
+}
+
+// lppUint returns the big endian unsigned value of b.
+func lppUint(b []byte) uint32 {
+	var v uint32
+	for _, x := range b {
+		v = v<<8 | uint32(x)
+	}
+	return v
+}
+
+// lppInt returns the big endian two's complement signed value of b, b is at most 4 bytes.
+func lppInt(b []byte) int32 {
+	bits := len(b) * 8
+	// shift the sign bit into the top bit of the int32 and back to sign extend.
+	return int32(lppUint(b)<<(32-bits)) >> (32 - bits)
+}
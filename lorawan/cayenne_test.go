@@ -0,0 +1,52 @@
+package lorawan
+
+import (
+	"errors"
+	"testing"
+
+	"go.viam.com/test"
+)
+
+func TestDecodeCayenneLPP(t *testing.T) {
+	// examples from the Cayenne LPP documentation.
+	readings, err := decodeCayenneLPP([]byte{0x03, 0x67, 0x01, 0x10, 0x05, 0x67, 0x00, 0xFF})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{"temperature_3": 27.2, "temperature_5": 25.5})
+
+	readings, err = decodeCayenneLPP([]byte{0x01, 0x67, 0xFF, 0xD7})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature_1"], test.ShouldEqual, -4.1)
+
+	readings, err = decodeCayenneLPP([]byte{0x01, 0x88, 0x06, 0x76, 0x5F, 0xF2, 0x96, 0x0A, 0x00, 0x03, 0xE8})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["gps_1"], test.ShouldResemble, map[string]interface{}{
+		"latitude":  42.3519,
+		"longitude": -87.9094,
+		"altitude":  10.0,
+	})
+
+	// humidity, analog and digital channels in one payload.
+	readings, err = decodeCayenneLPP([]byte{
+		0x02, 0x68, 0x61, // humidity 48.5%
+		0x04, 0x02, 0xFE, 0xD4, // analog input -3.00
+		0x06, 0x03, 0x01, 0x2C, // analog output 3.00
+		0x07, 0x00, 0x01, // digital input 1
+		0x08, 0x01, 0x00, // digital output 0
+	})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{
+		"humidity_2":       48.5,
+		"analog_input_4":   -3.0,
+		"analog_output_6":  3.0,
+		"digital_input_7":  1.0,
+		"digital_output_8": 0.0,
+	})
+
+	// unknown types and truncated values are rejected.
+	_, err = decodeCayenneLPP([]byte{0x01, 0x50, 0x00})
+	test.That(t, errors.Is(err, ErrInvalidCayenne), test.ShouldBeTrue)
+	_, err = decodeCayenneLPP([]byte{0x01, 0x67, 0x01})
+	test.That(t, errors.Is(err, ErrInvalidCayenne), test.ShouldBeTrue)
+	_, err = decodeCayenneLPP([]byte{0x01, 0x67, 0x01, 0x10, 0x02})
+	test.That(t, errors.Is(err, ErrInvalidCayenne), test.ShouldBeTrue)
+}
@@ -0,0 +1,623 @@
+package lorawan
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// Device is a device whose uplinks are decoded, with its session and decoder config.
+type Device struct {
+	Name    string
+	DevEUI  []byte
+	DevAddr []byte // big endian
+	NwkSKey []byte
+	AppSKey []byte
+	// LorawanVersion is the LoRaWAN MAC version of the device, 1.0.3 or 1.1.0.
+	LorawanVersion string
+	// FCntUp is the last uplink frame counter of the device, it is only used if FCntUpValid is set.
+	// Its 16 MSB extend the 16 bit counter sent in the uplink.
+	FCntUp      uint32
+	FCntUpValid bool
+	// PortAllowlist is the only fPorts uplinks are decoded on if set, uplinks on the PortDenylist fPorts are never decoded.
+	PortAllowlist []int
+	PortDenylist  []int
+	Decoder       DecoderConfig
+}
+
+// DecoderConfig is how the uplinks of a device are decoded and its downlinks encoded.
+type DecoderConfig struct {
+	// Path is the decoder script file or http or https URL.
+	Path string
+	// Script is the inline decoder script, if set it is used instead of Path.
+	Script string
+	// Format is the built-in format used to decode uplinks instead of the decoder script, such as cayenne.
+	// The decoder script is still used to encode downlinks.
+	Format string
+	// Fields are the readings of the fields format, decoded from their place in the payload.
+	Fields []DecoderField
+	// Function is the function of the decoder script called for uplinks.
+	// Decode is called as Decode(fPort, bytes), decodeUplink as decodeUplink({bytes, fPort}) from the TTN codec API.
+	Function string
+	// PortDecoders maps fPorts to decoder paths, they are used instead of the default decoder on those ports.
+	PortDecoders map[string]string
+	// Stages are decoder paths run in order on the readings of the decoder, as Decode(fPort, input).
+	Stages []string
+	// Vars are the device's values given to the decoder and its stages as device.vars.
+	Vars map[string]interface{}
+	// Helpers gives the decoder, its stages and the encoder console.log and bytesToHex.
+	Helpers bool
+	// Timeout is how long a script can run before it is interrupted, the default is used if zero.
+	Timeout time.Duration
+	// MaxOutputBytes is the largest readings a script can return, the default is used if zero.
+	MaxOutputBytes int
+}
+
+// DecoderField is a reading of the fields decoder format, read from Length bytes of the payload at Offset.
+type DecoderField struct {
+	Name   string `json:"name"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	// Type is uint, int for two's complement signed integers, or float for IEEE 754 floats.
+	Type string `json:"type"`
+	// Endianness is big, the default, or little.
+	Endianness string `json:"endianness,omitempty"`
+	// Scale multiplies the value, the value is used as is if it is zero.
+	Scale float64 `json:"scale,omitempty"`
+}
+
+// Valid returns true if the field has a name, a valid offset and endianness, and a length its type can be read from.
+func (f DecoderField) Valid() bool {
+	if f.Name == "" || f.Offset < 0 {
+		return false
+	}
+	switch f.Endianness {
+	case "big", "little", "":
+	default:
+		return false
+	}
+	switch f.Type {
+	case "uint", "int":
+		return f.Length >= 1 && f.Length <= 8
+	case "float":
+		return f.Length == 4 || f.Length == 8
+	}
+	return false
+}
+
+// PortFiltered returns true if uplinks on the fPort are dropped by the device's port allowlist or denylist.
+func (d Device) PortFiltered(fPort uint8) bool {
+	if len(d.PortAllowlist) > 0 {
+		return !slices.Contains(d.PortAllowlist, int(fPort))
+	}
+	return slices.Contains(d.PortDenylist, int(fPort))
+}
+
+// DecodePayload decodes the decrypted payload of an uplink from the device, like Decode.
+// A decoder that fails or returns no readings fails with ErrDecodeFailed.
+func (c *DecoderCache) DecodePayload(
+	ctx context.Context, fPort uint8, device Device, data []byte, logs DecoderLogs,
+) (map[string]interface{}, error) {
+	readings, err := c.Decode(ctx, fPort, device, data, logs)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecodeFailed, err)
+	}
+	// payload was empty or unparsable
+	if len(readings) == 0 {
+		return nil, fmt.Errorf("%w: decoder returned no readings", ErrDecodeFailed)
+	}
+	return readings, nil
+}
+
+// DecoderLogs receive the messages of the scripts decoding an uplink, messages to nil funcs are dropped.
+type DecoderLogs struct {
+	Warn  func(warning string) // warnings returned by the decoder and its stages
+	Print func(msg string)     // console output of the scripts of devices with decoder helpers set
+}
+
+// Decode runs the device's decoder on the uplink payload, followed by its decoder stages.
+// The readings only have the types of decoded JSON and 32 bit integers, which readings of a component can hold.
+func (c *DecoderCache) Decode(
+	ctx context.Context, fPort uint8, device Device, data []byte, logs DecoderLogs,
+) (map[string]interface{}, error) {
+	if logs.Warn == nil {
+		logs.Warn = func(string) {}
+	}
+	readings, err := c.decodeBytes(ctx, fPort, device, data, logs)
+	if err != nil {
+		return readings, err
+	}
+	if len(device.Decoder.Stages) == 0 {
+		return convertTo32Bit(readings), nil
+	}
+
+	for _, path := range device.Decoder.Stages {
+		stage, err := c.getStage(path)
+		if err != nil {
+			return map[string]interface{}{}, err
+		}
+		vars := scriptGlobals(device, logs.Print)
+		vars["fPort"] = fPort
+		vars["input"] = readings
+		vars["device"] = decoderDevice(device)
+		out, err := executeDecoder(ctx, stage, vars, device.Decoder.Timeout)
+		if err != nil {
+			return map[string]interface{}{}, fmt.Errorf("decoder stage %s: %w", path, err)
+		}
+		var warnings []string
+		readings, warnings, err = parseDecoderOutput(out)
+		if err != nil {
+			return map[string]interface{}{}, fmt.Errorf("decoder stage %s: %w", path, err)
+		}
+		if len(warnings) > 0 {
+			logs.Warn(fmt.Sprintf("decoder stage %s for %s returned warnings: %s", path, device.Name, strings.Join(warnings, ", ")))
+		}
+	}
+	if exceedsOutputSize(readings, device.Decoder.MaxOutputBytes) {
+		return map[string]interface{}{}, ErrDecoderOutputSize
+	}
+	normalizeTimestamps(readings, true)
+
+	return convertTo32Bit(readings), nil
+}
+
+// decodeBytes runs the device's decoder for fPort on the payload, the first stage of decoding.
+func (c *DecoderCache) decodeBytes(
+	ctx context.Context, fPort uint8, device Device, data []byte, logs DecoderLogs,
+) (map[string]interface{}, error) {
+	// built-in formats are decoded natively without running a script, unless the port has its own decoder.
+	if _, ok := device.Decoder.PortDecoders[strconv.Itoa(int(fPort))]; !ok {
+		switch device.Decoder.Format {
+		case "cayenne":
+			return decodeCayenneLPP(data)
+		case "fields":
+			return decodeFields(device.Decoder.Fields, data)
+		case "raw":
+			// the decrypted payload is passed through as is.
+			return map[string]interface{}{"payload_hex": hex.EncodeToString(data), "fport": int(fPort)}, nil
+		}
+	}
+
+	decoder, err := c.get(device, fPort)
+	if err != nil {
+		return map[string]interface{}{}, err
+	}
+
+	readingsMap, warnings, err := convertBinaryToMap(
+		ctx, fPort, decoder, data, decoderDevice(device), scriptGlobals(device, logs.Print), device.Decoder.Timeout)
+	if err != nil {
+		return map[string]interface{}{}, err
+	}
+	if exceedsOutputSize(readingsMap, device.Decoder.MaxOutputBytes) {
+		return map[string]interface{}{}, ErrDecoderOutputSize
+	}
+	if len(warnings) > 0 {
+		logs.Warn(fmt.Sprintf("decoder for %s returned warnings: %s", device.Name, strings.Join(warnings, ", ")))
+	}
+	normalizeTimestamps(readingsMap, true)
+
+	return readingsMap, nil
+}
+
+// 8 and 16 bit integers are not supported in protobuf.
+// If the decoder returns those types, convert to 32 bit integer.
+func convertTo32Bit(readings map[string]interface{}) map[string]interface{} {
+	// Iterate over the map and convert uint8 values to uint32, decoders can return null values so switch on the type.
+	for key, value := range readings {
+		switch v := value.(type) {
+		case uint8:
+			readings[key] = uint32(v)
+		case uint16:
+			readings[key] = uint32(v)
+		case int16:
+			readings[key] = int32(v)
+		case int8:
+			readings[key] = int32(v)
+		}
+	}
+	return readings
+}
+
+// decoderDevice returns the device object given to decoders, with the device's dev EUI, dev addr and decoder vars.
+// The vars are copied so a decoder changing them doesn't change the node's config.
+func decoderDevice(device Device) map[string]interface{} {
+	vars, _ := copyDecoderValue(device.Decoder.Vars).(map[string]interface{})
+	if vars == nil {
+		vars = map[string]interface{}{}
+	}
+	return map[string]interface{}{
+		"dev_eui":  hex.EncodeToString(device.DevEUI),
+		"dev_addr": hex.EncodeToString(device.DevAddr),
+		"vars":     vars,
+	}
+}
+
+// copyDecoderValue returns a deep copy of the maps and arrays of a decoder var.
+func copyDecoderValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[k] = copyDecoderValue(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = copyDecoderValue(item)
+		}
+		return out
+	}
+	return v
+}
+
+// normalizeTimestamps converts the timestamps returned by the decoder to RFC 3339 strings in UTC, the format of
+// the time reading, since readings can't hold times. Timestamps are the fields ending in _ts and the top level
+// timestamp field, as Unix seconds or RFC 3339 strings. Other values are left as is.
+func normalizeTimestamps(readings map[string]interface{}, topLevel bool) {
+	for key, value := range readings {
+		if nested, ok := value.(map[string]interface{}); ok {
+			normalizeTimestamps(nested, false)
+			continue
+		}
+		if !strings.HasSuffix(key, "_ts") && (!topLevel || key != "timestamp") {
+			continue
+		}
+
+		var t time.Time
+		switch v := value.(type) {
+		case int64:
+			t = time.Unix(v, 0)
+		case float64:
+			sec, frac := math.Modf(v)
+			t = time.Unix(int64(sec), int64(frac*1e9))
+		case string:
+			parsed, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				continue
+			}
+			t = parsed
+		default:
+			continue
+		}
+		readings[key] = t.UTC().Format(time.RFC3339Nano)
+	}
+}
+
+// convertBinaryToMap runs the decoder on the payload and returns the readings along with any warnings from the decoder.
+// Decoders either return the readings or a {data, warnings, errors} result.
+// The device is the device object of the decoder, it isn't defined if nil. globals are the other globals of the decoder.
+func convertBinaryToMap(
+	ctx context.Context,
+	fPort uint8,
+	decoder *goja.Program,
+	b []byte,
+	device map[string]interface{},
+	globals map[string]interface{},
+	timeout time.Duration,
+) (map[string]interface{}, []string, error) {
+	vars := maps.Clone(globals)
+	if vars == nil {
+		vars = make(map[string]interface{})
+	}
+
+	vars["fPort"] = fPort
+	vars["bytes"] = b
+	if device != nil {
+		vars["device"] = device
+	}
+
+	v, err := executeDecoder(ctx, decoder, vars, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseDecoderOutput(v)
+}
+
+// parseDecoderOutput returns the readings and warnings from the value returned by a decoder.
+func parseDecoderOutput(v interface{}) (map[string]interface{}, []string, error) {
+	normalized := normalizeDecoderValue(v)
+	if samples, ok := normalized.([]interface{}); ok {
+		readings, err := samplesReadings(samples)
+		return readings, nil, err
+	}
+	readings, ok := normalized.(map[string]interface{})
+	if !ok {
+		return map[string]interface{}{}, nil, errors.New("decoder returned unexpected data type")
+	}
+
+	if !isCodecResult(readings) {
+		return readings, nil, nil
+	}
+
+	// the decoder returned the {data, warnings, errors} shape of the TTN codec API.
+	if errs := toStrings(readings["errors"]); len(errs) > 0 {
+		return map[string]interface{}{}, nil, fmt.Errorf("%w: %s", ErrDecoderErrors, strings.Join(errs, ", "))
+	}
+	if samples, ok := readings["data"].([]interface{}); ok {
+		data, err := samplesReadings(samples)
+		return data, toStrings(readings["warnings"]), err
+	}
+	data, ok := readings["data"].(map[string]interface{})
+	if !ok {
+		return map[string]interface{}{}, nil, errors.New("decoder returned unexpected data type for data")
+	}
+
+	return data, toStrings(readings["warnings"]), nil
+}
+
+// samplesReadings returns the readings of a decoder that returned an array of samples, for devices that batch
+// several measurements in one uplink. The samples are oldest first, so the readings are the last sample with
+// every sample in samples.
+func samplesReadings(samples []interface{}) (map[string]interface{}, error) {
+	if len(samples) == 0 {
+		return map[string]interface{}{}, errors.New("decoder returned no samples")
+	}
+	for _, sample := range samples {
+		if _, ok := sample.(map[string]interface{}); !ok {
+			return map[string]interface{}{}, errors.New("decoder returned unexpected data type for a sample")
+		}
+	}
+	readings := maps.Clone(samples[len(samples)-1].(map[string]interface{}))
+	readings["samples"] = samples
+	return readings, nil
+}
+
+// normalizeDecoderValue converts a value exported from a decoder to the types of decoded JSON, so readings have
+// the same types however the decoder built them. Objects and maps with string keys become map[string]interface{},
+// arrays, typed arrays and Go slices become []interface{}, integers become int64 and other numbers float64.
+// Dates become RFC 3339 strings in UTC.
+func normalizeDecoderValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, bool, string, int64, float64:
+		return v
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = normalizeDecoderValue(item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeDecoderValue(item)
+		}
+		return v
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if rv.Uint() > math.MaxInt64 {
+			return float64(rv.Uint())
+		}
+		return int64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.Slice, reflect.Array:
+		items := make([]interface{}, rv.Len())
+		for i := range items {
+			items[i] = normalizeDecoderValue(rv.Index(i).Interface())
+		}
+		return items
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return v
+		}
+		m := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = normalizeDecoderValue(iter.Value().Interface())
+		}
+		return m
+	}
+	return v
+}
+
+// isCodecResult returns true if the decoder output is a {data, warnings, errors} result
+// rather than a flat map of readings.
+func isCodecResult(out map[string]interface{}) bool {
+	if _, ok := out["data"]; !ok {
+		if _, ok := out["errors"]; !ok {
+			return false
+		}
+	}
+	for k := range out {
+		switch k {
+		case "data", "warnings", "errors":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// toStrings converts the warnings or errors array returned by a decoder to strings.
+func toStrings(v interface{}) []string {
+	arr, ok := v.([]interface{})
+	if !ok {
+		if v == nil {
+			return nil
+		}
+		return []string{fmt.Sprint(v)}
+	}
+	strs := make([]string, 0, len(arr))
+	for _, s := range arr {
+		strs = append(strs, fmt.Sprint(s))
+	}
+	return strs
+}
+
+// decoder readings can be at most this many bytes if the node doesn't set a limit.
+const defaultDecoderMaxOutputBytes = 64 * 1024
+
+// exceedsOutputSize returns true if the readings returned by a decoder are larger than limit bytes, so a
+// decoder can't fill the gateway's memory with readings. If limit is zero, the default limit is used.
+// The size is about the size of the readings as JSON: keys and strings count their length, other values
+// count 8 bytes. It stops counting as soon as the limit is exceeded.
+func exceedsOutputSize(readings map[string]interface{}, limit int) bool {
+	if limit <= 0 {
+		limit = defaultDecoderMaxOutputBytes
+	}
+	remaining := limit
+	var exceeds func(v interface{}) bool
+	exceeds = func(v interface{}) bool {
+		remaining -= 8
+		if remaining < 0 {
+			return true
+		}
+		switch v := v.(type) {
+		case string:
+			remaining -= len(v)
+		case map[string]interface{}:
+			for k, item := range v {
+				remaining -= len(k)
+				if exceeds(item) {
+					return true
+				}
+			}
+		case []interface{}:
+			for _, item := range v {
+				if exceeds(item) {
+					return true
+				}
+			}
+		}
+		return remaining < 0
+	}
+	return exceeds(readings)
+}
+
+// max depth of the decoder's call stack, guards against runaway recursion.
+const decoderMaxCallStackSize = 32
+
+// decoder scripts must complete within this time if the node doesn't set a timeout.
+const defaultDecoderTimeout = 10 * time.Millisecond
+
+// executeDecoder runs the program, interrupting it if it runs for longer than timeout.
+// If timeout is zero, the default timeout is used.
+func executeDecoder(ctx context.Context, program *goja.Program, vars map[string]interface{}, timeout time.Duration) (out interface{}, err error) {
+	defer func() {
+		if caught := recover(); caught != nil {
+			err = fmt.Errorf("%s", caught)
+		}
+	}()
+
+	vm := goja.New()
+	vm.SetMaxCallStackSize(decoderMaxCallStackSize)
+
+	for k, v := range vars {
+		// decoders expect bytes to be a JS array so array methods like slice and map can be used.
+		if b, ok := v.([]byte); ok {
+			items := make([]interface{}, len(b))
+			for i, x := range b {
+				items[i] = x
+			}
+			v = vm.NewArray(items...)
+		}
+		if err := vm.Set(k, v); err != nil {
+			return nil, err
+		}
+	}
+
+	if timeout <= 0 {
+		timeout = defaultDecoderTimeout
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// interrupt the vm to halt the script if it runs past the timeout.
+	stop := context.AfterFunc(timeoutCtx, func() {
+		vm.Interrupt(errors.New("decoder timed out"))
+	})
+	defer stop()
+
+	v, err := vm.RunProgram(program)
+	if err != nil {
+		var interrupted *goja.InterruptedError
+		if errors.As(err, &interrupted) {
+			return nil, timeoutCtx.Err()
+		}
+		return nil, err
+	}
+
+	return v.Export(), nil
+}
+
+// Encode runs the Encode function of the device's decoder to convert obj into a downlink payload.
+// Encode takes the fPort and the object and should return an array of bytes.
+// output gets the console output of the encoder, it is dropped if output is nil.
+func (c *DecoderCache) Encode(
+	ctx context.Context, fPort uint8, device Device, obj map[string]interface{}, output func(msg string),
+) ([]byte, error) {
+	encoder, script, err := c.getEncoder(device, fPort)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := scriptGlobals(device, output)
+	vars["fPort"] = fPort
+	vars["obj"] = obj
+
+	v, err := executeDecoder(ctx, encoder, vars, device.Decoder.Timeout)
+	if err != nil {
+		if !hasEncodeFunction(ctx, script) {
+			return nil, ErrNoEncodeFunction
+		}
+		return nil, err
+	}
+
+	return convertToPayload(v)
+}
+
+// hasEncodeFunction checks if the decoder script defines an Encode function.
+func hasEncodeFunction(ctx context.Context, script string) bool {
+	check, err := goja.Compile("", script+"\n\ntypeof Encode === \"function\";\n", false)
+	if err != nil {
+		return false
+	}
+	v, err := executeDecoder(ctx, check, map[string]interface{}{}, 0)
+	if err != nil {
+		return false
+	}
+	defined, ok := v.(bool)
+	return ok && defined
+}
+
+// convertToPayload converts the array returned by Encode into bytes.
+func convertToPayload(v interface{}) ([]byte, error) {
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("encoder returned unexpected data type, expected an array of bytes")
+	}
+
+	payload := make([]byte, 0, len(arr))
+	for i, val := range arr {
+		var b float64
+		switch num := val.(type) {
+		case int64:
+			b = float64(num)
+		case float64:
+			b = num
+		default:
+			return nil, fmt.Errorf("encoder returned unexpected value %v at index %d, expected a byte", val, i)
+		}
+		if b < 0 || b > 255 || b != float64(int(b)) {
+			return nil, fmt.Errorf("encoder returned unexpected value %v at index %d, expected a byte", val, i)
+		}
+		payload = append(payload, byte(b))
+	}
+	return payload, nil
+}
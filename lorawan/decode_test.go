@@ -0,0 +1,300 @@
+package lorawan
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dop251/goja"
+	"go.viam.com/test"
+)
+
+func TestConvertTo32Bit(t *testing.T) {
+	// Create test input with various integer types
+	input := map[string]interface{}{
+		"uint8_val":  uint8(255),
+		"uint16_val": uint16(65535),
+		"int8_val":   int8(-128),
+		"int16_val":  int16(-32768),
+		"other_val":  "string", // Should remain unchanged
+	}
+
+	// Convert the values
+	result := convertTo32Bit(input)
+
+	// Verify uint8 was converted to uint32
+	uint8Conv, ok := result["uint8_val"].(uint32)
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, uint8Conv, test.ShouldEqual, uint32(255))
+
+	// Verify uint16 was converted to uint32
+	uint16Conv, ok := result["uint16_val"].(uint32)
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, uint16Conv, test.ShouldEqual, uint32(65535))
+
+	// Verify int8 was converted to int32
+	int8Conv, ok := result["int8_val"].(int32)
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, int8Conv, test.ShouldEqual, int32(-128))
+
+	// Verify int16 was converted to int32
+	int16Conv, ok := result["int16_val"].(int32)
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, int16Conv, test.ShouldEqual, int32(-32768))
+
+	// Verify non-integer values remain unchanged
+	otherVal, ok := result["other_val"].(string)
+	test.That(t, ok, test.ShouldBeTrue)
+	test.That(t, otherVal, test.ShouldEqual, "string")
+
+	// Verify empty input does nothing.
+	input = map[string]interface{}{}
+	result = convertTo32Bit(input)
+	test.That(t, result, test.ShouldEqual, input)
+
+	// null values from the decoder are kept.
+	result = convertTo32Bit(map[string]interface{}{"null_val": nil})
+	test.That(t, result, test.ShouldResemble, map[string]interface{}{"null_val": nil})
+}
+
+func TestConvertBinaryToMapES6(t *testing.T) {
+	ctx := context.Background()
+
+	// these decoders use ES6 syntax which otto could not run.
+	decoders := map[string]string{
+		"let and const": `function Decode(fPort, bytes) {
+	const whole = bytes[0];
+	let tenths = bytes[1] / 10;
+	return {"temperature": whole + tenths};
+}`,
+		"arrow function": `const toTemp = (b) => b[0] + b[1] / 10;
+function Decode(fPort, bytes) {
+	return {"temperature": toTemp(bytes)};
+}`,
+		"destructuring": `function Decode(fPort, bytes) {
+	const [whole, tenths] = bytes;
+	return {"temperature": whole + tenths / 10};
+}`,
+		"template literal": `function Decode(fPort, bytes) {
+	return {"temperature": bytes[0] + bytes[1] / 10, "label": ` + "`port ${fPort}`" + `};
+}`,
+		"array methods": `function Decode(fPort, bytes) {
+	const [whole, tenths] = bytes.slice(0, 2).map((b) => b);
+	return {"temperature": whole + tenths / 10};
+}`,
+	}
+
+	for name, script := range decoders {
+		t.Run(name, func(t *testing.T) {
+			decoder, err := compileDecoder(name, script)
+			test.That(t, err, test.ShouldBeNil)
+			readings, _, err := convertBinaryToMap(ctx, 1, decoder, []byte{0x15, 0x05}, nil, nil, 0)
+			test.That(t, err, test.ShouldBeNil)
+			test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+		})
+	}
+
+	decoder, err := compileDecoder("template literal", decoders["template literal"])
+	test.That(t, err, test.ShouldBeNil)
+	readings, _, err := convertBinaryToMap(ctx, 3, decoder, []byte{0x15, 0x05}, nil, nil, 0)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["label"], test.ShouldEqual, "port 3")
+}
+
+func TestConvertBinaryToMapCodecResult(t *testing.T) {
+	ctx := context.Background()
+	convert := func(script string) (map[string]interface{}, []string, error) {
+		decoder, err := compileDecoder("test", script)
+		test.That(t, err, test.ShouldBeNil)
+		return convertBinaryToMap(ctx, 1, decoder, []byte{0x15, 0x05}, nil, nil, 0)
+	}
+
+	// flat map of readings.
+	readings, warnings, err := convert(`function Decode(fPort, bytes) {
+	return {"temperature": bytes[0] + bytes[1] / 10};
+}`)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, warnings, test.ShouldBeEmpty)
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{"temperature": 21.5})
+
+	// the readings are taken from data and warnings are returned.
+	readings, warnings, err = convert(`function Decode(fPort, bytes) {
+	return {"data": {"temperature": bytes[0] + bytes[1] / 10}, "warnings": ["battery low"], "errors": []};
+}`)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, warnings, test.ShouldResemble, []string{"battery low"})
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{"temperature": 21.5})
+
+	// errors fail the decode.
+	readings, _, err = convert(`function Decode(fPort, bytes) {
+	return {"errors": ["unknown fPort", "bad length"]};
+}`)
+	test.That(t, errors.Is(err, ErrDecoderErrors), test.ShouldBeTrue)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "unknown fPort, bad length")
+	test.That(t, readings, test.ShouldBeEmpty)
+
+	// a reading named data alongside other readings is a flat map.
+	readings, _, err = convert(`function Decode(fPort, bytes) {
+	return {"data": 1, "temperature": 21.5};
+}`)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{"data": int64(1), "temperature": 21.5})
+}
+
+func TestConvertBinaryToMapNested(t *testing.T) {
+	ctx := context.Background()
+	decoder, err := compileDecoder("test", `function Decode(fPort, bytes) {
+	return {
+		"sensor": {"temperature": bytes[0] + bytes[1] / 10, "flags": [true, false], "probe": {"depth": 4 / 2}},
+		"samples": [1, 2.5, {"x": 3}, null],
+		"raw": bytes.slice(0, 2),
+	};
+}`)
+	test.That(t, err, test.ShouldBeNil)
+
+	// nested objects and arrays have the types of decoded JSON, with integers as int64.
+	readings, _, err := convertBinaryToMap(ctx, 1, decoder, []byte{0x15, 0x05}, nil, nil, 0)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{
+		"sensor": map[string]interface{}{
+			"temperature": 21.5,
+			"flags":       []interface{}{true, false},
+			"probe":       map[string]interface{}{"depth": int64(2)},
+		},
+		"samples": []interface{}{int64(1), 2.5, map[string]interface{}{"x": int64(3)}, nil},
+		"raw":     []interface{}{int64(0x15), int64(0x05)},
+	})
+}
+
+func TestParseDecoderOutputSamples(t *testing.T) {
+	// the samples can be the data of a codec result.
+	readings, _, err := parseDecoderOutput(map[string]interface{}{
+		"data": []interface{}{map[string]interface{}{"humidity": 40}, map[string]interface{}{"humidity": 41}},
+	})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["humidity"], test.ShouldEqual, 41)
+	test.That(t, len(readings["samples"].([]interface{})), test.ShouldEqual, 2)
+
+	// every sample has to be an object.
+	_, _, err = parseDecoderOutput([]interface{}{map[string]interface{}{"humidity": 40}, 41})
+	test.That(t, err, test.ShouldNotBeNil)
+	_, _, err = parseDecoderOutput([]interface{}{})
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestNormalizeDecoderValue(t *testing.T) {
+	// Go values passed to the decoder, such as device.vars, can be returned as is, and JS dates export as times.
+	v := normalizeDecoderValue(map[string]interface{}{
+		"small":   uint8(3),
+		"signed":  int16(-4),
+		"ratio":   float32(0.5),
+		"list":    []uint16{1, 2},
+		"labels":  map[string]string{"room": "kitchen"},
+		"nested":  []interface{}{map[string]interface{}{"n": 5}},
+		"counter": uint64(1 << 63),
+		"read_at": time.Date(2024, 5, 2, 19, 21, 34, 0, time.FixedZone("CEST", 2*60*60)),
+	})
+	test.That(t, v, test.ShouldResemble, map[string]interface{}{
+		"small":   int64(3),
+		"signed":  int64(-4),
+		"ratio":   0.5,
+		"list":    []interface{}{int64(1), int64(2)},
+		"labels":  map[string]interface{}{"room": "kitchen"},
+		"nested":  []interface{}{map[string]interface{}{"n": int64(5)}},
+		"counter": float64(1 << 63),
+		"read_at": "2024-05-02T17:21:34Z",
+	})
+}
+
+func TestExecuteDecoder(t *testing.T) {
+	ctx := context.Background()
+
+	// scripts that run too long are interrupted.
+	_, err := executeDecoder(ctx, compileTestScript(t, "while (true) {}"), map[string]interface{}{}, 0)
+	test.That(t, err, test.ShouldBeError, context.DeadlineExceeded)
+
+	// runaway recursion exceeds the max call stack size.
+	_, err = executeDecoder(ctx, compileTestScript(t, "function f() { return f(); }\nf();"), map[string]interface{}{}, 0)
+	test.That(t, err, test.ShouldNotBeNil)
+
+	// script errors are returned.
+	_, err = executeDecoder(ctx, compileTestScript(t, "throw new Error('bad payload');"), map[string]interface{}{}, 0)
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "bad payload")
+
+	// non object results are returned as is.
+	v, err := executeDecoder(ctx, compileTestScript(t, "bytes.length"), map[string]interface{}{"bytes": []byte{1, 2, 3}}, 0)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, v, test.ShouldEqual, 3)
+}
+
+func TestExecuteDecoderCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	// canceling the context, like when the gateway closes, interrupts the decoder before its timeout.
+	start := time.Now()
+	_, err := executeDecoder(ctx, compileTestScript(t, "while (true) {}"), map[string]interface{}{}, time.Minute)
+	test.That(t, err, test.ShouldBeError, context.Canceled)
+	test.That(t, time.Since(start), test.ShouldBeLessThan, time.Second)
+}
+
+// compileTestScript compiles a script to run directly with executeDecoder.
+func compileTestScript(t *testing.T, script string) *goja.Program {
+	program, err := goja.Compile("test", script, false)
+	test.That(t, err, test.ShouldBeNil)
+	return program
+}
+
+func TestExecuteDecoderTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	// busy loops for 20ms before returning.
+	program := compileTestScript(t, `var start = Date.now();
+while (Date.now() - start < 20) {}
+1;`)
+
+	// under the timeout
+	v, err := executeDecoder(ctx, program, map[string]interface{}{}, 200*time.Millisecond)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, v, test.ShouldEqual, 1)
+
+	// over the timeout
+	_, err = executeDecoder(ctx, program, map[string]interface{}{}, 5*time.Millisecond)
+	test.That(t, err, test.ShouldBeError, context.DeadlineExceeded)
+}
+
+func TestDecoderOutputSize(t *testing.T) {
+	ctx := context.Background()
+	var c DecoderCache
+	device := createTestDevice(t)
+	device.Decoder.Timeout = time.Second
+
+	// a decoder returning a huge map is rejected instead of filling memory.
+	huge := device
+	huge.Decoder.Path = writeTestDecoder(t, `function Decode(fPort, bytes) {
+	var readings = {};
+	for (var i = 0; i < 20000; i++) {
+		readings["reading_" + i] = i;
+	}
+	return readings;
+}`)
+	_, err := c.Decode(ctx, 1, huge, []byte{0x15, 0x05}, DecoderLogs{})
+	test.That(t, errors.Is(err, ErrDecoderOutputSize), test.ShouldBeTrue)
+
+	// nested arrays and strings count towards the size.
+	readings := map[string]interface{}{"values": []interface{}{"abcdefgh", 1.0, map[string]interface{}{"a": 2.0}}}
+	test.That(t, exceedsOutputSize(readings, 64), test.ShouldBeFalse)
+	test.That(t, exceedsOutputSize(readings, 32), test.ShouldBeTrue)
+	test.That(t, exceedsOutputSize(readings, 0), test.ShouldBeFalse)
+
+	// the device's limit is used.
+	device.Decoder.MaxOutputBytes = 16
+	_, err = c.Decode(ctx, 1, device, []byte{0x15, 0x05}, DecoderLogs{})
+	test.That(t, errors.Is(err, ErrDecoderOutputSize), test.ShouldBeTrue)
+	device.Decoder.MaxOutputBytes = 0
+	readings, err = c.Decode(ctx, 1, device, []byte{0x15, 0x05}, DecoderLogs{})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+}
@@ -0,0 +1,352 @@
+package lorawan
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// inlineDecoderName is the script name used in errors from decoders set with decoder_script.
+const inlineDecoderName = "decoder_script"
+
+const (
+	decoderURLRefresh     = time.Minute      // how often a decoder from a URL is checked for changes
+	decoderFetchTimeout   = 10 * time.Second // how long fetching a decoder from a URL can take
+	maxDecoderScriptBytes = 1 << 20          // largest decoder script fetched from a URL
+)
+
+var decoderClient = &http.Client{Timeout: decoderFetchTimeout}
+
+// DecoderCache caches compiled decoder scripts by path so the file isn't read and compiled on every uplink.
+// The zero value is ready to use.
+type DecoderCache struct {
+	mu       sync.Mutex
+	decoders map[string]*cachedDecoder // map of decoder path or URL to compiled decoder
+	inline   map[string]*cachedDecoder // map of inline script to compiled decoder
+}
+
+type cachedDecoder struct {
+	modTime time.Time
+	size    int64
+
+	// validators of a decoder from a URL, sent when it is checked for changes.
+	fetched      time.Time
+	etag         string
+	lastModified string
+
+	script  string
+	decoder *goja.Program // runs the script's Decode function
+	uplink  *goja.Program // runs the script's decodeUplink function
+	encoder *goja.Program // runs the script's Encode function
+	stage   *goja.Program // runs the script's Decode function on the readings of the previous decoder stage
+}
+
+// get returns the compiled decoder of the device for uplinks on fPort, calling the device's decoder function.
+func (c *DecoderCache) get(d Device, fPort uint8) (*goja.Program, error) {
+	cached, err := c.lookup(d, fPort)
+	if err != nil {
+		return nil, err
+	}
+	if d.Decoder.Function == "decodeUplink" {
+		return cached.uplink, nil
+	}
+	return cached.decoder, nil
+}
+
+// getEncoder returns the compiled encoder of the device for downlinks on fPort, along with the script source.
+func (c *DecoderCache) getEncoder(d Device, fPort uint8) (*goja.Program, string, error) {
+	cached, err := c.lookup(d, fPort)
+	if err != nil {
+		return nil, "", err
+	}
+	return cached.encoder, cached.script, nil
+}
+
+// getStage returns the compiled decoder stage at path.
+func (c *DecoderCache) getStage(path string) (*goja.Program, error) {
+	cached, err := c.load(path)
+	if err != nil {
+		return nil, err
+	}
+	return cached.stage, nil
+}
+
+// lookup returns the cached decoder of the device for fPort.
+// A decoder configured for the port is used first, then the inline script if it is set, then the decoder path.
+func (c *DecoderCache) lookup(d Device, fPort uint8) (*cachedDecoder, error) {
+	if path, ok := d.Decoder.PortDecoders[strconv.Itoa(int(fPort))]; ok {
+		return c.load(path)
+	}
+	if d.Decoder.Script != "" {
+		return c.loadInline(d.Decoder.Script)
+	}
+	return c.load(d.Decoder.Path)
+}
+
+// loadInline returns the cached decoder for an inline script.
+func (c *DecoderCache) loadInline(script string) (*cachedDecoder, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.inline[script]; ok {
+		return cached, nil
+	}
+
+	cached, err := compileScript(inlineDecoderName, script)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.inline == nil {
+		c.inline = make(map[string]*cachedDecoder)
+	}
+	c.inline[script] = cached
+
+	return cached, nil
+}
+
+// load returns the cached decoder file at path.
+// The file is stat'ed on each call and the decoder is reloaded if it was modified since it was cached.
+func (c *DecoderCache) load(path string) (*cachedDecoder, error) {
+	if isDecoderURL(path) {
+		return c.loadURL(path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.decoders[path]
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached, nil
+	}
+
+	script, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cached, err = compileScript(path, string(script))
+	if err != nil {
+		return nil, err
+	}
+	cached.modTime = info.ModTime()
+	cached.size = info.Size()
+
+	if c.decoders == nil {
+		c.decoders = make(map[string]*cachedDecoder)
+	}
+	c.decoders[path] = cached
+
+	return cached, nil
+}
+
+// Evict removes the decoders at paths from the cache, they are read and compiled again the next time they are used.
+func (c *DecoderCache) Evict(paths ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, path := range paths {
+		delete(c.decoders, path)
+	}
+}
+
+// loadURL returns the cached decoder fetched from the URL.
+// The decoder is checked for changes at most every decoderURLRefresh, sending the ETag and Last-Modified of
+// the cached copy so an unchanged decoder isn't downloaded again. If the fetch fails the last good copy is used.
+func (c *DecoderCache) loadURL(url string) (*cachedDecoder, error) {
+	c.mu.Lock()
+	cached, ok := c.decoders[url]
+	if ok && time.Since(cached.fetched) < decoderURLRefresh {
+		c.mu.Unlock()
+		return cached, nil
+	}
+	var etag, lastModified string
+	if ok {
+		etag, lastModified = cached.etag, cached.lastModified
+	}
+	// don't hold the lock while waiting on the server.
+	c.mu.Unlock()
+
+	script, etag, lastModified, err := fetchDecoder(url, etag, lastModified)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil && !ok {
+		return nil, err
+	}
+	if err != nil || script == nil {
+		// the decoder is unchanged or the server can't be reached, check again after the refresh interval.
+		cached.fetched = time.Now()
+		return cached, nil
+	}
+
+	cached, err = compileScript(url, string(script))
+	if err != nil {
+		return nil, err
+	}
+	cached.fetched = time.Now()
+	cached.etag = etag
+	cached.lastModified = lastModified
+
+	if c.decoders == nil {
+		c.decoders = make(map[string]*cachedDecoder)
+	}
+	c.decoders[url] = cached
+
+	return cached, nil
+}
+
+// fetchDecoder downloads the decoder script at url, returning it with its ETag and Last-Modified headers.
+// The script is nil if the server responds that it wasn't modified since the copy with etag and lastModified.
+func fetchDecoder(url, etag, lastModified string) ([]byte, string, string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	resp, err := decoderClient.Do(req)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to fetch decoder: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, etag, lastModified, nil
+	default:
+		return nil, "", "", fmt.Errorf("failed to fetch decoder %s: %s", url, resp.Status)
+	}
+
+	script, err := io.ReadAll(io.LimitReader(resp.Body, maxDecoderScriptBytes+1))
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to fetch decoder %s: %w", url, err)
+	}
+	if len(script) > maxDecoderScriptBytes {
+		return nil, "", "", fmt.Errorf("decoder %s is larger than %d bytes", url, maxDecoderScriptBytes)
+	}
+	return script, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), nil
+}
+
+// isDecoderURL returns true if the decoder path is an http or https URL instead of a file.
+func isDecoderURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// compileScript compiles the Decode, decodeUplink and Encode functions of the decoder script.
+func compileScript(name, script string) (*cachedDecoder, error) {
+	decoder, err := compileDecoder(name, script)
+	if err != nil {
+		return nil, err
+	}
+
+	uplink, err := compileUplinkDecoder(name, script)
+	if err != nil {
+		return nil, err
+	}
+
+	encoder, err := compileEncoder(name, script)
+	if err != nil {
+		return nil, err
+	}
+
+	stage, err := compileStage(name, script)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachedDecoder{
+		script:  script,
+		decoder: decoder,
+		uplink:  uplink,
+		encoder: encoder,
+		stage:   stage,
+	}, nil
+}
+
+// compileDecoder compiles the decoder script along with the call to its Decode function.
+func compileDecoder(path, script string) (*goja.Program, error) {
+	return goja.Compile(path, script+"\n\nDecode(fPort, bytes);\n", false)
+}
+
+// compileUplinkDecoder compiles the decoder script along with the call to its decodeUplink function from the
+// TTN codec API. Only the data, warnings and errors of the result are kept, so it is always read as a codec result.
+func compileUplinkDecoder(path, script string) (*goja.Program, error) {
+	return goja.Compile(path, script+`
+
+(function (result) {
+	return {data: result.data, warnings: result.warnings, errors: result.errors};
+})(decodeUplink({bytes: bytes, fPort: fPort}));
+`, false)
+}
+
+// compileEncoder compiles the decoder script along with the call to its Encode function.
+func compileEncoder(path, script string) (*goja.Program, error) {
+	return goja.Compile(path, script+"\n\nEncode(fPort, obj);\n", false)
+}
+
+// compileStage compiles the decoder script along with the call to its Decode function for a decoder stage,
+// which gets the readings of the previous stage as input instead of the payload bytes.
+func compileStage(path, script string) (*goja.Program, error) {
+	return goja.Compile(path, script+"\n\nDecode(fPort, input);\n", false)
+}
+
+// scriptGlobals returns the globals of the device's scripts besides their arguments, the decoder helpers if
+// decoder_helpers is set. output gets the console output of the scripts, it is dropped if output is nil.
+func scriptGlobals(device Device, output func(msg string)) map[string]interface{} {
+	if !device.Decoder.Helpers {
+		return map[string]interface{}{}
+	}
+	if output == nil {
+		output = func(string) {}
+	}
+	log := func(args ...interface{}) {
+		parts := make([]string, len(args))
+		for i, arg := range args {
+			parts[i] = consoleString(arg)
+		}
+		output(strings.Join(parts, " "))
+	}
+	// codecs written for other network servers expect these, they can't reach outside the script.
+	return map[string]interface{}{
+		"console": map[string]interface{}{
+			"log":   log,
+			"info":  log,
+			"warn":  log,
+			"error": log,
+			"debug": log,
+		},
+		"bytesToHex": func(b []byte) string {
+			return hex.EncodeToString(b)
+		},
+	}
+}
+
+// consoleString formats an argument of console.log, strings as they are and other values as JSON.
+func consoleString(arg interface{}) string {
+	if s, ok := arg.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(arg)
+	if err != nil {
+		return fmt.Sprint(arg)
+	}
+	return string(b)
+}
@@ -0,0 +1,207 @@
+package lorawan
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.viam.com/test"
+)
+
+func TestDecoderCacheReload(t *testing.T) {
+	ctx := context.Background()
+	var c DecoderCache
+	device := createTestDevice(t)
+	path := device.Decoder.Path
+
+	first, err := c.get(device, 1)
+	test.That(t, err, test.ShouldBeNil)
+
+	// the compiled decoder is reused while the file is unchanged.
+	second, err := c.get(device, 1)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, second, test.ShouldEqual, first)
+
+	readings, err := c.Decode(ctx, 1, device, []byte{0x15, 0x05}, DecoderLogs{})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+
+	// rewrite the decoder and move the mtime forward so the change is detected.
+	err = os.WriteFile(path, []byte(`function Decode(fPort, bytes) {
+	return {"humidity": bytes[0]};
+}`), 0o600)
+	test.That(t, err, test.ShouldBeNil)
+	modTime := time.Now().Add(time.Minute)
+	err = os.Chtimes(path, modTime, modTime)
+	test.That(t, err, test.ShouldBeNil)
+
+	reloaded, err := c.get(device, 1)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, reloaded, test.ShouldNotEqual, first)
+
+	readings, err = c.Decode(ctx, 1, device, []byte{0x15, 0x05}, DecoderLogs{})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldNotContainKey, "temperature")
+	test.That(t, readings["humidity"], test.ShouldEqual, 0x15)
+
+	// an evicted decoder is compiled again.
+	c.Evict(path)
+	evicted, err := c.get(device, 1)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, evicted, test.ShouldNotEqual, reloaded)
+
+	// a missing decoder file is an error.
+	_, err = c.get(Device{Decoder: DecoderConfig{Path: filepath.Join(t.TempDir(), "missing.js")}}, 1)
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestDecoderCacheURL(t *testing.T) {
+	ctx := context.Background()
+	var c DecoderCache
+
+	var mu sync.Mutex
+	script, etag := testDecoderScript, `"v1"`
+	var requests, notModified int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(script))
+	}))
+	url := server.URL + "/decoder.js"
+	device := Device{Decoder: DecoderConfig{Path: url}}
+	counts := func() (int, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests, notModified
+	}
+	// expire the cached copy so the next uplink checks the server.
+	expire := func() {
+		c.mu.Lock()
+		c.decoders[url].fetched = time.Time{}
+		c.mu.Unlock()
+	}
+
+	readings, err := c.Decode(ctx, 1, device, []byte{0x15, 0x05}, DecoderLogs{})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+	first, err := c.get(device, 1)
+	test.That(t, err, test.ShouldBeNil)
+	reqs, _ := counts()
+	test.That(t, reqs, test.ShouldEqual, 1)
+
+	// the server isn't checked again until the refresh interval passes, then an unchanged decoder isn't downloaded.
+	expire()
+	second, err := c.get(device, 1)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, second, test.ShouldEqual, first)
+	reqs, unchanged := counts()
+	test.That(t, reqs, test.ShouldEqual, 2)
+	test.That(t, unchanged, test.ShouldEqual, 1)
+
+	// a changed decoder is reloaded.
+	mu.Lock()
+	script, etag = `function Decode(fPort, bytes) {
+	return {"humidity": bytes[0]};
+}`, `"v2"`
+	mu.Unlock()
+	expire()
+	readings, err = c.Decode(ctx, 1, device, []byte{0x15, 0x05}, DecoderLogs{})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["humidity"], test.ShouldEqual, 0x15)
+
+	// the last good copy is used while the server can't be reached.
+	server.Close()
+	expire()
+	readings, err = c.Decode(ctx, 1, device, []byte{0x15, 0x05}, DecoderLogs{})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["humidity"], test.ShouldEqual, 0x15)
+
+	// a decoder that was never fetched is an error.
+	_, err = c.get(Device{Decoder: DecoderConfig{Path: server.URL + "/missing.js"}}, 1)
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestDecodeInlineScript(t *testing.T) {
+	ctx := context.Background()
+	var c DecoderCache
+	device := Device{Decoder: DecoderConfig{Script: testDecoderScript}}
+
+	readings, err := c.Decode(ctx, 1, device, []byte{0x15, 0x05}, DecoderLogs{})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+
+	// the inline script is compiled once.
+	first, err := c.get(device, 1)
+	test.That(t, err, test.ShouldBeNil)
+	second, err := c.get(device, 1)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, second, test.ShouldEqual, first)
+
+	// the inline script is used over the decoder path.
+	device.Decoder.Path = filepath.Join(t.TempDir(), "missing.js")
+	_, err = c.Decode(ctx, 1, device, []byte{0x15, 0x05}, DecoderLogs{})
+	test.That(t, err, test.ShouldBeNil)
+
+	// the decoder must return an object.
+	device = Device{Decoder: DecoderConfig{Script: `function Decode(fPort, bytes) { return bytes[0]; }`}}
+	readings, err = c.Decode(ctx, 1, device, []byte{0x15, 0x05}, DecoderLogs{})
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "unexpected data type")
+	test.That(t, readings, test.ShouldBeEmpty)
+}
+
+func BenchmarkDecode(b *testing.B) {
+	ctx := context.Background()
+	device := Device{Decoder: DecoderConfig{Path: writeBenchmarkDecoder(b)}}
+	var c DecoderCache
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Decode(ctx, 1, device, []byte{0x15, 0x05}, DecoderLogs{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDecodeUncached reads and compiles the decoder for every uplink, for comparison with the cache.
+func BenchmarkDecodeUncached(b *testing.B) {
+	ctx := context.Background()
+	path := writeBenchmarkDecoder(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		script, err := os.ReadFile(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		decoder, err := compileDecoder(path, string(script))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := convertBinaryToMap(ctx, 1, decoder, []byte{0x15, 0x05}, nil, nil, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func writeBenchmarkDecoder(b *testing.B) string {
+	path := filepath.Join(b.TempDir(), "decoder.js")
+	if err := os.WriteFile(path, []byte(testDecoderScript), 0o600); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,52 @@
+package lorawan
+
+import (
+	"fmt"
+	"math"
+)
+
+// decodeFields decodes the payload into a reading for each field of the fields decoder format, without a script.
+// Integer fields are sign extended from their length, and every value is multiplied by the field's scale if it is set.
+func decodeFields(fields []DecoderField, data []byte) (map[string]interface{}, error) {
+	readings := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		if field.Offset+field.Length > len(data) {
+			return map[string]interface{}{}, fmt.Errorf("%w: %s needs bytes %d to %d, payload is %d bytes",
+				ErrShortFieldsPayload, field.Name, field.Offset, field.Offset+field.Length-1, len(data))
+		}
+
+		// read the field into a big endian uint64 so every length is decoded the same way.
+		b := data[field.Offset : field.Offset+field.Length]
+		var raw uint64
+		for i := range b {
+			x := b[i]
+			if field.Endianness == "little" {
+				x = b[len(b)-1-i]
+			}
+			raw = raw<<8 | uint64(x)
+		}
+
+		var value float64
+		switch field.Type {
+		case "uint":
+			value = float64(raw)
+		case "int":
+			// shift the sign bit into the top bit of the int64 and back to sign extend.
+			bits := field.Length * 8
+			value = float64(int64(raw<<(64-bits)) >> (64 - bits))
+		case "float":
+			if field.Length == 4 {
+				value = float64(math.Float32frombits(uint32(raw)))
+			} else {
+				value = math.Float64frombits(raw)
+			}
+		default:
+			return map[string]interface{}{}, fmt.Errorf("unknown type %s of decoder field %s", field.Type, field.Name)
+		}
+		if field.Scale != 0 {
+			value *= field.Scale
+		}
+		readings[field.Name] = value
+	}
+	return readings, nil
+}
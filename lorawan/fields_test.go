@@ -0,0 +1,39 @@
+package lorawan
+
+import (
+	"errors"
+	"testing"
+
+	"go.viam.com/test"
+)
+
+func TestDecodeFields(t *testing.T) {
+	fields := []DecoderField{
+		{Name: "temperature", Offset: 0, Length: 2, Type: "int", Endianness: "little", Scale: 0.01},
+		{Name: "battery", Offset: 2, Length: 1, Type: "uint"},
+		{Name: "pressure", Offset: 3, Length: 4, Type: "float"},
+		{Name: "counter", Offset: 7, Length: 3, Type: "int"},
+	}
+	payload := []byte{
+		0x2E, 0xFB, // -1234 as a little endian int16
+		0xC8,                   // 200
+		0x44, 0x7D, 0x40, 0x00, // 1013.0 as a big endian float32
+		0xFF, 0xFF, 0xFE, // -2 as a big endian int24
+	}
+
+	readings, err := decodeFields(fields, payload)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldAlmostEqual, -12.34)
+	test.That(t, readings["battery"], test.ShouldEqual, 200.0)
+	test.That(t, readings["pressure"], test.ShouldEqual, 1013.0)
+	test.That(t, readings["counter"], test.ShouldEqual, -2.0)
+
+	// the same bytes read as big endian and unsigned.
+	readings, err = decodeFields([]DecoderField{{Name: "raw", Offset: 0, Length: 2, Type: "uint"}}, payload)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["raw"], test.ShouldEqual, 0x2EFB)
+
+	// fields past the end of the payload are rejected.
+	_, err = decodeFields(fields, payload[:8])
+	test.That(t, errors.Is(err, ErrShortFieldsPayload), test.ShouldBeTrue)
+}
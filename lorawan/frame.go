@@ -0,0 +1,228 @@
+// Package lorawan parses, authenticates and decodes LoRaWAN data uplinks without a gateway.
+// It has no cgo or Viam dependencies so the decoding of the gateway can be reused on its own.
+package lorawan
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"go.thethings.network/lorawan-stack/v3/pkg/crypto"
+	"go.thethings.network/lorawan-stack/v3/pkg/types"
+)
+
+// Errors from parsing and decoding data uplinks, use errors.Is to tell them apart.
+var (
+	ErrShortDataUplink    = errors.New("data uplink is too short")
+	ErrInvalidMIC         = errors.New("invalid MIC")
+	ErrFOptsWithPort0     = errors.New("uplink has mac commands in both fopts and a port 0 payload")
+	ErrDecryptFailed      = errors.New("failed to decrypt")
+	ErrNoAppSKey          = errors.New("device has no app session key to decrypt the payload")
+	ErrDecodeFailed       = errors.New("failed to decode payload")
+	ErrDecoderErrors      = errors.New("decoder returned errors")
+	ErrDecoderOutputSize  = errors.New("decoder returned readings larger than decoder_max_output_bytes")
+	ErrInvalidCayenne     = errors.New("invalid Cayenne LPP payload")
+	ErrShortFieldsPayload = errors.New("payload is too short for the decoder fields")
+	ErrNoEncodeFunction   = errors.New("decoder has no Encode function")
+	ErrNoDevice           = errors.New("no device has the dev addr of the uplink")
+	ErrUnsupportedMType   = errors.New("unsupported message type")
+	ErrDecodeUplink11     = errors.New("LoRaWAN 1.1 uplinks need the data rate and channel they were received on for the MIC")
+	ErrDecodeFragment     = errors.New("fragmented uplinks are only reassembled by the gateway")
+)
+
+// MType of data uplinks, the top 3 bits of the MHDR.
+const (
+	unconfirmedDataUp = 0x40
+	confirmedDataUp   = 0x80
+
+	mTypeMask = 0xE0
+)
+
+// FragmentationPort is the fPort of the fragmented data block transport messages.
+const FragmentationPort = 201
+
+// minDataUplinkLength is the length of the MHDR, DevAddr, FCtrl, FCnt and MIC of a data uplink.
+const minDataUplinkLength = 12
+
+// ValidateDataUplinkLength checks the uplink is long enough for its header, FOpts, FPort and MIC,
+// so a truncated frame is rejected before it is sliced.
+func ValidateDataUplinkLength(phyPayload []byte) error {
+	if len(phyPayload) < minDataUplinkLength {
+		return fmt.Errorf("%w: got %d bytes, need at least %d", ErrShortDataUplink, len(phyPayload), minDataUplinkLength)
+	}
+	foptsLength := int(phyPayload[5] & 0x0F)
+	if 8+foptsLength+1 > len(phyPayload)-4 {
+		return fmt.Errorf("%w: got %d bytes, need at least %d for %d bytes of fopts and the fport",
+			ErrShortDataUplink, len(phyPayload), minDataUplinkLength+foptsLength+1, foptsLength)
+	}
+	return nil
+}
+
+// DevAddr returns the big endian dev addr of the data uplink, it is sent little endian.
+func DevAddr(phyPayload []byte) []byte {
+	addr := make([]byte, 4)
+	for i := range addr {
+		addr[i] = phyPayload[4-i]
+	}
+	return addr
+}
+
+// ExtendFrameCounter combines the 16 MSB of the last accepted counter with the received 16 LSB.
+// If the received value is smaller than the 16 LSB of the last counter, the counter wrapped past 0xFFFF
+// and the 16 MSB are incremented.
+func ExtendFrameCounter(last uint32, fCnt uint16) uint32 {
+	full := last&0xFFFF0000 | uint32(fCnt)
+	if fCnt < uint16(last) {
+		full += 0x10000
+	}
+	return full
+}
+
+// ValidateUplinkMIC11 verifies the MIC of a LoRaWAN 1.1 data uplink.
+// Half of the MIC is computed with the SNwkSIntKey and half with the FNwkSIntKey.
+func ValidateUplinkMIC11(sNwkSIntKey, fNwkSIntKey []byte, txDR, txCh uint8, devAddr types.DevAddr, fCnt uint32, phyPayload []byte) error {
+	if len(sNwkSIntKey) != 16 || len(fNwkSIntKey) != 16 {
+		return ErrInvalidMIC
+	}
+	// confFCnt is only set when acknowledging a confirmed downlink, which the gateway doesn't send.
+	mic, err := crypto.ComputeUplinkMIC(
+		types.AES128Key(sNwkSIntKey),
+		types.AES128Key(fNwkSIntKey),
+		0,
+		txDR,
+		txCh,
+		devAddr,
+		fCnt,
+		phyPayload[:len(phyPayload)-4],
+	)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(phyPayload[len(phyPayload)-4:], mic[:]) {
+		return ErrInvalidMIC
+	}
+	return nil
+}
+
+// ValidateUplinkMIC verifies the message integrity code at the end of a data uplink.
+// The MIC is computed with the NwkSKey over the whole frame except the MIC itself.
+func ValidateUplinkMIC(nwkSKey []byte, devAddr types.DevAddr, fCnt uint32, phyPayload []byte) error {
+	if len(nwkSKey) != 16 {
+		return ErrInvalidMIC
+	}
+	mic, err := crypto.ComputeLegacyUplinkMIC(types.AES128Key(nwkSKey), devAddr, fCnt, phyPayload[:len(phyPayload)-4])
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(phyPayload[len(phyPayload)-4:], mic[:]) {
+		return ErrInvalidMIC
+	}
+	return nil
+}
+
+// Session is the session state an authenticated data uplink was sent with.
+type Session struct {
+	DevAddr types.DevAddr
+	FCnt    uint32 // full 32 bit frame counter
+	// the session keys are copied since a join replaces them on the device.
+	AppSKey    []byte
+	NwkSEncKey []byte // encrypts MAC commands, this is the NwkSKey for LoRaWAN 1.0 devices
+	// LorawanVersion is the LoRaWAN MAC version of the device, 1.1.0 devices encrypt the MAC commands in FOpts.
+	LorawanVersion string
+}
+
+// Frame is a data uplink with its MAC commands decrypted.
+type Frame struct {
+	FCtrl byte
+	FPort uint8
+	// MACCommands are the decrypted MAC commands, from FOpts or from the payload on port 0.
+	MACCommands []byte
+	// Payload is the FRMPayload, it is still encrypted with the app session key on other ports.
+	Payload []byte
+}
+
+// DecryptDataFrame splits the authenticated data uplink of the session into its fields and decrypts its MAC commands.
+// The application payload is decrypted separately so payloads that aren't decoded are never decrypted.
+func DecryptDataFrame(session Session, phyPayload []byte) (Frame, error) {
+	// Frame control byte contains various settings
+	// the last 4 bits is the fopts length
+	fctrl := phyPayload[5]
+	foptsLength := fctrl & 0x0F
+
+	// frame port specifies application port - 0 is for MAC commands 1-255 for device messages.
+	// framepayload is the device readings, or MAC commands on port 0.
+	// It is empty for frames without an application payload, such as keep-alives with only FOpts,
+	// which aren't decoded but still count as uplinks from the device.
+	frame := Frame{
+		FCtrl:   fctrl,
+		FPort:   phyPayload[8+foptsLength],
+		Payload: phyPayload[8+foptsLength+1 : len(phyPayload)-4],
+	}
+
+	// fopts contains MAC commands piggybacked on the uplink.
+	if foptsLength != 0 {
+		// MAC commands can be sent in FOpts or on port 0, but not both in the same frame.
+		if frame.FPort == 0 {
+			return Frame{}, ErrFOptsWithPort0
+		}
+		fopts := phyPayload[8 : 8+foptsLength]
+		// LoRaWAN 1.1 encrypts the MAC commands in FOpts with the NwkSEncKey.
+		if session.LorawanVersion == "1.1.0" {
+			var err error
+			fopts, err = crypto.DecryptUplink(types.AES128Key(session.NwkSEncKey), session.DevAddr, session.FCnt, fopts)
+			if err != nil {
+				return Frame{}, fmt.Errorf("%w fopts: %w", ErrDecryptFailed, err)
+			}
+		}
+		frame.MACCommands = fopts
+	}
+
+	if frame.FPort == 0 {
+		// port 0 payloads are encrypted with the network key instead of the app key.
+		decrypted, err := crypto.DecryptUplink(types.AES128Key(session.NwkSEncKey), session.DevAddr, session.FCnt, frame.Payload)
+		if err != nil {
+			return Frame{}, fmt.Errorf("%w mac commands: %w", ErrDecryptFailed, err)
+		}
+		frame.MACCommands = decrypted
+	}
+	return frame, nil
+}
+
+// DecryptPayload decrypts the application payload of the frame with the app session key.
+func (s Session) DecryptPayload(frame Frame) ([]byte, error) {
+	// only the MAC commands can be decrypted without the app key.
+	if len(s.AppSKey) != 16 {
+		return nil, fmt.Errorf("%w on port %d", ErrNoAppSKey, frame.FPort)
+	}
+	decrypted, err := crypto.DecryptUplink(types.AES128Key(s.AppSKey), s.DevAddr, s.FCnt, frame.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w payload: %w", ErrDecryptFailed, err)
+	}
+	return decrypted, nil
+}
+
+// UplinkError is an error from parsing a data uplink, with the dev addr and the device it came from.
+// Use errors.Is with the errors of the package to tell failures apart.
+type UplinkError struct {
+	DevAddr []byte // big endian
+	Device  string // empty if no device has the dev addr
+	Err     error
+}
+
+// NewUplinkError returns the error from parsing the data uplink, device is empty if it wasn't matched to a device.
+func NewUplinkError(phyPayload []byte, device string, err error) *UplinkError {
+	return &UplinkError{DevAddr: DevAddr(phyPayload), Device: device, Err: err}
+}
+
+func (e *UplinkError) Error() string {
+	if e.Device == "" {
+		return fmt.Sprintf("uplink from dev addr %x: %s", e.DevAddr, e.Err)
+	}
+	return fmt.Sprintf("uplink from device %s with dev addr %x: %s", e.Device, e.DevAddr, e.Err)
+}
+
+func (e *UplinkError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,123 @@
+package lorawan
+
+import (
+	"encoding/hex"
+)
+
+// MAC command identifiers (CID) from the LoRaWAN 1.0.3 spec.
+// https://lora-alliance.org/wp-content/uploads/2020/11/lorawan1.0.3.pdf page 31 for the list of MAC commands.
+// ResetInd and RekeyInd are only sent by LoRaWAN 1.1 devices.
+const (
+	CIDReset         = 0x01
+	CIDLinkCheck     = 0x02
+	CIDLinkADR       = 0x03
+	CIDDutyCycle     = 0x04
+	CIDRXParamSetup  = 0x05
+	CIDDevStatus     = 0x06
+	CIDNewChannel    = 0x07
+	CIDRXTimingSetup = 0x08
+	CIDTxParamSetup  = 0x09
+	CIDDlChannel     = 0x0A
+	CIDRekey         = 0x0B
+	CIDDeviceTime    = 0x0D
+)
+
+// MACCommand is a single MAC command sent by a device in the FOpts field.
+type MACCommand struct {
+	CID     byte
+	Payload []byte
+}
+
+// uplinkMACCommands maps the CID of each command sent by the end device to its name and payload length.
+var uplinkMACCommands = map[byte]struct {
+	name   string
+	length int
+}{
+	CIDReset:         {"ResetInd", 1},
+	CIDLinkCheck:     {"LinkCheckReq", 0},
+	CIDLinkADR:       {"LinkADRAns", 1},
+	CIDDutyCycle:     {"DutyCycleAns", 0},
+	CIDRXParamSetup:  {"RXParamSetupAns", 1},
+	CIDDevStatus:     {"DevStatusAns", 2},
+	CIDNewChannel:    {"NewChannelAns", 1},
+	CIDRXTimingSetup: {"RXTimingSetupAns", 0},
+	CIDTxParamSetup:  {"TxParamSetupAns", 0},
+	CIDDlChannel:     {"DlChannelAns", 1},
+	CIDRekey:         {"RekeyInd", 1},
+	CIDDeviceTime:    {"DeviceTimeReq", 0},
+}
+
+// ParseMACCommands splits the bytes of the FOpts field into MAC commands.
+// The length of an unknown command can't be determined, so parsing stops there and the
+// remaining bytes are returned as a single raw command.
+func ParseMACCommands(b []byte) []MACCommand {
+	commands := make([]MACCommand, 0)
+	for i := 0; i < len(b); {
+		cid := b[i]
+		info, ok := uplinkMACCommands[cid]
+		if !ok || i+1+info.length > len(b) {
+			commands = append(commands, MACCommand{CID: cid, Payload: b[i+1:]})
+			break
+		}
+		commands = append(commands, MACCommand{CID: cid, Payload: b[i+1 : i+1+info.length]})
+		i += 1 + info.length
+	}
+	return commands
+}
+
+// Complete returns true if the command is known and has its whole payload,
+// a command cut off at the end of the frame can only be returned in the readings.
+func (c MACCommand) Complete() bool {
+	info, ok := uplinkMACCommands[c.CID]
+	return ok && len(c.Payload) == info.length
+}
+
+// toMap converts the MAC command into a map that can be returned in the readings.
+func (c MACCommand) toMap() map[string]interface{} {
+	if !c.Complete() {
+		// unknown command, include the raw bytes so it can still be debugged.
+		return map[string]interface{}{
+			"command": "unknown",
+			"raw":     hex.EncodeToString(append([]byte{c.CID}, c.Payload...)),
+		}
+	}
+
+	m := map[string]interface{}{"command": uplinkMACCommands[c.CID].name}
+	switch c.CID {
+	case CIDLinkADR:
+		m["power_ack"] = c.Payload[0]&0x04 != 0
+		m["data_rate_ack"] = c.Payload[0]&0x02 != 0
+		m["channel_mask_ack"] = c.Payload[0]&0x01 != 0
+	case CIDRXParamSetup:
+		m["rx1_dr_offset_ack"] = c.Payload[0]&0x04 != 0
+		m["rx2_data_rate_ack"] = c.Payload[0]&0x02 != 0
+		m["channel_ack"] = c.Payload[0]&0x01 != 0
+	case CIDDevStatus:
+		m["battery"] = int(c.Payload[0])
+		// margin is a signed 6 bit integer.
+		m["margin"] = int(int8(c.Payload[1]<<2) >> 2)
+	case CIDNewChannel:
+		m["data_rate_range_ok"], m["channel_frequency_ok"] = NewChannelAnsStatus(c.Payload[0])
+	case CIDDlChannel:
+		m["uplink_frequency_exists"] = c.Payload[0]&0x02 != 0
+		m["channel_frequency_ok"] = c.Payload[0]&0x01 != 0
+	case CIDReset, CIDRekey:
+		m["minor_version"] = int(c.Payload[0] & 0x0F)
+	}
+	return m
+}
+
+// MACCommandsToReadings converts the MAC commands into a list that can be returned in the readings.
+func MACCommandsToReadings(commands []MACCommand) []interface{} {
+	res := make([]interface{}, 0, len(commands))
+	for _, c := range commands {
+		res = append(res, c.toMap())
+	}
+	return res
+}
+
+// NewChannelAnsStatus returns the status bits of a NewChannelAns, whether the device accepted the data rate range
+// and the frequency of the channel. The channel is only changed if both are ok.
+func NewChannelAnsStatus(status byte) (drOK, freqOK bool) {
+	return status&0x02 != 0, status&0x01 != 0
+}
@@ -0,0 +1,47 @@
+package lorawan
+
+import (
+	"testing"
+
+	"go.viam.com/test"
+)
+
+func TestParseMACCommands(t *testing.T) {
+	// LinkCheckReq, LinkADRAns with all acks, DeviceTimeReq.
+	commands := ParseMACCommands([]byte{0x02, 0x03, 0x07, 0x0D})
+	test.That(t, MACCommandsToReadings(commands), test.ShouldResemble, []interface{}{
+		map[string]interface{}{"command": "LinkCheckReq"},
+		map[string]interface{}{
+			"command":          "LinkADRAns",
+			"power_ack":        true,
+			"data_rate_ack":    true,
+			"channel_mask_ack": true,
+		},
+		map[string]interface{}{"command": "DeviceTimeReq"},
+	})
+
+	// DevStatusAns with a negative margin.
+	commands = ParseMACCommands([]byte{0x06, 0xFE, 0x3F})
+	test.That(t, commands[0].toMap(), test.ShouldResemble, map[string]interface{}{
+		"command": "DevStatusAns",
+		"battery": 254,
+		"margin":  -1,
+	})
+
+	// unknown command is returned as raw hex including everything after it.
+	commands = ParseMACCommands([]byte{0x02, 0x80, 0x01, 0x02})
+	test.That(t, len(commands), test.ShouldEqual, 2)
+	test.That(t, commands[1].toMap(), test.ShouldResemble, map[string]interface{}{
+		"command": "unknown",
+		"raw":     "800102",
+	})
+
+	// truncated command is returned as raw.
+	commands = ParseMACCommands([]byte{0x03})
+	test.That(t, commands[0].toMap(), test.ShouldResemble, map[string]interface{}{
+		"command": "unknown",
+		"raw":     "03",
+	})
+
+	test.That(t, ParseMACCommands([]byte{}), test.ShouldBeEmpty)
+}
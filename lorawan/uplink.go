@@ -0,0 +1,94 @@
+package lorawan
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"go.thethings.network/lorawan-stack/v3/pkg/types"
+)
+
+// uplinkDecoders caches the decoders compiled by DecodeUplink.
+var uplinkDecoders DecoderCache
+
+// DecodeUplink authenticates, decrypts and decodes a data uplink from one of the devices, without a gateway.
+// The device is matched by the dev addr of the uplink and the MIC is verified with its session keys.
+// It returns the name of the device and the decoded readings, with the uplink's MAC commands in mac_commands.
+// The readings are nil if the device filters the uplink's port.
+//
+// Unlike the gateway it keeps no state: the frame counter of the device only extends the 16 bit counter of the
+// uplink and isn't checked or updated, MAC commands aren't answered, fragments aren't reassembled and decoder
+// warnings are dropped. Uplinks from LoRaWAN 1.1 devices aren't supported.
+func DecodeUplink(
+	ctx context.Context, devices []Device, phyPayload []byte,
+) (name string, readings map[string]interface{}, err error) {
+	if err := ValidateDataUplinkLength(phyPayload); err != nil {
+		return "", map[string]interface{}{}, err
+	}
+	if mType := phyPayload[0] & mTypeMask; mType != unconfirmedDataUp && mType != confirmedDataUp {
+		return "", map[string]interface{}{}, fmt.Errorf("%w: MType %d", ErrUnsupportedMType, mType>>5)
+	}
+
+	// errors have the dev addr of the uplink, and the device once it is matched.
+	var matched string
+	defer func() {
+		if err != nil {
+			err = NewUplinkError(phyPayload, matched, err)
+		}
+	}()
+
+	devAddrBE := DevAddr(phyPayload)
+	var device *Device
+	for i := range devices {
+		if bytes.Equal(devices[i].DevAddr, devAddrBE) {
+			device = &devices[i]
+			break
+		}
+	}
+	if device == nil {
+		return "", map[string]interface{}{}, ErrNoDevice
+	}
+	matched = device.Name
+	// the 1.1 MIC includes the data rate and channel the uplink was sent on.
+	if device.LorawanVersion == "1.1.0" {
+		return "", map[string]interface{}{}, ErrDecodeUplink11
+	}
+
+	dAddr := types.MustDevAddr(devAddrBE)
+	fCnt := uint32(binary.LittleEndian.Uint16(phyPayload[6:8]))
+	if device.FCntUpValid {
+		fCnt = ExtendFrameCounter(device.FCntUp, uint16(fCnt))
+	}
+	if err := ValidateUplinkMIC(device.NwkSKey, *dAddr, fCnt, phyPayload); err != nil {
+		return "", map[string]interface{}{}, err
+	}
+	session := Session{DevAddr: *dAddr, FCnt: fCnt, AppSKey: device.AppSKey, NwkSEncKey: device.NwkSKey}
+
+	frame, err := DecryptDataFrame(session, phyPayload)
+	if err != nil {
+		return "", map[string]interface{}{}, err
+	}
+	if device.PortFiltered(frame.FPort) {
+		return device.Name, nil, nil
+	}
+
+	readings = map[string]interface{}{}
+	if frame.FPort != 0 && len(frame.Payload) > 0 {
+		if frame.FPort == FragmentationPort {
+			return "", map[string]interface{}{}, ErrDecodeFragment
+		}
+		payload, err := session.DecryptPayload(frame)
+		if err != nil {
+			return "", map[string]interface{}{}, err
+		}
+		readings, err = uplinkDecoders.DecodePayload(ctx, frame.FPort, *device, payload, DecoderLogs{})
+		if err != nil {
+			return "", map[string]interface{}{}, err
+		}
+	}
+	if len(frame.MACCommands) > 0 {
+		readings["mac_commands"] = MACCommandsToReadings(ParseMACCommands(frame.MACCommands))
+	}
+	return device.Name, readings, nil
+}
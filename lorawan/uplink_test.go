@@ -0,0 +1,168 @@
+package lorawan
+
+import (
+	"context"
+	"errors"
+	"gateway/testutils"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.viam.com/test"
+)
+
+const testDecoderScript = `function Decode(fPort, bytes) {
+	return {"temperature": bytes[0] + bytes[1] / 10};
+}`
+
+var (
+	testDevAddr = []byte{0x01, 0x02, 0x03, 0x04}
+	testAppSKey = []byte{
+		0x01, 0x23, 0x45, 0x67, 0x89, 0xAB, 0xCD, 0xEF,
+		0x01, 0x23, 0x45, 0x67, 0x89, 0xAB, 0xCD, 0xEE,
+	}
+	testNwkSKey = []byte{
+		0x01, 0x23, 0x45, 0x67, 0x89, 0xAB, 0xCD, 0xEF,
+		0x01, 0x23, 0x45, 0x67, 0x89, 0xAB, 0xCD, 0xEF,
+	}
+)
+
+// writeTestDecoder writes the decoder script to a file and returns its path.
+func writeTestDecoder(t *testing.T, script string) string {
+	path := filepath.Join(t.TempDir(), "codec.js")
+	err := os.WriteFile(path, []byte(script), 0o600)
+	test.That(t, err, test.ShouldBeNil)
+	return path
+}
+
+// createTestDevice returns an ABP device with the test session keys and decoder.
+func createTestDevice(t *testing.T) Device {
+	return Device{
+		Name:    "test-device",
+		DevAddr: testDevAddr,
+		NwkSKey: testNwkSKey,
+		AppSKey: testAppSKey,
+		Decoder: DecoderConfig{Path: writeTestDecoder(t, testDecoderScript)},
+	}
+}
+
+// createTestUplink builds an encrypted unconfirmed data uplink from the test device.
+func createTestUplink(t *testing.T, fCnt uint32, fPort uint8, data []byte) []byte {
+	return createTestUplinkWithFOpts(t, fCnt, nil, fPort, data)
+}
+
+// createTestUplinkWithFOpts builds an encrypted unconfirmed data uplink carrying MAC commands in FOpts.
+func createTestUplinkWithFOpts(t *testing.T, fCnt uint32, fOpts []byte, fPort uint8, data []byte) []byte {
+	device := testutils.Device{DevAddr: testDevAddr, NwkSKey: testNwkSKey, AppSKey: testAppSKey}
+	frame, err := device.Frame(testutils.UnconfirmedDataUp, fCnt, fOpts, fPort, data)
+	test.That(t, err, test.ShouldBeNil)
+	return frame
+}
+
+func TestDecodeUplink(t *testing.T) {
+	ctx := context.Background()
+	other := Device{Name: "other-device", DevAddr: []byte{0x0A, 0x0B, 0x0C, 0x0D}}
+	devices := []Device{other, createTestDevice(t)}
+
+	name, readings, err := DecodeUplink(ctx, devices, createTestUplink(t, 1, 1, []byte{0x15, 0x05}))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, name, test.ShouldEqual, "test-device")
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{"temperature": 21.5})
+
+	// without a gateway the frame counter isn't checked, so the same uplink decodes again.
+	_, readings, err = DecodeUplink(ctx, devices, createTestUplink(t, 1, 1, []byte{0x16, 0x05}))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 22.5)
+
+	// the upper 16 bits of the frame counter come from the device.
+	devices[1].FCntUp = 0x10005
+	devices[1].FCntUpValid = true
+	_, readings, err = DecodeUplink(ctx, devices, createTestUplink(t, 0x10006, 1, []byte{0x15, 0x05}))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["temperature"], test.ShouldEqual, 21.5)
+
+	// MAC commands in FOpts are returned with the readings, uplinks with only MAC commands aren't decoded.
+	_, readings, err = DecodeUplink(ctx, devices, createTestUplinkWithFOpts(t, 0x10007, []byte{CIDDutyCycle}, 1, nil))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{
+		"mac_commands": []interface{}{map[string]interface{}{"command": "DutyCycleAns"}},
+	})
+
+	// null values from the decoder are kept, also in nested objects.
+	devices[1].Decoder.Path = writeTestDecoder(t, `function Decode(fPort, bytes) { return {a: null, b: 1, c: {d: null}}; }`)
+	_, readings, err = DecodeUplink(ctx, devices, createTestUplink(t, 0x10008, 1, []byte{0x15, 0x05}))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldContainKey, "a")
+	test.That(t, readings["a"], test.ShouldBeNil)
+	test.That(t, readings["b"], test.ShouldEqual, 1)
+	test.That(t, readings["c"], test.ShouldResemble, map[string]interface{}{"d": nil})
+
+	// filtered ports return no readings.
+	devices[1].PortDenylist = []int{2}
+	name, readings, err = DecodeUplink(ctx, devices, createTestUplink(t, 0x10009, 2, []byte{0x15, 0x05}))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, name, test.ShouldEqual, "test-device")
+	test.That(t, readings, test.ShouldBeNil)
+}
+
+func TestDecodeUplinkErrors(t *testing.T) {
+	ctx := context.Background()
+	devices := []Device{createTestDevice(t)}
+
+	_, _, err := DecodeUplink(ctx, devices, []byte{0x40, 0x01})
+	test.That(t, errors.Is(err, ErrShortDataUplink), test.ShouldBeTrue)
+
+	joinRequest := make([]byte, 23)
+	_, _, err = DecodeUplink(ctx, devices, joinRequest)
+	test.That(t, errors.Is(err, ErrUnsupportedMType), test.ShouldBeTrue)
+
+	_, _, err = DecodeUplink(ctx, nil, createTestUplink(t, 1, 1, []byte{0x15, 0x05}))
+	test.That(t, errors.Is(err, ErrNoDevice), test.ShouldBeTrue)
+	var uplinkErr *UplinkError
+	test.That(t, errors.As(err, &uplinkErr), test.ShouldBeTrue)
+	test.That(t, uplinkErr.Device, test.ShouldBeEmpty)
+	test.That(t, uplinkErr.DevAddr, test.ShouldResemble, testDevAddr)
+
+	uplink := createTestUplink(t, 1, 1, []byte{0x15, 0x05})
+	uplink[len(uplink)-1] ^= 0xFF
+	_, _, err = DecodeUplink(ctx, devices, uplink)
+	test.That(t, errors.Is(err, ErrInvalidMIC), test.ShouldBeTrue)
+	test.That(t, errors.As(err, &uplinkErr), test.ShouldBeTrue)
+	test.That(t, uplinkErr.Device, test.ShouldEqual, "test-device")
+	test.That(t, err.Error(), test.ShouldEqual, "uplink from device test-device with dev addr 01020304: "+ErrInvalidMIC.Error())
+
+	_, _, err = DecodeUplink(ctx, devices, createTestUplink(t, 1, FragmentationPort, []byte{0x15, 0x05}))
+	test.That(t, errors.Is(err, ErrDecodeFragment), test.ShouldBeTrue)
+
+	devices[0].Decoder.Path = writeTestDecoder(t, `function Decode(fPort, bytes) { return {}; }`)
+	_, _, err = DecodeUplink(ctx, devices, createTestUplink(t, 1, 1, []byte{0x15, 0x05}))
+	test.That(t, errors.Is(err, ErrDecodeFailed), test.ShouldBeTrue)
+
+	devices[0].LorawanVersion = "1.1.0"
+	_, _, err = DecodeUplink(ctx, devices, createTestUplink(t, 1, 1, []byte{0x15, 0x05}))
+	test.That(t, errors.Is(err, ErrDecodeUplink11), test.ShouldBeTrue)
+}
+
+func TestDecodeUplinkHelpers(t *testing.T) {
+	// DecodeUplink drops the console output.
+	device := createTestDevice(t)
+	device.Decoder = DecoderConfig{
+		Script: `function Decode(fPort, bytes) {
+	console.log("decoding", bytes.length, "bytes");
+	return {"temperature": bytes[0], "raw": bytesToHex(bytes)};
+}`,
+		Helpers: true,
+	}
+	_, readings, err := DecodeUplink(context.Background(), []Device{device}, createTestUplink(t, 1, 1, []byte{0x15, 0xAB}))
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["raw"], test.ShouldEqual, "15ab")
+}
+
+func TestExtendFrameCounter(t *testing.T) {
+	test.That(t, ExtendFrameCounter(0, 1), test.ShouldEqual, 1)
+	test.That(t, ExtendFrameCounter(10, 10), test.ShouldEqual, 10)
+	test.That(t, ExtendFrameCounter(0x1FFFE, 0xFFFF), test.ShouldEqual, 0x1FFFF)
+	// wraps past 0xFFFF into the upper 16 bits.
+	test.That(t, ExtendFrameCounter(0xFFFF, 0), test.ShouldEqual, 0x10000)
+	test.That(t, ExtendFrameCounter(0x2FFF0, 0x0005), test.ShouldEqual, 0x30005)
+}
@@ -1,10 +1,20 @@
 package node
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"gateway/lorawan"
+	"maps"
+	"math"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"go.viam.com/rdk/components/sensor"
@@ -18,10 +28,14 @@ var Model = resource.NewModel("viam", "lorawan", "node")
 
 // Error variables for validation
 var (
-	errDecoderPathRequired = errors.New("decoder path is required")
+	errDecoderPathRequired = errors.New("decoder_path, decoder_script or decoder_format is required")
+	errDecoderPathScript   = errors.New("only one of decoder_path or decoder_script can be set")
+	errDecoderPathDir      = errors.New("decoder path is a directory, not a decoder file")
+	errInvalidDecoderURL   = errors.New("decoder path is not a valid URL")
 	errIntervalRequired    = errors.New("uplink_interval_mins is required")
 	errIntervalZero        = errors.New("uplink_interval_mins cannot be zero")
 	errInvalidJoinType     = errors.New("join type is OTAA or ABP - defaults to OTAA")
+	errMixedJoinType       = errors.New("attributes of the other join type are set, remove them or change join_type")
 	errDevEUIRequired      = errors.New("dev EUI is required for OTAA join type")
 	errDevEUILength        = errors.New("dev EUI must be 8 bytes")
 	errAppKeyRequired      = errors.New("app key is required for OTAA join type")
@@ -32,17 +46,124 @@ var (
 	errNwkSKeyLength       = errors.New("network session key must be 16 bytes")
 	errDevAddrRequired     = errors.New("device address is required for ABP join type")
 	errDevAddrLength       = errors.New("device address must be 4 bytes")
+	errDecoderTimeout      = errors.New("decoder_timeout_ms must be greater than zero")
+	errDecoderMaxOutput    = errors.New("decoder_max_output_bytes must be greater than zero")
+	errInvalidUnits        = errors.New("units must map reading names to units")
+	errInvalidHistorySize  = errors.New("history_size must be between 1 and 1024")
+	errInvalidVersion      = errors.New("lorawan_version is 1.0.3 or 1.1.0 - defaults to 1.0.3")
+	errNwkKeyRequired      = errors.New("network key is required for OTAA join type with LoRaWAN 1.1")
+	errNwkKeyLength        = errors.New("network key must be 16 bytes")
+	errFNwkSIntKeyRequired = errors.New("f_nwk_s_int_key is required for ABP join type with LoRaWAN 1.1")
+	errFNwkSIntKeyLength   = errors.New("f_nwk_s_int_key must be 16 bytes")
+	errSNwkSIntKeyRequired = errors.New("s_nwk_s_int_key is required for ABP join type with LoRaWAN 1.1")
+	errSNwkSIntKeyLength   = errors.New("s_nwk_s_int_key must be 16 bytes")
+	errNwkSEncKeyRequired  = errors.New("nwk_s_enc_key is required for ABP join type with LoRaWAN 1.1")
+	errNwkSEncKeyLength    = errors.New("nwk_s_enc_key must be 16 bytes")
+	errInvalidHex          = errors.New("must be a hex string")
+	errInvalidFormat       = errors.New("decoder_format must be cayenne, raw or fields")
+	errDecoderFieldsNeeded = errors.New("decoder_fields is required with decoder_format fields")
+	errInvalidDecoderField = errors.New("decoder_fields need a name, offset, endianness and a uint or int type of 1 to 8 bytes or float of 4 or 8 bytes")
+	errInvalidPortDecoder  = errors.New("port_decoders must map fPorts between 1 and 223 to decoder paths")
+	errInvalidClass        = errors.New("class is A or C - defaults to A")
+	errInvalidFunction     = errors.New("decoder_function is Decode or decodeUplink - defaults to Decode")
+	errInvalidRX1DROffset  = errors.New("rx1_dr_offset must be between 0 and 7")
+	errInvalidRX2DataRate  = errors.New("rx2_data_rate must be between 0 and 15")
+	errInvalidRXDelay      = errors.New("rx_delay_s must be between 1 and 15")
+	errInvalidRX2Frequency = errors.New("rx2_frequency must be a positive frequency in Hz")
+	errInvalidUpdateKeys   = errors.New("update_keys expects a map of the new session keys (hex)")
+	errInvalidPortFilter   = errors.New("port_allowlist and port_denylist must have fPorts between 0 and 223")
+	errPortAllowDeny       = errors.New("only one of port_allowlist or port_denylist can be set")
+	errUpdateKeysOTAA      = errors.New("update_keys is only supported for ABP nodes, OTAA nodes get new keys when they join")
+	errPlaceholderKey      = errors.New("key is all zeros or a repeated pattern, set the device's real key")
+	errNoGateway           = errors.New("node does not have gateway, it may have been removed or is being rebuilt")
 )
 
+// ErrDeviceRejected is returned by the gateway when it rejects the node, registering again won't succeed.
+var ErrDeviceRejected = errors.New("gateway rejected device")
+
+// Registration is retried while the gateway returns other errors, such as when it is still starting up.
+// The backoff doubles after each attempt.
+const (
+	registerAttempts       = 5
+	registerInitialBackoff = 100 * time.Millisecond
+	registerMaxBackoff     = 2 * time.Second
+)
+
+// defaultDecoderTimeoutMs is how long the decoder script can run if decoder_timeout_ms is not set.
+const defaultDecoderTimeoutMs = 10
+
+// defaultDecoderMaxOutputBytes is the largest readings the decoder script can return if decoder_max_output_bytes is not set.
+const defaultDecoderMaxOutputBytes = 64 * 1024
+
+// maxHistorySize is the most uplinks history_size can keep for the history docommand.
+const maxHistorySize = 1024
+
 type Config struct {
 	JoinType    string   `json:"join_type,omitempty"`
-	DecoderPath string   `json:"decoder_path"`
+	DecoderPath string   `json:"decoder_path,omitempty"`
 	Interval    *float64 `json:"uplink_interval_mins"`
 	DevEUI      string   `json:"dev_eui,omitempty"`
 	AppKey      string   `json:"app_key,omitempty"`
 	AppSKey     string   `json:"app_s_key,omitempty"`
 	NwkSKey     string   `json:"network_s_key,omitempty"`
 	DevAddr     string   `json:"dev_addr,omitempty"`
+	// RejectPlaceholderKeys makes an app key or app session key that looks like a placeholder an error instead of a warning.
+	RejectPlaceholderKeys bool `json:"reject_placeholder_keys,omitempty"`
+	// RelaxFCntCheck accepts an ABP device's frame counter starting over at a low value, such as after a reboot.
+	RelaxFCntCheck bool `json:"relax_fcnt_check,omitempty"`
+
+	DecoderTimeoutMs *int `json:"decoder_timeout_ms,omitempty"`
+	// DecoderMaxOutputBytes limits the size of the readings returned by the decoder script.
+	DecoderMaxOutputBytes *int `json:"decoder_max_output_bytes,omitempty"`
+	// DecoderScript is the decoder script itself, used instead of a decoder file.
+	DecoderScript string `json:"decoder_script,omitempty"`
+	// DecoderFormat is a built-in payload format decoded by the gateway instead of a decoder script.
+	DecoderFormat string `json:"decoder_format,omitempty"`
+	// DecoderFields are the readings decoded from the payload with the fields decoder format.
+	DecoderFields []DecoderField `json:"decoder_fields,omitempty"`
+	// DecoderFunction is the function of the decoder script called for uplinks, Decode or decodeUplink.
+	DecoderFunction string `json:"decoder_function,omitempty"`
+	// PortDecoders maps fPorts to the decoder file used for uplinks on that port.
+	// Uplinks on other ports use the default decoder.
+	PortDecoders map[string]string `json:"port_decoders,omitempty"`
+	// DecoderStages are decoder files run in order after the decoder, each gets the readings of the one before it.
+	DecoderStages []string `json:"decoder_stages,omitempty"`
+	// DecoderVars are values passed to the decoder as device.vars, such as calibration values of the device.
+	DecoderVars map[string]interface{} `json:"decoder_vars,omitempty"`
+	// DecoderHelpers gives the decoder the console and bytesToHex globals that codecs from other network servers use.
+	DecoderHelpers bool `json:"decoder_helpers,omitempty"`
+	// Units maps reading names to their units, returned in the units reading so decoders don't have to.
+	Units map[string]string `json:"units,omitempty"`
+	// IncludeSamples returns the samples of uplinks with several measurements in the samples reading, the
+	// readings are the latest sample either way.
+	IncludeSamples bool `json:"include_samples,omitempty"`
+	// HistorySize is how many of the node's decoded uplinks the gateway keeps for the history docommand.
+	HistorySize *int `json:"history_size,omitempty"`
+	// PortAllowlist and PortDenylist filter the fPorts uplinks are decoded on, uplinks on other ports are dropped.
+	PortAllowlist []int `json:"port_allowlist,omitempty"`
+	PortDenylist  []int `json:"port_denylist,omitempty"`
+
+	// LoRaWAN 1.1 only attributes.
+	LorawanVersion string `json:"lorawan_version,omitempty"`
+	NwkKey         string `json:"network_key,omitempty"`
+	FNwkSIntKey    string `json:"f_nwk_s_int_key,omitempty"`
+	SNwkSIntKey    string `json:"s_nwk_s_int_key,omitempty"`
+	NwkSEncKey     string `json:"nwk_s_enc_key,omitempty"`
+
+	// Gateways are the names of the gateways the node registers with, in order of preference for readings.
+	// If not set, the node uses the gateway it depends on.
+	Gateways []string `json:"gateways,omitempty"`
+
+	// Class is the LoRaWAN device class, A or C.
+	Class string `json:"class,omitempty"`
+
+	// Receive window settings sent to the device in the join accept, the region defaults are used if not set.
+	RX1DROffset *int `json:"rx1_dr_offset,omitempty"`
+	RX2DataRate *int `json:"rx2_data_rate,omitempty"`
+	RXDelayS    *int `json:"rx_delay_s,omitempty"`
+	// RX2Frequency overrides the region's rx2 frequency in Hz. It isn't sent in the join accept, so the device must
+	// be set up with the same frequency.
+	RX2Frequency *int `json:"rx2_frequency,omitempty"`
 }
 
 func init() {
@@ -56,9 +177,50 @@ func init() {
 
 // Validate ensures all parts of the config are valid.
 func (conf *Config) Validate(path string) ([]string, error) {
-	if conf.DecoderPath == "" {
+	switch conf.DecoderFormat {
+	case "cayenne", "raw", "":
+	case "fields":
+		if len(conf.DecoderFields) == 0 {
+			return nil, resource.NewConfigValidationError(path, errDecoderFieldsNeeded)
+		}
+	default:
+		return nil, resource.NewConfigValidationError(path, errInvalidFormat)
+	}
+	for _, field := range conf.DecoderFields {
+		if !field.Valid() {
+			return nil, resource.NewConfigValidationError(path, fmt.Errorf("%w: %s", errInvalidDecoderField, field.Name))
+		}
+	}
+	switch conf.DecoderFunction {
+	case "Decode", "decodeUplink", "":
+	default:
+		return nil, resource.NewConfigValidationError(path, errInvalidFunction)
+	}
+	if conf.DecoderPath == "" && conf.DecoderScript == "" && conf.DecoderFormat == "" {
 		return nil, resource.NewConfigValidationError(path, errDecoderPathRequired)
 	}
+	if conf.DecoderPath != "" && conf.DecoderScript != "" {
+		return nil, resource.NewConfigValidationError(path, errDecoderPathScript)
+	}
+	for port, decoderPath := range conf.PortDecoders {
+		fPort, err := strconv.Atoi(port)
+		if err != nil || fPort < 1 || fPort > 223 || decoderPath == "" {
+			return nil, resource.NewConfigValidationError(path, errInvalidPortDecoder)
+		}
+	}
+	for _, decoderPath := range conf.decoderPaths() {
+		if err := checkDecoderFile(decoderPath); err != nil {
+			return nil, resource.NewConfigValidationError(path, err)
+		}
+	}
+	if len(conf.PortAllowlist) > 0 && len(conf.PortDenylist) > 0 {
+		return nil, resource.NewConfigValidationError(path, errPortAllowDeny)
+	}
+	for _, fPort := range slices.Concat(conf.PortAllowlist, conf.PortDenylist) {
+		if fPort < 0 || fPort > 223 {
+			return nil, resource.NewConfigValidationError(path, errInvalidPortFilter)
+		}
+	}
 
 	if conf.Interval == nil {
 		return nil, resource.NewConfigValidationError(path, errIntervalRequired)
@@ -68,14 +230,67 @@ func (conf *Config) Validate(path string) ([]string, error) {
 		return nil, resource.NewConfigValidationError(path, errIntervalZero)
 	}
 
+	if conf.DecoderTimeoutMs != nil && *conf.DecoderTimeoutMs <= 0 {
+		return nil, resource.NewConfigValidationError(path, errDecoderTimeout)
+	}
+
+	if conf.DecoderMaxOutputBytes != nil && *conf.DecoderMaxOutputBytes <= 0 {
+		return nil, resource.NewConfigValidationError(path, errDecoderMaxOutput)
+	}
+
+	for name, unit := range conf.Units {
+		if name == "" || unit == "" {
+			return nil, resource.NewConfigValidationError(path, errInvalidUnits)
+		}
+	}
+
+	if conf.HistorySize != nil && (*conf.HistorySize < 1 || *conf.HistorySize > maxHistorySize) {
+		return nil, resource.NewConfigValidationError(path, errInvalidHistorySize)
+	}
+
+	switch conf.LorawanVersion {
+	case "1.0.3", "1.1.0", "":
+	default:
+		return nil, resource.NewConfigValidationError(path, errInvalidVersion)
+	}
+
+	switch conf.Class {
+	case "A", "C", "":
+	default:
+		return nil, resource.NewConfigValidationError(path, errInvalidClass)
+	}
+
+	if conf.RX1DROffset != nil && (*conf.RX1DROffset < 0 || *conf.RX1DROffset > 7) {
+		return nil, resource.NewConfigValidationError(path, errInvalidRX1DROffset)
+	}
+	if conf.RX2DataRate != nil && (*conf.RX2DataRate < 0 || *conf.RX2DataRate > 15) {
+		return nil, resource.NewConfigValidationError(path, errInvalidRX2DataRate)
+	}
+	if conf.RXDelayS != nil && (*conf.RXDelayS < 1 || *conf.RXDelayS > 15) {
+		return nil, resource.NewConfigValidationError(path, errInvalidRXDelay)
+	}
+	if conf.RX2Frequency != nil && (*conf.RX2Frequency <= 0 || *conf.RX2Frequency > math.MaxUint32) {
+		return nil, resource.NewConfigValidationError(path, errInvalidRX2Frequency)
+	}
+
+	var err error
 	switch conf.JoinType {
 	case "ABP":
-		return conf.validateABPAttributes(path)
+		_, err = conf.validateABPAttributes(path)
 	case "OTAA", "":
-		return conf.validateOTAAAttributes(path)
+		_, err = conf.validateOTAAAttributes(path)
 	default:
 		return nil, resource.NewConfigValidationError(path, errInvalidJoinType)
 	}
+	if err != nil {
+		return nil, err
+	}
+	if mixed := conf.otherJoinTypeAttributes(); len(mixed) > 0 {
+		return nil, resource.NewConfigValidationError(path, fmt.Errorf("%w: %s", errMixedJoinType, strings.Join(mixed, ", ")))
+	}
+
+	// the gateways are dependencies of the node.
+	return conf.Gateways, nil
 }
 
 func (conf *Config) validateOTAAAttributes(path string) ([]string, error) {
@@ -85,12 +300,33 @@ func (conf *Config) validateOTAAAttributes(path string) ([]string, error) {
 	if len(conf.DevEUI) != 16 {
 		return nil, resource.NewConfigValidationError(path, errDevEUILength)
 	}
+	if err := validateHex("dev_eui", conf.DevEUI); err != nil {
+		return nil, resource.NewConfigValidationError(path, err)
+	}
 	if conf.AppKey == "" {
 		return nil, resource.NewConfigValidationError(path, errAppKeyRequired)
 	}
 	if len(conf.AppKey) != 32 {
 		return nil, resource.NewConfigValidationError(path, errAppKeyLength)
 	}
+	if err := validateHex("app_key", conf.AppKey); err != nil {
+		return nil, resource.NewConfigValidationError(path, err)
+	}
+	if conf.RejectPlaceholderKeys && placeholderKey(conf.AppKey) {
+		return nil, resource.NewConfigValidationError(path, fmt.Errorf("%w: app_key", errPlaceholderKey))
+	}
+	// LoRaWAN 1.1 derives the network session keys from a separate network key.
+	if conf.LorawanVersion == "1.1.0" {
+		if conf.NwkKey == "" {
+			return nil, resource.NewConfigValidationError(path, errNwkKeyRequired)
+		}
+		if len(conf.NwkKey) != 32 {
+			return nil, resource.NewConfigValidationError(path, errNwkKeyLength)
+		}
+		if err := validateHex("network_key", conf.NwkKey); err != nil {
+			return nil, resource.NewConfigValidationError(path, err)
+		}
+	}
 	return nil, nil
 }
 
@@ -101,11 +337,51 @@ func (conf *Config) validateABPAttributes(path string) ([]string, error) {
 	if len(conf.AppSKey) != 32 {
 		return nil, resource.NewConfigValidationError(path, errAppSKeyLength)
 	}
-	if conf.NwkSKey == "" {
-		return nil, resource.NewConfigValidationError(path, errNwkSKeyRequired)
+	if err := validateHex("app_s_key", conf.AppSKey); err != nil {
+		return nil, resource.NewConfigValidationError(path, err)
+	}
+	if conf.RejectPlaceholderKeys && placeholderKey(conf.AppSKey) {
+		return nil, resource.NewConfigValidationError(path, fmt.Errorf("%w: app_s_key", errPlaceholderKey))
 	}
-	if len(conf.NwkSKey) != 32 {
-		return nil, resource.NewConfigValidationError(path, errNwkSKeyLength)
+	if conf.LorawanVersion == "1.1.0" {
+		// LoRaWAN 1.1 splits the network session key into three keys.
+		if conf.FNwkSIntKey == "" {
+			return nil, resource.NewConfigValidationError(path, errFNwkSIntKeyRequired)
+		}
+		if len(conf.FNwkSIntKey) != 32 {
+			return nil, resource.NewConfigValidationError(path, errFNwkSIntKeyLength)
+		}
+		if err := validateHex("f_nwk_s_int_key", conf.FNwkSIntKey); err != nil {
+			return nil, resource.NewConfigValidationError(path, err)
+		}
+		if conf.SNwkSIntKey == "" {
+			return nil, resource.NewConfigValidationError(path, errSNwkSIntKeyRequired)
+		}
+		if len(conf.SNwkSIntKey) != 32 {
+			return nil, resource.NewConfigValidationError(path, errSNwkSIntKeyLength)
+		}
+		if err := validateHex("s_nwk_s_int_key", conf.SNwkSIntKey); err != nil {
+			return nil, resource.NewConfigValidationError(path, err)
+		}
+		if conf.NwkSEncKey == "" {
+			return nil, resource.NewConfigValidationError(path, errNwkSEncKeyRequired)
+		}
+		if len(conf.NwkSEncKey) != 32 {
+			return nil, resource.NewConfigValidationError(path, errNwkSEncKeyLength)
+		}
+		if err := validateHex("nwk_s_enc_key", conf.NwkSEncKey); err != nil {
+			return nil, resource.NewConfigValidationError(path, err)
+		}
+	} else {
+		if conf.NwkSKey == "" {
+			return nil, resource.NewConfigValidationError(path, errNwkSKeyRequired)
+		}
+		if len(conf.NwkSKey) != 32 {
+			return nil, resource.NewConfigValidationError(path, errNwkSKeyLength)
+		}
+		if err := validateHex("network_s_key", conf.NwkSKey); err != nil {
+			return nil, resource.NewConfigValidationError(path, err)
+		}
 	}
 	if conf.DevAddr == "" {
 		return nil, resource.NewConfigValidationError(path, errDevAddrRequired)
@@ -113,26 +389,227 @@ func (conf *Config) validateABPAttributes(path string) ([]string, error) {
 	if len(conf.DevAddr) != 8 {
 		return nil, resource.NewConfigValidationError(path, errDevAddrLength)
 	}
+	if err := validateHex("dev_addr", conf.DevAddr); err != nil {
+		return nil, resource.NewConfigValidationError(path, err)
+	}
 
 	return nil, nil
 }
 
+// placeholderKey returns true if the hex key is all zeros or a pattern of up to 8 bytes repeated, like the
+// example keys in datasheets. A placeholder key left in the config makes every uplink fail to decrypt.
+func placeholderKey(key string) bool {
+	b, err := hex.DecodeString(key)
+	if err != nil || len(b) == 0 {
+		return false
+	}
+	for _, period := range []int{1, 2, 4, 8} {
+		if bytes.Equal(b[period:], b[:len(b)-period]) {
+			return true
+		}
+	}
+	return false
+}
+
+// DecoderField is a reading of the fields decoder format, read from Length bytes of the payload at Offset.
+type DecoderField = lorawan.DecoderField
+
+// decoderPaths returns the decoder files of the config.
+func (conf *Config) decoderPaths() []string {
+	var paths []string
+	if conf.DecoderPath != "" {
+		paths = append(paths, conf.DecoderPath)
+	}
+	for _, decoderPath := range conf.PortDecoders {
+		paths = append(paths, decoderPath)
+	}
+	return append(paths, conf.DecoderStages...)
+}
+
+// isDecoderURL returns true if the decoder path is an http or https URL instead of a file.
+func isDecoderURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// checkDecoderFile returns an error if the decoder file exists but can't be read.
+// A missing file isn't an error since it can be added after the node is configured, it is logged on reconfigure.
+func checkDecoderFile(path string) error {
+	// decoders from a URL are fetched by the gateway.
+	if isDecoderURL(path) {
+		if u, err := url.Parse(path); err != nil || u.Host == "" {
+			return fmt.Errorf("%w: %s", errInvalidDecoderURL, path)
+		}
+		return nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read decoder file: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to read decoder file: %w", err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%w: %s", errDecoderPathDir, path)
+	}
+	return nil
+}
+
+// optionalUint8 converts an optional attribute that was validated to fit in a byte.
+func optionalUint8(v *int) *uint8 {
+	if v == nil {
+		return nil
+	}
+	b := uint8(*v)
+	return &b
+}
+
+// otherJoinTypeAttributes returns the set attributes that only apply to the join type the node doesn't use.
+// The node would ignore them, so they are usually left over from copying another node's config.
+func (conf *Config) otherJoinTypeAttributes() []string {
+	var attributes map[string]string
+	if conf.JoinType == "ABP" {
+		attributes = map[string]string{"dev_eui": conf.DevEUI, "app_key": conf.AppKey, "network_key": conf.NwkKey}
+	} else {
+		attributes = map[string]string{
+			"dev_addr":        conf.DevAddr,
+			"app_s_key":       conf.AppSKey,
+			"network_s_key":   conf.NwkSKey,
+			"f_nwk_s_int_key": conf.FNwkSIntKey,
+			"s_nwk_s_int_key": conf.SNwkSIntKey,
+			"nwk_s_enc_key":   conf.NwkSEncKey,
+		}
+	}
+	var set []string
+	for attribute, value := range attributes {
+		if value != "" {
+			set = append(set, attribute)
+		}
+	}
+	slices.Sort(set)
+	return set
+}
+
+// validateHex checks the value of the attribute can be decoded as hex.
+func validateHex(attribute, value string) error {
+	if _, err := hex.DecodeString(value); err != nil {
+		return fmt.Errorf("%s %w", attribute, errInvalidHex)
+	}
+	return nil
+}
+
 type Node struct {
 	resource.Named
 	logger logging.Logger
 
-	nwkSKey []byte
+	NwkSKey []byte
 	AppSKey []byte
 	AppKey  []byte
 
+	// LoRaWAN 1.1 keys. The NwkKey is the root key the network session keys are derived from,
+	// the FNwkSIntKey and SNwkSIntKey are used for the MIC and the NwkSEncKey encrypts MAC commands.
+	NwkKey      []byte
+	FNwkSIntKey []byte
+	SNwkSIntKey []byte
+	NwkSEncKey  []byte
+
+	// LorawanVersion is the LoRaWAN MAC version of the device, 1.0.3 or 1.1.0.
+	LorawanVersion string
+	// JoinNonce is the last join nonce sent to the device, LoRaWAN 1.1 devices require it to increase with each join.
+	JoinNonce uint32
+
+	// Class is the LoRaWAN device class, A or C. Class C devices listen continuously,
+	// so downlinks to them are sent right away instead of after their next uplink.
+	Class string
+
 	Addr   []byte
 	DevEui []byte
 
-	DecoderPath      string
+	// FCntUp is the last uplink frame counter accepted by the gateway.
+	// FCntUpValid is false until the first uplink of the session has been accepted.
+	FCntUp      uint32
+	FCntUpValid bool
+	// FCntDown is the frame counter of the next downlink sent to the device.
+	FCntDown uint32
+	// RelaxFCntCheck accepts uplinks from an ABP device whose frame counter reset to a low value, instead of
+	// rejecting them as replays. ABP devices that don't keep their counter across reboots need it.
+	RelaxFCntCheck bool
+
+	// PreviousSession has the session keys and uplink frame counter an ABP device had before its keys were updated.
+	// Uplinks still sent with them are accepted until PreviousSessionExpires, then it is dropped.
+	PreviousSession        *Node
+	PreviousSessionExpires time.Time
+
+	// DevNonces are the dev nonces seen in join requests from the device.
+	DevNonces map[uint16]bool
+
+	// SNRHistory is the SNR of the most recent uplinks, used for adaptive data rate.
+	SNRHistory []float64
+	// ADR is set if the device's last uplink had the ADR bit set, asking the gateway to manage its data rate.
+	ADR bool
+
+	// RX1DROffset, RX2DataRate and RXDelay are the receive window settings of the device, RXDelay in seconds.
+	// OTAA devices get them in the join accept, ABP devices must be set up with the same settings.
+	// If nil, the gateway uses the defaults of its region.
+	RX1DROffset *uint8
+	RX2DataRate *uint8
+	RXDelay     *uint8
+	// RX2Frequency is the rx2 frequency of the device in Hz, if nil the region's is used.
+	RX2Frequency *uint32
+	// RXTimingDelay is the rx1 delay in seconds the device acknowledged after a RXTimingSetupReq, it is used instead
+	// of RXDelay until the device joins again. PendingRXTimingDelay is the delay of a request that isn't acknowledged yet.
+	RXTimingDelay        *uint8
+	PendingRXTimingDelay *uint8
+	// MaxDutyCycle is the max duty cycle exponent the device acknowledged after a DutyCycleReq, it transmits at most
+	// 1/2^MaxDutyCycle of the time until it joins again. PendingMaxDutyCycle is the exponent of a request that isn't
+	// acknowledged yet.
+	MaxDutyCycle        *uint8
+	PendingMaxDutyCycle *uint8
+	// TxParams is the EIRP_DwellTime byte of the TxParamSetupReq the device acknowledged, with its max EIRP and
+	// dwell time limits, until it joins again. PendingTxParams is the byte of a request that isn't acknowledged yet.
+	TxParams        *uint8
+	PendingTxParams *uint8
+
+	DecoderPath string
+	// DecoderScript is the inline decoder script, if set it is used instead of DecoderPath.
+	DecoderScript string
+	// DecoderFormat is the built-in format used to decode uplinks instead of the decoder script, such as cayenne.
+	// The decoder script is still used to encode downlinks.
+	DecoderFormat string
+	// DecoderFields are the readings of the fields format, decoded from their place in the payload.
+	DecoderFields []DecoderField
+	// DecoderFunction is the function of the decoder script called for uplinks.
+	// Decode is called as Decode(fPort, bytes), decodeUplink as decodeUplink({bytes, fPort}) from the TTN codec API.
+	DecoderFunction string
+	// PortDecoders maps fPorts to decoder paths, they are used instead of the default decoder on those ports.
+	PortDecoders map[string]string
+	// DecoderStages are decoder paths run in order on the readings of the decoder, as Decode(fPort, input).
+	DecoderStages []string
+	// DecoderVars are the node's values given to the decoder and its stages as device.vars.
+	DecoderVars map[string]interface{}
+	// DecoderHelpers gives the decoder, its stages and the encoder console.log, which logs at debug level, and bytesToHex.
+	DecoderHelpers bool
+	// PortAllowlist is the only fPorts uplinks are decoded on if set, uplinks on the PortDenylist fPorts are never decoded.
+	PortAllowlist []int
+	PortDenylist  []int
+	// DecoderTimeout is how long the decoder script can run before it is interrupted.
+	DecoderTimeout time.Duration
+	// DecoderMaxOutputBytes is the largest readings the decoder script can return, larger readings are rejected.
+	DecoderMaxOutputBytes int
+	// HistorySize is how many of the device's decoded uplinks the gateway keeps, if zero it keeps its default.
+	HistorySize int
+
 	NodeName         string
-	gateway          sensor.Sensor
+	mu               sync.Mutex      // guards gateways and the Addr of OTAA nodes, which change after the node is configured
+	gateways         []sensor.Sensor // in order of preference for readings
 	JoinType         string
 	expectedInterval int
+	units            map[string]string // units of the readings, from the config
+	includeSamples   bool              // return the samples reading of batched uplinks
 }
 
 func newNode(
@@ -165,17 +642,33 @@ func (n *Node) Reconfigure(ctx context.Context, deps resource.Dependencies, conf
 
 	switch cfg.JoinType {
 	case "OTAA", "":
+		// OTAA nodes get their dev addr from the gateway's readings once they join.
+		n.mu.Lock()
+		n.Addr = nil
+		n.mu.Unlock()
+
 		appKey, err := hex.DecodeString(cfg.AppKey)
 		if err != nil {
 			return err
 		}
 		n.AppKey = appKey
+		if placeholderKey(cfg.AppKey) {
+			n.logger.Warnf("app_key of node %s is all zeros or a repeated pattern, join requests will fail unless it is the device's real key", n.NodeName)
+		}
 
 		devEui, err := hex.DecodeString(cfg.DevEUI)
 		if err != nil {
 			return err
 		}
 		n.DevEui = devEui
+
+		if cfg.LorawanVersion == "1.1.0" {
+			nwkKey, err := hex.DecodeString(cfg.NwkKey)
+			if err != nil {
+				return err
+			}
+			n.NwkKey = nwkKey
+		}
 	case "ABP":
 		devAddr, err := hex.DecodeString(cfg.DevAddr)
 		if err != nil {
@@ -190,31 +683,130 @@ func (n *Node) Reconfigure(ctx context.Context, deps resource.Dependencies, conf
 		}
 
 		n.AppSKey = appSKey
+		if placeholderKey(cfg.AppSKey) {
+			n.logger.Warnf("app_s_key of node %s is all zeros or a repeated pattern, uplinks won't decrypt unless it is the device's real key", n.NodeName)
+		}
+
+		if cfg.LorawanVersion == "1.1.0" {
+			fNwkSIntKey, err := hex.DecodeString(cfg.FNwkSIntKey)
+			if err != nil {
+				return err
+			}
+			n.FNwkSIntKey = fNwkSIntKey
+
+			sNwkSIntKey, err := hex.DecodeString(cfg.SNwkSIntKey)
+			if err != nil {
+				return err
+			}
+			n.SNwkSIntKey = sNwkSIntKey
+
+			nwkSEncKey, err := hex.DecodeString(cfg.NwkSEncKey)
+			if err != nil {
+				return err
+			}
+			n.NwkSEncKey = nwkSEncKey
+		} else {
+			nwkSKey, err := hex.DecodeString(cfg.NwkSKey)
+			if err != nil {
+				return err
+			}
+
+			n.NwkSKey = nwkSKey
+		}
 	}
 
 	n.DecoderPath = cfg.DecoderPath
+	for _, decoderPath := range cfg.decoderPaths() {
+		if _, err := os.Stat(decoderPath); !isDecoderURL(decoderPath) && errors.Is(err, os.ErrNotExist) {
+			n.logger.Warnf("decoder file %s does not exist, uplinks won't be decoded until it is added", decoderPath)
+		}
+	}
+	n.DecoderScript = cfg.DecoderScript
+	n.DecoderFormat = cfg.DecoderFormat
+	n.DecoderFields = cfg.DecoderFields
+	n.DecoderFunction = cfg.DecoderFunction
+	if n.DecoderFunction == "" {
+		n.DecoderFunction = "Decode"
+	}
+	n.PortDecoders = cfg.PortDecoders
+	n.DecoderStages = cfg.DecoderStages
+	n.DecoderVars = cfg.DecoderVars
+	n.DecoderHelpers = cfg.DecoderHelpers
+	n.units = cfg.Units
+	n.includeSamples = cfg.IncludeSamples
+	n.HistorySize = 0
+	if cfg.HistorySize != nil {
+		n.HistorySize = *cfg.HistorySize
+	}
+	n.PortAllowlist = cfg.PortAllowlist
+	n.PortDenylist = cfg.PortDenylist
 	n.JoinType = cfg.JoinType
+	n.RelaxFCntCheck = cfg.RelaxFCntCheck
+
+	n.DecoderTimeout = defaultDecoderTimeoutMs * time.Millisecond
+	if cfg.DecoderTimeoutMs != nil {
+		n.DecoderTimeout = time.Duration(*cfg.DecoderTimeoutMs) * time.Millisecond
+	}
+
+	n.DecoderMaxOutputBytes = defaultDecoderMaxOutputBytes
+	if cfg.DecoderMaxOutputBytes != nil {
+		n.DecoderMaxOutputBytes = *cfg.DecoderMaxOutputBytes
+	}
 
 	if n.JoinType == "" {
 		n.JoinType = "OTAA"
 	}
 
-	gateway, err := getGateway(ctx, deps)
-	if err != nil {
-		return err
+	n.LorawanVersion = cfg.LorawanVersion
+	if n.LorawanVersion == "" {
+		n.LorawanVersion = "1.0.3"
 	}
 
-	cmd := make(map[string]interface{})
+	n.Class = cfg.Class
+	if n.Class == "" {
+		n.Class = "A"
+	}
 
-	// send the device to the gateway.
-	cmd["register_device"] = n
+	n.RX1DROffset = optionalUint8(cfg.RX1DROffset)
+	n.RX2DataRate = optionalUint8(cfg.RX2DataRate)
+	n.RXDelay = optionalUint8(cfg.RXDelayS)
+	n.RX2Frequency = nil
+	if cfg.RX2Frequency != nil {
+		freq := uint32(*cfg.RX2Frequency)
+		n.RX2Frequency = &freq
+	}
 
-	_, err = gateway.DoCommand(ctx, cmd)
+	gateways, err := getGateways(ctx, deps, cfg.Gateways)
 	if err != nil {
 		return err
 	}
 
-	n.gateway = gateway
+	cmd := make(map[string]interface{})
+
+	// send the device to the gateways.
+	cmd["register_device"] = n.DeviceMap()
+
+	var registered []sensor.Sensor
+	var registerErr error
+	for _, gateway := range gateways {
+		n.logger.Debugf("registering %s node %s with gateway %s", n.JoinType, n.NodeName, gateway.Name().Name)
+		err = n.registerWithGateway(ctx, gateway, cmd)
+		if err != nil {
+			// the node only needs one gateway, the others are for redundancy.
+			if len(gateways) > 1 {
+				n.logger.Warnf("failed to register node %s with gateway %s: %s", n.NodeName, gateway.Name().Name, err)
+			}
+			registerErr = err
+			continue
+		}
+		registered = append(registered, gateway)
+	}
+	n.mu.Lock()
+	n.gateways = registered
+	n.mu.Unlock()
+	if len(registered) == 0 {
+		return registerErr
+	}
 
 	// Warn if user's configured capture frequency is more than the expected uplink interval.
 	captureFreq, err := getCaptureFrequencyHzFromConfig(conf)
@@ -235,7 +827,118 @@ func (n *Node) Reconfigure(ctx context.Context, deps resource.Dependencies, conf
 	return nil
 }
 
-// getGateway sends the validate docommand to the gateway to confirm the dependency.
+// DeviceMap returns the fields of the node the gateway registers it with, as sent in the register_device docommand.
+// The map is converted to a structpb when the gateway is in another process, so unset optional fields are left out
+// instead of sent as nil pointers.
+func (n *Node) DeviceMap() map[string]interface{} {
+	n.mu.Lock()
+	addr := n.Addr
+	n.mu.Unlock()
+
+	device := map[string]interface{}{
+		"NodeName":              n.NodeName,
+		"JoinType":              n.JoinType,
+		"LorawanVersion":        n.LorawanVersion,
+		"Class":                 n.Class,
+		"AppKey":                n.AppKey,
+		"AppSKey":               n.AppSKey,
+		"NwkSKey":               n.NwkSKey,
+		"DevEui":                n.DevEui,
+		"Addr":                  addr,
+		"RelaxFCntCheck":        n.RelaxFCntCheck,
+		"DecoderPath":           n.DecoderPath,
+		"DecoderScript":         n.DecoderScript,
+		"DecoderFormat":         n.DecoderFormat,
+		"DecoderFields":         n.DecoderFields,
+		"DecoderFunction":       n.DecoderFunction,
+		"PortDecoders":          n.PortDecoders,
+		"DecoderStages":         n.DecoderStages,
+		"DecoderVars":           n.DecoderVars,
+		"DecoderHelpers":        n.DecoderHelpers,
+		"PortAllowlist":         n.PortAllowlist,
+		"PortDenylist":          n.PortDenylist,
+		"DecoderTimeout":        n.DecoderTimeout,
+		"DecoderMaxOutputBytes": n.DecoderMaxOutputBytes,
+		"HistorySize":           n.HistorySize,
+	}
+	// the LoRaWAN 1.1 keys are only set for 1.1 devices.
+	for key, val := range map[string][]byte{
+		"NwkKey":      n.NwkKey,
+		"FNwkSIntKey": n.FNwkSIntKey,
+		"SNwkSIntKey": n.SNwkSIntKey,
+		"NwkSEncKey":  n.NwkSEncKey,
+	} {
+		if val != nil {
+			device[key] = val
+		}
+	}
+	for key, val := range map[string]*uint8{
+		"RX1DROffset": n.RX1DROffset,
+		"RX2DataRate": n.RX2DataRate,
+		"RXDelay":     n.RXDelay,
+	} {
+		if val != nil {
+			device[key] = *val
+		}
+	}
+	if n.RX2Frequency != nil {
+		device["RX2Frequency"] = *n.RX2Frequency
+	}
+	return device
+}
+
+// registerWithGateway sends the register_device docommand to the gateway, retrying with backoff until
+// the gateway accepts or rejects the node, the attempts run out or the context is done.
+func (n *Node) registerWithGateway(ctx context.Context, gateway sensor.Sensor, cmd map[string]interface{}) error {
+	backoff := registerInitialBackoff
+	for attempt := 1; ; attempt++ {
+		_, err := gateway.DoCommand(ctx, cmd)
+		if err == nil || registrationRejected(err) || attempt == registerAttempts {
+			return err
+		}
+		n.logger.Debugf("failed to register node %s with gateway %s, retrying in %s: %s", n.NodeName, gateway.Name().Name, backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, registerMaxBackoff)
+	}
+}
+
+// registrationRejected returns true if the gateway rejected the node's config.
+// Errors from a gateway in another process lose their type, so the message is checked too.
+func registrationRejected(err error) bool {
+	return errors.Is(err, ErrDeviceRejected) || strings.Contains(err.Error(), ErrDeviceRejected.Error())
+}
+
+// getGateways returns the gateways with the given names from the dependencies.
+// If no names are given, the node's only dependency is used as the gateway.
+func getGateways(ctx context.Context, deps resource.Dependencies, names []string) ([]sensor.Sensor, error) {
+	if len(names) == 0 {
+		gateway, err := getGateway(ctx, deps)
+		if err != nil {
+			return nil, err
+		}
+		return []sensor.Sensor{gateway}, nil
+	}
+
+	gateways := make([]sensor.Sensor, 0, len(names))
+	for _, name := range names {
+		dep, err := sensor.FromDependencies(deps, name)
+		if err != nil {
+			return nil, err
+		}
+		gateway, err := validateGateway(ctx, dep)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		gateways = append(gateways, gateway)
+	}
+	return gateways, nil
+}
+
+// getGateway returns the node's only dependency after confirming it is the gateway.
 func getGateway(ctx context.Context, deps resource.Dependencies) (sensor.Sensor, error) {
 	if len(deps) == 0 {
 		return nil, errors.New("must add sx1302-gateway as dependency")
@@ -247,6 +950,11 @@ func getGateway(ctx context.Context, deps resource.Dependencies) (sensor.Sensor,
 		dep = val
 	}
 
+	return validateGateway(ctx, dep)
+}
+
+// validateGateway sends the validate docommand to the gateway to confirm the dependency.
+func validateGateway(ctx context.Context, dep resource.Resource) (sensor.Sensor, error) {
 	gateway, ok := dep.(sensor.Sensor)
 	if !ok {
 		return nil, errors.New("dependency must be the sx1302-gateway sensor")
@@ -271,28 +979,237 @@ func getGateway(ctx context.Context, deps resource.Dependencies) (sensor.Sensor,
 	return gateway, nil
 }
 
+// currentGateways returns the gateways the node is registered with, skipping any that are no longer set.
+func (n *Node) currentGateways() ([]sensor.Sensor, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	gateways := make([]sensor.Sensor, 0, len(n.gateways))
+	for _, gateway := range n.gateways {
+		if gateway != nil {
+			gateways = append(gateways, gateway)
+		}
+	}
+	if len(gateways) == 0 {
+		return nil, errNoGateway
+	}
+	return gateways, nil
+}
+
 func (n *Node) Close(ctx context.Context) error {
 	cmd := make(map[string]interface{})
-	cmd["remove_device"] = n.NodeName
-	_, err := n.gateway.DoCommand(ctx, cmd)
-	return err
+	cmd["deregister_device"] = n.NodeName
+	// a node without gateways has nothing to deregister from.
+	gateways, _ := n.currentGateways()
+	var errs []error
+	for _, gateway := range gateways {
+		if _, err := gateway.DoCommand(ctx, cmd); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
+// Readings returns the node's readings from the first of its gateways that has them.
 func (n *Node) Readings(ctx context.Context, extra map[string]interface{}) (map[string]interface{}, error) {
-	if n.gateway != nil {
-		allReadings, err := n.gateway.Readings(ctx, nil)
+	gateways, err := n.currentGateways()
+	if err != nil {
+		return map[string]interface{}{}, err
+	}
+
+	var errs []error
+	for _, gateway := range gateways {
+		allReadings, err := gateway.Readings(ctx, nil)
 		if err != nil {
-			return map[string]interface{}{}, err
+			// fall back to the next gateway.
+			errs = append(errs, err)
+			continue
 		}
 
-		reading, ok := allReadings[n.NodeName]
-		if !ok {
-			// no readings available yet
-			return map[string]interface{}{}, fmt.Errorf("no readings available yet: %w", data.ErrNoCaptureToStore)
+		// the gateway returns the readings of every node keyed by node name.
+		if reading, ok := allReadings[n.NodeName].(map[string]interface{}); ok {
+			if n.JoinType == "OTAA" {
+				n.updateDevAddr(reading)
+			}
+			// the gateway returns the dev addr of a joined node before its first uplink.
+			if _, ok := reading["dev_addr"]; ok && len(reading) == 1 {
+				continue
+			}
+			units := readingUnits(reading, n.units)
+			_, hasSamples := reading["samples"]
+			dropSamples := hasSamples && !n.includeSamples
+			if n.JoinType == "OTAA" || len(units) > 0 || dropSamples {
+				reading = maps.Clone(reading)
+			}
+			if dropSamples {
+				delete(reading, "samples")
+			}
+			// OTAA devices are identified by their dev EUI, so the readings can be matched to the device elsewhere.
+			if n.JoinType == "OTAA" {
+				reading["dev_eui"] = hex.EncodeToString(n.DevEui)
+			}
+			if len(units) > 0 {
+				reading["units"] = units
+			}
+			return reading, nil
 		}
-		return reading.(map[string]interface{}), nil
 	}
-	return map[string]interface{}{}, errors.New("node does not have gateway")
+	if len(errs) == len(gateways) {
+		return map[string]interface{}{}, errors.Join(errs...)
+	}
+
+	// no readings available yet, skip data capture so empty readings aren't stored.
+	if extra[data.FromDMString] == true {
+		return map[string]interface{}{}, fmt.Errorf("no readings available yet: %w", data.ErrNoCaptureToStore)
+	}
+	return map[string]interface{}{}, nil
+}
+
+// updateDevAddr sets Addr to the dev addr the gateway assigned to the node when it joined, from the gateway's
+// readings of the node.
+func (n *Node) updateDevAddr(reading map[string]interface{}) {
+	s, ok := reading["dev_addr"].(string)
+	if !ok {
+		return
+	}
+	devAddr, err := hex.DecodeString(s)
+	if err != nil || len(devAddr) != 4 {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !bytes.Equal(n.Addr, devAddr) {
+		n.logger.Infof("node %s joined with dev addr %s", n.NodeName, s)
+		n.Addr = devAddr
+	}
+}
+
+// readingUnits returns the configured units of the readings, as a map of reading name to unit.
+// Units of readings the device hasn't sent are left out.
+func readingUnits(readings map[string]interface{}, units map[string]string) map[string]interface{} {
+	out := make(map[string]interface{})
+	for name, unit := range units {
+		if _, ok := readings[name]; ok {
+			out[name] = unit
+		}
+	}
+	return out
+}
+
+// DoCommand handles get_uplinks, which returns the node's decoded uplinks with their sequence numbers
+// from the first of its gateways that answers. With after set, the uplinks newer than that seq are
+// returned, waiting up to wait_ms for one. Without after, the last uplink is returned.
+// It also handles history, update_keys and reload_decoder.
+func (n *Node) DoCommand(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+	if keys, ok := cmd["update_keys"]; ok {
+		return n.updateKeys(ctx, keys)
+	}
+	if _, ok := cmd["reload_decoder"]; ok {
+		return n.reloadDecoder(ctx)
+	}
+	if _, ok := cmd["history"]; ok {
+		return n.history(ctx)
+	}
+	up, ok := cmd["get_uplinks"]
+	if !ok {
+		return map[string]interface{}{}, nil
+	}
+	req := map[string]interface{}{"device": n.NodeName}
+	if upMap, ok := up.(map[string]interface{}); ok {
+		for _, key := range []string{"after", "wait_ms"} {
+			if val, ok := upMap[key]; ok {
+				req[key] = val
+			}
+		}
+	}
+
+	gateways, err := n.currentGateways()
+	if err != nil {
+		return map[string]interface{}{}, err
+	}
+	var errs []error
+	for _, gateway := range gateways {
+		// the gateways number uplinks separately, so the first gateway is used whenever it answers.
+		resp, err := gateway.DoCommand(ctx, map[string]interface{}{"get_uplinks": req})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return resp, nil
+	}
+	return map[string]interface{}{}, errors.Join(errs...)
+}
+
+// history returns the node's decoded uplinks kept by its gateway with the times they were received, from the history
+// docommand. Like get_uplinks, the first gateway that answers is used.
+func (n *Node) history(ctx context.Context) (map[string]interface{}, error) {
+	gateways, err := n.currentGateways()
+	if err != nil {
+		return map[string]interface{}{}, err
+	}
+	var errs []error
+	for _, gateway := range gateways {
+		resp, err := gateway.DoCommand(ctx, map[string]interface{}{"history": map[string]interface{}{"device": n.NodeName}})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return resp, nil
+	}
+	return map[string]interface{}{}, errors.Join(errs...)
+}
+
+// updateKeys replaces the session keys of the ABP node on each of its gateways, from the update_keys docommand.
+// The keys use the attribute names of the config. The frame counters are reset, so the device has to start
+// using the new keys with a new session.
+func (n *Node) updateKeys(ctx context.Context, keys interface{}) (map[string]interface{}, error) {
+	if n.JoinType != "ABP" {
+		return map[string]interface{}{}, errUpdateKeysOTAA
+	}
+	keysMap, ok := keys.(map[string]interface{})
+	if !ok {
+		return map[string]interface{}{}, errInvalidUpdateKeys
+	}
+	req := map[string]interface{}{"device": n.NodeName}
+	for _, attribute := range []string{"app_s_key", "network_s_key", "f_nwk_s_int_key", "s_nwk_s_int_key", "nwk_s_enc_key", "grace_period_s"} {
+		if key, ok := keysMap[attribute]; ok {
+			req[attribute] = key
+		}
+	}
+
+	gateways, err := n.currentGateways()
+	if err != nil {
+		return map[string]interface{}{}, err
+	}
+	// every gateway has to use the new keys, or it would reject the device's uplinks.
+	var errs []error
+	for _, gateway := range gateways {
+		if _, err := gateway.DoCommand(ctx, map[string]interface{}{"update_keys": req}); err != nil {
+			errs = append(errs, fmt.Errorf("gateway %s: %w", gateway.Name().Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return map[string]interface{}{}, errors.Join(errs...)
+	}
+	return map[string]interface{}{"update_keys": "updated"}, nil
+}
+
+// reloadDecoder makes each of the node's gateways read its decoders again, from the reload_decoder docommand.
+func (n *Node) reloadDecoder(ctx context.Context) (map[string]interface{}, error) {
+	gateways, err := n.currentGateways()
+	if err != nil {
+		return map[string]interface{}{}, err
+	}
+	var errs []error
+	for _, gateway := range gateways {
+		req := map[string]interface{}{"reload_decoder": map[string]interface{}{"device": n.NodeName}}
+		if _, err := gateway.DoCommand(ctx, req); err != nil {
+			errs = append(errs, fmt.Errorf("gateway %s: %w", gateway.Name().Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return map[string]interface{}{}, errors.Join(errs...)
+	}
+	return map[string]interface{}{"reload_decoder": "reloaded"}, nil
 }
 
 // getCaptureFrequencyHzFromConfig extract the capture_frequency_hz from the device config
@@ -3,9 +3,17 @@ package node
 import (
 	"context"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"go.viam.com/rdk/components/encoder"
+	"go.viam.com/rdk/components/sensor"
+	"go.viam.com/rdk/data"
 	"go.viam.com/rdk/logging"
 	"go.viam.com/rdk/resource"
 	"go.viam.com/rdk/testutils/inject"
@@ -36,6 +44,8 @@ const (
 var (
 	testInterval     = 5.0
 	testNodeReadings = map[string]interface{}{"reading": 1}
+	// testOTAAReadings are the readings of an OTAA node with testNodeReadings from the gateway.
+	testOTAAReadings = map[string]interface{}{"reading": 1, "dev_eui": "0123456789abcdef"}
 )
 
 func createMockGateway() *inject.Sensor {
@@ -77,6 +87,62 @@ func TestConfigValidate(t *testing.T) {
 	_, err = conf.Validate("")
 	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errDecoderPathRequired))
 
+	// Test inline decoder script
+	conf = &Config{
+		DecoderScript: "function Decode(fPort, bytes) { return {}; }",
+		Interval:      &testInterval,
+		DevEUI:        testDevEUI,
+		AppKey:        testAppKey,
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+
+	// Test both decoder path and script
+	conf.DecoderPath = testDecoderPath
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errDecoderPathScript))
+
+	// Test built-in decoder format
+	conf = &Config{
+		DecoderFormat: "cayenne",
+		Interval:      &testInterval,
+		DevEUI:        testDevEUI,
+		AppKey:        testAppKey,
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+
+	conf.DecoderFormat = "raw"
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+
+	conf.DecoderFormat = "json"
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errInvalidFormat))
+
+	// Test decoder function
+	conf.DecoderFormat = "cayenne"
+	conf.DecoderFunction = "decodeUplink"
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+
+	conf.DecoderFunction = "decode"
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errInvalidFunction))
+	conf.DecoderFunction = ""
+
+	// Test port decoders
+	conf.DecoderFormat = "cayenne"
+	conf.PortDecoders = map[string]string{"10": testDecoderPath}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+
+	for _, portDecoders := range []map[string]string{{"0": testDecoderPath}, {"224": testDecoderPath}, {"ten": testDecoderPath}, {"10": ""}} {
+		conf.PortDecoders = portDecoders
+		_, err = conf.Validate("")
+		test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errInvalidPortDecoder))
+	}
+
 	// Test missing interval
 	conf = &Config{
 		DecoderPath: testDecoderPath,
@@ -93,6 +159,125 @@ func TestConfigValidate(t *testing.T) {
 	_, err = conf.Validate("")
 	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errIntervalZero))
 
+	// Test zero and negative decoder timeout
+	for _, timeout := range []int{0, -5} {
+		conf = &Config{
+			DecoderPath:      testDecoderPath,
+			Interval:         &testInterval,
+			DecoderTimeoutMs: &timeout,
+		}
+		_, err = conf.Validate("")
+		test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errDecoderTimeout))
+	}
+
+	// Test zero and negative decoder output limit
+	for _, maxOutput := range []int{0, -5} {
+		conf = &Config{
+			DecoderPath:           testDecoderPath,
+			Interval:              &testInterval,
+			DecoderMaxOutputBytes: &maxOutput,
+		}
+		_, err = conf.Validate("")
+		test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errDecoderMaxOutput))
+	}
+
+	// Test invalid LoRaWAN version
+	conf = &Config{
+		DecoderPath:    testDecoderPath,
+		Interval:       &testInterval,
+		LorawanVersion: "1.0.2",
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errInvalidVersion))
+
+	// Test invalid device class
+	conf = &Config{
+		DecoderPath: testDecoderPath,
+		Interval:    &testInterval,
+		Class:       "B",
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errInvalidClass))
+
+	// Test receive window settings out of range
+	rx1DROffset, rx2DataRate, rxDelay := 8, 16, 0
+	conf = &Config{
+		DecoderPath: testDecoderPath,
+		Interval:    &testInterval,
+		RX1DROffset: &rx1DROffset,
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errInvalidRX1DROffset))
+	conf = &Config{
+		DecoderPath: testDecoderPath,
+		Interval:    &testInterval,
+		RX2DataRate: &rx2DataRate,
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errInvalidRX2DataRate))
+	rx2Frequency := 0
+	conf = &Config{
+		DecoderPath:  testDecoderPath,
+		Interval:     &testInterval,
+		RX2Frequency: &rx2Frequency,
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errInvalidRX2Frequency))
+	conf = &Config{
+		DecoderPath: testDecoderPath,
+		Interval:    &testInterval,
+		RXDelayS:    &rxDelay,
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errInvalidRXDelay))
+	historySize := maxHistorySize + 1
+	conf = &Config{
+		DecoderPath: testDecoderPath,
+		Interval:    &testInterval,
+		HistorySize: &historySize,
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errInvalidHistorySize))
+
+	// Test decoder fields
+	conf = &Config{
+		DecoderFormat: "fields",
+		Interval:      &testInterval,
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errDecoderFieldsNeeded))
+	conf.DecoderFields = []DecoderField{{Name: "temperature", Offset: 0, Length: 2, Type: "int", Endianness: "little", Scale: 0.01}}
+	test.That(t, conf.DecoderFields[0].Valid(), test.ShouldBeTrue)
+	for _, field := range []DecoderField{
+		{Name: "", Length: 2, Type: "int"},
+		{Name: "a", Offset: -1, Length: 2, Type: "int"},
+		{Name: "a", Length: 9, Type: "uint"},
+		{Name: "a", Length: 2, Type: "float"},
+		{Name: "a", Length: 2, Type: "string"},
+		{Name: "a", Length: 2, Type: "int", Endianness: "middle"},
+	} {
+		conf.DecoderFields = []DecoderField{field}
+		_, err = conf.Validate("")
+		test.That(t, errors.Is(err, errInvalidDecoderField), test.ShouldBeTrue)
+	}
+
+	// Test port filters
+	conf = &Config{
+		DecoderPath:   testDecoderPath,
+		Interval:      &testInterval,
+		PortAllowlist: []int{1, 224},
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errInvalidPortFilter))
+	conf = &Config{
+		DecoderPath:   testDecoderPath,
+		Interval:      &testInterval,
+		PortAllowlist: []int{1},
+		PortDenylist:  []int{2},
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errPortAllowDeny))
+
 	// Test invalid join type
 	conf = &Config{
 		DecoderPath: testDecoderPath,
@@ -125,6 +310,35 @@ func TestValidateOTAAAttributes(t *testing.T) {
 	_, err = conf.Validate("")
 	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errDevEUILength))
 
+	// Test non-hex DevEUI
+	conf = &Config{
+		DecoderPath: testDecoderPath,
+		Interval:    &testInterval,
+		JoinType:    testJoinTypeOTAA,
+		DevEUI:      "0123456789ABCDEG",
+		AppKey:      testAppKey,
+	}
+	_, err = conf.Validate("")
+	test.That(t, errors.Is(err, errInvalidHex), test.ShouldBeTrue)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "dev_eui")
+
+	// Test odd length DevEUI
+	conf.DevEUI = "0123456789ABCDE"
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errDevEUILength))
+
+	// Test non-hex AppKey
+	conf = &Config{
+		DecoderPath: testDecoderPath,
+		Interval:    &testInterval,
+		JoinType:    testJoinTypeOTAA,
+		DevEUI:      testDevEUI,
+		AppKey:      "0123456789ABCDEF0123456789ABAAAZ",
+	}
+	_, err = conf.Validate("")
+	test.That(t, errors.Is(err, errInvalidHex), test.ShouldBeTrue)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "app_key")
+
 	// Test missing AppKey
 	conf = &Config{
 		DecoderPath: testDecoderPath,
@@ -156,6 +370,125 @@ func TestValidateOTAAAttributes(t *testing.T) {
 	}
 	_, err = conf.Validate("")
 	test.That(t, err, test.ShouldBeNil)
+
+	// Test missing NwkKey for LoRaWAN 1.1
+	conf.LorawanVersion = "1.1.0"
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errNwkKeyRequired))
+
+	// Test valid LoRaWAN 1.1 OTAA config
+	conf.NwkKey = testNwkSKey
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+}
+
+func TestPlaceholderKeys(t *testing.T) {
+	for _, key := range []string{
+		"00000000000000000000000000000000",
+		"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF",
+		"01020102010201020102010201020102",
+		"0123456789ABCDEF0123456789ABCDEF",
+	} {
+		test.That(t, placeholderKey(key), test.ShouldBeTrue)
+	}
+	for _, key := range []string{testAppKey, testAppSKey, "2B7E151628AED2A6ABF7158809CF4F3C"} {
+		test.That(t, placeholderKey(key), test.ShouldBeFalse)
+	}
+
+	// placeholder keys are only an error if reject_placeholder_keys is set, otherwise a warning is logged.
+	conf := &Config{
+		DecoderPath: testDecoderPath,
+		Interval:    &testInterval,
+		JoinType:    testJoinTypeOTAA,
+		DevEUI:      testDevEUI,
+		AppKey:      "00000000000000000000000000000000",
+	}
+	_, err := conf.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+
+	logger, logs := logging.NewObservedTestLogger(t)
+	deps := resource.Dependencies{encoder.Named(testGatewayName): createMockGateway()}
+	_, err = newNode(context.Background(), deps, resource.Config{Name: "test-node", ConvertedAttributes: conf}, logger)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, logs.FilterMessageSnippet("app_key of node test-node is all zeros").Len(), test.ShouldEqual, 1)
+
+	conf.RejectPlaceholderKeys = true
+	_, err = conf.Validate("")
+	test.That(t, errors.Is(err, errPlaceholderKey), test.ShouldBeTrue)
+	conf.AppKey = testAppKey
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+
+	conf = &Config{
+		DecoderPath:           testDecoderPath,
+		Interval:              &testInterval,
+		JoinType:              testJoinTypeABP,
+		AppSKey:               "00000000000000000000000000000000",
+		NwkSKey:               testNwkSKey,
+		DevAddr:               testDevAddr,
+		RejectPlaceholderKeys: true,
+	}
+	_, err = conf.Validate("")
+	test.That(t, errors.Is(err, errPlaceholderKey), test.ShouldBeTrue)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "app_s_key")
+}
+
+func TestValidateMixedJoinType(t *testing.T) {
+	abp := func() *Config {
+		return &Config{
+			DecoderPath: testDecoderPath,
+			Interval:    &testInterval,
+			JoinType:    testJoinTypeABP,
+			AppSKey:     testAppSKey,
+			NwkSKey:     testNwkSKey,
+			DevAddr:     testDevAddr,
+		}
+	}
+	otaa := func() *Config {
+		return &Config{
+			DecoderPath: testDecoderPath,
+			Interval:    &testInterval,
+			JoinType:    testJoinTypeOTAA,
+			DevEUI:      testDevEUI,
+			AppKey:      testAppKey,
+		}
+	}
+
+	tests := []struct {
+		attribute string
+		conf      *Config
+		set       func(conf *Config)
+	}{
+		{"dev_eui", abp(), func(conf *Config) { conf.DevEUI = testDevEUI }},
+		{"app_key", abp(), func(conf *Config) { conf.AppKey = testAppKey }},
+		{"network_key", abp(), func(conf *Config) { conf.NwkKey = testAppKey }},
+		{"dev_addr", otaa(), func(conf *Config) { conf.DevAddr = testDevAddr }},
+		{"app_s_key", otaa(), func(conf *Config) { conf.AppSKey = testAppSKey }},
+		{"network_s_key", otaa(), func(conf *Config) { conf.NwkSKey = testNwkSKey }},
+		{"f_nwk_s_int_key", otaa(), func(conf *Config) { conf.FNwkSIntKey = testNwkSKey }},
+		{"s_nwk_s_int_key", otaa(), func(conf *Config) { conf.SNwkSIntKey = testNwkSKey }},
+		{"nwk_s_enc_key", otaa(), func(conf *Config) { conf.NwkSEncKey = testNwkSKey }},
+	}
+	for _, tc := range tests {
+		t.Run(tc.attribute, func(t *testing.T) {
+			_, err := tc.conf.Validate("")
+			test.That(t, err, test.ShouldBeNil)
+
+			tc.set(tc.conf)
+			_, err = tc.conf.Validate("")
+			test.That(t, errors.Is(err, errMixedJoinType), test.ShouldBeTrue)
+			test.That(t, err.Error(), test.ShouldContainSubstring, tc.attribute)
+		})
+	}
+
+	// an OTAA node is the default join type.
+	conf := otaa()
+	conf.JoinType = ""
+	conf.AppSKey = testAppSKey
+	conf.DevAddr = testDevAddr
+	_, err := conf.Validate("")
+	test.That(t, errors.Is(err, errMixedJoinType), test.ShouldBeTrue)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "app_s_key, dev_addr")
 }
 
 func TestValidateABPAttributes(t *testing.T) {
@@ -205,6 +538,30 @@ func TestValidateABPAttributes(t *testing.T) {
 	_, err = conf.Validate("")
 	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errNwkSKeyLength))
 
+	// Test non-hex NwkSKey
+	conf = &Config{
+		DecoderPath: testDecoderPath,
+		Interval:    &testInterval,
+		JoinType:    testJoinTypeABP,
+		AppSKey:     testAppSKey,
+		NwkSKey:     "0123456789ABCDEF0123456789ABCDE-",
+		DevAddr:     testDevAddr,
+	}
+	_, err = conf.Validate("")
+	test.That(t, errors.Is(err, errInvalidHex), test.ShouldBeTrue)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "network_s_key")
+
+	// Test non-hex and odd length DevAddr
+	conf.NwkSKey = testNwkSKey
+	conf.DevAddr = "0123456x"
+	_, err = conf.Validate("")
+	test.That(t, errors.Is(err, errInvalidHex), test.ShouldBeTrue)
+	test.That(t, err.Error(), test.ShouldContainSubstring, "dev_addr")
+
+	conf.DevAddr = "0123456"
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errDevAddrLength))
+
 	// Test missing DevAddr
 	conf = &Config{
 		DecoderPath: testDecoderPath,
@@ -239,6 +596,24 @@ func TestValidateABPAttributes(t *testing.T) {
 	}
 	_, err = conf.Validate("")
 	test.That(t, err, test.ShouldBeNil)
+
+	// Test LoRaWAN 1.1 ABP requires the three network session keys instead of NwkSKey
+	conf = &Config{
+		DecoderPath:    testDecoderPath,
+		Interval:       &testInterval,
+		JoinType:       testJoinTypeABP,
+		LorawanVersion: "1.1.0",
+		AppSKey:        testAppSKey,
+		DevAddr:        testDevAddr,
+		FNwkSIntKey:    testNwkSKey,
+		SNwkSIntKey:    testNwkSKey,
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeError, resource.NewConfigValidationError("", errNwkSEncKeyRequired))
+
+	conf.NwkSEncKey = testNwkSKey
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeNil)
 }
 
 func TestNewNode(t *testing.T) {
@@ -269,6 +644,13 @@ func TestNewNode(t *testing.T) {
 	test.That(t, node.NodeName, test.ShouldEqual, "test-node")
 	test.That(t, node.JoinType, test.ShouldEqual, testJoinTypeOTAA)
 	test.That(t, node.DecoderPath, test.ShouldEqual, testDecoderPath)
+	test.That(t, node.DecoderTimeout, test.ShouldEqual, defaultDecoderTimeoutMs*time.Millisecond)
+	test.That(t, node.DecoderMaxOutputBytes, test.ShouldEqual, defaultDecoderMaxOutputBytes)
+	test.That(t, node.DecoderFunction, test.ShouldEqual, "Decode")
+	test.That(t, node.Class, test.ShouldEqual, "A")
+	test.That(t, node.RX2DataRate, test.ShouldBeNil)
+	// the OTAA network session key is derived by the gateway when the device joins.
+	test.That(t, node.NwkSKey, test.ShouldBeEmpty)
 
 	// Test with valid ABP config
 	validABPConf := resource.Config{
@@ -300,6 +682,79 @@ func TestNewNode(t *testing.T) {
 	expectedAppSKey, err := hex.DecodeString(testAppSKey)
 	test.That(t, err, test.ShouldBeNil)
 	test.That(t, node.AppSKey, test.ShouldResemble, expectedAppSKey)
+
+	expectedNwkSKey, err := hex.DecodeString(testNwkSKey)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, node.NwkSKey, test.ShouldResemble, expectedNwkSKey)
+
+	// Test configured decoder timeout
+	decoderTimeoutMs := 50
+	timeoutConf := resource.Config{
+		Name: "test-node-timeout",
+		ConvertedAttributes: &Config{
+			DecoderPath:      testDecoderPath,
+			Interval:         &testInterval,
+			JoinType:         testJoinTypeOTAA,
+			DevEUI:           testDevEUI,
+			AppKey:           testAppKey,
+			DecoderTimeoutMs: &decoderTimeoutMs,
+		},
+	}
+
+	n, err = newNode(ctx, deps, timeoutConf, logger)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, n.(*Node).DecoderTimeout, test.ShouldEqual, 50*time.Millisecond)
+}
+
+func TestDecoderFileCheck(t *testing.T) {
+	ctx := context.Background()
+	decoderPath := filepath.Join(t.TempDir(), "decoder.js")
+	err := os.WriteFile(decoderPath, []byte("function Decode(fPort, bytes) { return {}; }"), 0o600)
+	test.That(t, err, test.ShouldBeNil)
+
+	conf := &Config{
+		DecoderPath: decoderPath,
+		Interval:    &testInterval,
+		JoinType:    testJoinTypeOTAA,
+		DevEUI:      testDevEUI,
+		AppKey:      testAppKey,
+	}
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+
+	// a directory can't be a decoder.
+	conf.DecoderPath = t.TempDir()
+	_, err = conf.Validate("")
+	test.That(t, errors.Is(err, errDecoderPathDir), test.ShouldBeTrue)
+	conf.DecoderPath = decoderPath
+	conf.PortDecoders = map[string]string{"2": t.TempDir()}
+	_, err = conf.Validate("")
+	test.That(t, errors.Is(err, errDecoderPathDir), test.ShouldBeTrue)
+
+	// a missing file is valid since it can be added later, but a warning is logged.
+	conf.PortDecoders = nil
+	conf.DecoderPath = filepath.Join(t.TempDir(), "missing.js")
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+
+	logger, logs := logging.NewObservedTestLogger(t)
+	deps := make(resource.Dependencies)
+	deps[encoder.Named(testGatewayName)] = createMockGateway()
+	_, err = newNode(ctx, deps, resource.Config{Name: "test-node", ConvertedAttributes: conf}, logger)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, logs.FilterMessageSnippet("missing.js does not exist").Len(), test.ShouldEqual, 1)
+
+	// decoders from a URL are fetched by the gateway, they aren't checked or logged as missing.
+	conf.DecoderPath = "https://example.com/decoder.js"
+	_, err = conf.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+	_, err = newNode(ctx, deps, resource.Config{Name: "test-node", ConvertedAttributes: conf}, logger)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, logs.FilterMessageSnippet("does not exist").Len(), test.ShouldEqual, 1)
+
+	conf.DecoderPath = "https://"
+	_, err = conf.Validate("")
+	test.That(t, errors.Is(err, errInvalidDecoderURL), test.ShouldBeTrue)
 }
 
 func TestReadings(t *testing.T) {
@@ -327,5 +782,528 @@ func TestReadings(t *testing.T) {
 
 	readings, err := n.Readings(ctx, nil)
 	test.That(t, err, test.ShouldBeNil)
-	test.That(t, readings, test.ShouldEqual, testNodeReadings)
+	test.That(t, readings, test.ShouldResemble, testOTAAReadings)
+	test.That(t, readings["dev_eui"], test.ShouldEqual, strings.ToLower(testDevEUI))
+	// the gateway's readings aren't modified.
+	test.That(t, testNodeReadings, test.ShouldNotContainKey, "dev_eui")
+}
+
+func TestReadingsDevAddr(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.NewTestLogger(t)
+	gatewayReadings := map[string]interface{}{}
+	mockGateway := createMockGateway()
+	mockGateway.ReadingsFunc = func(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"test-node": gatewayReadings}, nil
+	}
+	deps := resource.Dependencies{encoder.Named(testGatewayName): mockGateway}
+
+	conf := resource.Config{
+		Name: "test-node",
+		ConvertedAttributes: &Config{
+			DecoderPath: testDecoderPath,
+			Interval:    &testInterval,
+			JoinType:    testJoinTypeOTAA,
+			DevEUI:      testDevEUI,
+			AppKey:      testAppKey,
+		},
+	}
+	s, err := newNode(ctx, deps, conf, logger)
+	test.That(t, err, test.ShouldBeNil)
+	n := s.(*Node)
+	test.That(t, n.Addr, test.ShouldBeNil)
+
+	// the node gets its dev addr once it joins, before its first uplink there are no readings to capture.
+	gatewayReadings = map[string]interface{}{"dev_addr": "01020304"}
+	_, err = n.Readings(ctx, map[string]interface{}{data.FromDMString: true})
+	test.That(t, errors.Is(err, data.ErrNoCaptureToStore), test.ShouldBeTrue)
+	test.That(t, n.Addr, test.ShouldResemble, []byte{0x01, 0x02, 0x03, 0x04})
+
+	gatewayReadings = map[string]interface{}{"dev_addr": "01020304", "reading": 1}
+	readings, err := n.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["dev_addr"], test.ShouldEqual, "01020304")
+	test.That(t, readings["reading"], test.ShouldEqual, 1)
+
+	// a new join assigns a new dev addr.
+	gatewayReadings = map[string]interface{}{"dev_addr": "05060708", "reading": 1}
+	_, err = n.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, n.Addr, test.ShouldResemble, []byte{0x05, 0x06, 0x07, 0x08})
+
+	// the dev addr isn't sent to the gateway when the node registers again, the gateway keeps the session.
+	err = n.Reconfigure(ctx, deps, conf)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, n.Addr, test.ShouldBeNil)
+}
+
+func TestReadingsUnits(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.NewTestLogger(t)
+	deps := resource.Dependencies{encoder.Named(testGatewayName): createMockGateway()}
+
+	cfg := &Config{
+		DecoderPath: testDecoderPath,
+		Interval:    &testInterval,
+		JoinType:    testJoinTypeABP,
+		AppSKey:     testAppSKey,
+		NwkSKey:     testNwkSKey,
+		DevAddr:     testDevAddr,
+		Units:       map[string]string{"reading": "C", "humidity": "%"},
+	}
+	_, err := cfg.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+	n, err := newNode(ctx, deps, resource.Config{Name: "test-node", ConvertedAttributes: cfg}, logger)
+	test.That(t, err, test.ShouldBeNil)
+
+	// the units of the decoded readings are returned alongside them.
+	readings, err := n.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{
+		"reading": 1,
+		"units":   map[string]interface{}{"reading": "C"},
+	})
+	test.That(t, testNodeReadings, test.ShouldNotContainKey, "units")
+
+	cfg.Units = map[string]string{"reading": ""}
+	_, err = cfg.Validate("")
+	test.That(t, errors.Is(err, errInvalidUnits), test.ShouldBeTrue)
+}
+
+func TestReadingsSamples(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.NewTestLogger(t)
+	samples := []interface{}{map[string]interface{}{"temperature": 20}, map[string]interface{}{"temperature": 21}}
+	gatewayReadings := map[string]interface{}{"temperature": 21, "samples": samples}
+	mockGateway := createMockGateway()
+	mockGateway.ReadingsFunc = func(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"test-node": gatewayReadings}, nil
+	}
+	deps := resource.Dependencies{encoder.Named(testGatewayName): mockGateway}
+
+	cfg := &Config{
+		DecoderPath: testDecoderPath,
+		Interval:    &testInterval,
+		JoinType:    testJoinTypeABP,
+		AppSKey:     testAppSKey,
+		NwkSKey:     testNwkSKey,
+		DevAddr:     testDevAddr,
+	}
+	n, err := newNode(ctx, deps, resource.Config{Name: "test-node", ConvertedAttributes: cfg}, logger)
+	test.That(t, err, test.ShouldBeNil)
+
+	// the samples are only returned with include_samples.
+	readings, err := n.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{"temperature": 21})
+	test.That(t, gatewayReadings, test.ShouldContainKey, "samples")
+
+	cfg.IncludeSamples = true
+	n, err = newNode(ctx, deps, resource.Config{Name: "test-node", ConvertedAttributes: cfg}, logger)
+	test.That(t, err, test.ShouldBeNil)
+	readings, err = n.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings["samples"], test.ShouldResemble, samples)
+}
+
+func TestReadingsNoGateway(t *testing.T) {
+	ctx := context.Background()
+	n := &Node{NodeName: "test-node", JoinType: "ABP"}
+
+	// a node without a gateway, or whose gateway is gone, returns an error instead of panicking.
+	_, err := n.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeError, errNoGateway)
+	n.gateways = []sensor.Sensor{nil}
+	_, err = n.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeError, errNoGateway)
+	_, err = n.DoCommand(ctx, map[string]interface{}{"get_uplinks": true})
+	test.That(t, err, test.ShouldBeError, errNoGateway)
+	test.That(t, n.Close(ctx), test.ShouldBeNil)
+
+	// the gateways that are still set are used.
+	n.gateways = []sensor.Sensor{nil, createMockGateway()}
+	readings, err := n.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, testNodeReadings)
+}
+
+func TestReadingsPerNode(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.NewTestLogger(t)
+
+	mockGateway := createMockGateway()
+	deps := make(resource.Dependencies)
+	deps[encoder.Named(testGatewayName)] = mockGateway
+
+	newTestNode := func(name string) *Node {
+		conf := resource.Config{
+			Name: name,
+			ConvertedAttributes: &Config{
+				DecoderPath: testDecoderPath,
+				Interval:    &testInterval,
+				JoinType:    testJoinTypeOTAA,
+				DevEUI:      testDevEUI,
+				AppKey:      testAppKey,
+			},
+		}
+		n, err := newNode(ctx, deps, conf, logger)
+		test.That(t, err, test.ShouldBeNil)
+		return n.(*Node)
+	}
+
+	// each node only sees its own readings.
+	readings, err := newTestNode("test-node").Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, testOTAAReadings)
+
+	readings, err = newTestNode("other-node").Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, map[string]interface{}{"reading": "fake", "dev_eui": "0123456789abcdef"})
+
+	// a node with no readings yet returns an empty map.
+	noReadings := newTestNode("new-node")
+	readings, err = noReadings.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldBeEmpty)
+
+	// data capture skips the node until it has readings.
+	_, err = noReadings.Readings(ctx, data.FromDMExtraMap)
+	test.That(t, errors.Is(err, data.ErrNoCaptureToStore), test.ShouldBeTrue)
+}
+
+func TestMultipleGateways(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.NewTestLogger(t)
+
+	// the first gateway can't return readings.
+	failingGateway := createMockGateway()
+	failingGateway.ReadingsFunc = func(ctx context.Context, extra map[string]interface{}) (map[string]interface{}, error) {
+		return nil, errors.New("gateway unreachable")
+	}
+	var registered []string
+	backupGateway := createMockGateway()
+	backupGateway.DoFunc = func(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+		if _, ok := cmd["validate"]; ok {
+			return map[string]interface{}{"validate": 1.0}, nil
+		}
+		if _, ok := cmd["register_device"]; ok {
+			registered = append(registered, "gateway-2")
+		}
+		return map[string]interface{}{}, nil
+	}
+
+	deps := resource.Dependencies{
+		sensor.Named("gateway-1"): failingGateway,
+		sensor.Named("gateway-2"): backupGateway,
+	}
+
+	conf := &Config{
+		DecoderPath: testDecoderPath,
+		Interval:    &testInterval,
+		JoinType:    testJoinTypeOTAA,
+		DevEUI:      testDevEUI,
+		AppKey:      testAppKey,
+		Gateways:    []string{"gateway-1", "gateway-2"},
+	}
+	implicitDeps, err := conf.Validate("")
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, implicitDeps, test.ShouldResemble, []string{"gateway-1", "gateway-2"})
+
+	n, err := newNode(ctx, deps, resource.Config{Name: "test-node", ConvertedAttributes: conf}, logger)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, registered, test.ShouldResemble, []string{"gateway-2"})
+	test.That(t, len(n.(*Node).gateways), test.ShouldEqual, 2)
+
+	// readings fall back to the second gateway.
+	readings, err := n.Readings(ctx, nil)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, readings, test.ShouldResemble, testOTAAReadings)
+
+	// an error is returned if every gateway fails.
+	backupGateway.ReadingsFunc = failingGateway.ReadingsFunc
+	_, err = n.Readings(ctx, nil)
+	test.That(t, err, test.ShouldNotBeNil)
+
+	// a gateway that isn't a dependency is an error.
+	conf.Gateways = []string{"gateway-1", "gateway-3"}
+	_, err = newNode(ctx, deps, resource.Config{Name: "test-node", ConvertedAttributes: conf}, logger)
+	test.That(t, err, test.ShouldNotBeNil)
+}
+
+func TestRegisterRetry(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.NewTestLogger(t)
+
+	var attempts int
+	var registerErr func() error
+	mockGateway := createMockGateway()
+	mockGateway.DoFunc = func(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+		if _, ok := cmd["validate"]; ok {
+			return map[string]interface{}{"validate": 1.0}, nil
+		}
+		attempts++
+		return map[string]interface{}{}, registerErr()
+	}
+	deps := resource.Dependencies{encoder.Named(testGatewayName): mockGateway}
+	conf := resource.Config{
+		Name: "test-node",
+		ConvertedAttributes: &Config{
+			DecoderPath: testDecoderPath,
+			Interval:    &testInterval,
+			JoinType:    testJoinTypeOTAA,
+			DevEUI:      testDevEUI,
+			AppKey:      testAppKey,
+		},
+	}
+
+	// the node registers once the gateway is ready.
+	registerErr = func() error {
+		if attempts == 1 {
+			return errors.New("gateway not ready")
+		}
+		return nil
+	}
+	_, err := newNode(ctx, deps, conf, logger)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, attempts, test.ShouldEqual, 2)
+
+	// a rejected node isn't retried, also when the error lost its type.
+	for _, rejected := range []error{
+		fmt.Errorf("%w: invalid device", ErrDeviceRejected),
+		errors.New("rpc error: code = Unknown desc = gateway rejected device: invalid device"),
+	} {
+		attempts = 0
+		registerErr = func() error { return rejected }
+		_, err = newNode(ctx, deps, conf, logger)
+		test.That(t, err, test.ShouldBeError, rejected)
+		test.That(t, attempts, test.ShouldEqual, 1)
+	}
+
+	// retries stop when the context is done.
+	attempts = 0
+	registerErr = func() error { return errors.New("gateway not ready") }
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = newNode(canceledCtx, deps, conf, logger)
+	test.That(t, err, test.ShouldNotBeNil)
+	test.That(t, attempts, test.ShouldEqual, 1)
+}
+
+func TestCloseDeregisters(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.NewTestLogger(t)
+
+	var deregistered interface{}
+	mockGateway := createMockGateway()
+	mockGateway.DoFunc = func(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+		if _, ok := cmd["validate"]; ok {
+			return map[string]interface{}{"validate": 1.0}, nil
+		}
+		if name, ok := cmd["deregister_device"]; ok {
+			deregistered = name
+		}
+		return map[string]interface{}{}, nil
+	}
+	deps := resource.Dependencies{encoder.Named(testGatewayName): mockGateway}
+
+	conf := resource.Config{
+		Name: "test-node",
+		ConvertedAttributes: &Config{
+			DecoderPath: testDecoderPath,
+			Interval:    &testInterval,
+			JoinType:    testJoinTypeOTAA,
+			DevEUI:      testDevEUI,
+			AppKey:      testAppKey,
+		},
+	}
+	n, err := newNode(ctx, deps, conf, logger)
+	test.That(t, err, test.ShouldBeNil)
+
+	err = n.Close(ctx)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, deregistered, test.ShouldEqual, "test-node")
+}
+
+func TestGetUplinks(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.NewTestLogger(t)
+
+	var request interface{}
+	mockGateway := createMockGateway()
+	mockGateway.DoFunc = func(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+		if _, ok := cmd["validate"]; ok {
+			return map[string]interface{}{"validate": 1.0}, nil
+		}
+		if req, ok := cmd["get_uplinks"]; ok {
+			request = req
+			return map[string]interface{}{"uplinks": []interface{}{}, "seq": 3.0}, nil
+		}
+		return map[string]interface{}{}, nil
+	}
+	deps := resource.Dependencies{encoder.Named(testGatewayName): mockGateway}
+
+	conf := resource.Config{
+		Name: "test-node",
+		ConvertedAttributes: &Config{
+			DecoderPath: testDecoderPath,
+			Interval:    &testInterval,
+			JoinType:    testJoinTypeOTAA,
+			DevEUI:      testDevEUI,
+			AppKey:      testAppKey,
+		},
+	}
+	n, err := newNode(ctx, deps, conf, logger)
+	test.That(t, err, test.ShouldBeNil)
+
+	// the node asks the gateway for its own uplinks.
+	resp, err := n.DoCommand(ctx, map[string]interface{}{"get_uplinks": map[string]interface{}{"after": 2.0, "wait_ms": 100.0}})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, resp["seq"], test.ShouldEqual, 3.0)
+	test.That(t, request, test.ShouldResemble, map[string]interface{}{"device": "test-node", "after": 2.0, "wait_ms": 100.0})
+
+	_, err = n.DoCommand(ctx, map[string]interface{}{"get_uplinks": true})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, request, test.ShouldResemble, map[string]interface{}{"device": "test-node"})
+}
+
+func TestReloadDecoder(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.NewTestLogger(t)
+
+	var request interface{}
+	mockGateway := createMockGateway()
+	mockGateway.DoFunc = func(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+		if _, ok := cmd["validate"]; ok {
+			return map[string]interface{}{"validate": 1.0}, nil
+		}
+		if req, ok := cmd["reload_decoder"]; ok {
+			request = req
+			return map[string]interface{}{"reload_decoder": "reloaded"}, nil
+		}
+		return map[string]interface{}{}, nil
+	}
+	deps := resource.Dependencies{encoder.Named(testGatewayName): mockGateway}
+
+	conf := resource.Config{
+		Name: "test-node",
+		ConvertedAttributes: &Config{
+			DecoderPath: testDecoderPath,
+			Interval:    &testInterval,
+			JoinType:    testJoinTypeOTAA,
+			DevEUI:      testDevEUI,
+			AppKey:      testAppKey,
+		},
+	}
+	n, err := newNode(ctx, deps, conf, logger)
+	test.That(t, err, test.ShouldBeNil)
+
+	// the node asks its gateway to reload its own decoders.
+	resp, err := n.DoCommand(ctx, map[string]interface{}{"reload_decoder": true})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, resp["reload_decoder"], test.ShouldEqual, "reloaded")
+	test.That(t, request, test.ShouldResemble, map[string]interface{}{"device": "test-node"})
+}
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.NewTestLogger(t)
+
+	var request interface{}
+	var registered map[string]interface{}
+	history := []interface{}{map[string]interface{}{"time": "2024-05-02T17:21:34Z", "readings": map[string]interface{}{"temperature": 21.5}}}
+	mockGateway := createMockGateway()
+	mockGateway.DoFunc = func(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+		if _, ok := cmd["validate"]; ok {
+			return map[string]interface{}{"validate": 1.0}, nil
+		}
+		if device, ok := cmd["register_device"]; ok {
+			registered = device.(map[string]interface{})
+		}
+		if req, ok := cmd["history"]; ok {
+			request = req
+			return map[string]interface{}{"history": history}, nil
+		}
+		return map[string]interface{}{}, nil
+	}
+	deps := resource.Dependencies{encoder.Named(testGatewayName): mockGateway}
+
+	historySize := 3
+	conf := resource.Config{
+		Name: "test-node",
+		ConvertedAttributes: &Config{
+			DecoderPath: testDecoderPath,
+			Interval:    &testInterval,
+			JoinType:    testJoinTypeOTAA,
+			DevEUI:      testDevEUI,
+			AppKey:      testAppKey,
+			HistorySize: &historySize,
+		},
+	}
+	n, err := newNode(ctx, deps, conf, logger)
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, registered["HistorySize"], test.ShouldEqual, 3)
+
+	// the node asks its gateway for its own history.
+	resp, err := n.DoCommand(ctx, map[string]interface{}{"history": true})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, resp["history"], test.ShouldResemble, history)
+	test.That(t, request, test.ShouldResemble, map[string]interface{}{"device": "test-node"})
+}
+
+func TestUpdateKeys(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.NewTestLogger(t)
+
+	var request interface{}
+	mockGateway := createMockGateway()
+	mockGateway.DoFunc = func(ctx context.Context, cmd map[string]interface{}) (map[string]interface{}, error) {
+		if _, ok := cmd["validate"]; ok {
+			return map[string]interface{}{"validate": 1.0}, nil
+		}
+		if req, ok := cmd["update_keys"]; ok {
+			request = req
+			return map[string]interface{}{"update_keys": "updated"}, nil
+		}
+		return map[string]interface{}{}, nil
+	}
+	deps := resource.Dependencies{encoder.Named(testGatewayName): mockGateway}
+
+	conf := resource.Config{
+		Name: "test-node",
+		ConvertedAttributes: &Config{
+			DecoderPath: testDecoderPath,
+			Interval:    &testInterval,
+			JoinType:    testJoinTypeABP,
+			AppSKey:     testAppSKey,
+			NwkSKey:     testNwkSKey,
+			DevAddr:     testDevAddr,
+		},
+	}
+	n, err := newNode(ctx, deps, conf, logger)
+	test.That(t, err, test.ShouldBeNil)
+
+	// the node sends the keys to its gateway, other fields are dropped.
+	keys := map[string]interface{}{"app_s_key": testNwkSKey, "network_s_key": testAppSKey, "dev_addr": "01020304", "grace_period_s": 60.0}
+	resp, err := n.DoCommand(ctx, map[string]interface{}{"update_keys": keys})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, resp["update_keys"], test.ShouldEqual, "updated")
+	test.That(t, request, test.ShouldResemble, map[string]interface{}{
+		"device": "test-node", "app_s_key": testNwkSKey, "network_s_key": testAppSKey, "grace_period_s": 60.0,
+	})
+
+	_, err = n.DoCommand(ctx, map[string]interface{}{"update_keys": "keys"})
+	test.That(t, err, test.ShouldBeError, errInvalidUpdateKeys)
+
+	// OTAA nodes get new session keys by joining.
+	conf.ConvertedAttributes = &Config{
+		DecoderPath: testDecoderPath,
+		Interval:    &testInterval,
+		JoinType:    testJoinTypeOTAA,
+		DevEUI:      testDevEUI,
+		AppKey:      testAppKey,
+	}
+	n, err = newNode(ctx, deps, conf, logger)
+	test.That(t, err, test.ShouldBeNil)
+	_, err = n.DoCommand(ctx, map[string]interface{}{"update_keys": keys})
+	test.That(t, err, test.ShouldBeError, errUpdateKeysOTAA)
 }
@@ -0,0 +1,91 @@
+package testutils
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"go.thethings.network/lorawan-stack/v3/pkg/crypto"
+	"go.thethings.network/lorawan-stack/v3/pkg/types"
+	"go.viam.com/test"
+)
+
+var testDevice = Device{
+	DevAddr: []byte{0x01, 0x02, 0x03, 0x04},
+	NwkSKey: []byte{0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x11},
+	AppSKey: []byte{0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22, 0x22},
+}
+
+// decodeFrame verifies the MIC of the uplink and returns its frame counter, FPort and decrypted payload.
+func decodeFrame(t *testing.T, d Device, frame []byte) (uint32, uint8, []byte) {
+	devAddr := types.DevAddr{frame[4], frame[3], frame[2], frame[1]}
+	test.That(t, devAddr[:], test.ShouldResemble, d.DevAddr)
+	fCnt := uint32(binary.LittleEndian.Uint16(frame[6:8]))
+	fOptsLength := int(frame[5] & 0x0F)
+
+	mic, err := crypto.ComputeLegacyUplinkMIC(types.AES128Key(d.NwkSKey), devAddr, fCnt, frame[:len(frame)-4])
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, frame[len(frame)-4:], test.ShouldResemble, mic[:])
+
+	fPort := frame[8+fOptsLength]
+	key := d.AppSKey
+	if fPort == 0 {
+		key = d.NwkSKey
+	}
+	payload, err := crypto.DecryptUplink(types.AES128Key(key), devAddr, fCnt, frame[9+fOptsLength:len(frame)-4])
+	test.That(t, err, test.ShouldBeNil)
+	return fCnt, fPort, payload
+}
+
+func TestUplink(t *testing.T) {
+	d := testDevice
+	d.FCnt = 5
+
+	frame, err := d.Uplink(2, []byte{0x15, 0x05})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, frame[0], test.ShouldEqual, UnconfirmedDataUp)
+	fCnt, fPort, payload := decodeFrame(t, d, frame)
+	test.That(t, fCnt, test.ShouldEqual, 5)
+	test.That(t, fPort, test.ShouldEqual, 2)
+	test.That(t, payload, test.ShouldResemble, []byte{0x15, 0x05})
+
+	// the frame counter increments with each uplink.
+	frame, err = d.ConfirmedUplink(3, []byte{0x01})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, frame[0], test.ShouldEqual, ConfirmedDataUp)
+	fCnt, fPort, payload = decodeFrame(t, d, frame)
+	test.That(t, fCnt, test.ShouldEqual, 6)
+	test.That(t, fPort, test.ShouldEqual, 3)
+	test.That(t, payload, test.ShouldResemble, []byte{0x01})
+	test.That(t, d.FCnt, test.ShouldEqual, 7)
+}
+
+func TestFrame(t *testing.T) {
+	d := testDevice
+
+	// FOpts are sent in the clear after the frame counter, the fctrl has their length.
+	frame, err := d.Frame(UnconfirmedDataUp, 0x10002, []byte{0x02}, 1, []byte{0xAA})
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, frame[1:5], test.ShouldResemble, []byte{0x04, 0x03, 0x02, 0x01})
+	test.That(t, frame[5], test.ShouldEqual, 1)
+	test.That(t, frame[6:8], test.ShouldResemble, []byte{0x02, 0x00})
+	test.That(t, frame[8], test.ShouldEqual, 0x02)
+	test.That(t, d.FCnt, test.ShouldEqual, 0)
+
+	// the MIC and encryption use the full 32 bit frame counter.
+	mic, err := crypto.ComputeLegacyUplinkMIC(types.AES128Key(d.NwkSKey), types.DevAddr{0x01, 0x02, 0x03, 0x04}, 0x10002, frame[:len(frame)-4])
+	test.That(t, err, test.ShouldBeNil)
+	test.That(t, frame[len(frame)-4:], test.ShouldResemble, mic[:])
+
+	// port 0 payloads are encrypted with the NwkSKey.
+	frame, err = d.Frame(UnconfirmedDataUp, 1, nil, 0, []byte{0x0D})
+	test.That(t, err, test.ShouldBeNil)
+	_, fPort, payload := decodeFrame(t, d, frame)
+	test.That(t, fPort, test.ShouldEqual, 0)
+	test.That(t, payload, test.ShouldResemble, []byte{0x0D})
+
+	_, err = d.Frame(UnconfirmedDataUp, 1, make([]byte, 16), 1, nil)
+	test.That(t, err, test.ShouldNotBeNil)
+	d.DevAddr = []byte{0x01}
+	_, err = d.Frame(UnconfirmedDataUp, 1, nil, 1, nil)
+	test.That(t, err, test.ShouldNotBeNil)
+}